@@ -2,9 +2,11 @@ package restclient
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"io/ioutil"
 	"net/url"
@@ -17,6 +19,9 @@ const (
 	correlationIDLiteral = "correlationID"
 )
 
+// ErrRequestTimeout is returned by Request if no reply was received before the timeout
+var ErrRequestTimeout = errors.New("no reply received before timeout")
+
 type gubleSender struct {
 	Endpoint   string
 	httpClient *http.Client
@@ -24,6 +29,11 @@ type gubleSender struct {
 
 // New returns a new Sender.
 func New(endpoint string) Sender {
+	return NewRequester(endpoint)
+}
+
+// NewRequester returns a new Requester.
+func NewRequester(endpoint string) Requester {
 	return &gubleSender{
 		Endpoint:   endpoint,
 		httpClient: &http.Client{},
@@ -115,6 +125,41 @@ func (gs gubleSender) Send(topic string, body []byte, userID string, params map[
 	return nil
 }
 
+func (gs gubleSender) Request(topic string, body []byte, timeout time.Duration) ([]byte, error) {
+	logger.WithFields(log.Fields{
+		"topic":   topic,
+		"timeout": timeout,
+	}).Debug("Sending guble request")
+	uv := url.Values{}
+	uv.Add("timeout", timeout.String())
+	request, err := http.NewRequest(
+		http.MethodPost,
+		fmt.Sprintf("%s/request/%s?%s", gs.Endpoint, trimPrefixSlash(topic), uv.Encode()),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return nil, err
+	}
+	response, err := gs.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusGatewayTimeout {
+		return nil, ErrRequestTimeout
+	}
+	if response.StatusCode != http.StatusOK {
+		logger.WithFields(log.Fields{
+			"header": response.Header,
+			"code":   response.StatusCode,
+			"status": response.Status,
+		}).Error("Guble response error")
+		return nil, fmt.Errorf("Error code returned from guble: %d", response.StatusCode)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
 func getURL(endpoint, topic, userID string, params map[string]string) string {
 	uv := url.Values{}
 	uv.Add("userId", userID)
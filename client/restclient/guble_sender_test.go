@@ -1,9 +1,15 @@
 package restclient
 
 import (
-	"github.com/stretchr/testify/assert"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestGetURL(t *testing.T) {
@@ -83,3 +89,29 @@ func TestGetURL(t *testing.T) {
 	}
 
 }
+
+func TestRequest(t *testing.T) {
+	a := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.Equal(http.MethodPost, r.Method)
+		a.Equal("5s", r.URL.Query().Get("timeout"))
+		if r.URL.Path == "/api/request/unanswered" {
+			http.Error(w, "no reply", http.StatusGatewayTimeout)
+			return
+		}
+		a.Equal("/api/request/topic", r.URL.Path)
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "reply to %s", body)
+	}))
+	defer server.Close()
+
+	sender := NewRequester(server.URL + "/api")
+
+	reply, err := sender.Request("/topic", []byte("command"), 5*time.Second)
+	a.NoError(err)
+	a.Equal("reply to command", string(reply))
+
+	_, err = sender.Request("unanswered", []byte("command"), 5*time.Second)
+	a.Equal(ErrRequestTimeout, err)
+}
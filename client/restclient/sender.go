@@ -1,5 +1,7 @@
 package restclient
 
+import "time"
+
 // Sender is an interface used to send a message to the guble server.
 type Sender interface {
 	// Send a a message(body) to the guble Server, to the given topic, with the given userID.
@@ -11,3 +13,12 @@ type Sender interface {
 	// GetSubscribers returns a binary encoded JSON of all subscribers of 'topic' or an error otherwise
 	GetSubscribers(topic string) ([]byte, error)
 }
+
+// Requester is a Sender which can also send requests to the guble server, and wait for their replies.
+type Requester interface {
+	Sender
+
+	// Request sends a message(body) to the given topic and returns the body of its reply,
+	// or an error if no reply was received before the timeout.
+	Request(topic string, body []byte, timeout time.Duration) ([]byte, error)
+}
@@ -5,7 +5,11 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
+	"github.com/rs/xid"
 
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"sync"
 	"time"
@@ -15,6 +19,9 @@ var logger = log.WithFields(log.Fields{
 	"module": "wsclient",
 })
 
+// ErrRequestTimeout is returned by Request if no reply was received before the timeout
+var ErrRequestTimeout = errors.New("no reply received before timeout")
+
 type WSConnection interface {
 	WriteMessage(messageType int, data []byte) error
 	ReadMessage() (messageType int, p []byte, err error)
@@ -41,10 +48,15 @@ type Client interface {
 	Close()
 
 	Subscribe(path string) error
+	SubscribeAtLeastOnce(path string, ackTimeout time.Duration) error
+	SubscribeGroup(path string, group string) error
+	SubscribeWithOptions(path string, options *ReceiveOptions) error
 	Unsubscribe(path string) error
+	Ack(path string, id uint64) error
 
 	Send(path string, body string, header string) error
 	SendBytes(path string, body []byte, header string) error
+	Request(path string, body []byte, timeout time.Duration) (*protocol.Message, error)
 
 	WriteRawMessage(message []byte) error
 	Messages() chan *protocol.Message
@@ -69,6 +81,14 @@ type client struct {
 	wSConnectionFactory func(url string, origin string) (WSConnection, error)
 	// flag, to indicate if the client is connected
 	connected bool
+	// the requests waiting for a reply, by their reply topic
+	requests map[string]*pendingRequest
+}
+
+// pendingRequest is a request waiting for the subscription to its reply topic, and then for its reply
+type pendingRequest struct {
+	subscribed chan bool
+	reply      chan *protocol.Message
 }
 
 // Open is a shortcut for New() and Start()
@@ -88,6 +108,7 @@ func New(url, origin string, channelSize int, autoReconnect bool) Client {
 		origin:         origin,
 		shouldStopChan: make(chan bool, 1),
 		autoReconnect:  autoReconnect,
+		requests:       make(map[string]*pendingRequest),
 	}
 }
 
@@ -195,8 +216,24 @@ func (c *client) handleIncomingMessage(msg []byte) {
 
 	switch message := parsed.(type) {
 	case *protocol.Message:
+		if request := c.pendingRequest(string(message.Path)); request != nil {
+			select {
+			case request.reply <- message:
+			default:
+			}
+			return
+		}
 		c.messages <- message
 	case *protocol.NotificationMessage:
+		if message.Name == protocol.SUCCESS_SUBSCRIBED_TO {
+			if request := c.pendingRequest(message.Arg); request != nil {
+				select {
+				case request.subscribed <- true:
+				default:
+				}
+				return
+			}
+		}
 		if message.IsError {
 			select {
 			case c.errors <- message:
@@ -220,6 +257,55 @@ func (c *client) Subscribe(path string) error {
 	return err
 }
 
+// ReceiveOptions are the optional settings of a subscription, sent as the header of the receive command
+type ReceiveOptions struct {
+	AckMode    string `json:"Ack-Mode,omitempty"`
+	AckTimeout string `json:"Ack-Timeout,omitempty"`
+	Group      string `json:"Group,omitempty"`
+}
+
+// SubscribeWithOptions subscribes to the path with the receive options.
+func (c *client) SubscribeWithOptions(path string, options *ReceiveOptions) error {
+	header, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	cmd := &protocol.Cmd{
+		Name:       protocol.CmdReceive,
+		Arg:        path,
+		HeaderJSON: string(header),
+	}
+	return c.WriteRawMessage(cmd.Bytes())
+}
+
+// SubscribeAtLeastOnce subscribes to the path in the at-least-once mode: the messages are redelivered after the ackTimeout
+// (or the default timeout of the server, if it is zero), until they are acknowledged using Ack.
+// After a reconnect, the messages are delivered again from the last acknowledged message.
+func (c *client) SubscribeAtLeastOnce(path string, ackTimeout time.Duration) error {
+	options := &ReceiveOptions{AckMode: "at-least-once"}
+	if ackTimeout > 0 {
+		options.AckTimeout = ackTimeout.String()
+	}
+	return c.SubscribeWithOptions(path, options)
+}
+
+// SubscribeGroup subscribes to the path as a member of the consumer group:
+// each message is delivered to only one of the members of the group.
+// The groups require the at-least-once mode, so the messages have to be acknowledged using Ack;
+// a new member resumes after the messages acknowledged by the group.
+func (c *client) SubscribeGroup(path string, group string) error {
+	return c.SubscribeWithOptions(path, &ReceiveOptions{AckMode: "at-least-once", Group: group})
+}
+
+// Ack acknowledges the processing of the message with the id, received on the path.
+func (c *client) Ack(path string, id uint64) error {
+	cmd := &protocol.Cmd{
+		Name: protocol.CmdAck,
+		Arg:  fmt.Sprintf("%s %d", path, id),
+	}
+	return c.WriteRawMessage(cmd.Bytes())
+}
+
 func (c *client) Unsubscribe(path string) error {
 	cmd := &protocol.Cmd{
 		Name: protocol.CmdCancel,
@@ -244,6 +330,66 @@ func (c *client) SendBytes(path string, body []byte, header string) error {
 	return c.WriteRawMessage(cmd.Bytes())
 }
 
+// Request sends a message to the path and waits for its reply, up to the timeout.
+// The client subscribes to an ephemeral reply topic for the duration of the request;
+// the reply topic and the correlation id are sent in the header of the message (`Reply-To`, `Correlation-Id`).
+// The reply is not delivered on the Messages channel.
+func (c *client) Request(path string, body []byte, timeout time.Duration) (*protocol.Message, error) {
+	correlationID := xid.New().String()
+	replyTo := protocol.ReplyPrefix + correlationID
+	request := &pendingRequest{
+		subscribed: make(chan bool, 1),
+		reply:      make(chan *protocol.Message, 1),
+	}
+
+	c.mu.Lock()
+	c.requests[replyTo] = request
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.requests, replyTo)
+		c.mu.Unlock()
+		c.Unsubscribe(replyTo)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// the request is sent only after the subscription to the reply topic, so that the reply can not be missed
+	if err := c.Subscribe(replyTo); err != nil {
+		return nil, err
+	}
+	select {
+	case <-request.subscribed:
+	case <-timer.C:
+		return nil, ErrRequestTimeout
+	}
+
+	header, err := json.Marshal(map[string]string{
+		protocol.CorrelationIDHeader: correlationID,
+		protocol.ReplyToHeader:       replyTo,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.SendBytes(path, body, string(header)); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-request.reply:
+		return reply, nil
+	case <-timer.C:
+		return nil, ErrRequestTimeout
+	}
+}
+
+func (c *client) pendingRequest(replyTo string) *pendingRequest {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.requests[replyTo]
+}
+
 func (c *client) WriteRawMessage(message []byte) error {
 	return c.ws.WriteMessage(websocket.BinaryMessage, message)
 }
@@ -1,6 +1,7 @@
 package wsclient
 
 import (
+	"github.com/cosminrentea/gobbler/protocol"
 	"github.com/cosminrentea/gobbler/testutil"
 
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/golang/mock/gomock"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
@@ -294,3 +296,141 @@ func TestSendUnSubscribeMessage(t *testing.T) {
 	// stop client after 200ms
 	time.AfterFunc(time.Millisecond*200, func() { c.Close() })
 }
+
+// replyingConnection emulates a server on which a responder replies to every request
+type replyingConnection struct {
+	readC chan []byte
+}
+
+func (c *replyingConnection) WriteMessage(messageType int, data []byte) error {
+	cmd, err := protocol.ParseCmd(data)
+	if err != nil {
+		return err
+	}
+	switch cmd.Name {
+	case protocol.CmdReceive:
+		c.readC <- []byte("#" + protocol.SUCCESS_SUBSCRIBED_TO + " " + cmd.Arg)
+	case protocol.CmdSend:
+		request := &protocol.Message{Path: protocol.Path(cmd.Arg), HeaderJSON: cmd.HeaderJSON}
+		reply := &protocol.Message{
+			ID:         43,
+			Path:       request.ReplyTo(),
+			HeaderJSON: fmt.Sprintf(`{"Correlation-Id":"%s"}`, request.CorrelationID()),
+			Body:       append([]byte("reply to "), cmd.Body...),
+		}
+		c.readC <- reply.Encode()
+	}
+	return nil
+}
+
+func (c *replyingConnection) ReadMessage() (int, []byte, error) {
+	data, ok := <-c.readC
+	if !ok {
+		return 0, nil, fmt.Errorf("closed")
+	}
+	return websocket.BinaryMessage, data, nil
+}
+
+func (c *replyingConnection) Close() error {
+	close(c.readC)
+	return nil
+}
+
+func TestRequest(t *testing.T) {
+	a := assert.New(t)
+
+	conn := &replyingConnection{readC: make(chan []byte, 10)}
+	c := New("url", "origin", 10, false)
+	c.SetWSConnectionFactory(func(string, string) (WSConnection, error) { return conn, nil })
+	a.NoError(c.Start())
+	defer c.Close()
+
+	reply, err := c.Request("/foo", []byte("command"), time.Second)
+	a.NoError(err)
+	a.Equal("reply to command", string(reply.Body))
+	a.True(strings.HasPrefix(string(reply.Path), protocol.ReplyPrefix))
+	a.Equal(strings.TrimPrefix(string(reply.Path), protocol.ReplyPrefix), reply.CorrelationID())
+
+	// the reply and the subscription notification are not delivered to the client channels
+	a.Equal(0, len(c.Messages()))
+	a.Equal(0, len(c.StatusMessages()))
+}
+
+func TestRequestTimeout(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	c := New("url", "origin", 1, false)
+
+	// the subscription to the reply topic is never confirmed
+	connMock := NewMockWSConnection(ctrl)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, gomock.Any()).Times(2)
+	connMock.EXPECT().ReadMessage().Return(websocket.BinaryMessage, []byte(aNormalMessage), nil).
+		Do(func() { time.Sleep(time.Millisecond * 50) }).
+		AnyTimes()
+	connMock.EXPECT().Close()
+	c.SetWSConnectionFactory(MockConnectionFactory(connMock))
+	a.NoError(c.Start())
+	defer c.Close()
+
+	_, err := c.Request("/foo", []byte("command"), 10*time.Millisecond)
+	a.Equal(ErrRequestTimeout, err)
+}
+
+func TestSubscribeAtLeastOnceAndAck(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	// given a client
+	c := New("url", "origin", 1, true)
+
+	// when expects the messages
+	connMock := NewMockWSConnection(ctrl)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /foo\n{\"Ack-Mode\":\"at-least-once\",\"Ack-Timeout\":\"10s\"}"))
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /bar\n{\"Ack-Mode\":\"at-least-once\"}"))
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("ack /foo 42"))
+	connMock.EXPECT().
+		ReadMessage().
+		Return(websocket.BinaryMessage, []byte(aNormalMessage), nil).
+		Do(func() {
+			time.Sleep(time.Millisecond * 50)
+		}).
+		AnyTimes()
+	c.SetWSConnectionFactory(MockConnectionFactory(connMock))
+
+	c.Start()
+	c.SubscribeAtLeastOnce("/foo", 10*time.Second)
+	c.SubscribeAtLeastOnce("/bar", 0)
+	c.Ack("/foo", 42)
+
+	// stop client after 200ms
+	time.AfterFunc(time.Millisecond*200, func() { c.Close() })
+}
+
+func TestSubscribeGroup(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	// given a client
+	c := New("url", "origin", 1, true)
+
+	// when expects the messages
+	connMock := NewMockWSConnection(ctrl)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /jobs\n{\"Ack-Mode\":\"at-least-once\",\"Group\":\"workers\"}")).Times(2)
+	connMock.EXPECT().
+		ReadMessage().
+		Return(websocket.BinaryMessage, []byte(aNormalMessage), nil).
+		Do(func() {
+			time.Sleep(time.Millisecond * 50)
+		}).
+		AnyTimes()
+	c.SetWSConnectionFactory(MockConnectionFactory(connMock))
+
+	c.Start()
+	c.SubscribeGroup("/jobs", "workers")
+	c.SubscribeWithOptions("/jobs", &ReceiveOptions{AckMode: "at-least-once", Group: "workers"})
+
+	// stop client after 200ms
+	time.AfterFunc(time.Millisecond*200, func() { c.Close() })
+}
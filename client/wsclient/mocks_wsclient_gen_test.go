@@ -7,6 +7,7 @@ import (
 	
 	protocol "github.com/cosminrentea/gobbler/protocol"
 	gomock "github.com/golang/mock/gomock"
+	time "time"
 )
 
 // Mock of WSConnection interface
@@ -83,6 +84,16 @@ func (_m *MockClient) EXPECT() *_MockClientRecorder {
 	return _m.recorder
 }
 
+func (_m *MockClient) Ack(_param0 string, _param1 uint64) error {
+	ret := _m.ctrl.Call(_m, "Ack", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) Ack(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Ack", arg0, arg1)
+}
+
 func (_m *MockClient) Close() {
 	_m.ctrl.Call(_m, "Close")
 }
@@ -121,6 +132,17 @@ func (_mr *_MockClientRecorder) Messages() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Messages")
 }
 
+func (_m *MockClient) Request(_param0 string, _param1 []byte, _param2 time.Duration) (*protocol.Message, error) {
+	ret := _m.ctrl.Call(_m, "Request", _param0, _param1, _param2)
+	ret0, _ := ret[0].(*protocol.Message)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockClientRecorder) Request(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Request", arg0, arg1, arg2)
+}
+
 func (_m *MockClient) Send(_param0 string, _param1 string, _param2 string) error {
 	ret := _m.ctrl.Call(_m, "Send", _param0, _param1, _param2)
 	ret0, _ := ret[0].(error)
@@ -179,6 +201,36 @@ func (_mr *_MockClientRecorder) Subscribe(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Subscribe", arg0)
 }
 
+func (_m *MockClient) SubscribeAtLeastOnce(_param0 string, _param1 time.Duration) error {
+	ret := _m.ctrl.Call(_m, "SubscribeAtLeastOnce", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) SubscribeAtLeastOnce(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SubscribeAtLeastOnce", arg0, arg1)
+}
+
+func (_m *MockClient) SubscribeGroup(_param0 string, _param1 string) error {
+	ret := _m.ctrl.Call(_m, "SubscribeGroup", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) SubscribeGroup(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SubscribeGroup", arg0, arg1)
+}
+
+func (_m *MockClient) SubscribeWithOptions(_param0 string, _param1 *ReceiveOptions) error {
+	ret := _m.ctrl.Call(_m, "SubscribeWithOptions", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) SubscribeWithOptions(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SubscribeWithOptions", arg0, arg1)
+}
+
 func (_m *MockClient) Unsubscribe(_param0 string) error {
 	ret := _m.ctrl.Call(_m, "Unsubscribe", _param0)
 	ret0, _ := ret[0].(error)
@@ -11,6 +11,7 @@ const (
 	CmdSend    = ">"
 	CmdReceive = "+"
 	CmdCancel  = "-"
+	CmdAck     = "ack"
 )
 
 // Cmd is a representation of a command, which the client sends to the server
@@ -41,6 +41,14 @@ type Message struct {
 	// The time of publishing, as Unix Timestamp date
 	Time int64
 
+	// DeliverAt specifies when the message should be routed, if it is published for a later delivery.
+	// It is used only when publishing, and it is not part of the encoded message.
+	DeliverAt *time.Time
+
+	// Roles are the roles of the authenticated publisher, used for checking its access to the topic.
+	// They are used only when publishing, and they are not part of the encoded message.
+	Roles []string
+
 	// The header line of the message (optional). If set, then it has to be a valid JSON object structure.
 	HeaderJSON string
 
@@ -51,6 +59,37 @@ type Message struct {
 	NodeID uint8
 }
 
+const (
+	// IdempotencyKeyHeader is the name of the header field holding the idempotency key of a message
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// DeliverAtHeader is the name of the header field holding the delivery time of a message (RFC3339 format)
+	DeliverAtHeader = "Deliver-At"
+
+	// DelayHeader is the name of the header field holding the delivery delay of a message (e.g. `90s`, `2h`)
+	DelayHeader = "Delay"
+
+	// CorrelationIDHeader is the name of the header field relating a message to other messages, e.g. a reply to its request
+	CorrelationIDHeader = "Correlation-Id"
+
+	// ReplyToHeader is the name of the header field holding the topic on which the reply to a request is expected
+	ReplyToHeader = "Reply-To"
+
+	// ReplyPrefix is the prefix of the ephemeral topics on which the replies to requests are published
+	ReplyPrefix = "/reply/"
+
+	// RecipientHeader is the name of the header field holding the user ID of the recipient of a message
+	// (e.g. of an online-first message, or of a message indexed in the inbox of the user)
+	RecipientHeader = "Recipient"
+
+	// DeliveryModeHeader is the name of the header field holding the delivery mode of a message (e.g. `online-first`)
+	DeliveryModeHeader = "Delivery-Mode"
+
+	// OnlineFirstDelivery is the delivery mode of the messages which are delivered to the websocket sessions
+	// of their recipient, and to its push notification subscriptions only if they are not acknowledged
+	OnlineFirstDelivery = "online-first"
+)
+
 type MessageDeliveryCallback func(*Message)
 
 // Metadata returns the first line of a serialized message, without the newline
@@ -145,13 +184,10 @@ func (m *Message) SetFilter(key, value string) {
 }
 
 // IsExpired returns true if the message `Expires` field is set and the current time
-// has pasted the `Expires` time
+// has passed the `Expires` time. Messages without an `Expires` field never expire.
 //
 // Checks are made using `Expires` field timezone
 func (m *Message) IsExpired() bool {
-	if m.Expires == nil {
-		return true
-	}
 	return m.Expires != nil && m.Expires.Before(time.Now().In(m.Expires.Location()))
 }
 
@@ -226,6 +262,80 @@ func ParseMessage(message []byte) (*Message, error) {
 	return m, nil
 }
 
+// IdempotencyKey returns the value of the `Idempotency-Key` header field, if set.
+// Messages published with the same key are stored and delivered only once.
+func (m *Message) IdempotencyKey() string {
+	return m.HeaderField(IdempotencyKeyHeader)
+}
+
+// SetDeliverAtFromHeader sets the DeliverAt field from the `Deliver-At` or the `Delay` header field, if one of them is set.
+func (m *Message) SetDeliverAtFromHeader() error {
+	if deliverAt := m.HeaderField(DeliverAtHeader); deliverAt != "" {
+		t, err := time.Parse(time.RFC3339, deliverAt)
+		if err != nil {
+			return fmt.Errorf("invalid %s header: %v", DeliverAtHeader, err)
+		}
+		m.DeliverAt = &t
+		return nil
+	}
+	if delay := m.HeaderField(DelayHeader); delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return fmt.Errorf("invalid %s header: %v", DelayHeader, err)
+		}
+		t := time.Now().Add(d)
+		m.DeliverAt = &t
+	}
+	return nil
+}
+
+// IsOnlineFirst returns true if the message has the online-first delivery mode
+func (m *Message) IsOnlineFirst() bool {
+	return m.HeaderField(DeliveryModeHeader) == OnlineFirstDelivery
+}
+
+// Recipient returns the user ID of the recipient of the message, if it is addressed to a user
+func (m *Message) Recipient() string {
+	return m.HeaderField(RecipientHeader)
+}
+
+// ReplyTo returns the topic on which a reply is expected, if the message is a request
+func (m *Message) ReplyTo() Path {
+	return Path(m.HeaderField(ReplyToHeader))
+}
+
+// SetHeaderField sets a string field of the header JSON, keeping the other fields.
+func (m *Message) SetHeaderField(name, value string) error {
+	values := make(map[string]interface{})
+	if len(m.HeaderJSON) > 0 {
+		if err := json.Unmarshal([]byte(m.HeaderJSON), &values); err != nil {
+			return fmt.Errorf("invalid header: %v", err)
+		}
+	}
+	values[name] = value
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	m.HeaderJSON = string(data)
+	return nil
+}
+
+// HeaderField returns the string value of a field of the header JSON, or an empty string if it is not set.
+func (m *Message) HeaderField(name string) string {
+	if len(m.HeaderJSON) == 0 {
+		return ""
+	}
+	values := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(m.HeaderJSON), &values); err != nil {
+		return ""
+	}
+	if value, ok := values[name].(string); ok {
+		return value
+	}
+	return ""
+}
+
 func (m *Message) CorrelationID() string {
 	values := make(map[string]string)
 	err := json.Unmarshal([]byte(m.HeaderJSON), &values)
@@ -233,7 +343,7 @@ func (m *Message) CorrelationID() string {
 		log.WithField("error", err.Error()).Error("Correlation id decoding failed.")
 		return ""
 	}
-	correlationID, ok := values["Correlation-Id"]
+	correlationID, ok := values[CorrelationIDHeader]
 	if !ok {
 		log.Error("Correlation id not set")
 		return ""
@@ -112,6 +112,36 @@ func TestCorrelationIDError(t *testing.T) {
 	a.Equal("", msg.CorrelationID())
 }
 
+func TestIdempotencyKey(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal("", (&Message{}).IdempotencyKey())
+	a.Equal("", (&Message{HeaderJSON: `{"Content-Type": "text/plain"}`}).IdempotencyKey())
+	a.Equal("", (&Message{HeaderJSON: `{"Idempotency-Key": 42}`}).IdempotencyKey())
+	a.Equal("", (&Message{HeaderJSON: `invalid`}).IdempotencyKey())
+	a.Equal("order-42", (&Message{HeaderJSON: `{"Content-Type": "text/plain", "Idempotency-Key": "order-42"}`}).IdempotencyKey())
+}
+
+func TestSetDeliverAtFromHeader(t *testing.T) {
+	a := assert.New(t)
+
+	m := &Message{HeaderJSON: `{"Content-Type": "text/plain"}`}
+	a.NoError(m.SetDeliverAtFromHeader())
+	a.Nil(m.DeliverAt)
+
+	m = &Message{HeaderJSON: `{"Deliver-At": "2017-03-17T20:04:26+02:00", "Delay": "1h"}`}
+	a.NoError(m.SetDeliverAtFromHeader())
+	expected, _ := time.Parse(time.RFC3339, "2017-03-17T20:04:26+02:00")
+	a.True(expected.Equal(*m.DeliverAt))
+
+	m = &Message{HeaderJSON: `{"Delay": "1h"}`}
+	a.NoError(m.SetDeliverAtFromHeader())
+	a.WithinDuration(time.Now().Add(time.Hour), *m.DeliverAt, time.Second)
+
+	a.Error((&Message{HeaderJSON: `{"Deliver-At": "tomorrow"}`}).SetDeliverAtFromHeader())
+	a.Error((&Message{HeaderJSON: `{"Delay": "1 hour"}`}).SetDeliverAtFromHeader())
+}
+
 func TestSerializeANormalMessageWithExpires(t *testing.T) {
 	// given: a message
 	msg := &Message{
@@ -270,4 +300,26 @@ func TestMessage_IsExpired(t *testing.T) {
 		a.Equal(c.result, (&Message{Expires: &c.expires}).IsExpired(), "Failed IsExpired case: %d", i)
 	}
 
+	a.False((&Message{}).IsExpired(), "A message without Expires should not expire")
+
+}
+
+func TestMessage_ReplyHeaders(t *testing.T) {
+	a := assert.New(t)
+
+	msg := &Message{HeaderJSON: `{"Correlation-Id":"7sdks723ksgqn","Nested":{"a":1}}`}
+	a.Equal(Path(""), msg.ReplyTo())
+
+	a.NoError(msg.SetHeaderField(ReplyToHeader, "/reply/abc"))
+	a.Equal(Path("/reply/abc"), msg.ReplyTo())
+	a.Equal("7sdks723ksgqn", msg.HeaderField(CorrelationIDHeader))
+	a.JSONEq(`{"Correlation-Id":"7sdks723ksgqn","Nested":{"a":1},"Reply-To":"/reply/abc"}`, msg.HeaderJSON)
+
+	msg = &Message{}
+	a.NoError(msg.SetHeaderField(CorrelationIDHeader, "id1"))
+	a.Equal(`{"Correlation-Id":"id1"}`, msg.HeaderJSON)
+	a.Equal("id1", msg.CorrelationID())
+
+	msg = &Message{HeaderJSON: "{invalid"}
+	a.Error(msg.SetHeaderField(ReplyToHeader, "/reply/abc"))
 }
@@ -17,6 +17,9 @@ const (
 	ERROR_SUBSCRIBED_TO   = "error-subscribed-to"
 	ERROR_BAD_REQUEST     = "error-bad-request"
 	ERROR_INTERNAL_SERVER = "error-server-internal"
+	ERROR_FORBIDDEN       = "error-forbidden"
+	ERROR_RATE_LIMITED    = "error-rate-limited"
+	ERROR_REJECTED        = "error-rejected"
 )
 
 // NotificationMessage is a representation of a status messages or error message, sent from the server
@@ -1,6 +1,31 @@
 package protocol
 
-import "strings"
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// SingleLevelWildcard matches exactly one level of a topic path, e.g. `/tenant/+/events`
+	SingleLevelWildcard = "+"
+
+	// SingleLevelWildcardAlias is an alias of the SingleLevelWildcard, e.g. `/orders/*/status`
+	SingleLevelWildcardAlias = "*"
+
+	// MultiLevelWildcard matches any number of levels of a topic path (including none),
+	// and it is allowed only as the last level, e.g. `/tenant/+/events/#`
+	MultiLevelWildcard = "#"
+)
+
+// SystemPrefix is the prefix of the system topics, on which only the server publishes (e.g. the presence events)
+const SystemPrefix = "/_"
+
+// PresencePrefix is the prefix of the system topics on which the presence events of the users are published,
+// e.g. `/_presence/marvin`
+const PresencePrefix = SystemPrefix + "presence/"
+
+// ErrInvalidWildcard is returned when a multi-level wildcard is not the last level of a path
+var ErrInvalidWildcard = errors.New("multi-level wildcard is only allowed as the last level of a path")
 
 // Path is the path of a topic
 type Path string
@@ -16,3 +41,87 @@ func (path Path) Partition() string {
 func (path Path) RemovePrefixSlash() string {
 	return strings.TrimPrefix(string(path), "/")
 }
+
+// IsWildcard returns true if any level of the path is a wildcard
+func (path Path) IsWildcard() bool {
+	for _, level := range strings.Split(string(path), "/") {
+		if IsWildcardLevel(level) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSystem returns true if the path is a system topic, or one of its subtopics
+func (path Path) IsSystem() bool {
+	return strings.HasPrefix(string(path), SystemPrefix)
+}
+
+// HasWildcardPartition returns true if the partition level of the path is a wildcard,
+// meaning that the path spans messages from all partitions.
+func (path Path) HasWildcardPartition() bool {
+	return IsWildcardLevel(path.Partition())
+}
+
+// Validate checks that a multi-level wildcard, if present, is the last level of the path
+func (path Path) Validate() error {
+	levels := strings.Split(string(path), "/")
+	for i, level := range levels {
+		if level == MultiLevelWildcard && i != len(levels)-1 {
+			return ErrInvalidWildcard
+		}
+	}
+	return nil
+}
+
+// Matches returns true if the topic is matched by the path, considered as a pattern.
+// A path matches the topic itself and all its subtopics; single-level wildcards
+// match any value of a level and a multi-level wildcard matches any remaining levels.
+func (path Path) Matches(topic Path) bool {
+	topicLevels := strings.Split(string(topic), "/")
+	for i, level := range strings.Split(string(path), "/") {
+		if level == MultiLevelWildcard {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != topicLevels[i] && !IsSingleLevelWildcard(level) {
+			return false
+		}
+	}
+	return true
+}
+
+// Intersects returns true if some topic is matched by both paths, considered as patterns.
+// The levels of the paths are compared one by one, a wildcard on either side matching any value of the other.
+func (path Path) Intersects(other Path) bool {
+	levels, otherLevels := strings.Split(string(path), "/"), strings.Split(string(other), "/")
+	for i := 0; i < len(levels) && i < len(otherLevels); i++ {
+		level, otherLevel := levels[i], otherLevels[i]
+		if level == MultiLevelWildcard || otherLevel == MultiLevelWildcard {
+			return true
+		}
+		if level != otherLevel && !IsSingleLevelWildcard(level) && !IsSingleLevelWildcard(otherLevel) {
+			return false
+		}
+	}
+	// the shorter path matches the subtopics of the longer one
+	return true
+}
+
+// IsTopicLevel returns true if the value (e.g. a user ID) can be a single level of a topic,
+// meaning that it is not empty, it has no slash and it is not a wildcard
+func IsTopicLevel(value string) bool {
+	return value != "" && !strings.Contains(value, "/") && !IsWildcardLevel(value)
+}
+
+// IsWildcardLevel returns true if the level of a path is a wildcard
+func IsWildcardLevel(level string) bool {
+	return IsSingleLevelWildcard(level) || level == MultiLevelWildcard
+}
+
+// IsSingleLevelWildcard returns true if the level of a path is a single-level wildcard
+func IsSingleLevelWildcard(level string) bool {
+	return level == SingleLevelWildcard || level == SingleLevelWildcardAlias
+}
@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPath_Matches(t *testing.T) {
+	for _, test := range []struct {
+		pattern Path
+		topic   Path
+		matches bool
+	}{
+		{"/foo", "/foo", true},
+		{"/foo", "/foo/xyz", true},
+		{"/foo", "/fooxyz", false},
+		{"/foo/bar", "/foo", false},
+		{"/orders/*/status", "/orders/123/status", true},
+		{"/orders/*/status", "/orders/123/status/sub", true},
+		{"/orders/*/status", "/orders/123/other", false},
+		{"/orders/*/status", "/orders/123", false},
+		{"/tenant/+/events/#", "/tenant/t1/events", true},
+		{"/tenant/+/events/#", "/tenant/t1/events/a/b", true},
+		{"/tenant/+/events/#", "/tenant/t1/other/a", false},
+		{"/+", "/anything/at/all", true},
+		{"/#", "/anything", true},
+		{"/c++", "/c++", true},
+		{"/c++", "/cpp", false},
+	} {
+		assert.Equal(t, test.matches, test.pattern.Matches(test.topic), "%s matches %s", test.pattern, test.topic)
+	}
+}
+
+func TestPath_Intersects(t *testing.T) {
+	for _, test := range []struct {
+		path       Path
+		other      Path
+		intersects bool
+	}{
+		{"/foo", "/foo", true},
+		{"/foo", "/foo/xyz", true},
+		{"/foo/xyz", "/foo", true},
+		{"/foo", "/fooxyz", false},
+		{"/secret", "/+/x", true},
+		{"/secret/x", "/+/y", false},
+		{"/+/x", "/secret/+", true},
+		{"/a/+/c", "/a/b/d", false},
+		{"/a/+/c", "/*/b/c/d", true},
+		{"/secret", "/#", true},
+		{"/tenant/+/events/#", "/tenant/t1/other", false},
+		{"/tenant/#", "/+/t1/other", true},
+	} {
+		assert.Equal(t, test.intersects, test.path.Intersects(test.other), "%s intersects %s", test.path, test.other)
+		assert.Equal(t, test.intersects, test.other.Intersects(test.path), "%s intersects %s", test.other, test.path)
+	}
+}
+
+func TestPath_Wildcards(t *testing.T) {
+	a := assert.New(t)
+
+	a.False(Path("/foo/bar").IsWildcard())
+	a.False(Path("/c++/a*b").IsWildcard())
+	a.True(Path("/foo/+").IsWildcard())
+	a.True(Path("/foo/*/bar").IsWildcard())
+	a.True(Path("/foo/#").IsWildcard())
+
+	a.False(Path("/foo/+").HasWildcardPartition())
+	a.True(Path("/+/foo").HasWildcardPartition())
+	a.True(Path("/#").HasWildcardPartition())
+	a.Equal("+", Path("/+/foo").Partition())
+}
+
+func TestIsTopicLevel(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(IsTopicLevel("marvin"))
+	a.True(IsTopicLevel("c++"))
+	a.False(IsTopicLevel(""))
+	a.False(IsTopicLevel("marvin/x"))
+	a.False(IsTopicLevel("+"))
+	a.False(IsTopicLevel("#"))
+}
+
+func TestPath_Validate(t *testing.T) {
+	a := assert.New(t)
+
+	a.NoError(Path("/foo").Validate())
+	a.NoError(Path("/foo/+/bar/#").Validate())
+	a.NoError(Path("/#").Validate())
+	a.Equal(ErrInvalidWildcard, Path("/foo/#/bar").Validate())
+	a.Equal(ErrInvalidWildcard, Path("/#/#").Validate())
+}
+
+func TestPath_IsSystem(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(Path("/_presence/marvin").IsSystem())
+	a.True(Path(PresencePrefix).IsSystem())
+	a.False(Path("/presence/marvin").IsSystem())
+	a.False(Path("/foo/_bar").IsSystem())
+}
@@ -0,0 +1,337 @@
+package acl
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rs/xid"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/auth"
+	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/router"
+)
+
+const schema = "acl_rules"
+
+// ReloadInterval is the interval at which the rules are loaded again from the KVStore,
+// so that the changes made through the admin API of the other nodes sharing the KVStore are applied.
+var ReloadInterval = 30 * time.Second
+
+// ACL is a router.Router enforcing access control lists: the messages are passed to the wrapped router
+// only if the rules allow their publisher to publish on their topic, and the routes are subscribed only
+// if the rules allow their user to subscribe to their path.
+//
+// A request is denied if a deny rule applying to the user overlaps the topic, and it is allowed if an allow rule
+// applying to the user matches the topic. Otherwise, it is denied if an allow rule for other users matches the topic,
+// and the default effect is applied to the topics without rules.
+// The rules are stored in the KVStore, and ACL is also an Endpoint, used for managing them.
+type ACL struct {
+	router.Router
+
+	kvStore       kvstore.KVStore
+	prefix        string
+	defaultEffect Effect
+	authenticator *auth.Authenticator
+
+	mu    sync.RWMutex
+	rules map[string]*Rule
+
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+// New returns a new ACL wrapping the given router, having the admin API at the given prefix.
+// The default effect is Allow if it is empty.
+func New(r router.Router, prefix string, defaultEffect Effect) (*ACL, error) {
+	if defaultEffect == "" {
+		defaultEffect = Allow
+	}
+	if err := ParseEffect(string(defaultEffect)); err != nil {
+		return nil, err
+	}
+	kvStore, err := r.KVStore()
+	if err != nil {
+		return nil, err
+	}
+	return &ACL{
+		Router:        r,
+		kvStore:       kvStore,
+		prefix:        prefix,
+		defaultEffect: defaultEffect,
+		rules:         make(map[string]*Rule),
+	}, nil
+}
+
+// SetAuthenticator sets the authenticator of the requests to the admin API, which then requires the admin role.
+func (a *ACL) SetAuthenticator(authenticator *auth.Authenticator) {
+	a.authenticator = authenticator
+}
+
+// Start loads the rules from the KVStore, and reloads them periodically.
+func (a *ACL) Start() error {
+	a.load()
+
+	a.stopC = make(chan struct{})
+	a.wg.Add(1)
+	go a.reloadLoop()
+	return nil
+}
+
+// Stop stops reloading the rules.
+func (a *ACL) Stop() error {
+	close(a.stopC)
+	a.wg.Wait()
+	return nil
+}
+
+func (a *ACL) reloadLoop() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.load()
+		case <-a.stopC:
+			return
+		}
+	}
+}
+
+func (a *ACL) load() {
+	rules := make(map[string]*Rule)
+	for kv := range a.kvStore.Iterate(schema, "") {
+		rule := &Rule{}
+		if err := json.Unmarshal([]byte(kv[1]), rule); err != nil {
+			logger.WithError(err).WithField("key", kv[0]).Error("Error decoding rule")
+			continue
+		}
+		rules[rule.ID] = rule
+	}
+	logger.WithField("count", len(rules)).Debug("Loaded rules")
+
+	a.mu.Lock()
+	a.rules = rules
+	a.mu.Unlock()
+	pRules.Set(float64(len(rules)))
+}
+
+// HandleMessage passes the message to the wrapped router if its publisher is allowed to publish on its topic,
+// otherwise it returns router.ErrAccessDenied.
+// The messages received from other nodes were already checked by the node which created them,
+// and the messages on the system topics are published by the server (the clients can not publish on them).
+func (a *ACL) HandleMessage(message *protocol.Message) error {
+	if message.NodeID == 0 && !message.Path.IsSystem() && !a.CanPublish(message.UserID, message.Roles, message.Path) {
+		logger.WithFields(log.Fields{
+			"userID": message.UserID,
+			"path":   message.Path,
+		}).Info("Access denied for publishing")
+		mTotalDeniedPublishes.Add(1)
+		pDeniedPublishes.Inc()
+		return router.ErrAccessDenied
+	}
+	return a.Router.HandleMessage(message)
+}
+
+// HandleSystemMessage passes the message, created by the server, to the wrapped router without checking its publisher.
+// It is the router.SystemPublisher implementation.
+func (a *ACL) HandleSystemMessage(message *protocol.Message) error {
+	return a.Router.HandleMessage(message)
+}
+
+// InterceptFetched passes the message fetched for the route to the delivery interceptors of the wrapped router.
+// It is a part of the router.FetchInterceptor implementation.
+func (a *ACL) InterceptFetched(route *router.Route, message *protocol.Message) *protocol.Message {
+	return router.InterceptFetched(a.Router, route, message)
+}
+
+// Subscribe subscribes the route in the wrapped router if its user is allowed to subscribe to its path,
+// otherwise it returns router.ErrAccessDenied.
+func (a *ACL) Subscribe(r *router.Route) (*router.Route, error) {
+	if !a.CanSubscribe(r.Get("user_id"), r.Roles, r.Path) {
+		logger.WithFields(log.Fields{
+			"userID": r.Get("user_id"),
+			"path":   r.Path,
+		}).Info("Access denied for subscribing")
+		mTotalDeniedSubscriptions.Add(1)
+		pDeniedSubscriptions.Inc()
+		return nil, router.ErrAccessDenied
+	}
+	return a.Router.Subscribe(r)
+}
+
+// CanPublish returns true if the user having the roles is allowed to publish on the path.
+// It is a part of the router.AccessChecker implementation.
+func (a *ACL) CanPublish(userID string, roles []string, path protocol.Path) bool {
+	return a.allowed(Publish, userID, roles, path)
+}
+
+// CanSubscribe returns true if the user having the roles is allowed to subscribe to the path.
+// The ephemeral reply topics of the requests are always allowed, since they can not be guessed.
+// It is a part of the router.AccessChecker implementation.
+func (a *ACL) CanSubscribe(userID string, roles []string, path protocol.Path) bool {
+	if strings.HasPrefix(string(path), protocol.ReplyPrefix) && len(path) > len(protocol.ReplyPrefix) && !path.IsWildcard() {
+		return true
+	}
+	return a.allowed(Subscribe, userID, roles, path)
+}
+
+func (a *ACL) allowed(action Action, userID string, roles []string, path protocol.Path) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	allowed, governed := false, false
+	for _, rule := range a.rules {
+		if !rule.hasAction(action) {
+			continue
+		}
+		topic, ok := rule.topicFor(userID)
+		applies := ok && rule.appliesTo(userID, roles)
+		switch {
+		case rule.Effect == Deny:
+			if applies && overlaps(topic, path, action) {
+				return false
+			}
+		case applies && topic.Matches(path):
+			allowed = true
+		case overlaps(rule.pattern(), path, action):
+			governed = true
+		}
+	}
+	if allowed {
+		return true
+	}
+	return !governed && a.defaultEffect == Allow
+}
+
+// GetPrefix returns the prefix of the admin API.
+// It is a part of the service.endpoint implementation.
+func (a *ACL) GetPrefix() string {
+	return a.prefix
+}
+
+// ServeHTTP lists the rules on GET, and creates a rule on POST (the ID of the rule is generated).
+// GET, PUT and DELETE on `<prefix>/<id>` respectively return, replace and delete a rule.
+// If the authentication is enabled, the requests require the admin role.
+// It is a part of the service.endpoint implementation.
+func (a *ACL) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	a.authenticator.AdminOnly(a.serveRules)(w, req)
+}
+
+func (a *ACL) serveRules(w http.ResponseWriter, req *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, a.prefix), "/")
+
+	switch {
+	case req.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, a.list())
+	case req.Method == http.MethodPost && id == "":
+		a.save(w, req, xid.New().String(), http.StatusCreated)
+	case req.Method == http.MethodGet:
+		a.mu.RLock()
+		rule, ok := a.rules[id]
+		a.mu.RUnlock()
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		writeJSON(w, http.StatusOK, rule)
+	case req.Method == http.MethodPut:
+		a.mu.RLock()
+		_, ok := a.rules[id]
+		a.mu.RUnlock()
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		a.save(w, req, id, http.StatusOK)
+	case req.Method == http.MethodDelete:
+		a.delete(w, req, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// list returns the rules ordered by their ID, which is the order of their creation
+func (a *ACL) list() []*Rule {
+	a.mu.RLock()
+	rules := make([]*Rule, 0, len(a.rules))
+	for _, rule := range a.rules {
+		rules = append(rules, rule)
+	}
+	a.mu.RUnlock()
+
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].ID < rules[j].ID
+	})
+	return rules
+}
+
+// save stores the rule from the body of the request, having the given ID
+func (a *ACL) save(w http.ResponseWriter, req *http.Request, id string, status int) {
+	rule := &Rule{}
+	if err := json.NewDecoder(req.Body).Decode(rule); err != nil {
+		http.Error(w, "Invalid rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.ID = id
+	if err := rule.validate(); err != nil {
+		http.Error(w, "Invalid rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := json.Marshal(rule)
+	if err != nil {
+		http.Error(w, "Server error.", http.StatusInternalServerError)
+		return
+	}
+	if err := a.kvStore.Put(schema, rule.ID, data); err != nil {
+		logger.WithError(err).WithField("id", rule.ID).Error("Error storing rule")
+		http.Error(w, "Server error.", http.StatusInternalServerError)
+		return
+	}
+
+	a.mu.Lock()
+	a.rules[rule.ID] = rule
+	count := len(a.rules)
+	a.mu.Unlock()
+	pRules.Set(float64(count))
+
+	logger.WithField("rule", rule).Info("Saved rule")
+	writeJSON(w, status, rule)
+}
+
+func (a *ACL) delete(w http.ResponseWriter, req *http.Request, id string) {
+	a.mu.Lock()
+	_, ok := a.rules[id]
+	delete(a.rules, id)
+	count := len(a.rules)
+	a.mu.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	pRules.Set(float64(count))
+
+	if err := a.kvStore.Delete(schema, id); err != nil {
+		logger.WithError(err).WithField("id", id).Error("Error deleting rule")
+		http.Error(w, "Server error.", http.StatusInternalServerError)
+		return
+	}
+	logger.WithField("id", id).Info("Deleted rule")
+	w.Write([]byte("OK"))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.WithError(err).Error("Error encoding rules")
+	}
+}
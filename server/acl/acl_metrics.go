@@ -0,0 +1,11 @@
+package acl
+
+import (
+	"github.com/cosminrentea/expvarmetrics"
+)
+
+var (
+	ns                        = metrics.NS("acl")
+	mTotalDeniedPublishes     = ns.NewInt("total_denied_publishes")
+	mTotalDeniedSubscriptions = ns.NewInt("total_denied_subscriptions")
+)
@@ -0,0 +1,30 @@
+package acl
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pDeniedPublishes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "acl_denied_publishes",
+		Help: "Number of messages not published because the access control lists deny it",
+	})
+
+	pDeniedSubscriptions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "acl_denied_subscriptions",
+		Help: "Number of subscriptions denied by the access control lists",
+	})
+
+	pRules = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "acl_rules",
+		Help: "Number of access control rules",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		pDeniedPublishes,
+		pDeniedSubscriptions,
+		pRules,
+	)
+}
@@ -0,0 +1,241 @@
+package acl
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/auth"
+	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/router"
+	"github.com/cosminrentea/gobbler/server/store/dummystore"
+)
+
+type testRouter interface {
+	router.Router
+	Start() error
+	Stop() error
+}
+
+func newTestACL(a *assert.Assertions, kvStore kvstore.KVStore, defaultEffect Effect) (*ACL, testRouter) {
+	r := router.New(dummystore.New(kvstore.NewMemoryKVStore()), kvStore, nil).(testRouter)
+	a.NoError(r.Start())
+	acl, err := New(r, "/admin/acl", defaultEffect)
+	a.NoError(err)
+	a.NoError(acl.Start())
+	return acl, r
+}
+
+func serve(a *assert.Assertions, acl *ACL, method, url, body string, expectedCode int, v interface{}) {
+	w := httptest.NewRecorder()
+	acl.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+	a.Equal(expectedCode, w.Code, url)
+	if v != nil {
+		a.NoError(json.Unmarshal(w.Body.Bytes(), v))
+	}
+}
+
+func addRule(a *assert.Assertions, acl *ACL, rule string) string {
+	created := &Rule{}
+	serve(a, acl, http.MethodPost, "/admin/acl", rule, http.StatusCreated, created)
+	a.NotEmpty(created.ID)
+	return created.ID
+}
+
+func TestACL_Rules(t *testing.T) {
+	a := assert.New(t)
+	acl, r := newTestACL(a, kvstore.NewMemoryKVStore(), Allow)
+	defer r.Stop()
+	defer acl.Stop()
+
+	addRule(a, acl, `{"topic":"/user/{self}/#","user":"*","actions":["publish","subscribe"],"effect":"allow"}`)
+	addRule(a, acl, `{"topic":"/news","role":"editor","actions":["publish"],"effect":"allow"}`)
+	addRule(a, acl, `{"topic":"/news/secret","user":"*","actions":["subscribe"],"effect":"deny"}`)
+	addRule(a, acl, `{"topic":"/news","role":"reader","actions":["subscribe"],"effect":"allow"}`)
+
+	// the own topics of the user
+	a.True(acl.CanPublish("marvin", nil, "/user/marvin"))
+	a.True(acl.CanSubscribe("marvin", nil, "/user/marvin/inbox"))
+	a.False(acl.CanPublish("marvin", nil, "/user/alice/inbox"))
+	a.False(acl.CanSubscribe("marvin", nil, "/user/+/inbox"))
+	a.False(acl.CanSubscribe("marvin", nil, "/user"))
+	a.False(acl.CanPublish("", nil, "/user/marvin"))
+	a.False(acl.CanPublish("marvin/x", nil, "/user/marvin/x"))
+
+	// roles
+	a.True(acl.CanPublish("marvin", []string{"editor"}, "/news/sport"))
+	a.False(acl.CanPublish("marvin", []string{"reader"}, "/news/sport"))
+	a.True(acl.CanSubscribe("marvin", []string{"reader"}, "/news/sport"))
+	a.False(acl.CanSubscribe("marvin", nil, "/news/sport"))
+
+	// deny rules take precedence, also for the routes receiving the subtopics
+	a.False(acl.CanSubscribe("marvin", []string{"reader"}, "/news/secret"))
+	a.False(acl.CanSubscribe("marvin", []string{"reader"}, "/news"))
+	a.False(acl.CanSubscribe("marvin", []string{"reader"}, "/news/+"))
+
+	// the default effect applies to the topics without rules
+	a.True(acl.CanPublish("marvin", nil, "/weather"))
+}
+
+func TestACL_DefaultDeny(t *testing.T) {
+	a := assert.New(t)
+	acl, r := newTestACL(a, kvstore.NewMemoryKVStore(), Deny)
+	defer r.Stop()
+	defer acl.Stop()
+
+	addRule(a, acl, `{"topic":"/weather","user":"*","actions":["subscribe"],"effect":"allow"}`)
+	a.False(acl.CanPublish("marvin", nil, "/weather"))
+	a.True(acl.CanSubscribe("marvin", nil, "/weather/berlin"))
+	a.False(acl.CanSubscribe("marvin", nil, "/news"))
+
+	// the reply topics are always allowed, but not the wildcards matching them
+	a.True(acl.CanSubscribe("marvin", nil, "/reply/b5j0cj1c0000"))
+	a.False(acl.CanSubscribe("marvin", nil, "/reply/+"))
+
+	// the server publishes on the system topics, but the subscriptions to them are checked
+	a.NoError(acl.HandleMessage(&protocol.Message{Path: "/_presence/marvin", Body: []byte("connected")}))
+	a.False(acl.CanSubscribe("marvin", nil, "/_presence/marvin"))
+
+	_, err := New(r, "/admin/acl", Effect("maybe"))
+	a.Error(err)
+}
+
+func TestACL_DenyWildcards(t *testing.T) {
+	a := assert.New(t)
+	acl, r := newTestACL(a, kvstore.NewMemoryKVStore(), Allow)
+	defer r.Stop()
+	defer acl.Stop()
+
+	addRule(a, acl, `{"topic":"/secret","user":"*","actions":["subscribe"],"effect":"deny"}`)
+	addRule(a, acl, `{"topic":"/orders/+/payment","user":"bob","actions":["subscribe"],"effect":"deny"}`)
+
+	// the wildcard subscriptions receiving the denied topics are denied
+	a.False(acl.CanSubscribe("bob", nil, "/+/x"))
+	a.False(acl.CanSubscribe("bob", nil, "/+"))
+	a.False(acl.CanSubscribe("bob", nil, "/+/42/status"))
+	a.False(acl.CanSubscribe("bob", nil, "/#"))
+	a.False(acl.CanSubscribe("bob", nil, "/secret/+"))
+	a.False(acl.CanSubscribe("bob", nil, "/*/42/payment"))
+	a.False(acl.CanSubscribe("bob", nil, "/orders/42/+"))
+	a.False(acl.CanSubscribe("bob", nil, "/orders/42"))
+	a.False(acl.CanSubscribe("bob", nil, "/orders/#"))
+
+	// but not the ones receiving only other topics
+	a.True(acl.CanSubscribe("bob", nil, "/orders/+/status"))
+	a.True(acl.CanSubscribe("bob", nil, "/orders/42/status/+"))
+	a.True(acl.CanSubscribe("alice", nil, "/orders/+/+"))
+	a.True(acl.CanPublish("bob", nil, "/secret/x"))
+}
+
+func TestACL_Enforce(t *testing.T) {
+	a := assert.New(t)
+	acl, r := newTestACL(a, kvstore.NewMemoryKVStore(), Allow)
+	defer r.Stop()
+	defer acl.Stop()
+
+	addRule(a, acl, `{"topic":"/orders","role":"shop","actions":["publish","subscribe"],"effect":"allow"}`)
+
+	route := router.NewRoute(router.RouteConfig{
+		RouteParams: router.RouteParams{"application_id": "app", "user_id": "marvin"},
+		Path:        "/orders",
+		ChannelSize: 10,
+	})
+	_, err := acl.Subscribe(route)
+	a.Equal(router.ErrAccessDenied, err)
+
+	route.Roles = []string{"shop"}
+	_, err = acl.Subscribe(route)
+	a.NoError(err)
+
+	a.Equal(router.ErrAccessDenied, acl.HandleMessage(&protocol.Message{Path: "/orders", UserID: "marvin", Body: []byte("denied")}))
+	// the messages of the other nodes are not checked again
+	a.NoError(acl.HandleMessage(&protocol.Message{Path: "/orders", UserID: "marvin", NodeID: 2, Body: []byte("remote")}))
+	a.NoError(acl.HandleMessage(&protocol.Message{Path: "/orders", UserID: "marvin", Roles: []string{"shop"}, Body: []byte("allowed")}))
+	// the messages of the server are not checked
+	a.NoError(router.HandleSystemMessage(acl, &protocol.Message{Path: "/orders", UserID: "marvin", Body: []byte("system")}))
+
+	a.Equal("remote", string((<-route.MessagesChannel()).Body))
+	a.Equal("allowed", string((<-route.MessagesChannel()).Body))
+	a.Equal("system", string((<-route.MessagesChannel()).Body))
+}
+
+func TestACL_AdminAPI(t *testing.T) {
+	a := assert.New(t)
+	kvStore := kvstore.NewMemoryKVStore()
+	acl, r := newTestACL(a, kvStore, Allow)
+	defer r.Stop()
+
+	id := addRule(a, acl, `{"topic":"/news/","role":"editor","actions":["publish"],"effect":"allow"}`)
+
+	var rules []*Rule
+	serve(a, acl, http.MethodGet, "/admin/acl", "", http.StatusOK, &rules)
+	a.Len(rules, 1)
+	a.Equal(protocol.Path("/news"), rules[0].Topic)
+
+	rule := &Rule{}
+	serve(a, acl, http.MethodPut, "/admin/acl/"+id, `{"topic":"/news","role":"editor","actions":["publish"],"effect":"deny"}`, http.StatusOK, rule)
+	a.Equal(id, rule.ID)
+	serve(a, acl, http.MethodGet, "/admin/acl/"+id, "", http.StatusOK, rule)
+	a.Equal(Deny, rule.Effect)
+
+	for _, invalid := range []string{
+		`{"topic":"news","user":"*","actions":["publish"],"effect":"allow"}`,
+		`{"topic":"/news/#/sport","user":"*","actions":["publish"],"effect":"allow"}`,
+		`{"topic":"/news","actions":["publish"],"effect":"allow"}`,
+		`{"topic":"/news","user":"*","actions":[],"effect":"allow"}`,
+		`{"topic":"/news","user":"*","actions":["delete"],"effect":"allow"}`,
+		`{"topic":"/news","user":"*","actions":["publish"],"effect":"maybe"}`,
+		`not json`,
+	} {
+		serve(a, acl, http.MethodPost, "/admin/acl", invalid, http.StatusBadRequest, nil)
+	}
+	serve(a, acl, http.MethodPut, "/admin/acl/unknown", `{"topic":"/news","user":"*","actions":["publish"],"effect":"allow"}`, http.StatusNotFound, nil)
+
+	// the rules are loaded again from the KVStore
+	a.NoError(acl.Stop())
+	acl, err := New(r, "/admin/acl", Allow)
+	a.NoError(err)
+	a.NoError(acl.Start())
+	defer acl.Stop()
+	a.False(acl.CanPublish("marvin", []string{"editor"}, "/news"))
+
+	serve(a, acl, http.MethodDelete, "/admin/acl/"+id, "", http.StatusOK, nil)
+	serve(a, acl, http.MethodDelete, "/admin/acl/"+id, "", http.StatusNotFound, nil)
+	serve(a, acl, http.MethodGet, "/admin/acl/"+id, "", http.StatusNotFound, nil)
+	a.True(acl.CanPublish("marvin", []string{"editor"}, "/news"))
+	_, found, err := kvStore.Get(schema, id)
+	a.NoError(err)
+	a.False(found)
+}
+
+func TestACL_AdminAPIAuthentication(t *testing.T) {
+	a := assert.New(t)
+	acl, r := newTestACL(a, kvstore.NewMemoryKVStore(), Allow)
+	defer r.Stop()
+	defer acl.Stop()
+	acl.SetAuthenticator(auth.NewAuthenticator(auth.NewAPIKeyVerifier(map[string]*auth.Identity{
+		"key1":  {UserID: "marvin"},
+		"admin": {UserID: "root", Roles: []string{auth.AdminRole}},
+	})))
+
+	rule := `{"topic":"/news","user":"marvin","actions":["publish"],"effect":"allow"}`
+	for token, expectedCode := range map[string]int{
+		"":      http.StatusUnauthorized,
+		"key1":  http.StatusForbidden,
+		"admin": http.StatusCreated,
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/admin/acl", strings.NewReader(rule))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		acl.ServeHTTP(w, req)
+		a.Equal(expectedCode, w.Code, token)
+	}
+	a.Len(acl.list(), 1)
+}
@@ -0,0 +1,7 @@
+package acl
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+var logger = log.WithField("module", "acl")
@@ -0,0 +1,139 @@
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cosminrentea/gobbler/protocol"
+)
+
+// Action is an operation on a topic controlled by the rules
+type Action string
+
+const (
+	// Publish is the action of publishing messages on a topic
+	Publish Action = "publish"
+
+	// Subscribe is the action of subscribing to a topic, or fetching its messages
+	Subscribe Action = "subscribe"
+)
+
+// Effect is the decision of a rule, or the default decision when no rule applies
+type Effect string
+
+const (
+	// Allow is the effect of the rules granting access to a topic
+	Allow Effect = "allow"
+
+	// Deny is the effect of the rules refusing access to a topic; deny rules take precedence over allow rules
+	Deny Effect = "deny"
+)
+
+const (
+	// Self is the placeholder of the caller's own user ID in the topic of a rule, e.g. `/user/{self}/#`
+	Self = "{self}"
+
+	// AnyUser is the value of the user of a rule applying to all the callers
+	AnyUser = "*"
+)
+
+var (
+	errMissingTopic   = errors.New("the topic of the rule must be an absolute path")
+	errMissingSubject = errors.New("the rule must have a user or a role")
+	errMissingActions = errors.New("the rule must have at least one action")
+)
+
+// Rule allows or denies a user, or the users having a role, to publish and/or to subscribe to a topic.
+// The topic is a pattern matching itself and all its subtopics, which can contain wildcards and the Self placeholder.
+// If both a user and a role are given, the rule applies only to the user having the role.
+type Rule struct {
+	ID      string        `json:"id"`
+	Topic   protocol.Path `json:"topic"`
+	User    string        `json:"user,omitempty"`
+	Role    string        `json:"role,omitempty"`
+	Actions []Action      `json:"actions"`
+	Effect  Effect        `json:"effect"`
+}
+
+func (rule *Rule) validate() error {
+	rule.Topic = protocol.Path(strings.TrimSuffix(string(rule.Topic), "/"))
+	if !strings.HasPrefix(string(rule.Topic), "/") {
+		return errMissingTopic
+	}
+	if err := rule.Topic.Validate(); err != nil {
+		return err
+	}
+	if rule.User == "" && rule.Role == "" {
+		return errMissingSubject
+	}
+	if len(rule.Actions) == 0 {
+		return errMissingActions
+	}
+	for _, action := range rule.Actions {
+		if action != Publish && action != Subscribe {
+			return fmt.Errorf("unknown action: %q", action)
+		}
+	}
+	return ParseEffect(string(rule.Effect))
+}
+
+// ParseEffect returns an error if the value is not a valid effect
+func ParseEffect(value string) error {
+	if Effect(value) != Allow && Effect(value) != Deny {
+		return fmt.Errorf("unknown effect: %q (expected %q or %q)", value, Allow, Deny)
+	}
+	return nil
+}
+
+func (rule *Rule) hasAction(action Action) bool {
+	for _, a := range rule.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// appliesTo returns true if the rule applies to the user having the roles
+func (rule *Rule) appliesTo(userID string, roles []string) bool {
+	if rule.User != "" && rule.User != AnyUser && rule.User != userID {
+		return false
+	}
+	if rule.Role == "" {
+		return true
+	}
+	for _, role := range roles {
+		if role == rule.Role {
+			return true
+		}
+	}
+	return false
+}
+
+// topicFor returns the topic of the rule for the user, replacing the Self placeholder by the user ID.
+// It returns false if the topic references the user, but the user ID can not be a level of a topic.
+func (rule *Rule) topicFor(userID string) (protocol.Path, bool) {
+	if !strings.Contains(string(rule.Topic), Self) {
+		return rule.Topic, true
+	}
+	if !protocol.IsTopicLevel(userID) {
+		return "", false
+	}
+	return protocol.Path(strings.Replace(string(rule.Topic), Self, userID, -1)), true
+}
+
+// pattern returns the topic of the rule for any user, replacing the Self placeholder by a wildcard
+func (rule *Rule) pattern() protocol.Path {
+	return protocol.Path(strings.Replace(string(rule.Topic), Self, protocol.SingleLevelWildcard, -1))
+}
+
+// overlaps returns true if the path shares some topics with the given topic.
+// For a subscription, the topic and the path are intersected as patterns, since a route receives
+// the messages published on all the topics matched by its path, e.g. `/+/x` receives the ones of `/secret/x`.
+func overlaps(topic, path protocol.Path, action Action) bool {
+	if action == Subscribe {
+		return topic.Intersects(path)
+	}
+	return topic.Matches(path)
+}
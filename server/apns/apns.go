@@ -6,6 +6,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cosminrentea/expvarmetrics"
+	"github.com/cosminrentea/gobbler/server/auth"
 	"github.com/cosminrentea/gobbler/server/connector"
 	"github.com/cosminrentea/gobbler/server/kafka"
 	"github.com/cosminrentea/gobbler/server/router"
@@ -28,6 +29,10 @@ type Config struct {
 	Workers             *int
 	Prefix              *string
 	IntervalMetrics     *bool
+	QueueSize           *int
+	Backpressure        *string
+	DeadLetterAttempts  *int
+	Authenticator       *auth.Authenticator
 }
 
 // apns is the private struct for handling the communication with APNS
@@ -39,16 +44,21 @@ type apns struct {
 
 // New creates a new connector.ResponsiveConnector without starting it
 func New(router router.Router, sender connector.Sender, config Config, kafkaProducer kafka.Producer, subUnsubKafkaReportingTopic, apnsKafkaReportingTopic string) (connector.ResponsiveConnector, error) {
+	connectorConfig := connector.Config{
+		Name:       "apns",
+		Schema:     schema,
+		Prefix:     *config.Prefix,
+		URLPattern: fmt.Sprintf("/{%s}/{%s}/{%s:.*}", deviceIDKey, userIDKey, connector.TopicParam),
+		Workers:    *config.Workers,
+	}
+	connectorConfig.SetBackpressure(config.QueueSize, config.Backpressure)
+	connectorConfig.SetDeadLetterAttempts(config.DeadLetterAttempts)
+	connectorConfig.Authenticator = config.Authenticator
+
 	baseConn, err := connector.NewConnector(
 		router,
 		sender,
-		connector.Config{
-			Name:       "apns",
-			Schema:     schema,
-			Prefix:     *config.Prefix,
-			URLPattern: fmt.Sprintf("/{%s}/{%s}/{%s:.*}", deviceIDKey, userIDKey, connector.TopicParam),
-			Workers:    *config.Workers,
-		},
+		connectorConfig,
 		kafkaProducer,
 		subUnsubKafkaReportingTopic,
 	)
@@ -79,6 +89,7 @@ func (a *apns) Stop() error {
 
 func (a *apns) startMetrics() {
 	mTotalSentMessages.Set(0)
+	mTotalExpiredMessages.Set(0)
 	mTotalSendErrors.Set(0)
 	mTotalResponseErrors.Set(0)
 	mTotalResponseInternalErrors.Set(0)
@@ -111,6 +122,10 @@ func (a *apns) HandleResponse(request connector.Request, responseIface interface
 		logger.WithError(errFill).Error("Error filling event")
 	}
 
+	if errSend == connector.ErrMessageExpired {
+		return a.handleExpired(request, &event)
+	}
+
 	l.Info("Handle APNS response")
 	if errSend != nil {
 		l.WithFields(log.Fields{
@@ -188,3 +203,28 @@ func (a *apns) HandleResponse(request connector.Request, responseIface interface
 	}
 	return nil
 }
+
+// handleExpired moves the subscription past an expired message, which was not sent, and reports it to Kafka
+func (a *apns) handleExpired(request connector.Request, event *ApnsEvent) error {
+	message := request.Message()
+	logger.WithField("correlation_id", message.CorrelationID()).WithField("messageID", message.ID).
+		Info("Message expired, not sending it to APNS")
+	mTotalExpiredMessages.Add(1)
+	pExpiredMessages.Inc()
+
+	request.Subscriber().SetLastID(message.ID)
+	if err := a.Manager().Update(request.Subscriber()); err != nil {
+		logger.WithField("error", err.Error()).Error("Manager could not update subscription")
+		mTotalResponseInternalErrors.Add(1)
+		pResponseInternalErrors.Inc()
+		return err
+	}
+
+	event.Payload.Status = "Expired"
+	event.Payload.ErrorText = connector.ErrMessageExpired.Error()
+	err := event.report(a.KafkaProducer(), a.apnsKafkaReportingTopic)
+	if err != nil && err != errApnsKafkaReportingConfiguration {
+		logger.WithError(err).Error("Reporting APNS to kafka failed")
+	}
+	return nil
+}
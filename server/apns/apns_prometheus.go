@@ -49,6 +49,11 @@ var (
 		Name: "apns_send_retry_unrecoverable",
 		Help: "Number of unrecoverable retries in the APNS connector",
 	})
+
+	pExpiredMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "apns_expired_messages",
+		Help: "Number of expired messages which were not sent to APNS",
+	})
 )
 
 func init() {
@@ -62,5 +67,6 @@ func init() {
 		pSendNetworkErrors,
 		pSendRetryCloseTLS,
 		pSendRetryUnrecoverable,
+		pExpiredMessages,
 	)
 }
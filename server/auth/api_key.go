@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// apiKeyVerifier verifies static API keys
+type apiKeyVerifier struct {
+	keys map[string]*Identity
+}
+
+// NewAPIKeyVerifier returns a Verifier of the given API keys, mapped to the identities of their owners
+func NewAPIKeyVerifier(keys map[string]*Identity) Verifier {
+	return &apiKeyVerifier{keys: keys}
+}
+
+func (v *apiKeyVerifier) Verify(token string) (*Identity, error) {
+	for key, identity := range v.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+			return identity, nil
+		}
+	}
+	return nil, ErrInvalidToken
+}
+
+// ParseAPIKeys parses API keys formatted as `key=user_id` or `key=user_id:role1:role2`
+func ParseAPIKeys(settings []string) (map[string]*Identity, error) {
+	keys := make(map[string]*Identity, len(settings))
+	for _, setting := range settings {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid API key %q: the format is key=user_id[:role...]", setting)
+		}
+		fields := strings.Split(parts[1], ":")
+		if fields[0] == "" {
+			return nil, fmt.Errorf("invalid API key %q: missing user id", setting)
+		}
+		identity := &Identity{UserID: fields[0]}
+		for _, role := range fields[1:] {
+			if role != "" {
+				identity.Roles = append(identity.Roles, role)
+			}
+		}
+		keys[parts[0]] = identity
+	}
+	return keys, nil
+}
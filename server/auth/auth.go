@@ -0,0 +1,118 @@
+// Package auth verifies the identity of the clients, using HMAC-signed JWTs or static API keys.
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// TokenParam is the query parameter holding the token, for the clients which can not set the Authorization header
+	// (e.g. websockets opened by browsers)
+	TokenParam = "access_token"
+
+	// AdminRole is the role of the users allowed to manage the server and to access the data of the other users
+	AdminRole = "admin"
+
+	bearerPrefix = "Bearer "
+)
+
+var (
+	// ErrMissingToken is returned when a request does not carry a token
+	ErrMissingToken = errors.New("missing authentication token")
+
+	// ErrInvalidToken is returned when a token is not accepted by any verifier
+	ErrInvalidToken = errors.New("invalid authentication token")
+)
+
+// Identity is the verified identity of a client
+type Identity struct {
+	UserID string   `json:"user_id"`
+	Roles  []string `json:"roles,omitempty"`
+}
+
+// HasRole returns true if the identity has the role
+func (identity *Identity) HasRole(role string) bool {
+	for _, r := range identity.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifier verifies a token, returning the identity of its owner
+type Verifier interface {
+	Verify(token string) (*Identity, error)
+}
+
+// Authenticator authenticates the HTTP requests, using a list of verifiers.
+// A nil Authenticator, or one without verifiers, is disabled.
+type Authenticator struct {
+	verifiers []Verifier
+}
+
+// NewAuthenticator returns a new Authenticator, accepting the tokens accepted by any of the verifiers
+func NewAuthenticator(verifiers ...Verifier) *Authenticator {
+	return &Authenticator{verifiers: verifiers}
+}
+
+// Enabled returns true if the authenticator has verifiers, so the requests have to be authenticated
+func (a *Authenticator) Enabled() bool {
+	return a != nil && len(a.verifiers) > 0
+}
+
+// Authenticate returns the identity verified by the first verifier accepting the token of the request
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := Token(r)
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+	for _, verifier := range a.verifiers {
+		if identity, err := verifier.Verify(token); err == nil {
+			return identity, nil
+		}
+	}
+	logger.WithField("remoteAddr", r.RemoteAddr).Info("Request with an invalid token")
+	return nil, ErrInvalidToken
+}
+
+// AdminOnly wraps a handler of a management API, which requires the admin role if the authentication is enabled.
+// The requests without a valid token are answered with 401, and the ones without the admin role with 403.
+func (a *Authenticator) AdminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.Enabled() {
+			identity, err := a.Authenticate(r)
+			if err != nil {
+				Unauthorized(w, err)
+				return
+			}
+			if !identity.HasRole(AdminRole) {
+				logger.WithFields(log.Fields{
+					"userID": identity.UserID,
+					"path":   r.URL.Path,
+				}).Warn("Management request without the admin role")
+				http.Error(w, `{"error":"the admin role is required"}`, http.StatusForbidden)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// Token returns the token of the request, from the `Authorization: Bearer` header or from the `access_token` query parameter
+func Token(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, bearerPrefix) {
+		return strings.TrimSpace(strings.TrimPrefix(header, bearerPrefix))
+	}
+	return r.URL.Query().Get(TokenParam)
+}
+
+// Unauthorized writes the response to a request which could not be authenticated
+func Unauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="gobbler"`)
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var secret = []byte("secret")
+
+func aToken(header, claims string, key []byte) string {
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTVerifier(t *testing.T) {
+	a := assert.New(t)
+	v := NewJWTVerifier(secret)
+
+	header := `{"alg":"HS256","typ":"JWT"}`
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	identity, err := v.Verify(aToken(header, `{"sub":"marvin","roles":["admin"]}`, secret))
+	a.NoError(err)
+	a.Equal(&Identity{UserID: "marvin", Roles: []string{"admin"}}, identity)
+
+	identity, err = v.Verify(aToken(header, `{"sub":"marvin","exp":`+future+`,"nbf":`+past+`}`, secret))
+	a.NoError(err)
+	a.Equal("marvin", identity.UserID)
+
+	for name, token := range map[string]string{
+		"wrong secret":        aToken(header, `{"sub":"marvin"}`, []byte("other")),
+		"expired":             aToken(header, `{"sub":"marvin","exp":`+past+`}`, secret),
+		"not yet valid":       aToken(header, `{"sub":"marvin","nbf":`+future+`}`, secret),
+		"missing subject":     aToken(header, `{"roles":["admin"]}`, secret),
+		"unsigned":            aToken(`{"alg":"none"}`, `{"sub":"marvin"}`, secret),
+		"invalid claims JSON": aToken(header, `{"sub":`, secret),
+		"malformed":           "abc.def",
+	} {
+		_, err := v.Verify(token)
+		a.Error(err, name)
+	}
+}
+
+func TestParseAPIKeys(t *testing.T) {
+	a := assert.New(t)
+
+	keys, err := ParseAPIKeys([]string{"key1=marvin", "key2=arthur:admin:ops"})
+	a.NoError(err)
+	a.Equal(map[string]*Identity{
+		"key1": {UserID: "marvin"},
+		"key2": {UserID: "arthur", Roles: []string{"admin", "ops"}},
+	}, keys)
+
+	a.True(keys["key2"].HasRole(AdminRole))
+	a.False(keys["key1"].HasRole(AdminRole))
+
+	for _, setting := range []string{"key1", "=marvin", "key1=", "key1=:admin"} {
+		_, err := ParseAPIKeys([]string{setting})
+		a.Error(err, setting)
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	a := assert.New(t)
+
+	var disabled *Authenticator
+	a.False(disabled.Enabled())
+	a.False(NewAuthenticator().Enabled())
+
+	authenticator := NewAuthenticator(
+		NewJWTVerifier(secret),
+		NewAPIKeyVerifier(map[string]*Identity{"key1": {UserID: "arthur"}}),
+	)
+	a.True(authenticator.Enabled())
+
+	req := httptest.NewRequest(http.MethodGet, "/api/message/topic", nil)
+	_, err := authenticator.Authenticate(req)
+	a.Equal(ErrMissingToken, err)
+
+	req.Header.Set("Authorization", "Bearer "+aToken(`{"alg":"HS256"}`, `{"sub":"marvin"}`, secret))
+	identity, err := authenticator.Authenticate(req)
+	a.NoError(err)
+	a.Equal("marvin", identity.UserID)
+
+	req = httptest.NewRequest(http.MethodGet, "/stream/?access_token=key1", nil)
+	identity, err = authenticator.Authenticate(req)
+	a.NoError(err)
+	a.Equal("arthur", identity.UserID)
+
+	req = httptest.NewRequest(http.MethodGet, "/stream/?access_token=key2", nil)
+	_, err = authenticator.Authenticate(req)
+	a.Equal(ErrInvalidToken, err)
+
+	w := httptest.NewRecorder()
+	Unauthorized(w, err)
+	a.Equal(http.StatusUnauthorized, w.Code)
+	a.Contains(w.Header().Get("WWW-Authenticate"), "Bearer")
+}
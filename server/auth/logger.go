@@ -0,0 +1,7 @@
+package auth
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+var logger = log.WithField("module", "auth")
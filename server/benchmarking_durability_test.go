@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/server/configstring"
+	"github.com/cosminrentea/gobbler/server/store/filestore"
+	"github.com/cosminrentea/gobbler/testutil"
+)
+
+// Durability benchmarks
+// The messages are published through the REST API by 16 concurrent publishers,
+// with each sync policy of the file message store
+func Benchmark_E2E_Publish_SyncNone(b *testing.B) {
+	benchmarkPublish(b, "none", 16)
+}
+
+func Benchmark_E2E_Publish_SyncInterval(b *testing.B) {
+	benchmarkPublish(b, "interval", 16)
+}
+
+func Benchmark_E2E_Publish_SyncAlways(b *testing.B) {
+	benchmarkPublish(b, "always", 16)
+}
+
+func Benchmark_E2E_Publish_SyncAlways_1Publisher(b *testing.B) {
+	benchmarkPublish(b, "always", 1)
+}
+
+func benchmarkPublish(b *testing.B, syncPolicy string, publishers int) {
+	defer testutil.ResetDefaultRegistryHealthCheck()
+
+	a := assert.New(b)
+	dir, _ := ioutil.TempDir("", "guble_benchmarking_durability_test")
+	defer os.RemoveAll(dir)
+
+	*Config.HttpListen = "localhost:0"
+	*Config.KVS = "memory"
+	*Config.MS = "file"
+	*Config.MSSync = syncPolicy
+	*Config.MSSyncInterval = 100 * time.Millisecond
+	*Config.StoragePath = dir
+	*Config.WS.Enabled = false
+	*Config.KafkaProducer.Brokers = configstring.List{}
+	defer func() {
+		*Config.MSSync = "none"
+		filestore.Durability = filestore.SyncNone
+	}()
+
+	service := StartService()
+	defer service.Stop()
+
+	time.Sleep(time.Millisecond * 10)
+
+	url := "http://" + service.WebServer().GetAddr() + "/api/message/durability"
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: publishers}}
+
+	messages := make(chan int, b.N)
+	for i := 1; i <= b.N; i++ {
+		messages <- i
+	}
+	close(messages)
+
+	start := time.Now()
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range messages {
+				resp, err := client.Post(url, "text/plain", strings.NewReader(fmt.Sprintf("Hello %v", i)))
+				if !a.NoError(err) {
+					return
+				}
+				resp.Body.Close()
+				a.Equal(http.StatusOK, resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	end := time.Now()
+	throughput := float64(b.N) / end.Sub(start).Seconds()
+	fmt.Printf("\n\tThroughput (sync %v, %v publishers): %v/sec (%v message in %v)\n",
+		syncPolicy, publishers, int(throughput), b.N, end.Sub(start))
+}
@@ -10,32 +10,44 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cosminrentea/gobbler/server/acl"
 	"github.com/cosminrentea/gobbler/server/apns"
 	"github.com/cosminrentea/gobbler/server/configstring"
 	"github.com/cosminrentea/gobbler/server/fcm"
 	"github.com/cosminrentea/gobbler/server/kafka"
+	"github.com/cosminrentea/gobbler/server/router"
 	"github.com/cosminrentea/gobbler/server/sms"
 	"github.com/cosminrentea/gobbler/server/websocket"
 )
 
 const (
-	defaultHttpListen         = ":8080"
-	defaultHealthEndpoint     = "/admin/healthcheck"
-	defaultMetricsEndpoint    = "/admin/metrics-old"
-	defaultPrometheusEndpoint = "/admin/metrics"
-	defaultTogglesEndpoint    = "/admin/toggles"
-	defaultKVSBackend         = "file"
-	defaultMSBackend          = "file"
-	defaultStoragePath        = "/var/lib/gobbler"
-	defaultNodePort           = "10000"
-	development               = "dev"
-	integration               = "int"
-	preproduction             = "pre"
-	production                = "prod"
-	memProfile                = "mem"
-	cpuProfile                = "cpu"
-	blockProfile              = "block"
+	defaultHttpListen          = ":8080"
+	defaultHealthEndpoint      = "/admin/healthcheck"
+	defaultMetricsEndpoint     = "/admin/metrics-old"
+	defaultPrometheusEndpoint  = "/admin/metrics"
+	defaultTogglesEndpoint     = "/admin/toggles"
+	defaultIdempotencyWindow   = "10m"
+	defaultDeliveryAckTimeout  = "10s"
+	defaultSchedulerEndpoint   = "/admin/scheduled"
+	defaultTopicsEndpoint      = "/admin/topics"
+	defaultACLEndpoint         = "/admin/acl"
+	defaultKVSBackend          = "file"
+	defaultMSBackend           = "file"
+	defaultMSScrubInterval     = "1h"
+	defaultMSSync              = "none"
+	defaultMSSyncInterval      = "100ms"
+	defaultMSRetentionInterval = "1m"
+	defaultStoragePath         = "/var/lib/gobbler"
+	defaultNodePort            = "10000"
+	development                = "dev"
+	integration                = "int"
+	preproduction              = "pre"
+	production                 = "prod"
+	memProfile                 = "mem"
+	cpuProfile                 = "cpu"
+	blockProfile               = "block"
 )
 
 var (
@@ -62,6 +74,22 @@ type (
 		Password *string
 		DbName   *string
 	}
+	// AuthConfig is used for configuring the authentication of the websocket, REST and connector endpoints.
+	// The authentication is enabled if a JWT secret or API keys are configured.
+	AuthConfig struct {
+		JWTSecret *string
+		APIKeys   *configstring.List
+	}
+	// ACLConfig is used for configuring the access control lists of the topics.
+	ACLConfig struct {
+		Endpoint *string
+		Default  *string
+	}
+	// RateLimitConfig is used for configuring the rate limits of the publish and subscribe commands of the clients.
+	RateLimitConfig struct {
+		Publish   *configstring.List
+		Subscribe *configstring.List
+	}
 	// ClusterConfig is used for configuring the cluster component.
 	ClusterConfig struct {
 		NodeID   *uint8
@@ -75,12 +103,34 @@ type (
 		HttpListen           *string
 		KVS                  *string
 		MS                   *string
+		MSScrubInterval      *time.Duration
+		MSRecover            *bool
+		MSSync               *string
+		MSSyncInterval       *time.Duration
+		MSRetentionAge       *time.Duration
+		MSRetentionBytes     *int64
+		MSRetentionMessages  *uint64
+		MSRetention          *configstring.List
+		MSRetentionInterval  *time.Duration
+		MSOpenFiles          *int
+		MSMmap               *bool
+		MSHotMessages        *int
 		StoragePath          *string
 		HealthEndpoint       *string
 		MetricsEndpoint      *string
 		PrometheusEndpoint   *string
 		TogglesEndpoint      *string
+		SchedulerEndpoint    *string
+		TopicsEndpoint       *string
+		TopicsMetrics        *bool
 		Profile              *string
+		IdempotencyWindow    *time.Duration
+		DeliveryAckTimeout   *time.Duration
+		MaxBodySize          *int
+		TopicTTL             *configstring.List
+		Auth                 AuthConfig
+		ACL                  ACLConfig
+		RateLimit            RateLimitConfig
 		Postgres             PostgresConfig
 		FCM                  fcm.Config
 		APNS                 apns.Config
@@ -118,6 +168,51 @@ var (
 			HintOptions("file", "memory").
 			Envar(g("MS")).
 			String(),
+		MSScrubInterval: kingpin.Flag("ms-scrub-interval", `The interval at which the checksums of the messages stored in files are verified (value for disabling it: 0)`).
+			Default(defaultMSScrubInterval).
+			Envar(g("MS_SCRUB_INTERVAL")).
+			Duration(),
+		MSRecover: kingpin.Flag("ms-recover", `Rebuild at startup the index files of all the partitions stored in files, truncating their partial writes`).
+			Envar(g("MS_RECOVER")).
+			Bool(),
+		MSSync: kingpin.Flag("ms-sync", `When the messages stored in files are synced to the disk: none (by the operating system) | interval (every ms-sync-interval) | always (before being acknowledged)`).
+			Default(defaultMSSync).
+			Envar(g("MS_SYNC")).
+			Enum("none", "interval", "always"),
+		MSSyncInterval: kingpin.Flag("ms-sync-interval", `The interval of the syncs of the messages stored in files, with the "interval" sync policy`).
+			Default(defaultMSSyncInterval).
+			Envar(g("MS_SYNC_INTERVAL")).
+			Duration(),
+		MSRetentionAge: kingpin.Flag("ms-retention-age", `The default maximum age of the newest message of a file of a partition stored in files, before the file is deleted (value for disabling it: 0)`).
+			Default("0").
+			Envar(g("MS_RETENTION_AGE")).
+			Duration(),
+		MSRetentionBytes: kingpin.Flag("ms-retention-bytes", `The default maximum size in bytes of a partition stored in files, its oldest files being deleted when exceeded (value for disabling it: 0)`).
+			Default("0").
+			Envar(g("MS_RETENTION_BYTES")).
+			Int64(),
+		MSRetentionMessages: kingpin.Flag("ms-retention-messages", `The default maximum number of messages of a partition stored in files, its oldest files being deleted when exceeded (value for disabling it: 0)`).
+			Default("0").
+			Envar(g("MS_RETENTION_MESSAGES")).
+			Uint64(),
+		MSRetention: configstring.NewFromKingpin(
+			kingpin.Flag("ms-retention", `The retention policies of partitions, replacing the default one (formatted as partition:age=duration|bytes=number|messages=number, separated by spaces or commas)`).
+				Envar(g("MS_RETENTION"))),
+		MSRetentionInterval: kingpin.Flag("ms-retention-interval", `The interval at which the retention policies of the partitions stored in files are applied (value for disabling it: 0)`).
+			Default(defaultMSRetentionInterval).
+			Envar(g("MS_RETENTION_INTERVAL")).
+			Duration(),
+		MSOpenFiles: kingpin.Flag("ms-open-files", `The maximum number of message files kept open by each partition for the fetches`).
+			Default("8").
+			Envar(g("MS_OPEN_FILES")).
+			Int(),
+		MSMmap: kingpin.Flag("ms-mmap", `Map in memory the full message files read by the fetches`).
+			Envar(g("MS_MMAP")).
+			Bool(),
+		MSHotMessages: kingpin.Flag("ms-hot-messages", `The number of the last messages stored in each partition which are kept in memory for the fetches (value for disabling it: 0)`).
+			Default("256").
+			Envar(g("MS_HOT_MESSAGES")).
+			Int(),
 		StoragePath: kingpin.Flag("storage-path", "The path for storing messages and key-value data if 'file' is selected").
 			Default(defaultStoragePath).
 			Envar(g("STORAGE_PATH")).
@@ -138,10 +233,62 @@ var (
 			Default(defaultTogglesEndpoint).
 			Envar(g("TOGGLES_ENDPOINT")).
 			String(),
+		SchedulerEndpoint: kingpin.Flag("scheduler-endpoint", `The endpoint of the API for listing and cancelling the scheduled messages (value for disabling it: "")`).
+			Default(defaultSchedulerEndpoint).
+			Envar(g("SCHEDULER_ENDPOINT")).
+			String(),
+		TopicsEndpoint: kingpin.Flag("topics-endpoint", `The endpoint of the statistics of the topics and partitions (value for disabling it: "")`).
+			Default(defaultTopicsEndpoint).
+			Envar(g("TOPICS_ENDPOINT")).
+			String(),
+		TopicsMetrics: kingpin.Flag("topics-metrics", `Export the statistics of the partitions as Prometheus metrics, with a partition label`).
+			Envar(g("TOPICS_METRICS")).
+			Bool(),
 		Profile: kingpin.Flag("profile", `The profiler to be used (default: none): mem | cpu | block`).
 			Default("").
 			Envar(g("PROFILE")).
 			Enum("mem", "cpu", "block", ""),
+		IdempotencyWindow: kingpin.Flag("idempotency-window", `The duration for which the idempotency keys of the published messages are remembered (value for disabling it: 0)`).
+			Default(defaultIdempotencyWindow).
+			Envar(g("IDEMPOTENCY_WINDOW")).
+			Duration(),
+		DeliveryAckTimeout: kingpin.Flag("delivery-ack-timeout", `The default duration after which the online-first messages not acknowledged by a websocket session of their recipient fall back to push notifications`).
+			Default(defaultDeliveryAckTimeout).
+			Envar(g("DELIVERY_ACK_TIMEOUT")).
+			Duration(),
+		MaxBodySize: kingpin.Flag("max-body-size", `The maximum size in bytes of the body of the published messages; larger messages are rejected (value for disabling it: 0)`).
+			Default("0").
+			Envar(g("MAX_BODY_SIZE")).
+			Int(),
+		TopicTTL: configstring.NewFromKingpin(
+			kingpin.Flag("topic-ttl", `The default TTL of the messages published on a topic and its subtopics (formatted as /topic=duration, separated by spaces or commas)`).
+				Envar(g("TOPIC_TTL"))),
+		Auth: AuthConfig{
+			JWTSecret: kingpin.Flag("auth-jwt-secret", `The HMAC secret for verifying the JWTs of the clients (HS256, HS384 or HS512)`).
+				Envar(g("AUTH_JWT_SECRET")).
+				String(),
+			APIKeys: configstring.NewFromKingpin(
+				kingpin.Flag("auth-api-keys", `The static API keys of the clients (formatted as key=user_id[:role...], separated by spaces or commas)`).
+					Envar(g("AUTH_API_KEYS"))),
+		},
+		ACL: ACLConfig{
+			Endpoint: kingpin.Flag("acl-endpoint", `The endpoint of the API for managing the access control rules of the topics (value for disabling it: "")`).
+				Default(defaultACLEndpoint).
+				Envar(g("ACL_ENDPOINT")).
+				String(),
+			Default: kingpin.Flag("acl-default", `The access to the topics without access control rules: allow | deny`).
+				Default(string(acl.Allow)).
+				Envar(g("ACL_DEFAULT")).
+				Enum(string(acl.Allow), string(acl.Deny)),
+		},
+		RateLimit: RateLimitConfig{
+			Publish: configstring.NewFromKingpin(
+				kingpin.Flag("rate-limit-publish", `The rate limits of publishing per client on a topic and its subtopics (formatted as /topic=count/interval[:burst], separated by spaces or commas)`).
+					Envar(g("RATE_LIMIT_PUBLISH"))),
+			Subscribe: configstring.NewFromKingpin(
+				kingpin.Flag("rate-limit-subscribe", `The rate limits of the subscribe and fetch commands per client on a topic and its subtopics (formatted as /topic=count/interval[:burst], separated by spaces or commas)`).
+					Envar(g("RATE_LIMIT_SUBSCRIBE"))),
+		},
 		Postgres: PostgresConfig{
 			Host: kingpin.Flag("pg-host", "The PostgreSQL hostname").
 				Default("localhost").
@@ -183,6 +330,16 @@ var (
 				Envar(g("FCM_PREFIX")).
 				Default("/fcm/").
 				String(),
+			QueueSize: kingpin.Flag("fcm-queue-size", "The size of the queue of each FCM subscription (default: unbounded)").
+				Envar(g("FCM_QUEUE_SIZE")).
+				Int(),
+			Backpressure: kingpin.Flag("fcm-backpressure", "The policy applied when the queue of a FCM subscription is full").
+				Default(string(router.BackpressureClose)).
+				Envar(g("FCM_BACKPRESSURE")).
+				Enum(router.BackpressurePolicies()...),
+			DeadLetterAttempts: kingpin.Flag("fcm-dead-letter-attempts", "The number of attempts after which a message failing to be sent to FCM is moved to the dead letters (default: disabled)").
+				Envar(g("FCM_DEAD_LETTER_ATTEMPTS")).
+				Int(),
 			IntervalMetrics: &defaultFCMMetrics,
 		},
 		APNS: apns.Config{
@@ -212,6 +369,16 @@ var (
 				Default(strconv.Itoa(runtime.NumCPU())).
 				Envar(g("APNS_WORKERS")).
 				Int(),
+			QueueSize: kingpin.Flag("apns-queue-size", "The size of the queue of each APNS subscription (default: unbounded)").
+				Envar(g("APNS_QUEUE_SIZE")).
+				Int(),
+			Backpressure: kingpin.Flag("apns-backpressure", "The policy applied when the queue of an APNS subscription is full").
+				Default(string(router.BackpressureClose)).
+				Envar(g("APNS_BACKPRESSURE")).
+				Enum(router.BackpressurePolicies()...),
+			DeadLetterAttempts: kingpin.Flag("apns-dead-letter-attempts", "The number of attempts after which a message failing to be sent to APNS is moved to the dead letters (default: disabled)").
+				Envar(g("APNS_DEAD_LETTER_ATTEMPTS")).
+				Int(),
 			IntervalMetrics: &defaultAPNSMetrics,
 		},
 		Cluster: ClusterConfig{
@@ -246,6 +413,13 @@ var (
 				Default(strconv.Itoa(runtime.NumCPU())).
 				Envar(g("SMS_WORKERS")).
 				Int(),
+			QueueSize: kingpin.Flag("sms-queue-size", "The size of the queue of the sms route (default: unbounded)").
+				Envar(g("SMS_QUEUE_SIZE")).
+				Int(),
+			Backpressure: kingpin.Flag("sms-backpressure", "The policy applied when the queue of the sms route is full").
+				Default(string(router.BackpressureClose)).
+				Envar(g("SMS_BACKPRESSURE")).
+				Enum(router.BackpressurePolicies()...),
 			IntervalMetrics: &defaultSMSMetrics,
 		},
 		WS: websocket.Config{
@@ -4,8 +4,12 @@ import (
 	"net"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/server/acl"
+	"github.com/cosminrentea/gobbler/server/configstring"
 )
 
 func TestParsingOfEnvironmentVariables(t *testing.T) {
@@ -28,6 +32,60 @@ func TestParsingOfEnvironmentVariables(t *testing.T) {
 	os.Setenv("GUBLE_PROFILE", "mem")
 	defer os.Unsetenv("GUBLE_PROFILE")
 
+	os.Setenv("GUBLE_IDEMPOTENCY_WINDOW", "1h")
+	defer os.Unsetenv("GUBLE_IDEMPOTENCY_WINDOW")
+
+	os.Setenv("GUBLE_DELIVERY_ACK_TIMEOUT", "30s")
+	defer os.Unsetenv("GUBLE_DELIVERY_ACK_TIMEOUT")
+
+	os.Setenv("GUBLE_MAX_BODY_SIZE", "65536")
+	defer os.Unsetenv("GUBLE_MAX_BODY_SIZE")
+
+	os.Setenv("GUBLE_MS_SCRUB_INTERVAL", "30m")
+	defer os.Unsetenv("GUBLE_MS_SCRUB_INTERVAL")
+
+	os.Setenv("GUBLE_MS_RECOVER", "true")
+	defer os.Unsetenv("GUBLE_MS_RECOVER")
+
+	os.Setenv("GUBLE_MS_SYNC", "interval")
+	defer os.Unsetenv("GUBLE_MS_SYNC")
+
+	os.Setenv("GUBLE_MS_SYNC_INTERVAL", "50ms")
+	defer os.Unsetenv("GUBLE_MS_SYNC_INTERVAL")
+
+	os.Setenv("GUBLE_MS_RETENTION_AGE", "168h")
+	defer os.Unsetenv("GUBLE_MS_RETENTION_AGE")
+
+	os.Setenv("GUBLE_MS_RETENTION_BYTES", "1073741824")
+	defer os.Unsetenv("GUBLE_MS_RETENTION_BYTES")
+
+	os.Setenv("GUBLE_MS_RETENTION_MESSAGES", "1000000")
+	defer os.Unsetenv("GUBLE_MS_RETENTION_MESSAGES")
+
+	os.Setenv("GUBLE_MS_RETENTION", "news:age=24h|messages=1000,sms:bytes=1048576")
+	defer os.Unsetenv("GUBLE_MS_RETENTION")
+
+	os.Setenv("GUBLE_MS_RETENTION_INTERVAL", "5m")
+	defer os.Unsetenv("GUBLE_MS_RETENTION_INTERVAL")
+
+	os.Setenv("GUBLE_MS_OPEN_FILES", "16")
+	defer os.Unsetenv("GUBLE_MS_OPEN_FILES")
+
+	os.Setenv("GUBLE_MS_MMAP", "true")
+	defer os.Unsetenv("GUBLE_MS_MMAP")
+
+	os.Setenv("GUBLE_MS_HOT_MESSAGES", "1000")
+	defer os.Unsetenv("GUBLE_MS_HOT_MESSAGES")
+
+	os.Setenv("GUBLE_TOPIC_TTL", "/news=24h,/sms=10m")
+	defer os.Unsetenv("GUBLE_TOPIC_TTL")
+
+	os.Setenv("GUBLE_AUTH_JWT_SECRET", "jwt-secret")
+	defer os.Unsetenv("GUBLE_AUTH_JWT_SECRET")
+
+	os.Setenv("GUBLE_AUTH_API_KEYS", "key1=user1,key2=user2:admin")
+	defer os.Unsetenv("GUBLE_AUTH_API_KEYS")
+
 	os.Setenv("GUBLE_KVS", "kvs-backend")
 	defer os.Unsetenv("GUBLE_KVS")
 
@@ -46,6 +104,27 @@ func TestParsingOfEnvironmentVariables(t *testing.T) {
 	os.Setenv("GUBLE_TOGGLES_ENDPOINT", "toggles_endpoint")
 	defer os.Unsetenv("GUBLE_TOGGLES_ENDPOINT")
 
+	os.Setenv("GUBLE_SCHEDULER_ENDPOINT", "scheduler_endpoint")
+	defer os.Unsetenv("GUBLE_SCHEDULER_ENDPOINT")
+
+	os.Setenv("GUBLE_TOPICS_ENDPOINT", "topics_endpoint")
+	defer os.Unsetenv("GUBLE_TOPICS_ENDPOINT")
+
+	os.Setenv("GUBLE_TOPICS_METRICS", "true")
+	defer os.Unsetenv("GUBLE_TOPICS_METRICS")
+
+	os.Setenv("GUBLE_ACL_ENDPOINT", "acl_endpoint")
+	defer os.Unsetenv("GUBLE_ACL_ENDPOINT")
+
+	os.Setenv("GUBLE_ACL_DEFAULT", "deny")
+	defer os.Unsetenv("GUBLE_ACL_DEFAULT")
+
+	os.Setenv("GUBLE_RATE_LIMIT_PUBLISH", "/=100/s,/chat=10/s:20")
+	defer os.Unsetenv("GUBLE_RATE_LIMIT_PUBLISH")
+
+	os.Setenv("GUBLE_RATE_LIMIT_SUBSCRIBE", "/=5/s")
+	defer os.Unsetenv("GUBLE_RATE_LIMIT_SUBSCRIBE")
+
 	os.Setenv("GUBLE_MS", "ms-backend")
 	defer os.Unsetenv("GUBLE_MS")
 
@@ -64,6 +143,9 @@ func TestParsingOfEnvironmentVariables(t *testing.T) {
 	os.Setenv("GUBLE_FCM_WORKERS", "3")
 	defer os.Unsetenv("GUBLE_FCM_WORKERS")
 
+	os.Setenv("GUBLE_FCM_DEAD_LETTER_ATTEMPTS", "5")
+	defer os.Unsetenv("GUBLE_FCM_DEAD_LETTER_ATTEMPTS")
+
 	os.Setenv("GUBLE_APNS", "true")
 	defer os.Unsetenv("GUBLE_APNS")
 
@@ -130,6 +212,7 @@ func TestParsingOfEnvironmentVariables(t *testing.T) {
 
 func TestParsingArgs(t *testing.T) {
 	a := assert.New(t)
+	defer resetAuthConfig()
 
 	originalArgs := os.Args
 
@@ -141,6 +224,24 @@ func TestParsingArgs(t *testing.T) {
 		"--env", "dev",
 		"--log", "debug",
 		"--profile", "mem",
+		"--idempotency-window", "1h",
+		"--delivery-ack-timeout", "30s",
+		"--max-body-size", "65536",
+		"--ms-scrub-interval", "30m",
+		"--ms-recover",
+		"--ms-sync", "interval",
+		"--ms-sync-interval", "50ms",
+		"--ms-retention-age", "168h",
+		"--ms-retention-bytes", "1073741824",
+		"--ms-retention-messages", "1000000",
+		"--ms-retention", "news:age=24h|messages=1000,sms:bytes=1048576",
+		"--ms-retention-interval", "5m",
+		"--ms-open-files", "16",
+		"--ms-mmap",
+		"--ms-hot-messages", "1000",
+		"--topic-ttl", "/news=24h,/sms=10m",
+		"--auth-jwt-secret", "jwt-secret",
+		"--auth-api-keys", "key1=user1,key2=user2:admin",
 		"--storage-path", os.TempDir(),
 		"--kvs", "kvs-backend",
 		"--ms", "ms-backend",
@@ -148,11 +249,19 @@ func TestParsingArgs(t *testing.T) {
 		"--metrics-endpoint", "metrics_endpoint",
 		"--prometheus-endpoint", "prometheus_endpoint",
 		"--toggles-endpoint", "toggles_endpoint",
+		"--scheduler-endpoint", "scheduler_endpoint",
+		"--topics-endpoint", "topics_endpoint",
+		"--topics-metrics",
+		"--acl-endpoint", "acl_endpoint",
+		"--acl-default", "deny",
+		"--rate-limit-publish", "/=100/s,/chat=10/s:20",
+		"--rate-limit-subscribe", "/=5/s",
 		"--ws",
 		"--ws-prefix", "/wstream/",
 		"--fcm",
 		"--fcm-api-key", "fcm-api-key",
 		"--fcm-workers", "3",
+		"--fcm-dead-letter-attempts", "5",
 		"--apns",
 		"--apns-production",
 		"--apns-cert-bytes", "00ff",
@@ -181,6 +290,17 @@ func TestParsingArgs(t *testing.T) {
 	assertArguments(a)
 }
 
+// resetAuthConfig disables the authentication and the rate limits, and allows the access to all topics, as it would
+// otherwise be configured for the other tests (the configuration is parsed only once, so it is reset after the last parsing test)
+func resetAuthConfig() {
+	*Config.Auth.JWTSecret = ""
+	*Config.Auth.APIKeys = configstring.List{}
+	*Config.ACL.Endpoint = defaultACLEndpoint
+	*Config.ACL.Default = string(acl.Allow)
+	*Config.RateLimit.Publish = configstring.List{}
+	*Config.RateLimit.Subscribe = configstring.List{}
+}
+
 func assertArguments(a *assert.Assertions) {
 	a.Equal("http_listen", *Config.HttpListen)
 	a.Equal("kvs-backend", *Config.KVS)
@@ -191,6 +311,13 @@ func assertArguments(a *assert.Assertions) {
 	a.Equal("metrics_endpoint", *Config.MetricsEndpoint)
 	a.Equal("prometheus_endpoint", *Config.PrometheusEndpoint)
 	a.Equal("toggles_endpoint", *Config.TogglesEndpoint)
+	a.Equal("scheduler_endpoint", *Config.SchedulerEndpoint)
+	a.Equal("topics_endpoint", *Config.TopicsEndpoint)
+	a.True(*Config.TopicsMetrics)
+	a.Equal("acl_endpoint", *Config.ACL.Endpoint)
+	a.Equal("deny", *Config.ACL.Default)
+	a.Equal("[/=100/s /chat=10/s:20]", (*Config.RateLimit.Publish).String())
+	a.Equal("[/=5/s]", (*Config.RateLimit.Subscribe).String())
 
 	a.Equal(true, *Config.WS.Enabled)
 	a.Equal("/wstream/", *Config.WS.Prefix)
@@ -198,6 +325,7 @@ func assertArguments(a *assert.Assertions) {
 	a.Equal(true, *Config.FCM.Enabled)
 	a.Equal("fcm-api-key", *Config.FCM.APIKey)
 	a.Equal(3, *Config.FCM.Workers)
+	a.Equal(5, *Config.FCM.DeadLetterAttempts)
 
 	a.Equal(true, *Config.APNS.Enabled)
 	a.Equal(true, *Config.APNS.Production)
@@ -217,6 +345,24 @@ func assertArguments(a *assert.Assertions) {
 	a.Equal("debug", *Config.Log)
 	a.Equal("dev", *Config.EnvName)
 	a.Equal("mem", *Config.Profile)
+	a.Equal(time.Hour, *Config.IdempotencyWindow)
+	a.Equal(30*time.Second, *Config.DeliveryAckTimeout)
+	a.Equal(65536, *Config.MaxBodySize)
+	a.Equal(30*time.Minute, *Config.MSScrubInterval)
+	a.True(*Config.MSRecover)
+	a.Equal("interval", *Config.MSSync)
+	a.Equal(50*time.Millisecond, *Config.MSSyncInterval)
+	a.Equal(168*time.Hour, *Config.MSRetentionAge)
+	a.Equal(int64(1073741824), *Config.MSRetentionBytes)
+	a.Equal(uint64(1000000), *Config.MSRetentionMessages)
+	a.Equal("[news:age=24h|messages=1000 sms:bytes=1048576]", (*Config.MSRetention).String())
+	a.Equal(5*time.Minute, *Config.MSRetentionInterval)
+	a.Equal(16, *Config.MSOpenFiles)
+	a.True(*Config.MSMmap)
+	a.Equal(1000, *Config.MSHotMessages)
+	a.Equal("[/news=24h /sms=10m]", (*Config.TopicTTL).String())
+	a.Equal("jwt-secret", *Config.Auth.JWTSecret)
+	a.Equal("[key1=user1 key2=user2:admin]", (*Config.Auth.APIKeys).String())
 
 	a.Equal("[127.0.0.1:9092 127.0.0.1:9091]", (*Config.KafkaProducer.Brokers).String())
 	a.Equal("sms_reporting_topic", *Config.KafkaReportingConfig.SmsReportingTopic)
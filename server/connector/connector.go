@@ -13,7 +13,9 @@ import (
 
 
 	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/auth"
 	"github.com/cosminrentea/gobbler/server/kafka"
+	"github.com/cosminrentea/gobbler/server/kvstore"
 	"github.com/cosminrentea/gobbler/server/router"
 	"github.com/cosminrentea/gobbler/server/service"
 )
@@ -26,6 +28,7 @@ const (
 var (
 	TopicParam     = "topic"
 	ConnectorParam = "connector"
+	UserIDParam    = "user_id"
 )
 
 type Sender interface {
@@ -56,6 +59,12 @@ type Runner interface {
 	Run(Subscriber)
 }
 
+type Deliverer interface {
+	// Deliver queues a message for a subscriber, outside of its route
+	// (e.g. the push notification fallback of an online-first message)
+	Deliver(Subscriber, *protocol.Message) error
+}
+
 type Connector interface {
 	service.Startable
 	service.Stopable
@@ -63,6 +72,7 @@ type Connector interface {
 	SenderSetter
 	ResponseHandlerSetter
 	Runner
+	Deliverer
 	Manager() Manager
 	Context() context.Context
 	KafkaProducer() kafka.Producer
@@ -80,6 +90,7 @@ type connector struct {
 	manager Manager
 	queue   Queue
 	router  router.Router
+	kvStore kvstore.KVStore
 
 	mux *mux.Router
 
@@ -98,6 +109,36 @@ type Config struct {
 	Prefix     string
 	URLPattern string
 	Workers    int
+
+	// QueueSize and Backpressure are applied to the route of each subscriber.
+	// If QueueSize is not positive, the route queue is unbounded.
+	QueueSize    int
+	Backpressure router.BackpressurePolicy
+
+	// DeadLetterAttempts is the number of attempts of delivering a message to a subscriber,
+	// after which the message is moved to the dead letters. If not positive, the failed messages are dropped.
+	DeadLetterAttempts int
+
+	// Authenticator authenticates the subscribe and unsubscribe requests, if it is enabled:
+	// the `user_id` in the URL has to be the one of the verified token.
+	Authenticator *auth.Authenticator
+}
+
+// SetBackpressure sets the queue size and the backpressure policy of the subscriber routes, if they are configured
+func (c *Config) SetBackpressure(queueSize *int, policy *string) {
+	if queueSize != nil {
+		c.QueueSize = *queueSize
+	}
+	if policy != nil {
+		c.Backpressure = router.BackpressurePolicy(*policy)
+	}
+}
+
+// SetDeadLetterAttempts sets the number of attempts after which a failed message is moved to the dead letters, if it is configured
+func (c *Config) SetDeadLetterAttempts(attempts *int) {
+	if attempts != nil {
+		c.DeadLetterAttempts = *attempts
+	}
 }
 
 func NewConnector(router router.Router, sender Sender, config Config, kafkaProducer kafka.Producer, kafkaReportingTopic string) (Connector, error) {
@@ -116,6 +157,7 @@ func NewConnector(router router.Router, sender Sender, config Config, kafkaProdu
 		manager:                NewManager(config.Schema, kvs),
 		queue:                  NewQueue(sender, config.Workers),
 		router:                 router,
+		kvStore:                kvs,
 		logger:                 logger.WithField("name", config.Name),
 		ConnectorKafkaProducer: kafkaProducer,
 		KafkaReportingTopic:    kafkaReportingTopic,
@@ -128,6 +170,10 @@ func NewConnector(router router.Router, sender Sender, config Config, kafkaProdu
 			Info("Kafka reporting for subscribe/unsubscribe is  ACTIVE")
 	}
 
+	if config.DeadLetterAttempts > 0 {
+		c.queue.SetDeadLetterHandler(c, config.DeadLetterAttempts)
+	}
+
 	c.initMuxRouter()
 	return c, nil
 }
@@ -136,8 +182,11 @@ func (c *connector) initMuxRouter() {
 	muxRouter := mux.NewRouter()
 
 	baseRouter := muxRouter.PathPrefix(c.GetPrefix()).Subrouter()
-	baseRouter.Methods(http.MethodGet).HandlerFunc(c.GetList)
-	baseRouter.Methods(http.MethodPost).PathPrefix(SubstitutePath).HandlerFunc(c.Substitute)
+	baseRouter.Methods(http.MethodGet).Path(DeadLettersPath).HandlerFunc(c.adminOnly(c.GetDeadLetters))
+	baseRouter.Methods(http.MethodPost).Path(DeadLettersPath + "{id}").HandlerFunc(c.adminOnly(c.RequeueDeadLetter))
+	baseRouter.Methods(http.MethodDelete).Path(DeadLettersPath + "{id}").HandlerFunc(c.adminOnly(c.DeleteDeadLetter))
+	baseRouter.Methods(http.MethodGet).HandlerFunc(c.adminOnly(c.GetList))
+	baseRouter.Methods(http.MethodPost).PathPrefix(SubstitutePath).HandlerFunc(c.adminOnly(c.Substitute))
 
 	subRouter := baseRouter.Path(c.config.URLPattern).Subrouter()
 	subRouter.Methods(http.MethodPost).HandlerFunc(c.Post)
@@ -203,11 +252,18 @@ func (c *connector) Post(w http.ResponseWriter, req *http.Request) {
 
 	params := mux.Vars(req)
 	c.logger.WithField("params", params).Info("POST subscription")
+	if !c.authorize(w, req, params) {
+		return
+	}
 	topic, ok := params[TopicParam]
 	if !ok {
 		fmt.Fprintf(w, "Missing topic parameter.")
 		return
 	}
+	if err := protocol.Path("/" + topic).Validate(); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"invalid topic: %s"}`, err.Error()), http.StatusBadRequest)
+		return
+	}
 	event.Payload.Topic = topic
 	errFill := event.fillParams(params)
 	delete(params, TopicParam)
@@ -249,6 +305,9 @@ func (c *connector) Delete(w http.ResponseWriter, req *http.Request) {
 
 	params := mux.Vars(req)
 	c.logger.WithField("params", params).Info("DELETE subscription")
+	if !c.authorize(w, req, params) {
+		return
+	}
 	topic, ok := params[TopicParam]
 	if !ok {
 		fmt.Fprintf(w, "Missing topic parameter.")
@@ -283,6 +342,31 @@ func (c *connector) Delete(w http.ResponseWriter, req *http.Request) {
 
 }
 
+// authorize authenticates a subscription request, if the authentication is enabled.
+// The user_id of the subscription has to be the one of the verified token.
+func (c *connector) authorize(w http.ResponseWriter, req *http.Request, params map[string]string) bool {
+	if !c.config.Authenticator.Enabled() {
+		return true
+	}
+	identity, err := c.config.Authenticator.Authenticate(req)
+	if err != nil {
+		auth.Unauthorized(w, err)
+		return false
+	}
+	if userID, ok := params[UserIDParam]; ok && userID != identity.UserID {
+		c.logger.WithField("userID", userID).WithField("verifiedUserID", identity.UserID).Warn("Subscription request for another user")
+		http.Error(w, `{"error":"user_id does not match the authenticated user"}`, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// adminOnly wraps a handler of the management API of the connector (listing and substituting the subscriptions,
+// and handling the dead letters), which requires the admin role if the authentication is enabled.
+func (c *connector) adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return c.config.Authenticator.AdminOnly(handler)
+}
+
 func (c *connector) Substitute(w http.ResponseWriter, req *http.Request) {
 	s := new(substitution)
 	err := json.NewDecoder(req.Body).Decode(&s)
@@ -344,9 +428,12 @@ func (c *connector) Run(s Subscriber) {
 	c.wg.Add(1)
 	defer c.wg.Done()
 
+	route := s.Route()
+	c.configureRoute(route)
+
 	var provideErr error
 	go func() {
-		err := s.Route().Provide(c.router, true)
+		err := route.Provide(c.router, true)
 		if err != nil {
 			// cancel subscription loop if there is an error on the provider
 			provideErr = err
@@ -387,6 +474,19 @@ func (c *connector) Run(s Subscriber) {
 	}
 }
 
+// Deliver queues the message for the subscriber, as the messages received on its route
+func (c *connector) Deliver(s Subscriber, m *protocol.Message) error {
+	return c.queue.Push(NewRequest(s, m))
+}
+
+// configureRoute applies the queue size and the backpressure policy of the connector to a subscriber route
+func (c *connector) configureRoute(route *router.Route) {
+	if c.config.QueueSize > 0 {
+		route.QueueSize = c.config.QueueSize
+	}
+	route.Backpressure = c.config.Backpressure
+}
+
 func (c *connector) restart(s Subscriber) error {
 	s.Cancel()
 	err := s.Reset()
@@ -0,0 +1,9 @@
+package connector
+
+import "github.com/cosminrentea/expvarmetrics"
+
+var (
+	ns                        = metrics.NS("connector")
+	mTotalDeadLetters         = ns.NewInt("total_dead_letters")
+	mTotalRequeuedDeadLetters = ns.NewInt("total_requeued_dead_letters")
+)
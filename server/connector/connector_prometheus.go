@@ -0,0 +1,22 @@
+package connector
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	pDeadLetters = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "connector_dead_letters",
+		Help: "Number of messages moved to the dead letters after failing to be delivered by a connector",
+	})
+
+	pRequeuedDeadLetters = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "connector_requeued_dead_letters",
+		Help: "Number of dead letters sent again to their subscribers",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		pDeadLetters,
+		pRequeuedDeadLetters,
+	)
+}
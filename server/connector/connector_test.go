@@ -11,6 +11,7 @@ import (
 	"encoding/json"
 
 	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/auth"
 	"github.com/cosminrentea/gobbler/server/router"
 	"github.com/cosminrentea/gobbler/testutil"
 	"github.com/golang/mock/gomock"
@@ -137,6 +138,70 @@ func TestConnector_DeleteSubscription(t *testing.T) {
 	time.Sleep(200 * time.Millisecond)
 }
 
+func TestConnector_SubscriptionAuthentication(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	conn, mocks := getTestConnector(t, Config{
+		Name:       "name",
+		Schema:     "schema",
+		Prefix:     "/connector/",
+		URLPattern: "/{device_token}/{user_id}/{topic:.*}",
+		Authenticator: auth.NewAuthenticator(
+			auth.NewAPIKeyVerifier(map[string]*auth.Identity{
+				"key1":  {UserID: "user1"},
+				"admin": {UserID: "admin1", Roles: []string{auth.AdminRole}},
+			}),
+		),
+	}, true, false)
+
+	request := func(method, url, token string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest(method, url, strings.NewReader(""))
+		a.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		conn.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// unauthenticated requests are rejected
+	a.Equal(http.StatusUnauthorized, request(http.MethodPost, "/connector/device1/user1/topic1", "").Code)
+	a.Equal(http.StatusUnauthorized, request(http.MethodDelete, "/connector/device1/user1/topic1", "key2").Code)
+
+	// a subscription can not be changed for another user
+	a.Equal(http.StatusForbidden, request(http.MethodPost, "/connector/device1/user2/topic1", "key1").Code)
+	a.Equal(http.StatusForbidden, request(http.MethodDelete, "/connector/device1/user2/topic1", "key1").Code)
+
+	subscriber := NewMockSubscriber(testutil.MockCtrl)
+	mocks.manager.EXPECT().Find(gomock.Any()).Return(subscriber)
+	mocks.manager.EXPECT().Remove(subscriber).Return(nil)
+
+	recorder := request(http.MethodDelete, "/connector/device1/user1/topic1", "key1")
+	a.Equal(http.StatusOK, recorder.Code)
+	a.Equal(`{"unsubscribed":"/topic1"}`, recorder.Body.String())
+
+	// the management requests require the admin role
+	for _, r := range []struct{ method, url string }{
+		{http.MethodGet, "/connector/?user_id=user2"},
+		{http.MethodPost, "/connector/substitute/"},
+		{http.MethodGet, "/connector/deadletters/"},
+		{http.MethodPost, "/connector/deadletters/id1"},
+		{http.MethodDelete, "/connector/deadletters/id1"},
+	} {
+		a.Equal(http.StatusUnauthorized, request(r.method, r.url, "").Code, r.url)
+		a.Equal(http.StatusForbidden, request(r.method, r.url, "key1").Code, r.url)
+	}
+
+	mocks.manager.EXPECT().Filter(map[string]string{"user_id": "user2"}).Return(nil)
+	recorder = request(http.MethodGet, "/connector/?user_id=user2", "admin")
+	a.Equal(http.StatusOK, recorder.Code)
+	a.Equal("[]\n", recorder.Body.String())
+}
+
 func TestConnector_GetList_And_Getters(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -542,3 +607,20 @@ func getTestConnector(t *testing.T, config Config, mockManager bool, mockQueue b
 		mKVS,
 	}
 }
+
+func TestConnector_ConfigureRoute(t *testing.T) {
+	a := assert.New(t)
+
+	config := Config{}
+	config.SetBackpressure(nil, nil)
+	a.Equal(0, config.QueueSize)
+
+	queueSize, policy := 100, "drop-oldest"
+	config.SetBackpressure(&queueSize, &policy)
+
+	c := &connector{config: config}
+	r := router.NewRoute(router.RouteConfig{Path: protocol.Path("/topic"), QueueSize: -1})
+	c.configureRoute(r)
+	a.Equal(100, r.QueueSize)
+	a.Equal(router.BackpressureDropOldest, r.Backpressure)
+}
@@ -0,0 +1,221 @@
+package connector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/router"
+)
+
+const (
+	// DeadLetterPrefix is the prefix of the dead-letter topics; a connector publishes its dead letters on `/dlq/<name>`.
+	DeadLetterPrefix = "/dlq/"
+
+	// DeadLettersPath is the path of the admin API of the dead letters, relative to the prefix of the connector
+	DeadLettersPath = "/deadletters/"
+
+	deadLetterSchemaSuffix = "_dead_letters"
+)
+
+// the header fields describing the failure of a dead letter
+const (
+	DeadLetterIDHeader         = "Dead-Letter-Id"
+	DeadLetterConnectorHeader  = "Dead-Letter-Connector"
+	DeadLetterSubscriberHeader = "Dead-Letter-Subscriber"
+	DeadLetterTopicHeader      = "Dead-Letter-Topic"
+	DeadLetterMessageIDHeader  = "Dead-Letter-Message-Id"
+	DeadLetterErrorHeader      = "Dead-Letter-Error"
+	DeadLetterAttemptsHeader   = "Dead-Letter-Attempts"
+)
+
+// RetryDelay is the delay before attempting again to handle a failed request, if the connector has dead letters enabled
+var RetryDelay = 100 * time.Millisecond
+
+// DeadLetterHandler handles the requests which could not be handled after the configured number of attempts.
+type DeadLetterHandler interface {
+	HandleDeadLetter(request Request, err error, attempts int)
+}
+
+// deadLetter is a message which could not be delivered to a subscriber, as it is stored in the KVStore
+type deadLetter struct {
+	ID         string        `json:"id"`
+	Subscriber string        `json:"subscriber"`
+	Topic      protocol.Path `json:"topic"`
+	MessageID  uint64        `json:"message_id"`
+	Error      string        `json:"error"`
+	Attempts   int           `json:"attempts"`
+	Time       time.Time     `json:"time"`
+	Message    string        `json:"message"`
+}
+
+// HandleDeadLetter publishes the message of a failed request, with the details of the failure in its header,
+// on the dead-letter topic of the connector, as a message of the server which is not checked by the access control lists.
+// It is also kept in the KVStore, until it is requeued or deleted.
+// The subscriber moves past the message.
+func (c *connector) HandleDeadLetter(request Request, err error, attempts int) {
+	message := request.Message()
+	subscriber := request.Subscriber()
+
+	dl := &deadLetter{
+		ID:         xid.New().String(),
+		Subscriber: subscriber.Key(),
+		Topic:      message.Path,
+		MessageID:  message.ID,
+		Error:      err.Error(),
+		Attempts:   attempts,
+		Time:       time.Now(),
+		Message:    string(message.Encode()),
+	}
+	flog := c.logger.WithFields(log.Fields{
+		"deadLetterID": dl.ID,
+		"subscriber":   dl.Subscriber,
+		"messageID":    dl.MessageID,
+		"attempts":     attempts,
+	})
+	flog.WithError(err).Warn("Message could not be delivered, moving it to the dead letters")
+	mTotalDeadLetters.Add(1)
+	pDeadLetters.Inc()
+
+	data, errMarshal := json.Marshal(dl)
+	if errMarshal != nil {
+		flog.WithError(errMarshal).Error("Error encoding dead letter")
+		return
+	}
+	if errPut := c.kvStore.Put(c.deadLetterSchema(), dl.ID, data); errPut != nil {
+		flog.WithError(errPut).Error("Error storing dead letter")
+	}
+
+	if errPublish := router.HandleSystemMessage(c.router, c.deadLetterMessage(dl, message)); errPublish != nil {
+		flog.WithError(errPublish).Error("Error publishing dead letter")
+	}
+
+	subscriber.SetLastID(message.ID)
+	if errUpdate := c.manager.Update(subscriber); errUpdate != nil {
+		flog.WithError(errUpdate).Error("Manager could not update subscription")
+	}
+}
+
+// deadLetterMessage returns the message published on the dead-letter topic.
+// Its header contains the fields of the original header (except the idempotency key) and the details of the failure.
+func (c *connector) deadLetterMessage(dl *deadLetter, message *protocol.Message) *protocol.Message {
+	header := make(map[string]interface{})
+	if message.HeaderJSON != "" {
+		if err := json.Unmarshal([]byte(message.HeaderJSON), &header); err != nil {
+			c.logger.WithError(err).Error("Error decoding the header of a dead letter")
+		}
+	}
+	delete(header, protocol.IdempotencyKeyHeader)
+	header[DeadLetterIDHeader] = dl.ID
+	header[DeadLetterConnectorHeader] = c.config.Name
+	header[DeadLetterSubscriberHeader] = dl.Subscriber
+	header[DeadLetterTopicHeader] = string(dl.Topic)
+	header[DeadLetterMessageIDHeader] = strconv.FormatUint(dl.MessageID, 10)
+	header[DeadLetterErrorHeader] = dl.Error
+	header[DeadLetterAttemptsHeader] = strconv.Itoa(dl.Attempts)
+	headerJSON, _ := json.Marshal(header)
+
+	return &protocol.Message{
+		Path:          protocol.Path(DeadLetterPrefix + c.config.Name),
+		UserID:        message.UserID,
+		ApplicationID: message.ApplicationID,
+		HeaderJSON:    string(headerJSON),
+		Body:          message.Body,
+	}
+}
+
+func (c *connector) deadLetterSchema() string {
+	return c.config.Schema + deadLetterSchemaSuffix
+}
+
+// GetDeadLetters returns the list of dead letters of the connector, ordered by time
+func (c *connector) GetDeadLetters(w http.ResponseWriter, req *http.Request) {
+	deadLetters := make([]deadLetter, 0)
+	for kv := range c.kvStore.Iterate(c.deadLetterSchema(), "") {
+		var dl deadLetter
+		if err := json.Unmarshal([]byte(kv[1]), &dl); err != nil {
+			c.logger.WithError(err).WithField("key", kv[0]).Error("Error decoding dead letter")
+			continue
+		}
+		deadLetters = append(deadLetters, dl)
+	}
+	sort.Slice(deadLetters, func(i, j int) bool {
+		return deadLetters[i].Time.Before(deadLetters[j].Time)
+	})
+
+	if err := json.NewEncoder(w).Encode(deadLetters); err != nil {
+		http.Error(w, "Error encoding data.", http.StatusInternalServerError)
+		c.logger.WithField("error", err.Error()).Error("Error encoding data.")
+	}
+}
+
+// RequeueDeadLetter sends a dead letter again to its subscriber, removing it from the dead letters
+func (c *connector) RequeueDeadLetter(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	dl, ok := c.findDeadLetter(w, id)
+	if !ok {
+		return
+	}
+
+	subscriber := c.manager.Find(dl.Subscriber)
+	if subscriber == nil {
+		http.Error(w, `{"error":"subscription not found"}`, http.StatusNotFound)
+		return
+	}
+	message, err := protocol.ParseMessage([]byte(dl.Message))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"dead letter could not be decoded: %s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	if err := c.kvStore.Delete(c.deadLetterSchema(), id); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"unknown error: %s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	c.logger.WithField("deadLetterID", id).WithField("subscriber", dl.Subscriber).Info("Requeuing dead letter")
+	mTotalRequeuedDeadLetters.Add(1)
+	pRequeuedDeadLetters.Inc()
+	c.queue.Push(NewRequest(subscriber, message))
+
+	fmt.Fprintf(w, `{"requeued":"%s"}`, id)
+}
+
+// DeleteDeadLetter removes a dead letter
+func (c *connector) DeleteDeadLetter(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if _, ok := c.findDeadLetter(w, id); !ok {
+		return
+	}
+	if err := c.kvStore.Delete(c.deadLetterSchema(), id); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"unknown error: %s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, `{"deleted":"%s"}`, id)
+}
+
+// findDeadLetter returns the dead letter having the given id, or writes the error response
+func (c *connector) findDeadLetter(w http.ResponseWriter, id string) (*deadLetter, bool) {
+	data, exists, err := c.kvStore.Get(c.deadLetterSchema(), id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"unknown error: %s"}`, err.Error()), http.StatusInternalServerError)
+		return nil, false
+	}
+	if !exists {
+		http.Error(w, `{"error":"dead letter not found"}`, http.StatusNotFound)
+		return nil, false
+	}
+	dl := &deadLetter{}
+	if err := json.Unmarshal(data, dl); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"dead letter could not be decoded: %s"}`, err.Error()), http.StatusInternalServerError)
+		return nil, false
+	}
+	return dl, true
+}
@@ -0,0 +1,198 @@
+package connector
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/router"
+	"github.com/cosminrentea/gobbler/testutil"
+)
+
+func TestConnector_DeadLetters(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	defer func(delay time.Duration) { RetryDelay = delay }(RetryDelay)
+	RetryDelay = time.Millisecond
+
+	mRouter := NewMockRouter(testutil.MockCtrl)
+	mRouter.EXPECT().KVStore().Return(kvstore.NewMemoryKVStore(), nil).AnyTimes()
+	mSender := NewMockSender(testutil.MockCtrl)
+
+	conn, err := NewConnector(mRouter, mSender, Config{
+		Name:               "test",
+		Schema:             "test",
+		Prefix:             "/connector/",
+		URLPattern:         "/{device_token}/{user_id}/{topic:.*}",
+		DeadLetterAttempts: 2,
+	}, nil, "")
+	a.NoError(err)
+	a.NoError(conn.Start())
+	defer conn.Stop()
+
+	subscriber, err := conn.Manager().Create(protocol.Path("/topic"), router.RouteParams{"device_token": "device1"})
+	a.NoError(err)
+
+	message := &protocol.Message{
+		ID:         42,
+		Path:       "/topic",
+		UserID:     "user1",
+		HeaderJSON: `{"Correlation-Id":"7sdks723ksgqn","Idempotency-Key":"key1"}`,
+		Body:       []byte("body"),
+	}
+
+	// the message is attempted twice, then published on the dead-letter topic
+	mSender.EXPECT().Send(gomock.Any()).Return(nil, errors.New("send failed")).Times(2)
+	mRouter.EXPECT().HandleMessage(gomock.Any()).Do(func(m *protocol.Message) {
+		a.Equal(protocol.Path("/dlq/test"), m.Path)
+		a.Equal("user1", m.UserID)
+		a.Equal("body", string(m.Body))
+
+		header := make(map[string]string)
+		a.NoError(json.Unmarshal([]byte(m.HeaderJSON), &header))
+		a.Equal("7sdks723ksgqn", header["Correlation-Id"])
+		a.Equal("", header[protocol.IdempotencyKeyHeader])
+		a.Equal("test", header[DeadLetterConnectorHeader])
+		a.Equal(subscriber.Key(), header[DeadLetterSubscriberHeader])
+		a.Equal("/topic", header[DeadLetterTopicHeader])
+		a.Equal("42", header[DeadLetterMessageIDHeader])
+		a.Equal("send failed", header[DeadLetterErrorHeader])
+		a.Equal("2", header[DeadLetterAttemptsHeader])
+	})
+	a.NoError(conn.(*connector).queue.Push(NewRequest(subscriber, message)))
+	time.Sleep(50 * time.Millisecond)
+
+	// the subscriber moved past the message
+	data, err := conn.Manager().Find(subscriber.Key()).Encode()
+	a.NoError(err)
+	a.Contains(string(data), `"LastID":42`)
+
+	list := func() (deadLetters []deadLetter) {
+		w := httptest.NewRecorder()
+		conn.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/connector/deadletters/", nil))
+		a.Equal(http.StatusOK, w.Code)
+		a.NoError(json.Unmarshal(w.Body.Bytes(), &deadLetters))
+		return
+	}
+
+	deadLetters := list()
+	a.Len(deadLetters, 1)
+	a.Equal(subscriber.Key(), deadLetters[0].Subscriber)
+	a.Equal(uint64(42), deadLetters[0].MessageID)
+	a.Equal(2, deadLetters[0].Attempts)
+
+	// requeuing sends the message again to the subscriber
+	sent := make(chan Request, 1)
+	mSender.EXPECT().Send(gomock.Any()).Do(func(r Request) { sent <- r }).Return(nil, nil)
+
+	w := httptest.NewRecorder()
+	conn.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/connector/deadletters/"+deadLetters[0].ID, nil))
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal(`{"requeued":"`+deadLetters[0].ID+`"}`, w.Body.String())
+
+	select {
+	case r := <-sent:
+		a.Equal(subscriber.Key(), r.Subscriber().Key())
+		a.Equal(uint64(42), r.Message().ID)
+		a.Equal("body", string(r.Message().Body))
+	case <-time.After(50 * time.Millisecond):
+		a.Fail("Dead letter was not requeued")
+	}
+	a.Len(list(), 0)
+
+	w = httptest.NewRecorder()
+	conn.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/connector/deadletters/"+deadLetters[0].ID, nil))
+	a.Equal(http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	conn.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/connector/deadletters/"+deadLetters[0].ID, nil))
+	a.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestQueue_RetryDoesNotBlockWorker(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	defer func(delay time.Duration) { RetryDelay = delay }(RetryDelay)
+	RetryDelay = 50 * time.Millisecond
+
+	mSender := NewMockSender(testutil.MockCtrl)
+	q := NewQueue(mSender, 1)
+	q.SetDeadLetterHandler(nil, 2)
+	a.NoError(q.Start())
+
+	failing := NewRequest(nil, &protocol.Message{ID: 1})
+	other := NewRequest(nil, &protocol.Message{ID: 2})
+	sent := make(chan uint64, 3)
+	mSender.EXPECT().Send(gomock.Any()).Do(func(r Request) { sent <- r.Message().ID }).Return(nil, errors.New("send failed"))
+	mSender.EXPECT().Send(gomock.Any()).Do(func(r Request) { sent <- r.Message().ID }).Return(nil, nil).Times(2)
+
+	// the other request is sent by the single worker while the failing one waits for its retry
+	a.NoError(q.Push(failing))
+	a.NoError(q.Push(other))
+	a.Equal(uint64(1), <-sent)
+	select {
+	case id := <-sent:
+		a.Equal(uint64(2), id)
+	case <-time.After(RetryDelay / 2):
+		a.Fail("The worker was blocked by the retry")
+	}
+
+	// the queue is stopped after the retry
+	a.NoError(q.Stop())
+	a.Equal(uint64(1), <-sent)
+}
+
+func TestQueue_RetryKeepsOrderOfSubscriber(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	defer func(delay time.Duration) { RetryDelay = delay }(RetryDelay)
+	RetryDelay = 50 * time.Millisecond
+
+	mSender := NewMockSender(testutil.MockCtrl)
+	q := NewQueue(mSender, 2)
+	q.SetDeadLetterHandler(nil, 2)
+	a.NoError(q.Start())
+
+	subscriber := NewSubscriber("/topic", router.RouteParams{"device_token": "device1"}, 0)
+	other := NewSubscriber("/topic", router.RouteParams{"device_token": "device2"}, 0)
+	sent := make(chan uint64, 4)
+	mSender.EXPECT().Send(gomock.Any()).Do(func(r Request) { sent <- r.Message().ID }).Return(nil, errors.New("send failed"))
+	mSender.EXPECT().Send(gomock.Any()).Do(func(r Request) { sent <- r.Message().ID }).Return(nil, nil).Times(3)
+
+	// the messages of the subscriber following a failed one are sent after its retry
+	a.NoError(q.Push(NewRequest(subscriber, &protocol.Message{ID: 1})))
+	a.Equal(uint64(1), <-sent)
+	time.Sleep(10 * time.Millisecond)
+	a.NoError(q.Push(NewRequest(subscriber, &protocol.Message{ID: 2})))
+	a.NoError(q.Push(NewRequest(other, &protocol.Message{ID: 3})))
+	a.Equal(uint64(3), <-sent)
+	a.Equal(uint64(1), <-sent)
+	a.Equal(uint64(2), <-sent)
+
+	a.NoError(q.Stop())
+}
+
+func TestSubscriber_SetLastIDMovesForward(t *testing.T) {
+	a := assert.New(t)
+	subscriber := NewSubscriber("/topic", router.RouteParams{"device_token": "device1"}, 0)
+
+	subscriber.SetLastID(42)
+	subscriber.SetLastID(41)
+	data, err := subscriber.Encode()
+	a.NoError(err)
+	a.Contains(string(data), `"LastID":42`)
+}
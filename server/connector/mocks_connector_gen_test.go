@@ -44,6 +44,16 @@ func (_mr *_MockConnectorRecorder) Context() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Context")
 }
 
+func (_m *MockConnector) Deliver(_param0 Subscriber, _param1 *protocol.Message) error {
+	ret := _m.ctrl.Call(_m, "Deliver", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockConnectorRecorder) Deliver(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Deliver", arg0, arg1)
+}
+
 func (_m *MockConnector) GetPrefix() string {
 	ret := _m.ctrl.Call(_m, "GetPrefix")
 	ret0, _ := ret[0].(string)
@@ -372,6 +382,14 @@ func (_mr *_MockQueueRecorder) Sender() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Sender")
 }
 
+func (_m *MockQueue) SetDeadLetterHandler(_param0 DeadLetterHandler, _param1 int) {
+	_m.ctrl.Call(_m, "SetDeadLetterHandler", _param0, _param1)
+}
+
+func (_mr *_MockQueueRecorder) SetDeadLetterHandler(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDeadLetterHandler", arg0, arg1)
+}
+
 func (_m *MockQueue) SetResponseHandler(_param0 ResponseHandler) {
 	_m.ctrl.Call(_m, "SetResponseHandler", _param0)
 }
@@ -1,6 +1,7 @@
 package connector
 
 import (
+	"errors"
 	"sync"
 
 	"time"
@@ -8,23 +9,51 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
+// ErrMessageExpired is passed to the ResponseHandler instead of sending an expired message
+var ErrMessageExpired = errors.New("Message expired.")
+
 // Queue is an interface modeling a task-queue (it is started and more Requests can be pushed to it, and finally it is stopped after all requests are handled).
 type Queue interface {
 	ResponseHandlerSetter
 	SenderSetter
 
+	// SetDeadLetterHandler makes the queue attempt to handle each request the given number of times,
+	// before passing it to the DeadLetterHandler.
+	SetDeadLetterHandler(handler DeadLetterHandler, attempts int)
+
 	Start() error
 	Push(request Request) error
 	Stop() error
 }
 
 type queue struct {
-	sender          Sender
-	responseHandler ResponseHandler
-	requestsC       chan Request
-	nWorkers        int
-	metrics         bool
-	wg              sync.WaitGroup
+	sender            Sender
+	responseHandler   ResponseHandler
+	deadLetterHandler DeadLetterHandler
+	attempts          int
+	requestsC         chan queuedRequest
+	nWorkers          int
+	metrics           bool
+	wg                sync.WaitGroup
+	retries           sync.WaitGroup
+
+	// the subscribers having failed requests waiting to be retried, by key
+	mu      sync.Mutex
+	retried map[string]*retriedSubscriber
+}
+
+// queuedRequest is a request pushed to the workers, with the number of attempts already made
+type queuedRequest struct {
+	request  Request
+	attempts int
+	held     bool
+}
+
+// retriedSubscriber holds the requests of a subscriber pushed while its failed requests wait to be retried,
+// which are pushed after the retries to keep the order of its messages
+type retriedSubscriber struct {
+	retrying int
+	held     []queuedRequest
 }
 
 // NewQueue returns a new Queue (not started).
@@ -32,7 +61,9 @@ func NewQueue(sender Sender, nWorkers int) Queue {
 	q := &queue{
 		sender:   sender,
 		nWorkers: nWorkers,
+		attempts: 1,
 		metrics:  true,
+		retried:  make(map[string]*retriedSubscriber),
 	}
 	return q
 }
@@ -45,6 +76,11 @@ func (q *queue) ResponseHandler() ResponseHandler {
 	return q.responseHandler
 }
 
+func (q *queue) SetDeadLetterHandler(handler DeadLetterHandler, attempts int) {
+	q.deadLetterHandler = handler
+	q.attempts = attempts
+}
+
 func (q *queue) Sender() Sender {
 	return q.sender
 }
@@ -55,7 +91,7 @@ func (q *queue) SetSender(s Sender) {
 
 // Start a fixed number of goroutines to handle requests and responses w.r.t. external push-notification services.
 func (q *queue) Start() error {
-	q.requestsC = make(chan Request)
+	q.requestsC = make(chan queuedRequest)
 	for i := 1; i <= q.nWorkers; i++ {
 		go q.worker(i)
 	}
@@ -64,20 +100,139 @@ func (q *queue) Start() error {
 
 func (q *queue) worker(i int) {
 	logger.WithField("worker", i).Info("starting queue worker")
-	for request := range q.requestsC {
-		q.handle(request)
+	for queued := range q.requestsC {
+		q.handle(queued)
 	}
 }
 
-func (q *queue) handle(request Request) {
+// handle attempts the request; a failed request is pushed again after the RetryDelay, without blocking the worker,
+// until the configured number of attempts is reached
+func (q *queue) handle(queued queuedRequest) {
 	q.wg.Add(1)
 	defer q.wg.Done()
+	if queued.attempts > 0 || queued.held {
+		defer q.retries.Done()
+	}
+
+	attempts := queued.attempts + 1
+	err := q.attempt(queued.request)
+	if err != nil && attempts < q.attempts {
+		if queued.attempts == 0 {
+			q.startRetrying(queued.request)
+		}
+		q.retries.Add(1)
+		time.AfterFunc(RetryDelay, func() {
+			q.push(queuedRequest{request: queued.request, attempts: attempts})
+		})
+		return
+	}
+	if err != nil && q.deadLetterHandler != nil {
+		q.deadLetterHandler.HandleDeadLetter(queued.request, err, attempts)
+	}
+	if queued.attempts > 0 {
+		q.stopRetrying(queued.request)
+	}
+}
+
+func subscriberKey(request Request) (string, bool) {
+	if s := request.Subscriber(); s != nil {
+		return s.Key(), true
+	}
+	return "", false
+}
+
+// startRetrying holds the following requests of the subscriber of a failed request, until it is retried
+func (q *queue) startRetrying(request Request) {
+	key, ok := subscriberKey(request)
+	if !ok {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	rs, ok := q.retried[key]
+	if !ok {
+		rs = &retriedSubscriber{}
+		q.retried[key] = rs
+	}
+	rs.retrying++
+}
 
+// hold keeps the request if its subscriber has failed requests waiting to be retried
+func (q *queue) hold(request Request) bool {
+	key, ok := subscriberKey(request)
+	if !ok {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	rs, ok := q.retried[key]
+	if !ok {
+		return false
+	}
+	q.retries.Add(1)
+	rs.held = append(rs.held, queuedRequest{request: request, held: true})
+	return true
+}
+
+// stopRetrying pushes the requests held for the subscriber of a retried request, once it has no more failed requests.
+// The subscriber is released when all its held requests are pushed, the new requests being held meanwhile.
+func (q *queue) stopRetrying(request Request) {
+	key, ok := subscriberKey(request)
+	if !ok {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	rs := q.retried[key]
+	if rs.retrying--; rs.retrying > 0 {
+		return
+	}
+	if len(rs.held) == 0 {
+		delete(q.retried, key)
+		return
+	}
+	go q.release(key, rs)
+}
+
+func (q *queue) release(key string, rs *retriedSubscriber) {
+	for {
+		q.mu.Lock()
+		if rs.retrying > 0 {
+			// a released request failed, so the rest is pushed after its retry
+			q.mu.Unlock()
+			return
+		}
+		if len(rs.held) == 0 {
+			delete(q.retried, key)
+			q.mu.Unlock()
+			return
+		}
+		queued := rs.held[0]
+		rs.held = rs.held[1:]
+		q.mu.Unlock()
+
+		q.push(queued)
+	}
+}
+
+// attempt sends the request and handles the response, returning the error which was not handled
+func (q *queue) attempt(request Request) error {
 	var beforeSend time.Time
 	if q.metrics {
 		beforeSend = time.Now()
 	}
-	response, err := q.sender.Send(request)
+	var (
+		response interface{}
+		err      error
+	)
+	if request.Message().IsExpired() {
+		err = ErrMessageExpired
+	} else {
+		response, err = q.sender.Send(request)
+	}
 	if q.responseHandler != nil {
 		var metadata *Metadata
 		if q.metrics {
@@ -96,9 +251,17 @@ func (q *queue) handle(request Request) {
 	} else {
 		logger.WithField("error", err.Error()).Error("error while sending, and no response handler was set")
 	}
+	return err
 }
 
 func (q *queue) Push(request Request) error {
+	if !q.hold(request) {
+		q.push(queuedRequest{request: request})
+	}
+	return nil
+}
+
+func (q *queue) push(queued queuedRequest) {
 	// recover if the channel been closed
 	defer func() {
 		if r := recover(); r != nil {
@@ -111,11 +274,12 @@ func (q *queue) Push(request Request) error {
 		}
 	}()
 
-	q.requestsC <- request
-	return nil
+	q.requestsC <- queued
 }
 
+// Stop waits for the retries of the failed requests, then for the requests being handled
 func (q *queue) Stop() error {
+	q.retries.Wait()
 	close(q.requestsC)
 	q.wg.Wait()
 	return nil
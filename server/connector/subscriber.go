@@ -125,6 +125,10 @@ func (s *subscriber) Loop(ctx context.Context, q Queue) error {
 			if !opened {
 				break
 			}
+			// the online-first messages are delivered only as the fallback of their websocket delivery
+			if m.IsOnlineFirst() {
+				continue
+			}
 
 			q.Push(NewRequest(s, m))
 		case <-sCtx.Done():
@@ -141,8 +145,12 @@ func (s *subscriber) Loop(ctx context.Context, q Queue) error {
 	return ErrRouteChannelClosed
 }
 
+// SetLastID sets the ID of the last message handled, from which the subscriber resumes after a restart.
+// It only moves forward, since a message can be handled after the following ones (e.g. when it is retried).
 func (s *subscriber) SetLastID(ID uint64) {
-	s.data.LastID = ID
+	if ID > s.data.LastID {
+		s.data.LastID = ID
+	}
 }
 
 func (s *subscriber) Cancel() {
@@ -0,0 +1,14 @@
+package delivery
+
+import (
+	"github.com/cosminrentea/expvarmetrics"
+)
+
+var (
+	ns                        = metrics.NS("delivery")
+	mTotalOnlineFirstMessages = ns.NewInt("total_online_first_messages")
+	mTotalWebsocketDeliveries = ns.NewInt("total_websocket_deliveries")
+	mTotalPushDeliveries      = ns.NewInt("total_push_deliveries")
+	mTotalSMSDeliveries       = ns.NewInt("total_sms_deliveries")
+	mTotalUndelivered         = ns.NewInt("total_undelivered")
+)
@@ -0,0 +1,48 @@
+package delivery
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pOnlineFirstMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "delivery_online_first_messages",
+		Help: "Number of messages published with the online-first delivery mode",
+	})
+
+	pWebsocketDeliveries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "delivery_websocket_deliveries",
+		Help: "Number of online-first messages acknowledged by a websocket session of their recipient",
+	})
+
+	pPushDeliveries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "delivery_push_deliveries",
+		Help: "Number of online-first messages sent to the push notification subscriptions of their recipient",
+	})
+
+	pSMSDeliveries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "delivery_sms_deliveries",
+		Help: "Number of online-first messages sent as SMS to their recipient",
+	})
+
+	pUndelivered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "delivery_undelivered",
+		Help: "Number of online-first messages which could not be delivered on any channel",
+	})
+
+	pPendingMessages = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "delivery_pending_messages",
+		Help: "Number of online-first messages waiting for the acknowledgement of a websocket session",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		pOnlineFirstMessages,
+		pWebsocketDeliveries,
+		pPushDeliveries,
+		pSMSDeliveries,
+		pUndelivered,
+		pPendingMessages,
+	)
+}
@@ -0,0 +1,496 @@
+package delivery
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/connector"
+	"github.com/cosminrentea/gobbler/server/router"
+	"github.com/cosminrentea/gobbler/server/sms"
+	"github.com/cosminrentea/gobbler/server/websocket"
+)
+
+const (
+	// AckTimeoutHeader is the name of the header field holding the duration (e.g. `30s`) after which an online-first message
+	// falls back to the push notifications, if no websocket session of its recipient acknowledged it
+	AckTimeoutHeader = "Ack-Timeout"
+
+	// SMSToHeader is the name of the header field holding the phone number to which an online-first message
+	// is sent as SMS, if its recipient has no push notification subscriptions
+	SMSToHeader = "Sms-To"
+
+	// SMSFromHeader is the name of the header field holding the sender of the SMS fallback
+	SMSFromHeader = "Sms-From"
+
+	// ReportPrefix is the prefix of the system topics on which the delivery reports of the online-first messages
+	// are published, for their publisher (e.g. `/_delivery/backend`)
+	ReportPrefix = protocol.SystemPrefix + "delivery/"
+
+	// the system topic on which the acknowledgements are published to the other nodes of a cluster
+	ackTopic = protocol.SystemPrefix + "acks"
+
+	// the delivery reports and acknowledgements concern the subscribers online when they are published
+	eventTTL = time.Minute
+)
+
+// The channels on which an online-first message was finally delivered
+const (
+	ChannelWebsocket = "websocket"
+	ChannelPush      = "push"
+	ChannelSMS       = "sms"
+	ChannelNone      = "none"
+)
+
+// Report is the body of the messages published on the report topics
+type Report struct {
+	MessageID uint64        `json:"message_id"`
+	Path      protocol.Path `json:"path"`
+	Recipient string        `json:"recipient"`
+	Channel   string        `json:"channel"`
+	Time      time.Time     `json:"time"`
+
+	// Connectors are the names of the connectors to which the message was passed (only for the push channel)
+	Connectors []string `json:"connectors,omitempty"`
+}
+
+// ackEvent is the body of the messages published on the acknowledgement topic
+type ackEvent struct {
+	UserID string        `json:"user_id"`
+	Path   protocol.Path `json:"path"`
+	ID     uint64        `json:"id"`
+}
+
+type pendingKey struct {
+	path protocol.Path
+	id   uint64
+}
+
+// pending is an online-first message waiting for the acknowledgement of a websocket session
+type pending struct {
+	message   *protocol.Message
+	recipient string
+	timer     *time.Timer
+}
+
+// publishing counts the online-first messages being published on a path,
+// and holds the acknowledgements received for the path meanwhile, by message ID
+type publishing struct {
+	count int
+	acks  map[uint64]string
+}
+
+// Dispatcher is a router.Router delivering the online-first messages (see protocol.OnlineFirstDelivery):
+// such a message is routed only to the websocket sessions of its recipient, and if the recipient is not connected,
+// or if none of its sessions acknowledges the message in time, it is passed to the push notification subscriptions
+// of the recipient matching its topic, or else it is sent as SMS. The channel finally used is reported
+// on the topic `/_delivery/<publisher user ID>`.
+// In a cluster, the message is dispatched by the node on which it is published, receiving the acknowledgements
+// of the other nodes on a system topic.
+type Dispatcher struct {
+	router.Router
+
+	ackTimeout time.Duration
+	nodeID     uint8
+	clustered  bool
+
+	presence   *websocket.Presence
+	connectors []connector.Connector
+	smsTopic   protocol.Path
+
+	mu      sync.Mutex
+	pending map[pendingKey]*pending
+
+	// the paths on which online-first messages are being published: their IDs are known only after they are stored,
+	// so their acknowledgements can arrive before they are registered as pending
+	publishing map[protocol.Path]*publishing
+
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+// New returns a new Dispatcher wrapping the given router, having the default acknowledgement timeout.
+func New(r router.Router, ackTimeout time.Duration) *Dispatcher {
+	d := &Dispatcher{
+		Router:     r,
+		ackTimeout: ackTimeout,
+		pending:    make(map[pendingKey]*pending),
+		publishing: make(map[protocol.Path]*publishing),
+	}
+	if r.Cluster() != nil {
+		d.nodeID = r.Cluster().Config.ID
+		d.clustered = true
+	}
+	return d
+}
+
+// SetPresence sets the presence tracker, used for checking if the recipients are connected.
+// Without presence, the online-first messages fall back at once.
+func (d *Dispatcher) SetPresence(presence *websocket.Presence) {
+	d.presence = presence
+}
+
+// AddConnector adds a push notification connector, to the subscriptions of which the messages fall back.
+func (d *Dispatcher) AddConnector(c connector.Connector) {
+	d.connectors = append(d.connectors, c)
+}
+
+// SetSMSTopic sets the topic of the SMS gateway, on which the messages fall back as SMS.
+func (d *Dispatcher) SetSMSTopic(topic protocol.Path) {
+	d.smsTopic = topic
+}
+
+// Start subscribes to the acknowledgements of the other nodes, if the server is a part of a cluster.
+func (d *Dispatcher) Start() error {
+	d.stopC = make(chan struct{})
+	if !d.clustered {
+		return nil
+	}
+
+	route := router.NewRoute(router.RouteConfig{
+		RouteParams: router.RouteParams{"application_id": "delivery"},
+		Path:        ackTopic,
+		ChannelSize: 100,
+		QueueSize:   -1,
+	})
+	if _, err := d.Router.Subscribe(route); err != nil {
+		return err
+	}
+	d.wg.Add(1)
+	go d.receiveLoop(route)
+	return nil
+}
+
+// Stop passes the pending messages to their fallback at once, since their acknowledgements can not be received anymore.
+func (d *Dispatcher) Stop() error {
+	close(d.stopC)
+
+	d.mu.Lock()
+	pendingMessages := d.pending
+	d.pending = make(map[pendingKey]*pending)
+	d.mu.Unlock()
+
+	for _, p := range pendingMessages {
+		if p.timer.Stop() {
+			pPendingMessages.Dec()
+			d.fallback(p.message, p.recipient)
+		}
+	}
+	d.wg.Wait()
+	return nil
+}
+
+// HandleMessage routes an online-first message only to the websocket sessions of its recipient,
+// and waits for their acknowledgement. The other messages are passed to the wrapped router.
+func (d *Dispatcher) HandleMessage(message *protocol.Message) error {
+	if message.NodeID != 0 || !message.IsOnlineFirst() {
+		return d.Router.HandleMessage(message)
+	}
+
+	recipient := message.Recipient()
+	timeout, err := d.validate(message)
+	if err != nil {
+		return err
+	}
+	// the connectors skip the online-first messages, and the recipient is matched exactly
+	message.SetFilter(connector.UserIDParam, "="+recipient)
+	mTotalOnlineFirstMessages.Add(1)
+	pOnlineFirstMessages.Inc()
+
+	d.startPublishing(message.Path)
+	if err := d.Router.HandleMessage(message); err != nil {
+		d.mu.Lock()
+		d.stopPublishing(message.Path, 0)
+		d.mu.Unlock()
+		return err
+	}
+	online := d.presence.Online(recipient)
+
+	key := pendingKey{path: message.Path, id: message.ID}
+	d.mu.Lock()
+	acked := d.stopPublishing(message.Path, message.ID) == recipient
+	if online && !acked {
+		d.pending[key] = &pending{
+			message:   message,
+			recipient: recipient,
+			timer:     time.AfterFunc(timeout, func() { d.expire(key) }),
+		}
+		pPendingMessages.Inc()
+	}
+	d.mu.Unlock()
+
+	if acked {
+		d.report(&Report{MessageID: message.ID, Path: message.Path, Recipient: recipient, Channel: ChannelWebsocket}, message)
+	} else if !online {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.fallback(message, recipient)
+		}()
+	}
+	return nil
+}
+
+func (d *Dispatcher) startPublishing(path protocol.Path) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.publishing[path]
+	if !ok {
+		p = &publishing{acks: make(map[uint64]string)}
+		d.publishing[path] = p
+	}
+	p.count++
+}
+
+// stopPublishing returns the user who acknowledged the message with the ID while it was published, if any.
+// It is called while holding the mutex.
+func (d *Dispatcher) stopPublishing(path protocol.Path, id uint64) string {
+	p := d.publishing[path]
+	userID := p.acks[id]
+	delete(p.acks, id)
+	if p.count--; p.count == 0 {
+		delete(d.publishing, path)
+	}
+	return userID
+}
+
+// ValidateMessage returns ErrInvalidDelivery for an online-first message without a valid recipient or acknowledgement timeout,
+// and otherwise the error with which the wrapped router would reject the message.
+// It is a part of the router.Validator implementation.
+func (d *Dispatcher) ValidateMessage(message *protocol.Message) error {
+	if message.IsOnlineFirst() {
+		if _, err := d.validate(message); err != nil {
+			return err
+		}
+	}
+	return router.ValidateMessage(d.Router, message)
+}
+
+// InterceptFetched passes the message fetched for the route to the delivery interceptors of the wrapped router.
+// It is a part of the router.FetchInterceptor implementation.
+func (d *Dispatcher) InterceptFetched(route *router.Route, message *protocol.Message) *protocol.Message {
+	return router.InterceptFetched(d.Router, route, message)
+}
+
+// validate returns the acknowledgement timeout of an online-first message, or ErrInvalidDelivery
+func (d *Dispatcher) validate(message *protocol.Message) (time.Duration, error) {
+	timeout, err := d.timeout(message)
+	if err != nil || !protocol.IsTopicLevel(message.Recipient()) {
+		return 0, router.ErrInvalidDelivery
+	}
+	return timeout, nil
+}
+
+// Acknowledge completes the delivery of a pending online-first message, if the user is its recipient.
+// In a cluster, the acknowledgements of the messages which are not pending on this node are published to the other nodes.
+// It is a part of the websocket.Acknowledger implementation.
+func (d *Dispatcher) Acknowledge(userID string, path protocol.Path, id uint64) {
+	if d.acknowledge(userID, path, id) || !d.clustered {
+		return
+	}
+
+	body, err := json.Marshal(&ackEvent{UserID: userID, Path: path, ID: id})
+	if err != nil {
+		logger.WithError(err).Error("Error encoding acknowledgement")
+		return
+	}
+	expires := time.Now().Add(eventTTL)
+	if err := d.Router.HandleMessage(&protocol.Message{Path: ackTopic, Body: body, Expires: &expires}); err != nil {
+		logger.WithError(err).Error("Error publishing acknowledgement")
+	}
+}
+
+func (d *Dispatcher) acknowledge(userID string, path protocol.Path, id uint64) bool {
+	p, found := d.take(pendingKey{path: path, id: id}, userID)
+	if p == nil {
+		return found
+	}
+	pPendingMessages.Dec()
+
+	d.report(&Report{MessageID: id, Path: path, Recipient: userID, Channel: ChannelWebsocket}, p.message)
+	return true
+}
+
+// take removes the pending message having the key, if the user is its recipient and its timeout was not reached.
+// It returns a nil message if the message is not pending, and false if it is not pending on this node:
+// an acknowledgement received while messages are published on the path is kept until they are registered.
+func (d *Dispatcher) take(key pendingKey, userID string) (*pending, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.pending[key]
+	if !ok {
+		if pub, ok := d.publishing[key.path]; ok {
+			pub.acks[key.id] = userID
+			return nil, true
+		}
+		return nil, false
+	}
+	if p.recipient != userID || !p.timer.Stop() {
+		return nil, false
+	}
+	delete(d.pending, key)
+	return p, true
+}
+
+// expire passes a pending message to its fallback, when its acknowledgement timeout is reached
+func (d *Dispatcher) expire(key pendingKey) {
+	d.mu.Lock()
+	p, ok := d.pending[key]
+	delete(d.pending, key)
+	d.mu.Unlock()
+	if !ok {
+		return
+	}
+	pPendingMessages.Dec()
+
+	logger.WithFields(log.Fields{
+		"path":      key.path,
+		"id":        key.id,
+		"recipient": p.recipient,
+	}).Debug("Online-first message was not acknowledged")
+	d.fallback(p.message, p.recipient)
+}
+
+// fallback passes the message to the push notification subscriptions of the recipient matching its topic,
+// or sends it as SMS if there are none
+func (d *Dispatcher) fallback(message *protocol.Message, recipient string) {
+	report := &Report{MessageID: message.ID, Path: message.Path, Recipient: recipient, Channel: ChannelNone}
+
+	for _, c := range d.connectors {
+		for _, s := range c.Manager().Filter(map[string]string{connector.UserIDParam: "=" + recipient}) {
+			if !s.Route().Path.Matches(message.Path) {
+				continue
+			}
+			if err := c.Deliver(s, message); err != nil {
+				logger.WithError(err).WithField("subscriber", s.Key()).Error("Error passing message to subscriber")
+				continue
+			}
+			report.addConnector(s.Route().Get(connector.ConnectorParam))
+		}
+	}
+
+	if len(report.Connectors) > 0 {
+		report.Channel = ChannelPush
+	} else if to := message.HeaderField(SMSToHeader); to != "" && d.smsTopic != "" && d.sendSMS(message, to) {
+		report.Channel = ChannelSMS
+	}
+	d.report(report, message)
+}
+
+// sendSMS publishes the body of the message as SMS on the topic of the SMS gateway
+func (d *Dispatcher) sendSMS(message *protocol.Message, to string) bool {
+	body, err := json.Marshal(&sms.NexmoSms{
+		To:        to,
+		From:      message.HeaderField(SMSFromHeader),
+		Text:      string(message.Body),
+		ClientRef: strconv.FormatUint(message.ID, 10),
+	})
+	if err != nil {
+		logger.WithError(err).Error("Error encoding SMS")
+		return false
+	}
+	if err := d.Router.HandleMessage(&protocol.Message{
+		Path:          d.smsTopic,
+		UserID:        message.UserID,
+		ApplicationID: message.ApplicationID,
+		Expires:       message.Expires,
+		Body:          body,
+	}); err != nil {
+		logger.WithError(err).WithField("path", d.smsTopic).Error("Error publishing SMS")
+		return false
+	}
+	return true
+}
+
+// report publishes the channel finally used for the message, to its publisher
+func (d *Dispatcher) report(report *Report, message *protocol.Message) {
+	logger.WithFields(log.Fields{
+		"path":      report.Path,
+		"id":        report.MessageID,
+		"recipient": report.Recipient,
+		"channel":   report.Channel,
+	}).Debug("Delivered online-first message")
+
+	switch report.Channel {
+	case ChannelWebsocket:
+		mTotalWebsocketDeliveries.Add(1)
+		pWebsocketDeliveries.Inc()
+	case ChannelPush:
+		mTotalPushDeliveries.Add(1)
+		pPushDeliveries.Inc()
+	case ChannelSMS:
+		mTotalSMSDeliveries.Add(1)
+		pSMSDeliveries.Inc()
+	default:
+		mTotalUndelivered.Add(1)
+		pUndelivered.Inc()
+	}
+
+	if !protocol.IsTopicLevel(message.UserID) {
+		return
+	}
+	report.Time = time.Now()
+	body, err := json.Marshal(report)
+	if err != nil {
+		logger.WithError(err).Error("Error encoding delivery report")
+		return
+	}
+	expires := time.Now().Add(eventTTL)
+	path := protocol.Path(ReportPrefix + message.UserID)
+	if err := d.Router.HandleMessage(&protocol.Message{Path: path, Body: body, Expires: &expires}); err != nil {
+		logger.WithError(err).WithField("path", path).Error("Error publishing delivery report")
+	}
+}
+
+// receiveLoop applies the acknowledgements of the other nodes
+func (d *Dispatcher) receiveLoop(route *router.Route) {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case m, ok := <-route.MessagesChannel():
+			if !ok {
+				return
+			}
+			if m.NodeID == d.nodeID {
+				continue
+			}
+			event := &ackEvent{}
+			if err := json.Unmarshal(m.Body, event); err != nil {
+				logger.WithError(err).WithField("path", m.Path).Error("Error decoding acknowledgement")
+				continue
+			}
+			d.acknowledge(event.UserID, event.Path, event.ID)
+		case <-d.stopC:
+			return
+		}
+	}
+}
+
+// timeout returns the acknowledgement timeout of the message, from its header or the default one
+func (d *Dispatcher) timeout(message *protocol.Message) (time.Duration, error) {
+	value := message.HeaderField(AckTimeoutHeader)
+	if value == "" {
+		return d.ackTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, router.ErrInvalidDelivery
+	}
+	return timeout, nil
+}
+
+func (r *Report) addConnector(name string) {
+	for _, existing := range r.Connectors {
+		if existing == name {
+			return
+		}
+	}
+	r.Connectors = append(r.Connectors, name)
+}
@@ -0,0 +1,315 @@
+package delivery
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/connector"
+	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/router"
+	"github.com/cosminrentea/gobbler/server/sms"
+	"github.com/cosminrentea/gobbler/server/store/dummystore"
+	"github.com/cosminrentea/gobbler/server/websocket"
+)
+
+type testRouter interface {
+	router.Router
+	Start() error
+	Stop() error
+}
+
+// senderFunc is a connector.Sender passing the requests to a func
+type senderFunc func(connector.Request) (interface{}, error)
+
+func (f senderFunc) Send(request connector.Request) (interface{}, error) {
+	return f(request)
+}
+
+type fixture struct {
+	router     testRouter
+	dispatcher *Dispatcher
+	presence   *websocket.Presence
+	connector  connector.Connector
+	requests   chan connector.Request
+}
+
+func newFixture(a *assert.Assertions) *fixture {
+	r := router.New(dummystore.New(kvstore.NewMemoryKVStore()), kvstore.NewMemoryKVStore(), nil).(testRouter)
+	a.NoError(r.Start())
+
+	f := &fixture{
+		router:     r,
+		dispatcher: New(r, time.Second),
+		presence:   websocket.NewPresence(r),
+		requests:   make(chan connector.Request, 10),
+	}
+	var err error
+	f.connector, err = connector.NewConnector(r, senderFunc(func(request connector.Request) (interface{}, error) {
+		f.requests <- request
+		return nil, nil
+	}), connector.Config{
+		Name:       "fcm",
+		Schema:     "fcm_test",
+		Prefix:     "/fcm/",
+		URLPattern: "/{device_token}/{user_id}/{topic:.*}",
+	}, nil, "")
+	a.NoError(err)
+	a.NoError(f.connector.Start())
+
+	f.dispatcher.SetPresence(f.presence)
+	f.dispatcher.AddConnector(f.connector)
+	f.dispatcher.SetSMSTopic("/sms")
+	a.NoError(f.dispatcher.Start())
+	return f
+}
+
+func (f *fixture) stop() {
+	f.dispatcher.Stop()
+	f.connector.Stop()
+	f.router.Stop()
+}
+
+func (f *fixture) subscribe(a *assert.Assertions, path protocol.Path, params router.RouteParams) *router.Route {
+	route, err := f.router.Subscribe(router.NewRoute(router.RouteConfig{
+		RouteParams: params,
+		Path:        path,
+		ChannelSize: 10,
+	}))
+	a.NoError(err)
+	return route
+}
+
+func receive(a *assert.Assertions, route *router.Route) *protocol.Message {
+	select {
+	case m := <-route.MessagesChannel():
+		return m
+	case <-time.After(time.Second):
+		a.FailNow("message not received", string(route.Path))
+	}
+	return nil
+}
+
+func nothingReceived(a *assert.Assertions, route *router.Route) {
+	select {
+	case m := <-route.MessagesChannel():
+		a.Fail("unexpected message", m.String())
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func receiveReport(a *assert.Assertions, route *router.Route) *Report {
+	report := &Report{}
+	a.NoError(json.Unmarshal(receive(a, route).Body, report))
+	return report
+}
+
+func onlineFirst(header string) *protocol.Message {
+	return &protocol.Message{
+		Path:       "/chat/room",
+		UserID:     "backend",
+		HeaderJSON: header,
+		Body:       []byte("Hello Marvin"),
+	}
+}
+
+func TestDispatcher_Acknowledged(t *testing.T) {
+	a := assert.New(t)
+	f := newFixture(a)
+	defer f.stop()
+
+	f.presence.Connected("marvin", "app1")
+	marvin := f.subscribe(a, "/chat", router.RouteParams{"application_id": "app1", "user_id": "marvin"})
+	arthur := f.subscribe(a, "/chat", router.RouteParams{"application_id": "app2", "user_id": "arthur"})
+	reports := f.subscribe(a, ReportPrefix+"backend", router.RouteParams{"application_id": "app3", "user_id": "backend"})
+
+	// the push subscription of the recipient does not receive the message on its route
+	subscriber, err := f.connector.Manager().Create("/chat", router.RouteParams{"device_token": "token", "user_id": "marvin", "connector": "fcm"})
+	a.NoError(err)
+	go f.connector.Run(subscriber)
+	time.Sleep(10 * time.Millisecond)
+
+	message := onlineFirst(`{"Delivery-Mode":"online-first","Recipient":"marvin"}`)
+	a.NoError(f.dispatcher.HandleMessage(message))
+
+	// only the websocket sessions of the recipient receive the message
+	a.Equal("Hello Marvin", string(receive(a, marvin).Body))
+	nothingReceived(a, arthur)
+
+	// the acknowledgements of the other users are ignored
+	f.dispatcher.Acknowledge("arthur", message.Path, message.ID)
+	f.dispatcher.Acknowledge("marvin", message.Path, message.ID)
+
+	report := receiveReport(a, reports)
+	a.Equal(message.ID, report.MessageID)
+	a.Equal("marvin", report.Recipient)
+	a.Equal(ChannelWebsocket, report.Channel)
+	nothingReceived(a, reports)
+
+	select {
+	case request := <-f.requests:
+		a.Fail("unexpected push", request.Message().String())
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestDispatcher_PushFallback(t *testing.T) {
+	a := assert.New(t)
+	f := newFixture(a)
+	defer f.stop()
+
+	f.presence.Connected("marvin", "app1")
+	reports := f.subscribe(a, ReportPrefix+"backend", router.RouteParams{"application_id": "app3", "user_id": "backend"})
+	_, err := f.connector.Manager().Create("/chat", router.RouteParams{"device_token": "token", "user_id": "marvin", "connector": "fcm"})
+	a.NoError(err)
+	_, err = f.connector.Manager().Create("/news", router.RouteParams{"device_token": "token", "user_id": "marvin", "connector": "fcm"})
+	a.NoError(err)
+
+	// the message is not acknowledged in time
+	message := onlineFirst(`{"Delivery-Mode":"online-first","Recipient":"marvin","Ack-Timeout":"20ms"}`)
+	a.NoError(f.dispatcher.HandleMessage(message))
+
+	select {
+	case request := <-f.requests:
+		a.Equal(message.ID, request.Message().ID)
+		a.Equal(protocol.Path("/chat"), request.Subscriber().Route().Path)
+	case <-time.After(time.Second):
+		a.FailNow("push not sent")
+	}
+	report := receiveReport(a, reports)
+	a.Equal(ChannelPush, report.Channel)
+	a.Equal([]string{"fcm"}, report.Connectors)
+
+	// a late acknowledgement is ignored
+	f.dispatcher.Acknowledge("marvin", message.Path, message.ID)
+	nothingReceived(a, reports)
+}
+
+func TestDispatcher_SMSFallback(t *testing.T) {
+	a := assert.New(t)
+	f := newFixture(a)
+	defer f.stop()
+
+	smsRoute := f.subscribe(a, "/sms", router.RouteParams{"application_id": "sms"})
+	reports := f.subscribe(a, ReportPrefix+"backend", router.RouteParams{"application_id": "app3", "user_id": "backend"})
+
+	// the recipient is not connected, and has no push subscriptions
+	message := onlineFirst(`{"Delivery-Mode":"online-first","Recipient":"marvin","Sms-To":"+491234","Sms-From":"Gobbler"}`)
+	a.NoError(f.dispatcher.HandleMessage(message))
+
+	nexmoSMS := &sms.NexmoSms{}
+	a.NoError(json.Unmarshal(receive(a, smsRoute).Body, nexmoSMS))
+	a.Equal("+491234", nexmoSMS.To)
+	a.Equal("Gobbler", nexmoSMS.From)
+	a.Equal("Hello Marvin", nexmoSMS.Text)
+	a.Equal(ChannelSMS, receiveReport(a, reports).Channel)
+
+	// without a phone number, the message is not delivered
+	a.NoError(f.dispatcher.HandleMessage(onlineFirst(`{"Delivery-Mode":"online-first","Recipient":"marvin"}`)))
+	a.Equal(ChannelNone, receiveReport(a, reports).Channel)
+}
+
+// blockingRouter passes the messages to the wrapped router, then waits until it is released
+type blockingRouter struct {
+	router.Router
+	handled chan *protocol.Message
+	release chan struct{}
+}
+
+func (r *blockingRouter) HandleMessage(message *protocol.Message) error {
+	err := r.Router.HandleMessage(message)
+	r.handled <- message
+	<-r.release
+	return err
+}
+
+func TestDispatcher_AcknowledgedWhilePublishing(t *testing.T) {
+	a := assert.New(t)
+	f := newFixture(a)
+	defer f.stop()
+
+	blocking := &blockingRouter{Router: f.router, handled: make(chan *protocol.Message, 10), release: make(chan struct{})}
+	d := New(blocking, time.Second)
+	d.SetPresence(f.presence)
+	a.NoError(d.Start())
+	defer d.Stop()
+
+	f.presence.Connected("marvin", "app1")
+	reports := f.subscribe(a, ReportPrefix+"backend", router.RouteParams{"application_id": "app3", "user_id": "backend"})
+
+	// the online-first messages are published concurrently
+	for i := 0; i < 2; i++ {
+		go d.HandleMessage(onlineFirst(`{"Delivery-Mode":"online-first","Recipient":"marvin"}`))
+	}
+	first, second := <-blocking.handled, <-blocking.handled
+
+	// a message acknowledged before it is registered as pending is acknowledged once it is
+	d.Acknowledge("marvin", first.Path, first.ID)
+
+	// the acknowledgements do not wait for the messages being published
+	acknowledged := make(chan struct{})
+	go func() {
+		d.Acknowledge("marvin", "/other", 1)
+		close(acknowledged)
+	}()
+	select {
+	case <-acknowledged:
+	case <-time.After(time.Second):
+		a.FailNow("acknowledgement waited for the publishing")
+	}
+	close(blocking.release)
+
+	report := receiveReport(a, reports)
+	a.Equal(first.ID, report.MessageID)
+	a.Equal(ChannelWebsocket, report.Channel)
+
+	d.Acknowledge("marvin", second.Path, second.ID)
+	report = receiveReport(a, reports)
+	a.Equal(second.ID, report.MessageID)
+	a.Equal(ChannelWebsocket, report.Channel)
+}
+
+func TestDispatcher_InvalidMessages(t *testing.T) {
+	a := assert.New(t)
+	f := newFixture(a)
+	defer f.stop()
+
+	for _, header := range []string{
+		`{"Delivery-Mode":"online-first"}`,
+		`{"Delivery-Mode":"online-first","Recipient":"+"}`,
+		`{"Delivery-Mode":"online-first","Recipient":"marvin","Ack-Timeout":"soon"}`,
+		`{"Delivery-Mode":"online-first","Recipient":"marvin","Ack-Timeout":"-1s"}`,
+	} {
+		a.Equal(router.ErrInvalidDelivery, f.dispatcher.ValidateMessage(onlineFirst(header)), header)
+		a.Equal(router.ErrInvalidDelivery, f.dispatcher.HandleMessage(onlineFirst(header)), header)
+	}
+	a.NoError(f.dispatcher.ValidateMessage(onlineFirst(`{"Delivery-Mode":"online-first","Recipient":"marvin"}`)))
+
+	// the other messages are passed to the router
+	route := f.subscribe(a, "/chat", router.RouteParams{"application_id": "app1", "user_id": "arthur"})
+	a.NoError(f.dispatcher.HandleMessage(onlineFirst(`{"Recipient":"marvin"}`)))
+	a.Empty(receive(a, route).Filters)
+}
+
+func TestDispatcher_StopFallsBack(t *testing.T) {
+	a := assert.New(t)
+	f := newFixture(a)
+	defer f.connector.Stop()
+	defer f.router.Stop()
+
+	f.presence.Connected("marvin", "app1")
+	_, err := f.connector.Manager().Create("/chat", router.RouteParams{"device_token": "token", "user_id": "marvin", "connector": "fcm"})
+	a.NoError(err)
+
+	a.NoError(f.dispatcher.HandleMessage(onlineFirst(`{"Delivery-Mode":"online-first","Recipient":"marvin","Ack-Timeout":"1h"}`)))
+	a.NoError(f.dispatcher.Stop())
+
+	select {
+	case <-f.requests:
+	case <-time.After(time.Second):
+		a.Fail("push not sent when stopping")
+	}
+}
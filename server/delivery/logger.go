@@ -0,0 +1,7 @@
+package delivery
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+var logger = log.WithField("module", "delivery")
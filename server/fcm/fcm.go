@@ -8,6 +8,7 @@ import (
 	"github.com/Bogh/gcm"
 	"github.com/cosminrentea/expvarmetrics"
 	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/auth"
 	"github.com/cosminrentea/gobbler/server/connector"
 	"github.com/cosminrentea/gobbler/server/kafka"
 	"github.com/cosminrentea/gobbler/server/router"
@@ -29,7 +30,11 @@ type Config struct {
 	Endpoint             *string
 	Prefix               *string
 	IntervalMetrics      *bool
+	QueueSize            *int
+	Backpressure         *string
+	DeadLetterAttempts   *int
 	AfterMessageDelivery protocol.MessageDeliveryCallback
+	Authenticator        *auth.Authenticator
 }
 
 // Connector is the structure for handling the communication with Firebase Cloud Messaging
@@ -41,13 +46,18 @@ type fcm struct {
 
 // New creates a new *fcm and returns it as an connector.ResponsiveConnector
 func New(router router.Router, sender connector.Sender, config Config, kafkaProducer kafka.Producer, kafkaReportingTopic string, fcmKafkaReportingTopic string) (connector.ResponsiveConnector, error) {
-	baseConn, err := connector.NewConnector(router, sender, connector.Config{
+	connectorConfig := connector.Config{
 		Name:       "fcm",
 		Schema:     schema,
 		Prefix:     *config.Prefix,
 		URLPattern: fmt.Sprintf("/{%s}/{%s}/{%s:.*}", deviceTokenKey, userIDKEy, connector.TopicParam),
 		Workers:    *config.Workers,
-	},
+	}
+	connectorConfig.SetBackpressure(config.QueueSize, config.Backpressure)
+	connectorConfig.SetDeadLetterAttempts(config.DeadLetterAttempts)
+	connectorConfig.Authenticator = config.Authenticator
+
+	baseConn, err := connector.NewConnector(router, sender, connectorConfig,
 		kafkaProducer,
 		kafkaReportingTopic,
 	)
@@ -76,6 +86,7 @@ func (f *fcm) Stop() error {
 
 func (f *fcm) startMetrics() {
 	mTotalSentMessages.Set(0)
+	mTotalExpiredMessages.Set(0)
 	mTotalSendErrors.Set(0)
 	mTotalResponseErrors.Set(0)
 	mTotalResponseInternalErrors.Set(0)
@@ -106,6 +117,9 @@ func (f *fcm) HandleResponse(request connector.Request, responseIface interface{
 		logger.WithError(errFill).Error("Error filling event")
 	}
 
+	if err == connector.ErrMessageExpired {
+		return f.handleExpired(request, &event)
+	}
 
 	if err != nil && !isValidResponseError(err) {
 		l.WithField("error", err.Error()).Error("Error sending message to FCM")
@@ -188,6 +202,31 @@ func (f *fcm) HandleResponse(request connector.Request, responseIface interface{
 	return nil
 }
 
+// handleExpired moves the subscription past an expired message, which was not sent, and reports it to Kafka
+func (f *fcm) handleExpired(request connector.Request, event *FcmEvent) error {
+	message := request.Message()
+	logger.WithField("correlation_id", message.CorrelationID()).WithField("messageID", message.ID).
+		Info("Message expired, not sending it to FCM")
+	mTotalExpiredMessages.Add(1)
+	pExpiredMessages.Inc()
+
+	request.Subscriber().SetLastID(message.ID)
+	if err := f.Manager().Update(request.Subscriber()); err != nil {
+		logger.WithField("error", err.Error()).Error("Manager could not update subscription")
+		mTotalResponseInternalErrors.Add(1)
+		pResponseInternalErrors.Inc()
+		return err
+	}
+
+	event.Payload.Status = "Expired"
+	event.Payload.ErrorText = connector.ErrMessageExpired.Error()
+	err := event.report(f.KafkaProducer(), f.fcmKafkaReportingTopic)
+	if err != nil && err != errFcmKafkaReportingConfiguration {
+		logger.WithError(err).Error("Reporting FCM to kafka failed")
+	}
+	return nil
+}
+
 func (f *fcm) replaceCanonical(subscriber connector.Subscriber, newToken string) error {
 	manager := f.Manager()
 	err := manager.Remove(subscriber)
@@ -39,6 +39,11 @@ var (
 		Name: "fcm_response_other_errors",
 		Help: "Number of other errors related to responses in the FCM connector",
 	})
+
+	pExpiredMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "fcm_expired_messages",
+		Help: "Number of expired messages which were not sent to FCM",
+	})
 )
 
 func init() {
@@ -50,5 +55,6 @@ func init() {
 		pResponseNotRegisteredErrors,
 		pResponseReplacedCanonicalErrors,
 		pResponseOtherErrors,
+		pExpiredMessages,
 	)
 }
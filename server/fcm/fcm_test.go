@@ -279,6 +279,52 @@ func TestConn_HandleResponseReporting(t *testing.T) {
 	a.NoError(err)
 }
 
+func TestConn_HandleResponseExpired(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	mockProducer := NewMockProducer(ctrl)
+	a := assert.New(t)
+	fcm, mocks := testFCM(t, true, mockProducer)
+
+	err := fcm.Start()
+	a.NoError(err)
+
+	mocks.router.EXPECT().Subscribe(gomock.Any())
+	mockProducer.EXPECT().Report("sub_topic", gomock.Any(), gomock.Any())
+
+	postSubscription(t, fcm, "user_id", "device_id", "topic")
+	time.Sleep(100 * time.Millisecond)
+
+	expires := time.Now().Add(-time.Minute)
+	message := &protocol.Message{
+		UserID:     "user_id",
+		ID:         42,
+		Expires:    &expires,
+		HeaderJSON: `{"Content-Type": "text/plain", "Correlation-Id": "7sdks723ksgqn"}`,
+		Body:       []byte(`{"to":"","data":{"notification_title":"Valid Title"}}`),
+	}
+
+	// the expired message is only reported
+	mockProducer.EXPECT().Report("fcm_topic", gomock.Any(), gomock.Any()).Do(func(topic string, bytes []byte, key string) {
+		var event FcmEvent
+		a.NoError(json.Unmarshal(bytes, &event))
+		a.Equal("Expired", event.Payload.Status)
+		a.Equal("device_id", event.Payload.DeviceID)
+		a.Equal(connector.ErrMessageExpired.Error(), event.Payload.ErrorText)
+	})
+
+	// the queue of the connector does not send the message if it expired meanwhile
+	subscribers := fcm.Manager().List()
+	a.Len(subscribers, 1)
+	a.NoError(fcm.HandleResponse(connector.NewRequest(subscribers[0], message), nil, nil, connector.ErrMessageExpired))
+
+	// the subscription moved past the expired message
+	data, err := subscribers[0].Encode()
+	a.NoError(err)
+	a.Contains(string(data), `"LastID":42`)
+	a.NoError(fcm.Stop())
+}
+
 func testFCM(t *testing.T, mockStore bool, producer kafka.Producer) (connector.ResponsiveConnector, *mocks) {
 	mcks := new(mocks)
 
@@ -5,17 +5,25 @@ import (
 
 	"github.com/cosminrentea/gobbler/logformatter"
 	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/acl"
 	"github.com/cosminrentea/gobbler/server/apns"
+	"github.com/cosminrentea/gobbler/server/auth"
+	"github.com/cosminrentea/gobbler/server/connector"
+	"github.com/cosminrentea/gobbler/server/delivery"
 	"github.com/cosminrentea/gobbler/server/fcm"
+	"github.com/cosminrentea/gobbler/server/inbox"
 	"github.com/cosminrentea/gobbler/server/kafka"
 	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/ratelimit"
 	"github.com/cosminrentea/gobbler/server/rest"
 	"github.com/cosminrentea/gobbler/server/router"
+	"github.com/cosminrentea/gobbler/server/scheduler"
 	"github.com/cosminrentea/gobbler/server/service"
 	"github.com/cosminrentea/gobbler/server/sms"
 	"github.com/cosminrentea/gobbler/server/store"
 	"github.com/cosminrentea/gobbler/server/store/dummystore"
 	"github.com/cosminrentea/gobbler/server/store/filestore"
+	"github.com/cosminrentea/gobbler/server/topics"
 	"github.com/cosminrentea/gobbler/server/webserver"
 	"github.com/cosminrentea/gobbler/server/websocket"
 
@@ -99,7 +107,35 @@ var CreateMessageStore = func() store.MessageStore {
 		return dummystore.New(kvstore.NewMemoryKVStore())
 	case "file":
 		logger.WithField("storagePath", *Config.StoragePath).Info("Using FileMessageStore in directory")
-		return filestore.New(*Config.StoragePath)
+		filestore.ScrubInterval = *Config.MSScrubInterval
+		filestore.Durability = filestore.SyncPolicy(*Config.MSSync)
+		filestore.SyncPeriod = *Config.MSSyncInterval
+		filestore.RetentionInterval = *Config.MSRetentionInterval
+		filestore.MaxOpenFiles = *Config.MSOpenFiles
+		filestore.MmapFiles = *Config.MSMmap
+		filestore.HotMessages = *Config.MSHotMessages
+		filestore.Retention = filestore.RetentionPolicy{
+			MaxAge:      *Config.MSRetentionAge,
+			MaxBytes:    *Config.MSRetentionBytes,
+			MaxMessages: *Config.MSRetentionMessages,
+		}
+		policies, err := filestore.ParseRetention(*Config.MSRetention)
+		if err != nil {
+			logger.WithError(err).Panic("Error parsing the retention policies of the partitions")
+		}
+		filestore.PartitionRetention = policies
+		// the presence events are not kept forever, unless a policy of their partition is configured
+		presencePartition := protocol.Path(protocol.PresencePrefix).Partition()
+		if _, ok := filestore.PartitionRetention[presencePartition]; !ok {
+			filestore.PartitionRetention[presencePartition] = filestore.RetentionPolicy{MaxAge: websocket.PresenceRetention}
+		}
+		fms := filestore.New(*Config.StoragePath)
+		if *Config.MSRecover {
+			if err := fms.Recover(); err != nil {
+				logger.WithError(err).Panic("Could not recover the FileMessageStore")
+			}
+		}
+		return fms
 	default:
 		panic(fmt.Errorf("Unknown message-store backend: %q", *Config.MS))
 	}
@@ -109,8 +145,13 @@ var CreateMessageStore = func() store.MessageStore {
 // (currently, based on guble configuration);
 // see package `service` for terminological details.
 var CreateModules = func(router router.Router) (modules []interface{}) {
+	authenticator := createAuthenticator()
+	rateLimiter := createRateLimiter()
 
-	modules = append(modules, rest.NewRestMessageAPI(router, "/api/"))
+	restAPI := rest.NewRestMessageAPI(router, "/api/")
+	restAPI.SetAuthenticator(authenticator)
+	restAPI.SetRateLimiter(rateLimiter)
+	modules = append(modules, restAPI)
 
 	var kafkaProducer kafka.Producer
 	if (*Config.KafkaProducer.Brokers).IsEmpty() {
@@ -130,6 +171,8 @@ var CreateModules = func(router router.Router) (modules []interface{}) {
 		if wsHandler, err := websocket.NewWSHandler(router, *Config.WS.Prefix); err != nil {
 			logger.WithError(err).Error("Error loading WSHandler module")
 		} else {
+			wsHandler.SetAuthenticator(authenticator)
+			wsHandler.SetRateLimiter(rateLimiter)
 			modules = append(modules, wsHandler)
 		}
 	}
@@ -140,6 +183,7 @@ var CreateModules = func(router router.Router) (modules []interface{}) {
 			logger.Panic("The API Key has to be provided when Firebase Cloud Messaging is enabled")
 		}
 		Config.FCM.AfterMessageDelivery = AfterMessageDelivery
+		Config.FCM.Authenticator = authenticator
 		*Config.FCM.IntervalMetrics = true
 		if Config.FCM.Endpoint != nil {
 			gcm.GcmSendEndpoint = *Config.FCM.Endpoint
@@ -177,6 +221,7 @@ var CreateModules = func(router router.Router) (modules []interface{}) {
 			logger.Panic("APNS Sender could not be created")
 		}
 		*Config.APNS.IntervalMetrics = true
+		Config.APNS.Authenticator = authenticator
 		if apnsConn, err := apns.New(router,
 			apnsSender, Config.APNS, kafkaProducer,
 			*Config.KafkaReportingConfig.SubscribeUnsubscribeReportingTopic,
@@ -262,6 +307,94 @@ func Main() {
 	})
 }
 
+// createAuthenticator returns the authenticator of the clients, which is disabled if no JWT secret or API keys are configured
+func createAuthenticator() *auth.Authenticator {
+	var verifiers []auth.Verifier
+	if *Config.Auth.JWTSecret != "" {
+		verifiers = append(verifiers, auth.NewJWTVerifier([]byte(*Config.Auth.JWTSecret)))
+	}
+	if !Config.Auth.APIKeys.IsEmpty() {
+		keys, err := auth.ParseAPIKeys(*Config.Auth.APIKeys)
+		if err != nil {
+			logger.WithError(err).Panic("Error parsing the API keys")
+		}
+		verifiers = append(verifiers, auth.NewAPIKeyVerifier(keys))
+	}
+	if len(verifiers) == 0 {
+		logger.Info("Authentication: disabled")
+		return nil
+	}
+	logger.Info("Authentication: enabled")
+	return auth.NewAuthenticator(verifiers...)
+}
+
+// createRateLimiter returns the rate limiter of the clients, or nil if no rate limits are configured
+func createRateLimiter() *ratelimit.Limiter {
+	publish, err := ratelimit.ParseLimits(*Config.RateLimit.Publish)
+	if err != nil {
+		logger.WithError(err).Panic("Error parsing the publish rate limits")
+	}
+	subscribe, err := ratelimit.ParseLimits(*Config.RateLimit.Subscribe)
+	if err != nil {
+		logger.WithError(err).Panic("Error parsing the subscribe rate limits")
+	}
+	rateLimiter := ratelimit.New(publish, subscribe)
+	logger.WithField("enabled", rateLimiter.Enabled()).Info("Rate limits")
+	return rateLimiter
+}
+
+// withPresence adds the presence tracker to the modules, if the websocket module is enabled,
+// and sets it on the websocket and REST modules. It publishes directly through the router,
+// since its events are published on system topics, which are neither checked nor scheduled.
+func withPresence(r router.Router, modules []interface{}) []interface{} {
+	if !*Config.WS.Enabled {
+		return modules
+	}
+	presence := websocket.NewPresence(r)
+	for _, module := range modules {
+		switch m := module.(type) {
+		case *websocket.WSHandler:
+			m.SetPresence(presence)
+		case *rest.RestMessageAPI:
+			m.SetPresence(presence)
+		}
+	}
+	return append(modules, presence)
+}
+
+// withDelivery sets on the dispatcher of the online-first messages the presence tracker,
+// the push notification connectors and the topic of the SMS gateway found in the modules,
+// and sets it as the acknowledger of the websocket module.
+func withDelivery(dispatcher *delivery.Dispatcher, modules []interface{}) []interface{} {
+	for _, module := range modules {
+		switch m := module.(type) {
+		case *websocket.Presence:
+			dispatcher.SetPresence(m)
+		case *websocket.WSHandler:
+			m.SetAcknowledger(dispatcher)
+		case connector.Connector:
+			dispatcher.AddConnector(m)
+		}
+	}
+	if *Config.SMS.Enabled {
+		dispatcher.SetSMSTopic(protocol.Path(*Config.SMS.SMSTopic))
+	}
+	return modules
+}
+
+// withInbox sets the inbox of the users on the REST module.
+func withInbox(userInbox *inbox.Inbox, modules []interface{}) []interface{} {
+	if userInbox == nil {
+		return modules
+	}
+	for _, module := range modules {
+		if m, ok := module.(*rest.RestMessageAPI); ok {
+			m.SetInbox(userInbox)
+		}
+	}
+	return modules
+}
+
 // StartService starts a server.Service after first creating the router (and its dependencies), the webserver.
 func StartService() *service.Service {
 	//TODO StartService could return an error in case it fails to start
@@ -269,6 +402,12 @@ func StartService() *service.Service {
 	messageStore := CreateMessageStore()
 	kvStore := CreateKVStore()
 
+	router.IdempotencyWindow = *Config.IdempotencyWindow
+	ttls, err := router.ParseTopicTTLs(*Config.TopicTTL)
+	if err != nil {
+		logger.WithError(err).Panic("Error parsing the topic TTLs")
+	}
+	router.TopicTTLs = ttls
 	r := router.New(messageStore, kvStore, createCluster())
 	websrv := webserver.New(*Config.HttpListen)
 
@@ -279,7 +418,51 @@ func StartService() *service.Service {
 		TogglesEndpoint(*Config.TogglesEndpoint)
 
 	srv.RegisterModules(0, 6, kvStore, messageStore)
-	srv.RegisterModules(4, 3, CreateModules(r)...)
+
+	// the size of the messages is checked before the interceptors of the other modules
+	if *Config.MaxBodySize > 0 {
+		srv.RegisterModules(1, 6, router.MaxBodySize(*Config.MaxBodySize))
+	}
+
+	// the messages addressed to users are indexed in their inboxes once they are stored
+	var inboxRouter router.Router = r
+	userInbox, err := inbox.New(r)
+	if err != nil {
+		logger.WithError(err).Error("Error creating the inbox")
+	} else {
+		inboxRouter = userInbox
+	}
+
+	// the online-first messages are dispatched when they are due, so the dispatcher is wrapped by the scheduler
+	dispatcher := delivery.New(inboxRouter, *Config.DeliveryAckTimeout)
+	srv.RegisterModules(4, 1, dispatcher)
+
+	// the admin APIs of the scheduler and of the access control lists require the admin role
+	authenticator := createAuthenticator()
+
+	// the modules publish through the scheduler, which holds the messages to be delivered later;
+	// it is stopped before the router, keeping the messages not yet due in the KVStore
+	var publisher router.Router = dispatcher
+	if sched, err := scheduler.New(dispatcher, *Config.SchedulerEndpoint); err != nil {
+		logger.WithError(err).Error("Error creating the scheduler")
+	} else {
+		sched.SetAuthenticator(authenticator)
+		srv.RegisterModules(4, 1, sched)
+		publisher = sched
+	}
+	// the access control lists are checked before scheduling the messages;
+	// their rules are loaded before the webserver starts, and the server does not start without them
+	accessControl, err := acl.New(publisher, *Config.ACL.Endpoint, acl.Effect(*Config.ACL.Default))
+	if err != nil {
+		logger.WithError(err).Panic("Error creating the access control lists")
+	}
+	accessControl.SetAuthenticator(authenticator)
+	srv.RegisterModules(2, 1, accessControl)
+	publisher = accessControl
+	if *Config.TopicsEndpoint != "" || *Config.TopicsMetrics {
+		srv.RegisterModules(4, 3, topics.New(r, *Config.TopicsEndpoint, *Config.TopicsMetrics))
+	}
+	srv.RegisterModules(4, 3, withInbox(userInbox, withDelivery(dispatcher, withPresence(r, CreateModules(publisher))))...)
 
 	if err := srv.Start(); err != nil {
 		logger.WithField("error", err.Error()).Error("errors occurred while starting service")
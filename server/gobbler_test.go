@@ -12,8 +12,11 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cosminrentea/gobbler/server/configstring"
+	"github.com/cosminrentea/gobbler/server/store/filestore"
+	"github.com/cosminrentea/gobbler/server/websocket"
 )
 
 func TestValidateStoragePath(t *testing.T) {
@@ -106,6 +109,25 @@ func TestCreateStoreBackendPanicInvalidBackend(t *testing.T) {
 	assert.NotNil(t, p)
 }
 
+func TestStartServicePanicInvalidTopicTTL(t *testing.T) {
+	defer func() {
+		*Config.TopicTTL = configstring.List{}
+	}()
+
+	var p interface{}
+	func() {
+		defer func() {
+			p = recover()
+		}()
+
+		*Config.KVS = "memory"
+		*Config.MS = "memory"
+		*Config.TopicTTL = configstring.List{"/news=tomorrow"}
+		StartService()
+	}()
+	assert.NotNil(t, p)
+}
+
 func TestStartServiceModules(t *testing.T) {
 	defer testutil.ResetDefaultRegistryHealthCheck()
 	defer testutil.EnableDebugForMethod()()
@@ -120,6 +142,7 @@ func TestStartServiceModules(t *testing.T) {
 	*Config.WS.Enabled = false
 	*Config.KafkaProducer.Brokers = configstring.List{}
 	*Config.Cluster.NodeID = 0
+	*Config.MaxBodySize = 0
 
 	// using an available port for http
 	testHttpPort++
@@ -129,13 +152,13 @@ func TestStartServiceModules(t *testing.T) {
 	s := StartService()
 	defer s.Stop()
 	// then the number and ordering of modules should be correct
-	a.Equal(5, len(s.ModulesSortedByStartOrder()))
+	a.Equal(9, len(s.ModulesSortedByStartOrder()))
 	var moduleNames []string
 	for _, iface := range s.ModulesSortedByStartOrder() {
 		name := reflect.TypeOf(iface).String()
 		moduleNames = append(moduleNames, name)
 	}
-	a.Equal("*kvstore.MemoryKVStore *filestore.FileMessageStore *router.router *webserver.WebServer *rest.RestMessageAPI",
+	a.Equal("*kvstore.MemoryKVStore *filestore.FileMessageStore *router.router *acl.ACL *webserver.WebServer *delivery.Dispatcher *scheduler.Scheduler *topics.Topics *rest.RestMessageAPI",
 		strings.Join(moduleNames, " "))
 }
 
@@ -148,3 +171,51 @@ func initRouterMock() *MockRouter {
 
 	return routerMock
 }
+
+func TestCreateMessageStorePresenceRetention(t *testing.T) {
+	a := assert.New(t)
+	defer func(policies map[string]filestore.RetentionPolicy, ms string, retention configstring.List) {
+		filestore.PartitionRetention = policies
+		*Config.MS = ms
+		*Config.MSRetention = retention
+	}(filestore.PartitionRetention, *Config.MS, *Config.MSRetention)
+
+	dir, _ := ioutil.TempDir("", "guble_test")
+	defer os.RemoveAll(dir)
+	*Config.MS = "file"
+	*Config.StoragePath = dir
+
+	// the partition of the presence events has a retention policy by default
+	*Config.MSRetention = configstring.List{"news:age=24h"}
+	CreateMessageStore()
+	a.Equal(filestore.RetentionPolicy{MaxAge: 24 * time.Hour}, filestore.PartitionRetention["news"])
+	a.Equal(filestore.RetentionPolicy{MaxAge: websocket.PresenceRetention}, filestore.PartitionRetention["_presence"])
+
+	// unless it is configured
+	*Config.MSRetention = configstring.List{"_presence:messages=1000"}
+	CreateMessageStore()
+	a.Equal(filestore.RetentionPolicy{MaxMessages: 1000}, filestore.PartitionRetention["_presence"])
+}
+
+func TestCreateMessageStorePanicInvalidRetention(t *testing.T) {
+	defer func(ms string, retention configstring.List) {
+		*Config.MS = ms
+		*Config.MSRetention = retention
+	}(*Config.MS, *Config.MSRetention)
+
+	dir, _ := ioutil.TempDir("", "guble_test")
+	defer os.RemoveAll(dir)
+	*Config.MS = "file"
+	*Config.StoragePath = dir
+
+	var p interface{}
+	func() {
+		defer func() {
+			p = recover()
+		}()
+
+		*Config.MSRetention = configstring.List{"news:age=tomorrow"}
+		CreateMessageStore()
+	}()
+	assert.NotNil(t, p)
+}
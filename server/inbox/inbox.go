@@ -0,0 +1,311 @@
+package inbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/router"
+)
+
+const (
+	schema = "inbox"
+
+	// Prefix is the prefix of the system topics on which the read events of the inbox of a user are published,
+	// for the other devices of the user (e.g. `/_inbox/marvin`)
+	Prefix = protocol.SystemPrefix + "inbox/"
+
+	// EventRead is the event of messages marked as read by a device of the user
+	EventRead = "read"
+
+	// a device connecting later gets the read state of the messages from the inbox itself
+	eventTTL = time.Minute
+)
+
+// Entry is a message in the inbox of a user, with its read state
+type Entry struct {
+	ID              uint64        `json:"id"`
+	Path            protocol.Path `json:"path"`
+	PublisherUserID string        `json:"publisher_user_id,omitempty"`
+	Time            int64         `json:"time"`
+	Expires         *time.Time    `json:"expires,omitempty"`
+	Header          string        `json:"header,omitempty"`
+	Body            string        `json:"body"`
+
+	Read bool `json:"read"`
+
+	// ReadAt and ReadBy are the time and the application ID of the device which marked the message as read
+	ReadAt *time.Time `json:"read_at,omitempty"`
+	ReadBy string     `json:"read_by,omitempty"`
+}
+
+// ReadEvent is the body of the messages published on the inbox topic of a user, when messages are marked as read
+type ReadEvent struct {
+	Event         string    `json:"event"`
+	UserID        string    `json:"user_id"`
+	ApplicationID string    `json:"application_id,omitempty"`
+	IDs           []uint64  `json:"ids"`
+	Time          time.Time `json:"time"`
+}
+
+// Counts are the numbers of messages in the inbox of a user
+type Counts struct {
+	UserID string `json:"user_id"`
+	Unread int    `json:"unread"`
+	Total  int    `json:"total"`
+}
+
+// Inbox is a router.Router indexing the messages addressed to a user (having a `Recipient` header) in the inbox of the user,
+// after passing them to the wrapped router. The entries and their read state are stored in the KVStore,
+// keyed by user and message ID, so the nodes of a cluster sharing the KVStore share the inboxes.
+type Inbox struct {
+	router.Router
+
+	kvStore kvstore.KVStore
+
+	// mu serializes the changes of the read state
+	mu sync.Mutex
+}
+
+// New returns a new Inbox wrapping the given router.
+func New(r router.Router) (*Inbox, error) {
+	kvStore, err := r.KVStore()
+	if err != nil {
+		return nil, err
+	}
+	return &Inbox{Router: r, kvStore: kvStore}, nil
+}
+
+// HandleMessage passes the message to the wrapped router, and indexes it in the inbox of its recipient.
+// The messages received from other nodes are indexed by the node which created them.
+func (i *Inbox) HandleMessage(message *protocol.Message) error {
+	local := message.NodeID == 0
+	if err := i.Router.HandleMessage(message); err != nil {
+		return err
+	}
+	if local {
+		i.index(message)
+	}
+	return nil
+}
+
+// ValidateMessage returns the error with which the wrapped router would reject the message.
+// It is a part of the router.Validator implementation.
+func (i *Inbox) ValidateMessage(message *protocol.Message) error {
+	return router.ValidateMessage(i.Router, message)
+}
+
+// InterceptFetched passes the message fetched for the route to the delivery interceptors of the wrapped router.
+// It is a part of the router.FetchInterceptor implementation.
+func (i *Inbox) InterceptFetched(route *router.Route, message *protocol.Message) *protocol.Message {
+	return router.InterceptFetched(i.Router, route, message)
+}
+
+func (i *Inbox) index(message *protocol.Message) {
+	recipient := message.Recipient()
+	if !protocol.IsTopicLevel(recipient) || message.Path.IsSystem() {
+		return
+	}
+
+	data, err := json.Marshal(&Entry{
+		ID:              message.ID,
+		Path:            message.Path,
+		PublisherUserID: message.UserID,
+		Time:            message.Time,
+		Expires:         message.Expires,
+		Header:          message.HeaderJSON,
+		Body:            string(message.Body),
+	})
+	if err == nil {
+		err = i.kvStore.Put(schema, key(recipient, message.ID), data)
+	}
+	if err != nil {
+		// the message was already published, so it is only missing from the inbox
+		logger.WithError(err).WithFields(log.Fields{
+			"recipient": recipient,
+			"id":        message.ID,
+		}).Error("Error indexing message")
+		mTotalIndexErrors.Add(1)
+		pIndexErrors.Inc()
+		return
+	}
+	mTotalIndexedMessages.Add(1)
+	pIndexedMessages.Inc()
+}
+
+// Messages returns the messages in the inbox of the user, ordered by their ID (which is their publishing order).
+// If all is false, only the unread messages are returned. The expired messages are removed.
+func (i *Inbox) Messages(userID string, all bool) ([]*Entry, error) {
+	entries, err := i.entries(userID)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*Entry, 0, len(entries))
+	for _, entry := range entries {
+		if all || !entry.Read {
+			messages = append(messages, entry)
+		}
+	}
+	return messages, nil
+}
+
+// Counts returns the numbers of unread and total messages in the inbox of the user.
+func (i *Inbox) Counts(userID string) (*Counts, error) {
+	entries, err := i.entries(userID)
+	if err != nil {
+		return nil, err
+	}
+	counts := &Counts{UserID: userID, Total: len(entries)}
+	for _, entry := range entries {
+		if !entry.Read {
+			counts.Unread++
+		}
+	}
+	return counts, nil
+}
+
+// MarkRead marks the messages of the user having the given IDs as read by the device with the application ID,
+// or all the unread messages if no IDs are given. It publishes a read event on the inbox topic of the user,
+// so that its other devices are synchronized, and returns the IDs of the messages which were unread.
+func (i *Inbox) MarkRead(userID, applicationID string, ids []uint64) ([]uint64, error) {
+	if !protocol.IsTopicLevel(userID) {
+		return []uint64{}, nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var entries []*Entry
+	if len(ids) == 0 {
+		all, err := i.entries(userID)
+		if err != nil {
+			return nil, err
+		}
+		entries = all
+	} else {
+		for _, id := range ids {
+			data, exists, err := i.kvStore.Get(schema, key(userID, id))
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				continue
+			}
+			entry := &Entry{}
+			if err := json.Unmarshal(data, entry); err != nil {
+				logger.WithError(err).WithField("id", id).Error("Error decoding inbox entry")
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	now := time.Now()
+	read := make([]uint64, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Read {
+			continue
+		}
+		entry.Read, entry.ReadAt, entry.ReadBy = true, &now, applicationID
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return read, err
+		}
+		if err := i.kvStore.Put(schema, key(userID, entry.ID), data); err != nil {
+			return read, err
+		}
+		read = append(read, entry.ID)
+	}
+	if len(read) == 0 {
+		return read, nil
+	}
+	mTotalReadMessages.Add(int64(len(read)))
+	pReadMessages.Add(float64(len(read)))
+
+	i.publish(userID, &ReadEvent{
+		Event:         EventRead,
+		UserID:        userID,
+		ApplicationID: applicationID,
+		IDs:           read,
+		Time:          now,
+	})
+	return read, nil
+}
+
+// GetInbox returns the JSON-encoded messages in the inbox of the user.
+// It is a part of the rest.InboxProvider implementation.
+func (i *Inbox) GetInbox(userID string, all bool) ([]byte, error) {
+	messages, err := i.Messages(userID, all)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(messages)
+}
+
+// GetInboxCounts returns the JSON-encoded numbers of messages in the inbox of the user.
+// It is a part of the rest.InboxProvider implementation.
+func (i *Inbox) GetInboxCounts(userID string) ([]byte, error) {
+	counts, err := i.Counts(userID)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(counts)
+}
+
+// entries returns the entries of the user ordered by their ID, removing the expired ones
+func (i *Inbox) entries(userID string) ([]*Entry, error) {
+	if !protocol.IsTopicLevel(userID) {
+		return []*Entry{}, nil
+	}
+
+	now := time.Now()
+	entries := make([]*Entry, 0)
+	var expired []uint64
+	for kv := range i.kvStore.Iterate(schema, userID+"/") {
+		entry := &Entry{}
+		if err := json.Unmarshal([]byte(kv[1]), entry); err != nil {
+			logger.WithError(err).WithField("key", kv[0]).Error("Error decoding inbox entry")
+			continue
+		}
+		if entry.Expires != nil && entry.Expires.Before(now) {
+			expired = append(expired, entry.ID)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, id := range expired {
+		if err := i.kvStore.Delete(schema, key(userID, id)); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].ID < entries[b].ID
+	})
+	return entries, nil
+}
+
+func (i *Inbox) publish(userID string, event *ReadEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.WithError(err).Error("Error encoding read event")
+		return
+	}
+	expires := time.Now().Add(eventTTL)
+	path := protocol.Path(Prefix + userID)
+	if err := i.Router.HandleMessage(&protocol.Message{Path: path, Body: body, Expires: &expires}); err != nil {
+		logger.WithError(err).WithField("path", path).Error("Error publishing read event")
+	}
+}
+
+// key returns the key of a message in the inbox of a user; the IDs are padded, so that the keys are ordered by ID
+func key(userID string, id uint64) string {
+	return fmt.Sprintf("%s/%020d", userID, id)
+}
@@ -0,0 +1,12 @@
+package inbox
+
+import (
+	"github.com/cosminrentea/expvarmetrics"
+)
+
+var (
+	ns                    = metrics.NS("inbox")
+	mTotalIndexedMessages = ns.NewInt("total_indexed_messages")
+	mTotalReadMessages    = ns.NewInt("total_read_messages")
+	mTotalIndexErrors     = ns.NewInt("total_index_errors")
+)
@@ -0,0 +1,30 @@
+package inbox
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pIndexedMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "inbox_indexed_messages",
+		Help: "Number of messages indexed in the inboxes of their recipients",
+	})
+
+	pReadMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "inbox_read_messages",
+		Help: "Number of inbox messages marked as read",
+	})
+
+	pIndexErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "inbox_index_errors",
+		Help: "Number of messages which could not be indexed in the inboxes of their recipients",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		pIndexedMessages,
+		pReadMessages,
+		pIndexErrors,
+	)
+}
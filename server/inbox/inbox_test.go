@@ -0,0 +1,142 @@
+package inbox
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/router"
+	"github.com/cosminrentea/gobbler/server/store/dummystore"
+)
+
+type testRouter interface {
+	router.Router
+	Start() error
+	Stop() error
+}
+
+func newTestInbox(a *assert.Assertions) (*Inbox, testRouter) {
+	r := router.New(dummystore.New(kvstore.NewMemoryKVStore()), kvstore.NewMemoryKVStore(), nil).(testRouter)
+	a.NoError(r.Start())
+	inbox, err := New(r)
+	a.NoError(err)
+	return inbox, r
+}
+
+func publish(a *assert.Assertions, inbox *Inbox, path protocol.Path, recipient, body string) *protocol.Message {
+	message := &protocol.Message{
+		Path:       path,
+		UserID:     "backend",
+		HeaderJSON: `{"Recipient":"` + recipient + `"}`,
+		Body:       []byte(body),
+	}
+	a.NoError(inbox.HandleMessage(message))
+	return message
+}
+
+func TestInbox_Index(t *testing.T) {
+	a := assert.New(t)
+	inbox, r := newTestInbox(a)
+	defer r.Stop()
+
+	first := publish(a, inbox, "/chat/room", "marvin", "first")
+	second := publish(a, inbox, "/chat/news", "marvin", "second")
+	publish(a, inbox, "/chat/room", "arthur", "other")
+
+	// the messages without a valid recipient, or on system topics, are not indexed
+	publish(a, inbox, "/chat/room", "", "none")
+	publish(a, inbox, "/chat/room", "mar/vin", "invalid")
+	publish(a, inbox, "/_presence/marvin", "marvin", "system")
+
+	// the expired messages are removed
+	expired := time.Now().Add(-time.Second)
+	a.NoError(inbox.HandleMessage(&protocol.Message{Path: "/chat", HeaderJSON: `{"Recipient":"marvin"}`, Expires: &expired}))
+
+	messages, err := inbox.Messages("marvin", false)
+	a.NoError(err)
+	if a.Len(messages, 2) {
+		a.Equal(first.ID, messages[0].ID)
+		a.Equal(protocol.Path("/chat/room"), messages[0].Path)
+		a.Equal("backend", messages[0].PublisherUserID)
+		a.Equal("first", messages[0].Body)
+		a.Equal(second.ID, messages[1].ID)
+		a.False(messages[1].Read)
+	}
+
+	counts, err := inbox.Counts("arthur")
+	a.NoError(err)
+	a.Equal(&Counts{UserID: "arthur", Unread: 1, Total: 1}, counts)
+
+	counts, err = inbox.Counts("trillian")
+	a.NoError(err)
+	a.Equal(&Counts{UserID: "trillian"}, counts)
+}
+
+func TestInbox_MarkRead(t *testing.T) {
+	a := assert.New(t)
+	inbox, r := newTestInbox(a)
+	defer r.Stop()
+
+	events, err := r.Subscribe(router.NewRoute(router.RouteConfig{
+		RouteParams: router.RouteParams{"application_id": "tablet", "user_id": "marvin"},
+		Path:        Prefix + "marvin",
+		ChannelSize: 10,
+	}))
+	a.NoError(err)
+
+	first := publish(a, inbox, "/chat", "marvin", "first")
+	second := publish(a, inbox, "/chat", "marvin", "second")
+	third := publish(a, inbox, "/chat", "marvin", "third")
+
+	read, err := inbox.MarkRead("marvin", "phone", []uint64{second.ID, 42})
+	a.NoError(err)
+	a.Equal([]uint64{second.ID}, read)
+
+	// the read state is synchronized to the other devices
+	select {
+	case m := <-events.MessagesChannel():
+		event := &ReadEvent{}
+		a.NoError(json.Unmarshal(m.Body, event))
+		a.Equal(EventRead, event.Event)
+		a.Equal("marvin", event.UserID)
+		a.Equal("phone", event.ApplicationID)
+		a.Equal([]uint64{second.ID}, event.IDs)
+	case <-time.After(time.Second):
+		a.FailNow("read event not received")
+	}
+
+	counts, err := inbox.Counts("marvin")
+	a.NoError(err)
+	a.Equal(1, counts.Total-counts.Unread)
+
+	all, err := inbox.Messages("marvin", true)
+	a.NoError(err)
+	if a.Len(all, 3) {
+		a.True(all[1].Read)
+		a.Equal("phone", all[1].ReadBy)
+		a.NotNil(all[1].ReadAt)
+	}
+
+	// the messages already read are not marked again
+	read, err = inbox.MarkRead("marvin", "tablet", nil)
+	a.NoError(err)
+	a.Equal([]uint64{first.ID, third.ID}, read)
+	<-events.MessagesChannel()
+
+	read, err = inbox.MarkRead("marvin", "tablet", nil)
+	a.NoError(err)
+	a.Empty(read)
+	select {
+	case m := <-events.MessagesChannel():
+		a.Fail("unexpected read event", m.String())
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	unread, err := inbox.Messages("marvin", false)
+	a.NoError(err)
+	a.Empty(unread)
+}
@@ -0,0 +1,7 @@
+package inbox
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+var logger = log.WithField("module", "inbox")
@@ -134,3 +134,88 @@ func subscribeMultipleClients(t *testing.T, service *service.Service, noOfClient
 		a.Equal(fmt.Sprintf(`{"subscribed":"%s"}`, testTopic), string(body))
 	}
 }
+
+func TestRequestReplyIntegration(t *testing.T) {
+	defer testutil.ResetDefaultRegistryHealthCheck()
+	a := assert.New(t)
+
+	s, responder, requester, cleanup := initServerAndClients(t)
+	defer cleanup()
+
+	a.NoError(responder.Subscribe("/command"))
+	expectStatusMessage(t, responder, protocol.SUCCESS_SUBSCRIBED_TO, "/command")
+
+	// the responder replies to every request on its reply topic, with the same correlation id
+	go func() {
+		for request := range responder.Messages() {
+			header := fmt.Sprintf(`{"%s":"%s"}`, protocol.CorrelationIDHeader, request.CorrelationID())
+			responder.Send(string(request.ReplyTo()), "reply to "+string(request.Body), header)
+		}
+	}()
+
+	reply, err := requester.Request("/command", []byte("ws"), 5*time.Second)
+	a.NoError(err)
+	a.Equal("reply to ws", string(reply.Body))
+
+	restClient := restclient.NewRequester(fmt.Sprintf("http://%s/api", s.WebServer().GetAddr()))
+	body, err := restClient.Request("/command", []byte("rest"), 5*time.Second)
+	a.NoError(err)
+	a.Equal("reply to rest", string(body))
+
+	_, err = restClient.Request("/nobody", []byte("rest"), 50*time.Millisecond)
+	a.Equal(restclient.ErrRequestTimeout, err)
+}
+
+func TestAuthenticationIntegration(t *testing.T) {
+	defer testutil.ResetDefaultRegistryHealthCheck()
+	a := assert.New(t)
+
+	*Config.HttpListen = "localhost:0"
+	*Config.KVS = "memory"
+	*Config.WS.Enabled = true
+	*Config.WS.Prefix = "/stream/"
+	*Config.KafkaProducer.Brokers = configstring.List{}
+	*Config.MS = "memory"
+	*Config.Auth.APIKeys = configstring.List{"key1=user1:admin"}
+	defer func() { *Config.Auth.APIKeys = configstring.List{} }()
+
+	s := StartService()
+	defer s.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	// websockets without a valid token are rejected
+	_, err := wsclient.Open("ws://"+s.WebServer().GetAddr()+"/stream/user/user1", "http://localhost", 1, false)
+	a.Error(err)
+
+	client, err := wsclient.Open("ws://"+s.WebServer().GetAddr()+"/stream/user/user2?access_token=key1", "http://localhost", 10, false)
+	a.NoError(err)
+	defer client.Close()
+
+	connected := make(map[string]interface{})
+	a.NoError(json.Unmarshal([]byte(expectStatusMessage(t, client, protocol.SUCCESS_CONNECTED, "You are connected to the server.")), &connected))
+	a.Equal("user1", connected["UserId"])
+	a.Equal([]interface{}{"admin"}, connected["Roles"])
+
+	a.NoError(client.Subscribe("/auth"))
+	expectStatusMessage(t, client, protocol.SUCCESS_SUBSCRIBED_TO, "/auth")
+
+	url := fmt.Sprintf("http://%s/api/message/auth?userId=user2", s.WebServer().GetAddr())
+	response, err := http.Post(url, "text/plain", bytes.NewBufferString("unauthenticated"))
+	a.NoError(err)
+	a.Equal(http.StatusUnauthorized, response.StatusCode)
+
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString("authenticated"))
+	a.NoError(err)
+	request.Header.Set("Authorization", "Bearer key1")
+	response, err = http.DefaultClient.Do(request)
+	a.NoError(err)
+	a.Equal(http.StatusOK, response.StatusCode)
+
+	select {
+	case m := <-client.Messages():
+		a.Equal("authenticated", string(m.Body))
+		a.Equal("user1", m.UserID)
+	case <-time.After(time.Second):
+		a.Fail("message was not received")
+	}
+}
@@ -0,0 +1,7 @@
+package ratelimit
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+var logger = log.WithField("module", "ratelimit")
@@ -0,0 +1,225 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/cosminrentea/gobbler/protocol"
+)
+
+// the interval at which the idle buckets are removed
+const sweepInterval = time.Minute
+
+// now returns the current time; it is replaced in tests
+var now = time.Now
+
+// Limit is the rate of a token bucket: Rate tokens are added per second, up to Burst tokens
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseLimits parses the limits of the topics, given as `/topic=count/interval[:burst]`
+// (e.g. `/chat=10/s`, `/=1000/m:100`). The burst defaults to the count.
+func ParseLimits(settings []string) (map[protocol.Path]Limit, error) {
+	limits := make(map[protocol.Path]Limit, len(settings))
+	for _, setting := range settings {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %q: the format is /topic=count/interval[:burst]", setting)
+		}
+		path := protocol.Path(strings.TrimSuffix(parts[0], "/"))
+		if parts[0] == "/" {
+			path = "/"
+		}
+		if !strings.HasPrefix(parts[0], "/") || path.IsWildcard() {
+			return nil, fmt.Errorf("invalid rate limit %q: invalid topic", setting)
+		}
+		limit, err := parseLimit(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit %q: %v", setting, err)
+		}
+		limits[path] = limit
+	}
+	return limits, nil
+}
+
+func parseLimit(value string) (Limit, error) {
+	burst := ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		value, burst = value[:i], value[i+1:]
+	}
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("the rate must be given as count/interval")
+	}
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count <= 0 {
+		return Limit{}, fmt.Errorf("invalid count")
+	}
+	interval := parts[1]
+	if interval != "" && (interval[0] < '0' || interval[0] > '9') {
+		interval = "1" + interval
+	}
+	duration, err := time.ParseDuration(interval)
+	if err != nil || duration <= 0 {
+		return Limit{}, fmt.Errorf("invalid interval")
+	}
+	limit := Limit{Rate: float64(count) / duration.Seconds(), Burst: count}
+	if burst != "" {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst <= 0 {
+			return Limit{}, fmt.Errorf("invalid burst")
+		}
+	}
+	return limit, nil
+}
+
+// Limiter limits the rates of the publish and subscribe commands of the clients, using token buckets.
+// The limit of a command is the one of its topic, or of the closest parent topic having one,
+// and a bucket is kept for every user ID, application ID and limited topic.
+// The application ID should be given only when it is a stable, verified identity of the client:
+// otherwise a client could get new buckets by changing it.
+type Limiter struct {
+	publish   *limits
+	subscribe *limits
+}
+
+// New returns a new Limiter, or nil if no limits are given.
+func New(publish, subscribe map[protocol.Path]Limit) *Limiter {
+	if len(publish) == 0 && len(subscribe) == 0 {
+		return nil
+	}
+	return &Limiter{
+		publish:   newLimits(publish),
+		subscribe: newLimits(subscribe),
+	}
+}
+
+// Enabled returns true if the limiter has limits; it can be called on a nil Limiter.
+func (l *Limiter) Enabled() bool {
+	return l != nil
+}
+
+// AllowPublish returns true if the user (or application) can publish on the path,
+// otherwise it returns the duration (rounded up to seconds) after which the publishing can be retried.
+func (l *Limiter) AllowPublish(userID, applicationID string, path protocol.Path) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	ok, retryAfter := l.publish.take(userID, applicationID, path)
+	if !ok {
+		mTotalRejectedPublishes.Add(1)
+		pRejectedPublishes.Inc()
+	}
+	return ok, retryAfter
+}
+
+// AllowSubscribe returns true if the user (or application) can subscribe to the path, or fetch its messages,
+// otherwise it returns the duration (rounded up to seconds) after which the command can be retried.
+func (l *Limiter) AllowSubscribe(userID, applicationID string, path protocol.Path) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	ok, retryAfter := l.subscribe.take(userID, applicationID, path)
+	if !ok {
+		mTotalRejectedSubscriptions.Add(1)
+		pRejectedSubscriptions.Inc()
+	}
+	return ok, retryAfter
+}
+
+type bucketKey struct {
+	userID        string
+	applicationID string
+	topic         protocol.Path
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limits are the limits of the topics for an action, with the buckets of the clients
+type limits struct {
+	topics map[protocol.Path]Limit
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+}
+
+func newLimits(topics map[protocol.Path]Limit) *limits {
+	return &limits{
+		topics:    topics,
+		buckets:   make(map[bucketKey]*bucket),
+		lastSweep: now(),
+	}
+}
+
+// limit returns the limit of the topic, or of its closest parent topic having one
+func (ls *limits) limit(path protocol.Path) (protocol.Path, Limit, bool) {
+	topic := string(path)
+	for topic != "" {
+		if limit, ok := ls.topics[protocol.Path(topic)]; ok {
+			return protocol.Path(topic), limit, true
+		}
+		topic = topic[:strings.LastIndex(topic, "/")]
+	}
+	limit, ok := ls.topics["/"]
+	return "/", limit, ok
+}
+
+func (ls *limits) take(userID, applicationID string, path protocol.Path) (bool, time.Duration) {
+	topic, limit, ok := ls.limit(path)
+	if !ok {
+		return true, 0
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	t := now()
+	if t.Sub(ls.lastSweep) > sweepInterval {
+		ls.sweep(t)
+	}
+
+	key := bucketKey{userID: userID, applicationID: applicationID, topic: topic}
+	b, ok := ls.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: t}
+		ls.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+t.Sub(b.last).Seconds()*limit.Rate)
+	b.last = t
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	// the duration until the next token, rounded up to seconds (as in the Retry-After header of HTTP)
+	retryAfter := time.Duration(math.Ceil((1-b.tokens)/limit.Rate)) * time.Second
+	logger.WithFields(log.Fields{
+		"userID":        userID,
+		"applicationID": applicationID,
+		"path":          path,
+		"retryAfter":    retryAfter,
+	}).Debug("Rate limit exceeded")
+	return false, retryAfter
+}
+
+// sweep removes the buckets which were refilled, since they are equivalent to new buckets
+func (ls *limits) sweep(t time.Time) {
+	for key, b := range ls.buckets {
+		limit := ls.topics[key.topic]
+		if b.tokens+t.Sub(b.last).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(ls.buckets, key)
+		}
+	}
+	ls.lastSweep = t
+}
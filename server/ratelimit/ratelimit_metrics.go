@@ -0,0 +1,11 @@
+package ratelimit
+
+import (
+	"github.com/cosminrentea/expvarmetrics"
+)
+
+var (
+	ns                          = metrics.NS("ratelimit")
+	mTotalRejectedPublishes     = ns.NewInt("total_rejected_publishes")
+	mTotalRejectedSubscriptions = ns.NewInt("total_rejected_subscriptions")
+)
@@ -0,0 +1,24 @@
+package ratelimit
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pRejectedPublishes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ratelimit_rejected_publishes",
+		Help: "Number of messages not published because the publisher exceeded its rate limit",
+	})
+
+	pRejectedSubscriptions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ratelimit_rejected_subscriptions",
+		Help: "Number of subscribe and fetch commands rejected because the client exceeded its rate limit",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		pRejectedPublishes,
+		pRejectedSubscriptions,
+	)
+}
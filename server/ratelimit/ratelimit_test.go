@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+)
+
+// fakeClock replaces the current time of the package, until the returned func is called
+func fakeClock() (*time.Time, func()) {
+	t := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return t }
+	return &t, func() { now = time.Now }
+}
+
+func TestParseLimits(t *testing.T) {
+	a := assert.New(t)
+
+	limits, err := ParseLimits([]string{"/=100/m", "/chat/=10/s:20", "/news=1/10s"})
+	a.NoError(err)
+	a.Equal(map[protocol.Path]Limit{
+		"/":     {Rate: 100.0 / 60, Burst: 100},
+		"/chat": {Rate: 10, Burst: 20},
+		"/news": {Rate: 0.1, Burst: 1},
+	}, limits)
+
+	for _, invalid := range []string{"/chat", "chat=1/s", "/chat/*=1/s", "/chat=1", "/chat=0/s", "/chat=1/x", "/chat=1/s:0", "/chat=1/-1s"} {
+		_, err := ParseLimits([]string{invalid})
+		a.Error(err, invalid)
+	}
+}
+
+func TestLimiter_Buckets(t *testing.T) {
+	a := assert.New(t)
+	clock, reset := fakeClock()
+	defer reset()
+
+	l := New(map[protocol.Path]Limit{
+		"/":     {Rate: 1, Burst: 2},
+		"/chat": {Rate: 10, Burst: 1},
+	}, nil)
+	a.True(l.Enabled())
+
+	allow := func(userID, applicationID string, path protocol.Path) bool {
+		ok, _ := l.AllowPublish(userID, applicationID, path)
+		return ok
+	}
+
+	// the burst of the closest limited topic is available, then the rate applies
+	a.True(allow("marvin", "app1", "/news"))
+	a.True(allow("marvin", "app1", "/news/sport"))
+	ok, retryAfter := l.AllowPublish("marvin", "app1", "/weather")
+	a.False(ok)
+	a.Equal(time.Second, retryAfter)
+
+	// the buckets are kept per user, application and limited topic
+	a.True(allow("arthur", "app1", "/news"))
+	a.True(allow("marvin", "app2", "/news"))
+	a.True(allow("marvin", "app1", "/chat/room"))
+	a.False(allow("marvin", "app1", "/chat"))
+
+	*clock = clock.Add(100 * time.Millisecond)
+	a.True(allow("marvin", "app1", "/chat"))
+	a.False(allow("marvin", "app1", "/news"))
+	*clock = clock.Add(time.Second)
+	a.True(allow("marvin", "app1", "/news"))
+
+	// the subscriptions are not limited
+	for i := 0; i < 10; i++ {
+		ok, _ := l.AllowSubscribe("marvin", "app1", "/news")
+		a.True(ok)
+	}
+}
+
+func TestLimiter_Sweep(t *testing.T) {
+	a := assert.New(t)
+	clock, reset := fakeClock()
+	defer reset()
+
+	l := New(nil, map[protocol.Path]Limit{"/": {Rate: 1, Burst: 10}})
+	l.AllowSubscribe("marvin", "app1", "/news")
+	a.Len(l.subscribe.buckets, 1)
+
+	// the refilled buckets are removed
+	*clock = clock.Add(sweepInterval + time.Second)
+	l.AllowSubscribe("arthur", "app1", "/news")
+	a.Len(l.subscribe.buckets, 1)
+}
+
+func TestLimiter_Disabled(t *testing.T) {
+	a := assert.New(t)
+
+	var l *Limiter
+	a.False(l.Enabled())
+	a.Nil(New(nil, nil))
+	ok, _ := l.AllowPublish("marvin", "app1", "/news")
+	a.True(ok)
+	ok, _ = l.AllowSubscribe("marvin", "app1", "/news")
+	a.True(ok)
+}
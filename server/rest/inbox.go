@@ -0,0 +1,99 @@
+package rest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/auth"
+	"github.com/cosminrentea/gobbler/server/inbox"
+	"github.com/cosminrentea/gobbler/server/router"
+)
+
+const inboxPrefix = "/inbox"
+
+// InboxProvider returns the JSON-encoded messages of the inbox of a user and their counts,
+// and marks messages of the inbox as read.
+type InboxProvider interface {
+	GetInbox(userID string, all bool) ([]byte, error)
+	GetInboxCounts(userID string) ([]byte, error)
+	MarkRead(userID, applicationID string, ids []uint64) ([]uint64, error)
+}
+
+// inboxRead is the JSON body of a request marking messages as read, and of its response
+type inboxRead struct {
+	IDs []uint64 `json:"ids"`
+}
+
+// serveInbox serves the inbox of the user following the inboxPrefix:
+// GET `<userId>` returns the unread messages (or all the messages, with `all=true`),
+// GET `<userId>/count` returns the numbers of unread and total messages,
+// and POST `<userId>/read` marks as read the messages with the IDs in the body (or all the messages, if none are given)
+// for the device with the `applicationId` parameter.
+// Only the user and the admins can access the inbox; if access control is enabled,
+// the requesting user must also be allowed to subscribe to the inbox topic of the user.
+func (api *RestMessageAPI) serveInbox(w http.ResponseWriter, r *http.Request, identity *auth.Identity) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, removeTrailingSlash(api.prefix)+inboxPrefix), "/"), "/")
+	userID, action := parts[0], ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	if api.inbox == nil || userID == "" || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if identity.UserID != userID && !identity.HasRole(auth.AdminRole) {
+		http.Error(w, router.ErrAccessDenied.Error(), http.StatusForbidden)
+		return
+	}
+	if checker, ok := api.router.(router.AccessChecker); ok {
+		if !checker.CanSubscribe(identity.UserID, identity.Roles, protocol.Path(inbox.Prefix+userID)) {
+			http.Error(w, router.ErrAccessDenied.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	var resp []byte
+	var err error
+	switch {
+	case r.Method == http.MethodGet && action == "":
+		resp, err = api.inbox.GetInbox(userID, q(r, "all") == "true")
+	case r.Method == http.MethodGet && action == "count":
+		resp, err = api.inbox.GetInboxCounts(userID)
+	case r.Method == http.MethodPost && action == "read":
+		body, readErr := ioutil.ReadAll(r.Body)
+		if readErr != nil {
+			http.Error(w, "Can not read body", http.StatusBadRequest)
+			return
+		}
+		request := &inboxRead{}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, request); err != nil {
+				http.Error(w, "Invalid body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		var read []uint64
+		if read, err = api.inbox.MarkRead(userID, q(r, "applicationId"), request.IDs); err == nil {
+			resp, err = json.Marshal(&inboxRead{IDs: read})
+		}
+	case action == "" || action == "count" || action == "read":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.WithError(err).WithField("userID", userID).Error("Serving inbox failed")
+		http.Error(w, "Server error.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
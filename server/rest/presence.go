@@ -0,0 +1,45 @@
+package rest
+
+import (
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/auth"
+	"github.com/cosminrentea/gobbler/server/router"
+)
+
+const presencePrefix = "/presence"
+
+// PresenceProvider returns the JSON-encoded presence of a user.
+type PresenceProvider interface {
+	GetPresence(userID string) ([]byte, error)
+}
+
+// servePresence writes the presence of the user following the presencePrefix.
+// If access control is enabled, the requesting user must be allowed to subscribe to the presence topic of the user.
+func (api *RestMessageAPI) servePresence(w http.ResponseWriter, r *http.Request, identity *auth.Identity) {
+	userID := strings.Trim(strings.TrimPrefix(r.URL.Path, removeTrailingSlash(api.prefix)+presencePrefix), "/")
+	if api.presence == nil || userID == "" || strings.Contains(userID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if checker, ok := api.router.(router.AccessChecker); ok {
+		if !checker.CanSubscribe(identity.UserID, identity.Roles, protocol.Path(protocol.PresencePrefix+userID)) {
+			http.Error(w, router.ErrAccessDenied.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	resp, err := api.presence.GetPresence(userID)
+	if err != nil {
+		log.WithError(err).WithField("userID", userID).Error("Getting presence failed")
+		http.Error(w, "Server error.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
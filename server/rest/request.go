@@ -0,0 +1,124 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rs/xid"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/auth"
+	"github.com/cosminrentea/gobbler/server/router"
+)
+
+const (
+	requestPrefix = "/request"
+
+	defaultRequestTimeout = 10 * time.Second
+	maxRequestTimeout     = time.Minute
+)
+
+// serveRequest publishes a request message and blocks until its reply arrives, or the timeout expires.
+// The request carries in its header the ephemeral topic on which the reply is expected (`Reply-To`),
+// and the correlation id (`Correlation-Id`), which is generated if it is not given by the client.
+// The response contains the body of the reply, and the fields of its header as `X-Guble-` headers.
+func (api *RestMessageAPI) serveRequest(w http.ResponseWriter, r *http.Request, identity *auth.Identity) {
+	timeout, err := requestTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	msg, ok := api.parseMessage(w, r, requestPrefix, identity)
+	if !ok || !api.allowPublish(w, msg) {
+		return
+	}
+	if msg.DeliverAt != nil {
+		http.Error(w, "a request can not be scheduled", http.StatusBadRequest)
+		return
+	}
+
+	correlationID := r.Header.Get(XHeaderPrefix + protocol.CorrelationIDHeader)
+	if correlationID == "" {
+		correlationID = xid.New().String()
+	}
+	replyTo := protocol.Path(protocol.ReplyPrefix + xid.New().String())
+	if err := msg.SetHeaderField(protocol.CorrelationIDHeader, correlationID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := msg.SetHeaderField(protocol.ReplyToHeader, string(replyTo)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	route := router.NewRoute(router.RouteConfig{
+		RouteParams: router.RouteParams{"application_id": msg.ApplicationID, "user_id": msg.UserID},
+		Path:        replyTo,
+		Roles:       identity.Roles,
+		ChannelSize: 1,
+	})
+	if _, err := api.router.Subscribe(route); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer api.router.Unsubscribe(route)
+
+	if err := api.router.HandleMessage(msg); err == router.ErrAccessDenied {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if rejected, ok := err.(*router.RejectedError); ok {
+		http.Error(w, rejected.Error(), rejected.HTTPStatus())
+		return
+	} else if err != nil && err != router.ErrDuplicateMessage {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	logger := log.WithFields(log.Fields{
+		"correlation_id": correlationID,
+		"replyTo":        replyTo,
+		"id":             msg.ID,
+	})
+	logger.Debug("Waiting for the reply to a request")
+
+	w.Header().Set(messageIDHeader, strconv.FormatUint(msg.ID, 10))
+	w.Header().Set(XHeaderPrefix+protocol.CorrelationIDHeader, correlationID)
+
+	select {
+	case reply, ok := <-route.MessagesChannel():
+		if !ok {
+			http.Error(w, "reply route was closed", http.StatusServiceUnavailable)
+			return
+		}
+		writeReply(w, reply)
+	case <-time.After(timeout):
+		logger.Info("No reply received before the timeout of the request")
+		http.Error(w, "no reply received before timeout", http.StatusGatewayTimeout)
+	}
+}
+
+// requestTimeout returns the duration to wait for a reply, from the `timeout` query parameter (e.g. `timeout=5s`)
+func requestTimeout(r *http.Request) (time.Duration, error) {
+	timeoutParam := q(r, "timeout")
+	if timeoutParam == "" {
+		return defaultRequestTimeout, nil
+	}
+	timeout, err := time.ParseDuration(timeoutParam)
+	if err != nil || timeout <= 0 || timeout > maxRequestTimeout {
+		return 0, fmt.Errorf("invalid timeout: %s (maximum %v)", timeoutParam, maxRequestTimeout)
+	}
+	return timeout, nil
+}
+
+// writeReply writes the body of the reply, with the fields of its header as `X-Guble-` headers
+func writeReply(w http.ResponseWriter, reply *protocol.Message) {
+	for name, value := range jsonToHeaders(reply.HeaderJSON) {
+		w.Header().Set(XHeaderPrefix+name, value)
+	}
+	w.Header().Set(XHeaderPrefix+"Reply-Message-Id", strconv.FormatUint(reply.ID, 10))
+	w.Write(reply.Body)
+}
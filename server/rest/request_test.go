@@ -0,0 +1,106 @@
+package rest
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/router"
+	"github.com/cosminrentea/gobbler/testutil"
+)
+
+func TestServeHTTP_Request(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/request/my/command?userId=marvin", bytes.NewReader(testBytes))
+	req.Header.Set("X-Guble-Correlation-Id", "7sdks723ksgqn")
+	w := httptest.NewRecorder()
+
+	var route *router.Route
+	routerMock.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) {
+		route = r
+		a.Equal("marvin", r.Get("user_id"))
+	}).Return(nil, nil)
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		msg.ID = 42
+		a.Equal(protocol.Path("/my/command"), msg.Path)
+		a.Equal(testBytes, msg.Body)
+		a.Equal("7sdks723ksgqn", msg.CorrelationID())
+		a.Equal(route.Path, msg.ReplyTo())
+		a.True(len(msg.ReplyTo()) > len(protocol.ReplyPrefix))
+
+		// the reply is published on the reply topic
+		go route.Deliver(&protocol.Message{
+			ID:         43,
+			Path:       msg.ReplyTo(),
+			HeaderJSON: `{"Correlation-Id":"7sdks723ksgqn","Status":"done"}`,
+			Body:       []byte("reply"),
+		}, false)
+	})
+	routerMock.EXPECT().Unsubscribe(gomock.Any())
+
+	api.ServeHTTP(w, req)
+
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("reply", w.Body.String())
+	a.Equal("42", w.Header().Get("X-Guble-Message-Id"))
+	a.Equal("43", w.Header().Get("X-Guble-Reply-Message-Id"))
+	a.Equal("7sdks723ksgqn", w.Header().Get("X-Guble-Correlation-Id"))
+	a.Equal("done", w.Header().Get("X-Guble-Status"))
+}
+
+func TestServeHTTP_RequestTimeout(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/request/my/command?timeout=10ms", bytes.NewReader(testBytes))
+	w := httptest.NewRecorder()
+
+	routerMock.EXPECT().Subscribe(gomock.Any()).Return(nil, nil)
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		// a correlation id is generated if it is not given
+		a.NotEmpty(msg.CorrelationID())
+	})
+	routerMock.EXPECT().Unsubscribe(gomock.Any())
+
+	api.ServeHTTP(w, req)
+
+	a.Equal(http.StatusGatewayTimeout, w.Code)
+	a.NotEmpty(w.Header().Get("X-Guble-Correlation-Id"))
+}
+
+func TestServeHTTP_RequestInvalid(t *testing.T) {
+	a := assert.New(t)
+	api := NewRestMessageAPI(nil, "/api")
+
+	for _, url := range []string{
+		"http://localhost/api/request/my/command?timeout=forever",
+		"http://localhost/api/request/my/command?timeout=2h",
+		"http://localhost/api/request/my/*",
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodPost, url, bytes.NewReader(testBytes)))
+		a.Equal(http.StatusBadRequest, w.Code, url)
+	}
+
+	// a request can not be scheduled
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/request/my/command", bytes.NewReader(testBytes))
+	req.Header.Set("X-Guble-Delay", "1h")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusBadRequest, w.Code)
+}
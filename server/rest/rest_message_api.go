@@ -1,12 +1,15 @@
 package rest
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 
 	"github.com/azer/snakecase"
 
 	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/auth"
+	"github.com/cosminrentea/gobbler/server/ratelimit"
 	"github.com/cosminrentea/gobbler/server/router"
 
 	"github.com/rs/xid"
@@ -14,13 +17,16 @@ import (
 	"bytes"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
 const (
 	XHeaderPrefix     = "x-guble-"
+	messageIDHeader   = "X-Guble-Message-Id"
 	filterPrefix      = "filter"
 	subscribersPrefix = "/subscribers"
 )
@@ -29,13 +35,38 @@ var errNotFound = errors.New("Not Found.")
 
 // RestMessageAPI is a struct representing a router's connector for a REST API.
 type RestMessageAPI struct {
-	router router.Router
-	prefix string
+	router        router.Router
+	prefix        string
+	authenticator *auth.Authenticator
+	rateLimiter   *ratelimit.Limiter
+	presence      PresenceProvider
+	inbox         InboxProvider
 }
 
 // NewRestMessageAPI returns a new RestMessageAPI.
 func NewRestMessageAPI(router router.Router, prefix string) *RestMessageAPI {
-	return &RestMessageAPI{router, prefix}
+	return &RestMessageAPI{router: router, prefix: prefix}
+}
+
+// SetAuthenticator sets the authenticator of the requests.
+// If it is enabled, the user ID of the published messages is the one of the verified token, instead of the `userId` parameter.
+func (api *RestMessageAPI) SetAuthenticator(authenticator *auth.Authenticator) {
+	api.authenticator = authenticator
+}
+
+// SetRateLimiter sets the rate limiter of the published messages, which are limited by their user ID.
+func (api *RestMessageAPI) SetRateLimiter(rateLimiter *ratelimit.Limiter) {
+	api.rateLimiter = rateLimiter
+}
+
+// SetPresence sets the provider of the presence of the users, served on `<prefix>/presence/<userId>`.
+func (api *RestMessageAPI) SetPresence(presence PresenceProvider) {
+	api.presence = presence
+}
+
+// SetInbox sets the provider of the inboxes of the users, served on `<prefix>/inbox/<userId>`.
+func (api *RestMessageAPI) SetInbox(inbox InboxProvider) {
+	api.inbox = inbox
 }
 
 // GetPrefix returns the prefix.
@@ -51,9 +82,28 @@ func (api *RestMessageAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	identity := &auth.Identity{UserID: q(r, "userId")}
+	if api.authenticator.Enabled() {
+		var err error
+		if identity, err = api.authenticator.Authenticate(r); err != nil {
+			auth.Unauthorized(w, err)
+			return
+		}
+	}
+
+	if strings.HasPrefix(r.URL.Path, removeTrailingSlash(api.prefix)+inboxPrefix+"/") {
+		api.serveInbox(w, r, identity)
+		return
+	}
+
 	if r.Method == http.MethodGet {
 		log.WithField("url", r.URL.Path).Debug("GET")
 
+		if strings.HasPrefix(r.URL.Path, removeTrailingSlash(api.prefix)+presencePrefix+"/") {
+			api.servePresence(w, r, identity)
+			return
+		}
+
 		topic, err := api.extractTopic(r.URL.Path, subscribersPrefix)
 		if err != nil {
 			log.WithError(err).Error("Extracting topic failed")
@@ -66,6 +116,11 @@ func (api *RestMessageAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		resp, err := api.router.GetSubscribers(topic)
+		if err != nil {
+			log.WithError(err).Error("Getting subscribers failed")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 
 		_, err = w.Write(resp)
@@ -82,35 +137,105 @@ func (api *RestMessageAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if strings.HasPrefix(r.URL.Path, removeTrailingSlash(api.prefix)+requestPrefix+"/") {
+		api.serveRequest(w, r, identity)
+		return
+	}
+
+	msg, ok := api.parseMessage(w, r, "/message", identity)
+	if !ok || !api.allowPublish(w, msg) {
+		return
+	}
+
+	err := api.router.HandleMessage(msg)
+	if err == router.ErrAccessDenied {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err == router.ErrInvalidDelivery {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rejected, ok := err.(*router.RejectedError); ok {
+		http.Error(w, rejected.Error(), rejected.HTTPStatus())
+		return
+	}
+	if err == router.ErrDuplicateMessage {
+		log.WithField("id", msg.ID).Info("Duplicate message was not published again")
+	} else if err != nil {
+		log.WithError(err).Error("Handling the published message failed")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the ID of a duplicate message is the ID of the originally published message
+	w.Header().Set(messageIDHeader, strconv.FormatUint(msg.ID, 10))
+	fmt.Fprintf(w, "OK")
+}
+
+// parseMessage returns the message published by a POST request on the topic following the requestTypeTopicPrefix,
+// or writes the error response.
+func (api *RestMessageAPI) parseMessage(w http.ResponseWriter, r *http.Request, requestTypeTopicPrefix string, identity *auth.Identity) (*protocol.Message, bool) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Can not read body", http.StatusBadRequest)
-		return
+		return nil, false
 	}
 
-	topic, err := api.extractTopic(r.URL.Path, "/message")
+	topic, err := api.extractTopic(r.URL.Path, requestTypeTopicPrefix)
 	if err != nil {
 		if err == errNotFound {
 			http.NotFound(w, r)
-			return
+			return nil, false
 		}
 		http.Error(w, "Server error.", http.StatusInternalServerError)
-		return
+		return nil, false
+	}
+
+	if protocol.Path(topic).IsWildcard() {
+		http.Error(w, router.ErrWildcardTopic.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if protocol.Path(topic).IsSystem() {
+		http.Error(w, router.ErrSystemTopic.Error(), http.StatusForbidden)
+		return nil, false
 	}
 
 	msg := &protocol.Message{
 		Path:          protocol.Path(topic),
 		Body:          body,
-		UserID:        q(r, "userId"),
+		UserID:        identity.UserID,
+		Roles:         identity.Roles,
 		ApplicationID: xid.New().String(),
 		HeaderJSON:    headersToJSON(r.Header),
 	}
 
 	// add filters
-	api.setFilters(r, msg)
+	if err := api.setFilters(r, msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
 
-	api.router.HandleMessage(msg)
-	fmt.Fprintf(w, "OK")
+	if err := msg.SetDeliverAtFromHeader(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if err := setExpires(r, msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return msg, true
+}
+
+// allowPublish returns true if the publisher did not exceed its rate limit,
+// otherwise it writes the response with the number of seconds after which the publishing can be retried.
+func (api *RestMessageAPI) allowPublish(w http.ResponseWriter, msg *protocol.Message) bool {
+	ok, retryAfter := api.rateLimiter.AllowPublish(msg.UserID, "", msg.Path)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		http.Error(w, "Rate limit exceeded.", http.StatusTooManyRequests)
+	}
+	return ok
 }
 
 func (api *RestMessageAPI) extractTopic(path string, requestTypeTopicPrefix string) (string, error) {
@@ -127,13 +252,38 @@ func (api *RestMessageAPI) extractTopic(path string, requestTypeTopicPrefix stri
 }
 
 // setFilters sets a field found in the format `filterCamelCaseField` in the
-// query of the request to underscore format on the message filters
-func (api *RestMessageAPI) setFilters(r *http.Request, msg *protocol.Message) {
+// query of the request to underscore format on the message filters.
+// The values are filter expressions, which are validated.
+func (api *RestMessageAPI) setFilters(r *http.Request, msg *protocol.Message) error {
 	for name, values := range r.URL.Query() {
 		if strings.HasPrefix(name, filterPrefix) && len(values) > 0 {
+			if _, err := router.CompileFilter(values[0]); err != nil {
+				return err
+			}
 			msg.SetFilter(filterName(name), values[0])
 		}
 	}
+	return nil
+}
+
+// setExpires sets the expiration time of the message from the `ttl` query parameter (e.g. `ttl=1h30m`).
+// The TTL of a scheduled message starts when it is due.
+func setExpires(r *http.Request, msg *protocol.Message) error {
+	ttlParam := q(r, "ttl")
+	if ttlParam == "" {
+		return nil
+	}
+	ttl, err := time.ParseDuration(ttlParam)
+	if err != nil || ttl <= 0 {
+		return fmt.Errorf("invalid ttl: %s", ttlParam)
+	}
+	start := time.Now()
+	if msg.DeliverAt != nil && msg.DeliverAt.After(start) {
+		start = *msg.DeliverAt
+	}
+	expires := start.Add(ttl)
+	msg.Expires = &expires
+	return nil
 }
 
 // returns a query parameter
@@ -172,6 +322,28 @@ func headersToJSON(header http.Header) string {
 	return string(buff.Bytes())
 }
 
+// jsonToHeaders returns the fields of a header JSON, as strings; it is the inverse of headersToJSON
+func jsonToHeaders(headerJSON string) map[string]string {
+	headers := make(map[string]string)
+	if len(headerJSON) == 0 {
+		return headers
+	}
+	values := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(headerJSON), &values); err != nil {
+		log.WithError(err).WithField("header", headerJSON).Error("Error decoding header")
+		return headers
+	}
+	for key, value := range values {
+		if s, ok := value.(string); ok {
+			headers[key] = s
+		} else {
+			data, _ := json.Marshal(value)
+			headers[key] = string(data)
+		}
+	}
+	return headers
+}
+
 func removeTrailingSlash(path string) string {
 	if len(path) > 1 && path[len(path)-1] == '/' {
 		return path[:len(path)-1]
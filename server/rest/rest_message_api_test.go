@@ -2,6 +2,11 @@ package rest
 
 import (
 	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/auth"
+	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/ratelimit"
+	"github.com/cosminrentea/gobbler/server/router"
+	"github.com/cosminrentea/gobbler/server/store/dummystore"
 	"github.com/cosminrentea/gobbler/testutil"
 
 	"github.com/golang/mock/gomock"
@@ -9,12 +14,14 @@ import (
 
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/cosminrentea/go-uuid"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
@@ -81,6 +88,99 @@ func TestServerHTTP(t *testing.T) {
 	api.ServeHTTP(w, req)
 }
 
+func TestServeHTTP_DuplicateMessage(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic", bytes.NewReader(testBytes))
+	req.Header.Set("X-Guble-Idempotency-Key", "key")
+	w := httptest.NewRecorder()
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		a.Equal("key", msg.IdempotencyKey())
+		msg.ID = 42
+	}).Return(router.ErrDuplicateMessage)
+
+	api.ServeHTTP(w, req)
+
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("42", w.Header().Get("X-Guble-Message-Id"))
+	a.Equal("OK", w.Body.String())
+}
+
+func TestServeHTTP_DeliverAt(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic", bytes.NewReader(testBytes))
+	req.Header.Set("X-Guble-Delay", "1h")
+	w := httptest.NewRecorder()
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		a.NotNil(msg.DeliverAt)
+		a.WithinDuration(time.Now().Add(time.Hour), *msg.DeliverAt, time.Second)
+	})
+
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+
+	// an invalid delivery time is rejected
+	req = httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic", bytes.NewReader(testBytes))
+	req.Header.Set("X-Guble-Deliver-At", "tomorrow")
+	w = httptest.NewRecorder()
+
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestServeHTTP_TTL(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?ttl=10m", bytes.NewReader(testBytes))
+	w := httptest.NewRecorder()
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		a.NotNil(msg.Expires)
+		a.WithinDuration(time.Now().Add(10*time.Minute), *msg.Expires, time.Second)
+	})
+
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+
+	// the TTL of a scheduled message starts at its delivery time
+	req = httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?ttl=10m", bytes.NewReader(testBytes))
+	req.Header.Set("X-Guble-Delay", "1h")
+	w = httptest.NewRecorder()
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		a.NotNil(msg.Expires)
+		a.WithinDuration(time.Now().Add(70*time.Minute), *msg.Expires, time.Second)
+	})
+
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+
+	// an invalid TTL is rejected
+	req = httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?ttl=forever", bytes.NewReader(testBytes))
+	w = httptest.NewRecorder()
+
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusBadRequest, w.Code)
+}
+
 // Server should return an 405 Method Not Allowed in case method request is not POST
 func TestServeHTTP_GetError(t *testing.T) {
 	a := assert.New(t)
@@ -198,7 +298,7 @@ func TestRestMessageAPI_setFilters(t *testing.T) {
 	api := &RestMessageAPI{}
 	msg := &protocol.Message{}
 
-	api.setFilters(req, msg)
+	a.NoError(api.setFilters(req, msg))
 
 	a.NotNil(msg.Filters)
 	if a.Contains(msg.Filters, "user_id") {
@@ -212,6 +312,41 @@ func TestRestMessageAPI_setFilters(t *testing.T) {
 	}
 }
 
+func TestRestMessageAPI_setFiltersExpressions(t *testing.T) {
+	a := assert.New(t)
+
+	req, err := http.NewRequest(
+		http.MethodPost,
+		"http://localhost/api/message/topic?filterUserID=!user01&filterPriority=%3E%3D5",
+		bytes.NewBufferString(""))
+	a.NoError(err)
+
+	api := &RestMessageAPI{}
+	msg := &protocol.Message{}
+	a.NoError(api.setFilters(req, msg))
+	a.Equal("!user01", msg.Filters["user_id"])
+	a.Equal(">=5", msg.Filters["priority"])
+}
+
+func TestRestMessageAPI_InvalidFilterExpression(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	req, err := http.NewRequest(
+		http.MethodPost,
+		"http://localhost/test/message/topic?filterPriority=%3Efive",
+		bytes.NewBufferString(""))
+	a.NoError(err)
+
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	api := NewRestMessageAPI(routerMock, "/test/")
+	recorder := httptest.NewRecorder()
+
+	api.ServeHTTP(recorder, req)
+	a.Equal(http.StatusBadRequest, recorder.Code)
+}
+
 func TestRestMessageAPI_SetFiltersWhenServing(t *testing.T) {
 	testutil.SkipIfDisabled(t)
 	_, finish := testutil.NewMockCtrl(t)
@@ -248,3 +383,286 @@ func TestRestMessageAPI_SetFiltersWhenServing(t *testing.T) {
 
 	time.Sleep(10 * time.Millisecond)
 }
+
+func TestServeHTTP_Authentication(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+	api.SetAuthenticator(auth.NewAuthenticator(
+		auth.NewAPIKeyVerifier(map[string]*auth.Identity{"key1": {UserID: "marvin", Roles: []string{"editor"}}}),
+	))
+
+	// unauthenticated requests are rejected
+	for _, token := range []string{"", "key2"} {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?userId=arthur", bytes.NewReader(testBytes))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		a.Equal(http.StatusUnauthorized, w.Code)
+	}
+
+	// the user id of the verified token is used instead of the userId parameter
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?userId=arthur", bytes.NewReader(testBytes))
+	req.Header.Set("Authorization", "Bearer key1")
+	w := httptest.NewRecorder()
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		a.Equal("marvin", msg.UserID)
+		a.Equal([]string{"editor"}, msg.Roles)
+	})
+
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+}
+
+func TestServeHTTP_AccessDenied(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Return(router.ErrAccessDenied)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?userId=marvin", bytes.NewReader(testBytes)))
+	a.Equal(http.StatusForbidden, w.Code)
+	a.Empty(w.Header().Get("X-Guble-Message-Id"))
+}
+
+func TestServeHTTP_Rejected(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Return(&router.RejectedError{Reason: "too large", StatusCode: http.StatusRequestEntityTooLarge})
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?userId=marvin", bytes.NewReader(testBytes)))
+	a.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	a.Equal("Message rejected: too large\n", w.Body.String())
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Return(&router.RejectedError{Reason: "missing tenant"})
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?userId=marvin", bytes.NewReader(testBytes)))
+	a.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestServeHTTP_HandleMessageError(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Return(errors.New("store error"))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?userId=marvin", bytes.NewReader(testBytes)))
+	a.Equal(http.StatusInternalServerError, w.Code)
+	a.Empty(w.Header().Get("X-Guble-Message-Id"))
+}
+
+type testRouter interface {
+	router.Router
+	Start() error
+	Stop() error
+}
+
+// failingStore is a message store failing to store the messages, e.g. because the sync of a message fails
+type failingStore struct {
+	*dummystore.DummyMessageStore
+}
+
+func (fs failingStore) StoreMessage(message *protocol.Message, nodeID uint8) (int, error) {
+	return 0, errors.New("sync failed")
+}
+
+func TestServeHTTP_StoreError(t *testing.T) {
+	a := assert.New(t)
+
+	r := router.New(failingStore{dummystore.New(kvstore.NewMemoryKVStore())}, kvstore.NewMemoryKVStore(), nil).(testRouter)
+	a.NoError(r.Start())
+	defer r.Stop()
+	api := NewRestMessageAPI(r, "/api")
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?userId=marvin", bytes.NewReader(testBytes)))
+	a.Equal(http.StatusInternalServerError, w.Code)
+	a.Equal("sync failed\n", w.Body.String())
+	a.Empty(w.Header().Get("X-Guble-Message-Id"))
+}
+
+func TestServeHTTP_RateLimit(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+	api.SetRateLimiter(ratelimit.New(map[protocol.Path]ratelimit.Limit{"/my": {Rate: 0.1, Burst: 1}}, nil))
+
+	publish := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodPost, url, bytes.NewReader(testBytes)))
+		return w
+	}
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Times(2)
+	a.Equal(http.StatusOK, publish("http://localhost/api/message/my/topic?userId=marvin").Code)
+
+	// the publisher is limited on the topic and its subtopics, while the other users are not limited
+	w := publish("http://localhost/api/message/my/other?userId=marvin")
+	a.Equal(http.StatusTooManyRequests, w.Code)
+	a.Equal("10", w.Header().Get("Retry-After"))
+	a.Equal(http.StatusTooManyRequests, publish("http://localhost/api/request/my/command?userId=marvin").Code)
+	a.Equal(http.StatusOK, publish("http://localhost/api/message/my/topic?userId=arthur").Code)
+}
+
+// presenceFunc is a PresenceProvider returning the presence of a user
+type presenceFunc func(userID string) ([]byte, error)
+
+func (f presenceFunc) GetPresence(userID string) ([]byte, error) {
+	return f(userID)
+}
+
+// accessCheckingRouter is a router allowing the users to subscribe only to their own topics
+type accessCheckingRouter struct {
+	*MockRouter
+}
+
+func (accessCheckingRouter) CanPublish(userID string, roles []string, path protocol.Path) bool {
+	return true
+}
+
+func (accessCheckingRouter) CanSubscribe(userID string, roles []string, path protocol.Path) bool {
+	return strings.HasSuffix(string(path), "/"+userID)
+}
+
+func TestServeHTTP_Presence(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	api := NewRestMessageAPI(accessCheckingRouter{NewMockRouter(ctrl)}, "/api")
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+
+	// presence is not available without the websocket module
+	a.Equal(http.StatusNotFound, get("http://localhost/api/presence/marvin?userId=marvin").Code)
+
+	api.SetPresence(presenceFunc(func(userID string) ([]byte, error) {
+		return []byte(`{"user_id":"` + userID + `","online":false,"sessions":[]}`), nil
+	}))
+	w := get("http://localhost/api/presence/marvin?userId=marvin")
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("application/json", w.Header().Get("Content-Type"))
+	a.Equal(`{"user_id":"marvin","online":false,"sessions":[]}`, w.Body.String())
+
+	a.Equal(http.StatusForbidden, get("http://localhost/api/presence/marvin?userId=arthur").Code)
+	a.Equal(http.StatusNotFound, get("http://localhost/api/presence/marvin/x?userId=marvin").Code)
+
+	// the clients can not publish on the presence topics
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://localhost/api/message/_presence/marvin?userId=marvin", bytes.NewReader(testBytes)))
+	a.Equal(http.StatusForbidden, w.Code)
+}
+
+// fakeInbox is an InboxProvider recording the messages marked as read
+type fakeInbox struct {
+	applicationID string
+	ids           []uint64
+}
+
+func (f *fakeInbox) GetInbox(userID string, all bool) ([]byte, error) {
+	return []byte(fmt.Sprintf(`[{"id":1,"all":%v}]`, all)), nil
+}
+
+func (f *fakeInbox) GetInboxCounts(userID string) ([]byte, error) {
+	return []byte(`{"user_id":"` + userID + `","unread":1,"total":2}`), nil
+}
+
+func (f *fakeInbox) MarkRead(userID, applicationID string, ids []uint64) ([]uint64, error) {
+	f.applicationID, f.ids = applicationID, ids
+	return []uint64{1}, nil
+}
+
+func TestServeHTTP_Inbox(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	api := NewRestMessageAPI(accessCheckingRouter{NewMockRouter(ctrl)}, "/api")
+	serve := func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+
+	// the inbox is not available without a provider
+	a.Equal(http.StatusNotFound, serve(http.MethodGet, "http://localhost/api/inbox/marvin?userId=marvin", "").Code)
+
+	inbox := &fakeInbox{}
+	api.SetInbox(inbox)
+
+	w := serve(http.MethodGet, "http://localhost/api/inbox/marvin?userId=marvin", "")
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("application/json", w.Header().Get("Content-Type"))
+	a.Equal(`[{"id":1,"all":false}]`, w.Body.String())
+	a.Equal(`[{"id":1,"all":true}]`, serve(http.MethodGet, "http://localhost/api/inbox/marvin?userId=marvin&all=true", "").Body.String())
+	a.Equal(`{"user_id":"marvin","unread":1,"total":2}`, serve(http.MethodGet, "http://localhost/api/inbox/marvin/count?userId=marvin", "").Body.String())
+
+	w = serve(http.MethodPost, "http://localhost/api/inbox/marvin/read?userId=marvin&applicationId=phone", `{"ids":[1,2]}`)
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal(`{"ids":[1]}`, w.Body.String())
+	a.Equal("phone", inbox.applicationID)
+	a.Equal([]uint64{1, 2}, inbox.ids)
+
+	// without IDs, all the messages are marked as read
+	a.Equal(http.StatusOK, serve(http.MethodPost, "http://localhost/api/inbox/marvin/read?userId=marvin", "").Code)
+	a.Nil(inbox.ids)
+
+	a.Equal(http.StatusBadRequest, serve(http.MethodPost, "http://localhost/api/inbox/marvin/read?userId=marvin", "[1]").Code)
+	a.Equal(http.StatusMethodNotAllowed, serve(http.MethodPost, "http://localhost/api/inbox/marvin?userId=marvin", "").Code)
+	a.Equal(http.StatusNotFound, serve(http.MethodGet, "http://localhost/api/inbox/marvin/x?userId=marvin", "").Code)
+	a.Equal(http.StatusForbidden, serve(http.MethodGet, "http://localhost/api/inbox/marvin?userId=arthur", "").Code)
+}
+
+func TestServeHTTP_InboxOfOtherUser(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// the router does not check the access, like an ACL allowing everything by default
+	api := NewRestMessageAPI(NewMockRouter(ctrl), "/api")
+	api.SetInbox(&fakeInbox{})
+	api.SetAuthenticator(auth.NewAuthenticator(auth.NewAPIKeyVerifier(map[string]*auth.Identity{
+		"key1": {UserID: "marvin"},
+		"key2": {UserID: "arthur", Roles: []string{auth.AdminRole}},
+	})))
+	serve := func(method, url, token string) int {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// a user can access only the own inbox
+	a.Equal(http.StatusOK, serve(http.MethodGet, "http://localhost/api/inbox/marvin", "key1"))
+	a.Equal(http.StatusForbidden, serve(http.MethodGet, "http://localhost/api/inbox/zaphod", "key1"))
+	a.Equal(http.StatusForbidden, serve(http.MethodGet, "http://localhost/api/inbox/zaphod/count", "key1"))
+	a.Equal(http.StatusForbidden, serve(http.MethodPost, "http://localhost/api/inbox/zaphod/read", "key1"))
+
+	// unless having the admin role
+	a.Equal(http.StatusOK, serve(http.MethodGet, "http://localhost/api/inbox/zaphod", "key2"))
+	a.Equal(http.StatusOK, serve(http.MethodGet, "http://localhost/api/inbox/zaphod/count", "key2"))
+}
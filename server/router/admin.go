@@ -0,0 +1,247 @@
+package router
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosminrentea/gobbler/protocol"
+)
+
+const (
+	adminRoutesPath = "/routes"
+
+	// the maximum duration to wait for the router goroutine to take a snapshot of the routes
+	adminTimeout = 5 * time.Second
+)
+
+var errRouterBusy = errors.New("router did not respond in time")
+
+// routeInfo describes the state of a route in the admin API
+type routeInfo struct {
+	ID              string             `json:"id"`
+	Path            protocol.Path      `json:"path"`
+	Params          RouteParams        `json:"params"`
+	QueueSize       int                `json:"queue_size"`
+	QueueLength     int                `json:"queue_length"`
+	ChannelLength   int                `json:"channel_length"`
+	ChannelCapacity int                `json:"channel_capacity"`
+	ChannelFill     float64            `json:"channel_fill"`
+	Backpressure    BackpressurePolicy `json:"backpressure,omitempty"`
+	Consuming       bool               `json:"consuming"`
+	Spilling        bool               `json:"spilling"`
+	Invalid         bool               `json:"invalid"`
+	Delivered       uint64             `json:"delivered"`
+	Dropped         uint64             `json:"dropped"`
+}
+
+// routerInfo describes the state of the router in the admin API
+type routerInfo struct {
+	HandleChannelLength     int     `json:"handle_channel_length"`
+	HandleChannelCapacity   int     `json:"handle_channel_capacity"`
+	HandleChannelSaturation float64 `json:"handle_channel_saturation"`
+	Paths                   int     `json:"paths"`
+	Routes                  int     `json:"routes"`
+}
+
+// ID returns a short identifier of the route, derived from its key, used by the admin API
+func (r *Route) ID() string {
+	sum := sha1.Sum([]byte(r.Key()))
+	return hex.EncodeToString(sum[:])
+}
+
+func (r *Route) countDelivered() {
+	atomic.AddUint64(&r.delivered, 1)
+}
+
+func (r *Route) countDropped() {
+	atomic.AddUint64(&r.dropped, 1)
+}
+
+func (r *Route) info() routeInfo {
+	info := routeInfo{
+		ID:              r.ID(),
+		Path:            r.Path,
+		Params:          r.RouteParams,
+		QueueSize:       r.QueueSize,
+		QueueLength:     r.queue.size(),
+		ChannelLength:   len(r.messagesC),
+		ChannelCapacity: cap(r.messagesC),
+		Backpressure:    r.Backpressure,
+		Consuming:       r.isConsuming(),
+		Spilling:        r.isSpilling(),
+		Invalid:         r.isInvalid(),
+		Delivered:       atomic.LoadUint64(&r.delivered),
+		Dropped:         atomic.LoadUint64(&r.dropped),
+	}
+	if info.ChannelCapacity > 0 {
+		info.ChannelFill = float64(info.ChannelLength) / float64(info.ChannelCapacity)
+	}
+	return info
+}
+
+// allRoutes returns all the routes; it is called by the router goroutine, which owns the index of the routes
+func (router *router) allRoutes() []*Route {
+	var routes []*Route
+	router.routes.walk(func(path protocol.Path, pathRoutes []*Route) {
+		routes = append(routes, pathRoutes...)
+	})
+	return routes
+}
+
+// routesSnapshot returns all the routes, as seen by the router goroutine
+func (router *router) routesSnapshot() ([]*Route, error) {
+	if err := router.isStopping(); err != nil {
+		return nil, err
+	}
+	resultC := make(chan []*Route, 1)
+	select {
+	case router.routesC <- resultC:
+		return <-resultC, nil
+	case <-time.After(adminTimeout):
+		return nil, errRouterBusy
+	}
+}
+
+// ServeHTTP implements the admin API of the router.
+// GET on the prefix returns the state of the router, including the saturation of the handle channel.
+// GET on `<prefix>/routes` returns the routes, optionally filtered by `path` and by params (e.g. `user_id`, `application_id`),
+// and GET on `<prefix>/routes/<id>` returns a route.
+// POST on `<prefix>/routes/<id>/close` unsubscribes the route and closes its channel, while POST on `<prefix>/routes/<id>/invalidate`
+// closes it like a full route: it is unsubscribed by the router on the next message routed to it.
+func (router *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, prefix), "/")
+	segments := strings.Split(path, "/")
+
+	switch {
+	case path == "" && req.Method == http.MethodGet:
+		router.serveInfo(w)
+	case segments[0] != strings.Trim(adminRoutesPath, "/"):
+		http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+	case len(segments) == 1 && req.Method == http.MethodGet:
+		router.serveRoutes(w, req)
+	case len(segments) == 2 && req.Method == http.MethodGet:
+		router.serveRoute(w, segments[1], "")
+	case len(segments) == 3 && req.Method == http.MethodPost:
+		router.serveRoute(w, segments[1], segments[2])
+	case len(segments) <= 3:
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+	}
+}
+
+func (router *router) serveInfo(w http.ResponseWriter) {
+	routes, err := router.routesSnapshot()
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	paths := make(map[protocol.Path]bool)
+	for _, r := range routes {
+		paths[r.Path] = true
+	}
+	info := routerInfo{
+		HandleChannelLength:   len(router.handleC),
+		HandleChannelCapacity: cap(router.handleC),
+		Paths:                 len(paths),
+		Routes:                len(routes),
+	}
+	info.HandleChannelSaturation = float64(info.HandleChannelLength) / float64(info.HandleChannelCapacity)
+	writeAdminJSON(w, info)
+}
+
+func (router *router) serveRoutes(w http.ResponseWriter, req *http.Request) {
+	routes, err := router.routesSnapshot()
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	query := req.URL.Query()
+	infos := make([]routeInfo, 0, len(routes))
+	for _, r := range routes {
+		if matchesAdminQuery(r, query) {
+			infos = append(infos, r.info())
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Path != infos[j].Path {
+			return infos[i].Path < infos[j].Path
+		}
+		return infos[i].ID < infos[j].ID
+	})
+	writeAdminJSON(w, infos)
+}
+
+// matchesAdminQuery returns true if the route has the queried path (or a path matched by it, if it is a wildcard)
+// and all the queried params
+func matchesAdminQuery(r *Route, query map[string][]string) bool {
+	for name, values := range query {
+		if len(values) == 0 || values[0] == "" {
+			continue
+		}
+		if name == "path" {
+			pattern := protocol.Path(values[0])
+			if r.Path != pattern && !pattern.Matches(r.Path) {
+				return false
+			}
+		} else if r.Get(name) != values[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func (router *router) serveRoute(w http.ResponseWriter, id, action string) {
+	routes, err := router.routesSnapshot()
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	var route *Route
+	for _, r := range routes {
+		if r.ID() == id {
+			route = r
+			break
+		}
+	}
+	if route == nil {
+		http.Error(w, `{"error":"route not found"}`, http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+	case "close":
+		logger.WithField("route", route).Warn("Closing route from the admin API")
+		router.Unsubscribe(route)
+		route.Close()
+	case "invalidate":
+		logger.WithField("route", route).Warn("Invalidating route from the admin API")
+		route.Close()
+	default:
+		http.Error(w, `{"error":"unknown action"}`, http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(w, route.info())
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, `{"error":"Error encoding data."}`, http.StatusInternalServerError)
+		logger.WithField("error", err.Error()).Error("Error encoding data.")
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusServiceUnavailable)
+}
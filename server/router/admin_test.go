@@ -0,0 +1,126 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+)
+
+func adminRequest(a *assert.Assertions, router *router, method, url string, expectedCode int, v interface{}) {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	a.Equal(expectedCode, w.Code, url)
+	if v != nil {
+		a.NoError(json.Unmarshal(w.Body.Bytes(), v))
+	}
+}
+
+func TestRouter_AdminRoutes(t *testing.T) {
+	a := assert.New(t)
+
+	router, _, _ := aStartedRouter()
+	defer router.Stop()
+
+	route1, err := router.Subscribe(NewRoute(RouteConfig{
+		RouteParams: RouteParams{"application_id": "app1", "user_id": "user1"},
+		Path:        protocol.Path("/blah"),
+		ChannelSize: 10,
+	}))
+	a.NoError(err)
+	route2, err := router.Subscribe(NewRoute(RouteConfig{
+		RouteParams: RouteParams{"application_id": "app2", "user_id": "user2"},
+		Path:        protocol.Path("/blah/sub"),
+		ChannelSize: 5,
+	}))
+	a.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		a.NoError(router.HandleMessage(&protocol.Message{Path: "/blah/sub", Body: aTestByteMessage}))
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	var info routerInfo
+	adminRequest(a, router, http.MethodGet, "/admin/router", http.StatusOK, &info)
+	a.Equal(2, info.Routes)
+	a.Equal(2, info.Paths)
+	a.Equal(handleChannelCapacity, info.HandleChannelCapacity)
+
+	var routes []routeInfo
+	adminRequest(a, router, http.MethodGet, "/admin/router/routes", http.StatusOK, &routes)
+	a.Len(routes, 2)
+	a.Equal(route1.ID(), routes[0].ID)
+	a.Equal(protocol.Path("/blah"), routes[0].Path)
+	a.Equal(uint64(3), routes[0].Delivered)
+	a.Equal(3, routes[0].ChannelLength)
+	a.Equal(0.3, routes[0].ChannelFill)
+
+	a.Equal(route2.ID(), routes[1].ID)
+	a.Equal(uint64(3), routes[1].Delivered)
+	a.Equal(0.6, routes[1].ChannelFill)
+
+	adminRequest(a, router, http.MethodGet, "/admin/router/routes?user_id=user1", http.StatusOK, &routes)
+	a.Len(routes, 1)
+	a.Equal("app1", routes[0].Params["application_id"])
+	adminRequest(a, router, http.MethodGet, "/admin/router/routes?application_id=app2&path=/blah/*", http.StatusOK, &routes)
+	a.Len(routes, 1)
+	adminRequest(a, router, http.MethodGet, "/admin/router/routes?user_id=nobody", http.StatusOK, &routes)
+	a.Len(routes, 0)
+
+	var route routeInfo
+	adminRequest(a, router, http.MethodGet, "/admin/router/routes/"+route1.ID(), http.StatusOK, &route)
+	a.Equal(protocol.Path("/blah"), route.Path)
+	a.False(route.Invalid)
+
+	// closing unsubscribes the route
+	adminRequest(a, router, http.MethodPost, "/admin/router/routes/"+route1.ID()+"/close", http.StatusOK, &route)
+	a.True(route.Invalid)
+	for range route1.MessagesChannel() {
+	}
+	adminRequest(a, router, http.MethodGet, "/admin/router/routes/"+route1.ID(), http.StatusNotFound, nil)
+
+	adminRequest(a, router, http.MethodGet, "/admin/router/unknown", http.StatusNotFound, nil)
+	adminRequest(a, router, http.MethodPost, "/admin/router/routes/unknown/close", http.StatusNotFound, nil)
+	adminRequest(a, router, http.MethodDelete, "/admin/router/routes", http.StatusMethodNotAllowed, nil)
+}
+
+func TestRouter_AdminInvalidateRoute(t *testing.T) {
+	a := assert.New(t)
+
+	router, r := aRouterRoute(chanSize)
+	defer router.Stop()
+
+	var route routeInfo
+	adminRequest(a, router, http.MethodPost, "/admin/router/routes/"+r.ID()+"/invalidate", http.StatusOK, &route)
+	a.True(route.Invalid)
+
+	// the invalid route is unsubscribed on the next message
+	adminRequest(a, router, http.MethodGet, "/admin/router/routes/"+r.ID(), http.StatusOK, nil)
+	a.NoError(router.HandleMessage(&protocol.Message{Path: r.Path, Body: aTestByteMessage}))
+	time.Sleep(10 * time.Millisecond)
+	adminRequest(a, router, http.MethodGet, "/admin/router/routes/"+r.ID(), http.StatusNotFound, nil)
+}
+
+func TestRoute_DroppedCounter(t *testing.T) {
+	a := assert.New(t)
+
+	r := NewRoute(RouteConfig{
+		Path:         protocol.Path("/blah"),
+		ChannelSize:  1,
+		QueueSize:    0,
+		Backpressure: BackpressureDropNewest,
+	})
+	for i := 0; i < 3; i++ {
+		a.NoError(r.Deliver(&protocol.Message{Path: "/blah", Body: aTestByteMessage}, false))
+	}
+
+	info := r.info()
+	a.Equal(uint64(1), info.Delivered)
+	a.Equal(uint64(2), info.Dropped)
+	a.Equal(1.0, info.ChannelFill)
+}
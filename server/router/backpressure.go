@@ -0,0 +1,385 @@
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/store"
+)
+
+// BackpressurePolicy defines how a route behaves when a message is delivered
+// and its queue (or its channel, if the route has no queue) is full.
+type BackpressurePolicy string
+
+const (
+	// BackpressureClose closes the route (default)
+	BackpressureClose BackpressurePolicy = "close"
+
+	// BackpressureDropOldest drops the oldest message waiting to be sent, to make room for the new one
+	BackpressureDropOldest BackpressurePolicy = "drop-oldest"
+
+	// BackpressureDropNewest drops the delivered message
+	BackpressureDropNewest BackpressurePolicy = "drop-newest"
+
+	// BackpressureBlock holds the message until there is room for it, up to the BlockTimeout;
+	// the message is dropped when the timeout expires. The router does not wait for the route:
+	// the blocked messages are held by the route, at most as many as the size of its queue
+	// (or of its channel, if the route has no queue), and the newer ones are dropped.
+	BackpressureBlock BackpressurePolicy = "block"
+
+	// BackpressureSpill drops the messages while the route is full, relying on the fact that they are
+	// already in the message store, and fetches them again as soon as the route has been drained.
+	// It is not supported for the paths with a wildcard partition (see ErrSpillWildcardPartition).
+	BackpressureSpill BackpressurePolicy = "spill"
+
+	defaultBlockTimeout = time.Second
+
+	// MaxBlockTimeout is the maximum time a message can be held by a route with the block policy
+	MaxBlockTimeout = 10 * time.Second
+)
+
+// blockedMessage is a message held by a route with the block policy, until there is room for it
+type blockedMessage struct {
+	msg      *protocol.Message
+	deadline time.Time
+}
+
+// ParseBackpressurePolicy returns the policy having the given name.
+// An empty name returns the default policy.
+func ParseBackpressurePolicy(name string) (BackpressurePolicy, error) {
+	switch policy := BackpressurePolicy(name); policy {
+	case "":
+		return BackpressureClose, nil
+	case BackpressureClose, BackpressureDropOldest, BackpressureDropNewest, BackpressureBlock, BackpressureSpill:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown backpressure policy %q", name)
+}
+
+// BackpressurePolicies returns the names of all policies
+func BackpressurePolicies() []string {
+	return []string{
+		string(BackpressureClose),
+		string(BackpressureDropOldest),
+		string(BackpressureDropNewest),
+		string(BackpressureBlock),
+		string(BackpressureSpill),
+	}
+}
+
+// deliverFull applies the backpressure policy when the route queue is full
+func (r *Route) deliverFull(msg *protocol.Message) error {
+	loggerMessage := r.logger.WithField("correlation_id", msg.CorrelationID()).WithField("policy", r.Backpressure)
+
+	switch r.Backpressure {
+	case BackpressureDropOldest:
+		loggerMessage.Warn("Dropping oldest message because queue is full")
+		mTotalBackpressureDropOldest.Add(1)
+		pBackpressureDropOldest.Inc()
+		r.countDropped()
+		// the first message can be in-flight while the route is consuming
+		r.queue.dropOldest(r.isConsuming())
+	case BackpressureDropNewest:
+		loggerMessage.Warn("Dropping message because queue is full")
+		mTotalBackpressureDropNewest.Add(1)
+		pBackpressureDropNewest.Inc()
+		r.countDropped()
+		return nil
+	case BackpressureBlock:
+		return r.block(msg)
+	case BackpressureSpill:
+		r.spill(msg)
+		return nil
+	default:
+		loggerMessage.Error("Closing route because queue is full")
+		mTotalBackpressureClose.Add(1)
+		pBackpressureClose.Inc()
+		r.Close()
+		mTotalDeliverMessageErrors.Add(1)
+		pDeliverMessageErrors.Inc()
+		return ErrQueueFull
+	}
+
+	r.queue.push(msg)
+	r.consume()
+	return nil
+}
+
+// sendDirectFull applies the backpressure policy when the channel of a route without queue is full
+func (r *Route) sendDirectFull(msg *protocol.Message) error {
+	switch r.Backpressure {
+	case BackpressureDropOldest:
+		r.logger.Warn("Dropping oldest message because channel is full")
+		mTotalBackpressureDropOldest.Add(1)
+		pBackpressureDropOldest.Inc()
+		return r.replaceOldest(msg)
+	case BackpressureDropNewest:
+		r.logger.Warn("Dropping message because channel is full")
+		mTotalBackpressureDropNewest.Add(1)
+		pBackpressureDropNewest.Inc()
+		r.countDropped()
+		return nil
+	case BackpressureBlock:
+		return r.block(msg)
+	case BackpressureSpill:
+		r.spill(msg)
+		// the consumer goroutine will refetch the spilled messages
+		r.consume()
+		return nil
+	}
+
+	r.logger.Debug("Closing route because of full channel")
+	mTotalBackpressureClose.Add(1)
+	pBackpressureClose.Inc()
+	r.Close()
+	return ErrChannelFull
+}
+
+func (r *Route) blockTimeout() time.Duration {
+	if r.BlockTimeout > MaxBlockTimeout {
+		return MaxBlockTimeout
+	}
+	if r.BlockTimeout > 0 {
+		return r.BlockTimeout
+	}
+	return defaultBlockTimeout
+}
+
+// blockCapacity returns how many blocked messages the route can hold
+func (r *Route) blockCapacity() int {
+	if r.QueueSize > 0 {
+		return r.QueueSize
+	}
+	if r.ChannelSize > 0 {
+		return r.ChannelSize
+	}
+	return 1
+}
+
+// block holds the message until the consumer goroutine finds room for it, so that the router never waits.
+// The message is dropped if the route already holds as many blocked messages as its capacity.
+func (r *Route) block(msg *protocol.Message) error {
+	mTotalBackpressureBlock.Add(1)
+	pBackpressureBlock.Inc()
+
+	r.mu.Lock()
+	full := len(r.blocked) >= r.blockCapacity()
+	if !full {
+		r.blocked = append(r.blocked, blockedMessage{msg: msg, deadline: time.Now().Add(r.blockTimeout())})
+	}
+	r.mu.Unlock()
+
+	if full {
+		r.logger.Warn("Dropping message because route holds too many blocked messages")
+		r.dropBlocked()
+		return ErrBlockTimeout
+	}
+	r.consume()
+	return nil
+}
+
+func (r *Route) dropBlocked() {
+	mTotalBackpressureBlockTimeouts.Add(1)
+	pBackpressureBlockTimeouts.Inc()
+	r.countDropped()
+}
+
+func (r *Route) hasBlocked() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.blocked) > 0
+}
+
+// unblock moves the blocked messages into the queue while it has room, dropping the expired ones.
+// It is called only by the consumer goroutine.
+func (r *Route) unblock() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for len(r.blocked) > 0 {
+		if now.After(r.blocked[0].deadline) {
+			r.logger.Warn("Dropping message because route was still full after blocking")
+			r.dropBlocked()
+		} else if r.QueueSize > 0 && r.queue.size() < r.QueueSize {
+			r.queue.push(r.blocked[0].msg)
+		} else {
+			return
+		}
+		r.blocked = r.blocked[1:]
+	}
+}
+
+// sendBlocked sends the oldest blocked message of a route without queue through the channel,
+// waiting until its block timeout. It is called only by the consumer goroutine.
+func (r *Route) sendBlocked() (err error) {
+	r.mu.RLock()
+	blocked := r.blocked[0]
+	r.mu.RUnlock()
+
+	defer func() {
+		if r.invalidRecover() != nil {
+			err = ErrInvalidRoute
+		}
+	}()
+
+	timer := time.NewTimer(blocked.deadline.Sub(time.Now()))
+	defer timer.Stop()
+
+	select {
+	case r.messagesC <- blocked.msg:
+		r.countDelivered()
+	case <-r.closeC:
+		return ErrInvalidRoute
+	case <-timer.C:
+		r.logger.Warn("Dropping message because channel was still full after blocking")
+		r.dropBlocked()
+	}
+
+	r.mu.Lock()
+	r.blocked = r.blocked[1:]
+	r.mu.Unlock()
+	return nil
+}
+
+// replaceOldest removes the oldest message from the channel to make room for msg
+func (r *Route) replaceOldest(msg *protocol.Message) (err error) {
+	defer func() {
+		if r.invalidRecover() != nil {
+			err = ErrInvalidRoute
+		}
+	}()
+
+	select {
+	case <-r.messagesC:
+		r.countDropped()
+	default:
+	}
+	select {
+	case r.messagesC <- msg:
+		r.countDelivered()
+	default:
+		// the consumer is not the only one filling the channel, so drop the message instead
+		mTotalBackpressureDropNewest.Add(1)
+		pBackpressureDropNewest.Inc()
+		r.countDropped()
+	}
+	return nil
+}
+
+// spill drops the message, remembering the ID of the first message which has to be refetched
+func (r *Route) spill(msg *protocol.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mTotalBackpressureSpill.Add(1)
+	pBackpressureSpill.Inc()
+	if !r.spilling {
+		r.logger.WithField("messageID", msg.ID).Warn("Spilling messages to the store because route is full")
+		r.spilling = true
+		r.spillFromID = msg.ID
+	}
+}
+
+func (r *Route) isSpilling() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.spilling
+}
+
+// isRefetched returns true if a live message was already sent by the refetch of spilled messages
+func (r *Route) isRefetched(msg *protocol.Message) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return msg.ID <= r.refetchedID
+}
+
+// refetchSpilled sends the spilled messages fetched from the store through the route channel.
+// It is called by the consumer goroutine when the queue is drained.
+func (r *Route) refetchSpilled() error {
+	r.mu.RLock()
+	router, fromID := r.router, r.spillFromID
+	r.mu.RUnlock()
+
+	if router == nil {
+		r.logger.Error("Cannot refetch spilled messages because route is not subscribed")
+		r.Close()
+		return ErrInvalidRoute
+	}
+
+	r.logger.WithField("fromID", fromID).Debug("Refetching spilled messages")
+	var lastID uint64
+	deliver := func(msg *protocol.Message) error {
+		if msg.ID > lastID {
+			lastID = msg.ID
+		}
+		if !r.Path.Matches(msg.Path) || !r.messageFilter(msg) {
+			return nil
+		}
+		if msg = InterceptFetched(router, r, msg); msg == nil {
+			return nil
+		}
+		mTotalBackpressureRefetched.Add(1)
+		pBackpressureRefetched.Inc()
+		return r.send(msg)
+	}
+
+	for {
+		lastID = fromID - 1
+		maxID, err := r.maxMessageID(router)
+		if err != nil {
+			return err
+		}
+
+		fr := store.NewFetchRequest("", fromID, 0, store.DirectionForward, -1)
+		if err := r.fetch(router, fr, deliver); err != nil {
+			return err
+		}
+		// the fetch skips the messages not matched by wildcard paths, but all messages up to maxID were read
+		if lastID < maxID {
+			lastID = maxID
+		}
+
+		done, err := r.stopSpilling(router, lastID)
+		if err != nil || done {
+			return err
+		}
+		// new messages were spilled while refetching
+		fromID = lastID + 1
+	}
+}
+
+// maxMessageID returns the ID of the last message stored in the partition of the route
+func (r *Route) maxMessageID(router Router) (uint64, error) {
+	ms, err := router.MessageStore()
+	if err != nil {
+		return 0, err
+	}
+	return ms.MaxMessageID(r.Path.Partition())
+}
+
+// stopSpilling ends the spilling if no message newer than lastID was stored in the meantime,
+// which is checked while holding the partition lock.
+func (r *Route) stopSpilling(router Router, lastID uint64) (bool, error) {
+	stop := func(maxID uint64) error {
+		if maxID > lastID {
+			return errUnreadMessages
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.spilling = false
+		r.refetchedID = lastID
+		return nil
+	}
+
+	ms, err := router.MessageStore()
+	if err != nil {
+		return false, err
+	}
+	err = ms.DoInTx(r.Path.Partition(), stop)
+	if err == errUnreadMessages {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,286 @@
+package router
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/store"
+	"github.com/cosminrentea/gobbler/testutil"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBackpressurePolicy(t *testing.T) {
+	a := assert.New(t)
+
+	policy, err := ParseBackpressurePolicy("")
+	a.NoError(err)
+	a.Equal(BackpressureClose, policy)
+
+	for _, name := range BackpressurePolicies() {
+		policy, err := ParseBackpressurePolicy(name)
+		a.NoError(err)
+		a.Equal(BackpressurePolicy(name), policy)
+	}
+
+	_, err = ParseBackpressurePolicy("unknown")
+	a.Error(err)
+}
+
+func messageWithID(id uint64) *protocol.Message {
+	return &protocol.Message{ID: id, Path: dummyPath, Body: []byte("dummy body"), HeaderJSON: `{"Correlation-Id": "id"}`}
+}
+
+func receiveIDs(a *assert.Assertions, r *Route, count int) []uint64 {
+	ids := make([]uint64, 0, count)
+	for i := 0; i < count; i++ {
+		select {
+		case m, open := <-r.MessagesChannel():
+			a.True(open)
+			ids = append(ids, m.ID)
+		case <-time.After(50 * time.Millisecond):
+			a.Fail("Message not received")
+			return ids
+		}
+	}
+	return ids
+}
+
+func idsRange(from, to uint64) []uint64 {
+	ids := make([]uint64, 0, to-from+1)
+	for id := from; id <= to; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// fill the channel buffer and the queue of a route, giving the consumer time to move the messages in the channel
+func fillRoute(a *assert.Assertions, r *Route) {
+	for i := 1; i <= chanSize+r.QueueSize; i++ {
+		a.NoError(r.Deliver(messageWithID(uint64(i)), false))
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestRouteDeliver_DropNewest(t *testing.T) {
+	a := assert.New(t)
+	r := testRoute()
+	r.QueueSize = queueSize
+	r.Timeout = -1
+	r.Backpressure = BackpressureDropNewest
+
+	fillRoute(a, r)
+	a.NoError(r.Deliver(messageWithID(100), false))
+	a.False(r.isInvalid())
+
+	a.Equal(idsRange(1, uint64(chanSize+queueSize)), receiveIDs(a, r, chanSize+queueSize))
+	a.Equal(0, len(r.MessagesChannel()))
+}
+
+func TestRouteDeliver_DropOldest(t *testing.T) {
+	a := assert.New(t)
+	r := testRoute()
+	r.QueueSize = queueSize
+	r.Timeout = -1
+	r.Backpressure = BackpressureDropOldest
+
+	fillRoute(a, r)
+	a.NoError(r.Deliver(messageWithID(100), false))
+	a.False(r.isInvalid())
+
+	// the in-flight message is sent, the next one is dropped
+	expected := idsRange(1, uint64(chanSize+1))
+	expected = append(expected, idsRange(uint64(chanSize+3), uint64(chanSize+queueSize))...)
+	expected = append(expected, 100)
+	a.Equal(expected, receiveIDs(a, r, chanSize+queueSize))
+}
+
+func TestRouteDeliver_DropOldestWithoutQueue(t *testing.T) {
+	a := assert.New(t)
+	r := testRoute()
+	r.Backpressure = BackpressureDropOldest
+
+	for i := 1; i <= chanSize+1; i++ {
+		a.NoError(r.Deliver(messageWithID(uint64(i)), false))
+	}
+	a.False(r.isInvalid())
+	a.Equal(idsRange(2, uint64(chanSize+1)), receiveIDs(a, r, chanSize))
+}
+
+func TestRouteDeliver_Block(t *testing.T) {
+	a := assert.New(t)
+	r := testRoute()
+	r.QueueSize = queueSize
+	r.Timeout = -1
+	r.Backpressure = BackpressureBlock
+	r.BlockTimeout = time.Second
+
+	fillRoute(a, r)
+
+	// the router does not wait for the full route
+	start := time.Now()
+	for i := 100; i < 100+queueSize; i++ {
+		a.NoError(r.Deliver(messageWithID(uint64(i)), false))
+	}
+	a.Equal(ErrBlockTimeout, r.Deliver(messageWithID(200), false))
+	a.True(time.Since(start) < r.BlockTimeout)
+	a.False(r.isInvalid())
+
+	// reading from the channel makes room for the blocked messages, which keep their order
+	expected := idsRange(1, uint64(chanSize+queueSize))
+	expected = append(expected, idsRange(100, uint64(100+queueSize-1))...)
+	a.Equal(expected, receiveIDs(a, r, len(expected)))
+	a.Equal(uint64(1), r.info().Dropped)
+}
+
+func TestRouteDeliver_BlockTimeout(t *testing.T) {
+	a := assert.New(t)
+	r := testRoute()
+	r.QueueSize = queueSize
+	r.Timeout = -1
+	r.Backpressure = BackpressureBlock
+	r.BlockTimeout = 10 * time.Millisecond
+
+	fillRoute(a, r)
+	a.NoError(r.Deliver(messageWithID(100), false))
+	a.False(r.isInvalid())
+
+	// the blocked message is dropped, since there is no room for it before the timeout
+	time.Sleep(2 * r.BlockTimeout)
+	a.Equal(idsRange(1, uint64(chanSize+queueSize)), receiveIDs(a, r, chanSize+queueSize))
+	time.Sleep(10 * time.Millisecond)
+	a.Equal(0, len(r.MessagesChannel()))
+	a.Equal(uint64(1), r.info().Dropped)
+
+	// the route is not blocked anymore
+	a.NoError(r.Deliver(messageWithID(101), false))
+	a.Equal([]uint64{101}, receiveIDs(a, r, 1))
+}
+
+func TestRouteDeliver_BlockWithoutQueue(t *testing.T) {
+	a := assert.New(t)
+	r := testRoute()
+	r.Backpressure = BackpressureBlock
+	r.BlockTimeout = time.Second
+
+	for i := 1; i <= chanSize; i++ {
+		a.NoError(r.Deliver(messageWithID(uint64(i)), false))
+	}
+	start := time.Now()
+	a.NoError(r.Deliver(messageWithID(100), false))
+	a.NoError(r.Deliver(messageWithID(101), false))
+	a.True(time.Since(start) < r.BlockTimeout)
+	a.False(r.isInvalid())
+
+	expected := append(idsRange(1, uint64(chanSize)), 100, 101)
+	a.Equal(expected, receiveIDs(a, r, len(expected)))
+}
+
+func TestRouteDeliver_BlockTimeoutWithoutQueue(t *testing.T) {
+	a := assert.New(t)
+	r := testRoute()
+	r.Backpressure = BackpressureBlock
+	r.BlockTimeout = 10 * time.Millisecond
+
+	for i := 1; i <= chanSize; i++ {
+		a.NoError(r.Deliver(messageWithID(uint64(i)), false))
+	}
+	a.NoError(r.Deliver(messageWithID(100), false))
+
+	time.Sleep(2 * r.BlockTimeout)
+	a.Equal(idsRange(1, uint64(chanSize)), receiveIDs(a, r, chanSize))
+	a.Equal(0, len(r.MessagesChannel()))
+	a.Equal(uint64(1), r.info().Dropped)
+}
+
+func TestRouteBlockTimeout(t *testing.T) {
+	a := assert.New(t)
+	r := testRoute()
+	a.Equal(defaultBlockTimeout, r.blockTimeout())
+
+	r.BlockTimeout = time.Hour
+	a.Equal(MaxBlockTimeout, r.blockTimeout())
+}
+
+func TestRouteDeliver_Spill(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+	msMock := NewMockMessageStore(ctrl)
+	routerMock := NewMockRouter(ctrl)
+
+	r := NewRoute(RouteConfig{
+		Path:         dummyPath,
+		ChannelSize:  1,
+		QueueSize:    1,
+		Timeout:      -1,
+		Backpressure: BackpressureSpill,
+	})
+	r.setRouter(routerMock)
+
+	routerMock.EXPECT().MessageStore().Return(msMock, nil).AnyTimes()
+	routerMock.EXPECT().Done().Return(make(chan bool)).AnyTimes()
+	msMock.EXPECT().MaxMessageID("dummy").Return(uint64(4), nil).AnyTimes()
+	routerMock.EXPECT().Fetch(gomock.Any()).Do(func(req *store.FetchRequest) {
+		a.Equal("dummy", req.Partition)
+		a.Equal(uint64(3), req.StartID)
+		go func() {
+			req.StartC <- 2
+			req.Push(3, []byte(strings.Replace(dummyMessageBytes, "MESSAGE_ID", strconv.Itoa(3), 1)))
+			req.Push(4, []byte(strings.Replace(dummyMessageBytes, "MESSAGE_ID", strconv.Itoa(4), 1)))
+			req.Done()
+		}()
+	})
+	msMock.EXPECT().DoInTx("dummy", gomock.Any()).Do(func(partition string, fn func(uint64) error) {
+		a.NoError(fn(4))
+	}).Return(nil)
+
+	// the first message fills the channel and the second one the queue
+	a.NoError(r.Deliver(messageWithID(1), false))
+	time.Sleep(10 * time.Millisecond)
+	a.NoError(r.Deliver(messageWithID(2), false))
+	time.Sleep(10 * time.Millisecond)
+
+	// the next messages are spilled
+	a.NoError(r.Deliver(messageWithID(3), false))
+	a.NoError(r.Deliver(messageWithID(4), false))
+	a.True(r.isSpilling())
+
+	// draining the route refetches the spilled messages from the store
+	a.Equal(idsRange(1, 4), receiveIDs(a, r, 4))
+	time.Sleep(10 * time.Millisecond)
+	a.False(r.isSpilling())
+	a.False(r.isInvalid())
+
+	// a refetched message delivered again is skipped
+	a.NoError(r.Deliver(messageWithID(4), false))
+	a.NoError(r.Deliver(messageWithID(5), false))
+	a.Equal([]uint64{5}, receiveIDs(a, r, 1))
+}
+
+func TestRouter_SubscribeSpillWildcardPartition(t *testing.T) {
+	a := assert.New(t)
+	router, _, _ := aStartedRouter()
+	defer router.Stop()
+
+	// the spilled messages can be fetched again only from a single partition
+	for path, expected := range map[protocol.Path]error{
+		"/+/status":  ErrSpillWildcardPartition,
+		"/#":         ErrSpillWildcardPartition,
+		"/orders/+":  nil,
+		"/orders/42": nil,
+	} {
+		_, err := router.Subscribe(NewRoute(RouteConfig{
+			RouteParams:  RouteParams{"application_id": "appid01", "user_id": "user01"},
+			Path:         path,
+			ChannelSize:  1,
+			Backpressure: BackpressureSpill,
+		}))
+		a.Equal(expected, err, string(path))
+	}
+}
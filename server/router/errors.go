@@ -17,8 +17,37 @@ var (
 	// and the channel is full
 	ErrChannelFull = errors.New("Route channel is full. Route is closed.")
 
+	// ErrBlockTimeout is returned when trying to `Deliver` a message in a full route with the block
+	// backpressure policy, and the route already holds as many blocked messages as it can
+	ErrBlockTimeout = errors.New("Route is full after blocking. Message is dropped.")
+
+	// ErrSpillWildcardPartition is returned when subscribing with the spill backpressure policy to a path with a wildcard partition,
+	// since the message IDs from which the spilled messages are fetched again are generated by partition
+	ErrSpillWildcardPartition = errors.New("The spill backpressure policy is not supported for a path with a wildcard partition.")
+
+	// ErrGroupInCluster is returned when subscribing a member of a consumer group to a node of a cluster,
+	// since the nodes would each deliver the messages to one of their own members
+	ErrGroupInCluster = errors.New("Consumer groups are not supported in a cluster.")
+
+	// ErrDuplicateMessage is returned when a message is published with an idempotency key which was already seen.
+	// The message is not stored and routed again.
+	ErrDuplicateMessage = errors.New("Duplicate message. The idempotency key was already used.")
+
+	// ErrWildcardTopic is returned when trying to publish a message on a wildcard path
+	ErrWildcardTopic = errors.New("Cannot publish a message on a wildcard path.")
+
+	// ErrSystemTopic is returned when a client tries to publish a message on a system topic
+	ErrSystemTopic = errors.New("Cannot publish a message on a system topic.")
+
 	// ErrQueueFull is returned when trying to `Deliver` a message in a full queued route
 	ErrQueueFull = errors.New("Route queue is full. Route is closed.")
+
+	// ErrAccessDenied is returned when the access control lists do not allow the user
+	// to publish or to subscribe to a topic
+	ErrAccessDenied = errors.New("Access denied.")
+
+	// ErrInvalidDelivery is returned when an online-first message has no valid recipient or acknowledgement timeout
+	ErrInvalidDelivery = errors.New("An online-first message requires a valid Recipient and Ack-Timeout.")
 )
 
 // ModuleStoppingError is returned when the module is stopping
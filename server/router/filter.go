@@ -0,0 +1,224 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SubscriberFilterPrefix is the prefix of the route params holding the filter expressions of a subscriber.
+// The route param `filter_priority` with the value `>5` matches only the messages having the filter
+// `priority` set to a number greater than 5.
+const SubscriberFilterPrefix = "filter_"
+
+// maximum number of publisher filter expressions kept compiled
+const filterCacheSize = 1024
+
+// FilterExpr is a compiled filter expression matching a single value.
+//
+// The syntax of the filter expressions:
+//
+//	value          the value is equal to `value`
+//	=value         the value is equal to `value`, even if it starts with an operator
+//	!expr          the value is not matched by expr (e.g. `!value`, `!in(a,b)`)
+//	in(a,b,c)      the value is one of `a`, `b`, `c`
+//	prefix(abc)    the value starts with `abc`
+//	regex(^a.*z$)  the value matches the regular expression
+//	>10 >=10 <10 <=10
+//	               the value is a number and the comparison is true
+type FilterExpr interface {
+	Match(value string) bool
+}
+
+type equalFilter string
+
+func (f equalFilter) Match(value string) bool {
+	return string(f) == value
+}
+
+type notFilter struct {
+	expr FilterExpr
+}
+
+func (f notFilter) Match(value string) bool {
+	return !f.expr.Match(value)
+}
+
+type inFilter map[string]struct{}
+
+func (f inFilter) Match(value string) bool {
+	_, ok := f[value]
+	return ok
+}
+
+type prefixFilter string
+
+func (f prefixFilter) Match(value string) bool {
+	return strings.HasPrefix(value, string(f))
+}
+
+type regexFilter struct {
+	re *regexp.Regexp
+}
+
+func (f regexFilter) Match(value string) bool {
+	return f.re.MatchString(value)
+}
+
+type numericFilter struct {
+	op      string
+	operand float64
+}
+
+func (f numericFilter) Match(value string) bool {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false
+	}
+	switch f.op {
+	case ">":
+		return number > f.operand
+	case ">=":
+		return number >= f.operand
+	case "<":
+		return number < f.operand
+	case "<=":
+		return number <= f.operand
+	}
+	return false
+}
+
+// noneFilter is used in place of invalid expressions, so that they don't match any value
+type noneFilter struct{}
+
+func (noneFilter) Match(value string) bool {
+	return false
+}
+
+// CompileFilter parses a filter expression.
+func CompileFilter(expr string) (FilterExpr, error) {
+	switch {
+	case strings.HasPrefix(expr, "="):
+		return equalFilter(expr[1:]), nil
+	case strings.HasPrefix(expr, "!"):
+		negated, err := CompileFilter(expr[1:])
+		if err != nil {
+			return nil, err
+		}
+		return notFilter{negated}, nil
+	case strings.HasPrefix(expr, ">=") || strings.HasPrefix(expr, "<="):
+		return compileNumeric(expr[:2], expr[2:])
+	case strings.HasPrefix(expr, ">") || strings.HasPrefix(expr, "<"):
+		return compileNumeric(expr[:1], expr[1:])
+	}
+
+	if name, arg, ok := parseFunction(expr); ok {
+		switch name {
+		case "in":
+			set := make(inFilter)
+			for _, value := range strings.Split(arg, ",") {
+				set[strings.TrimSpace(value)] = struct{}{}
+			}
+			return set, nil
+		case "prefix":
+			return prefixFilter(arg), nil
+		case "regex":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter expression %q: %v", expr, err)
+			}
+			return regexFilter{re}, nil
+		}
+	}
+	return equalFilter(expr), nil
+}
+
+func compileNumeric(op, operand string) (FilterExpr, error) {
+	number, err := strconv.ParseFloat(strings.TrimSpace(operand), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter expression %q: %q is not a number", op+operand, operand)
+	}
+	return numericFilter{op: op, operand: number}, nil
+}
+
+// parseFunction splits an expression like `name(arg)`
+func parseFunction(expr string) (name, arg string, ok bool) {
+	open := strings.IndexByte(expr, '(')
+	if open <= 0 || !strings.HasSuffix(expr, ")") {
+		return "", "", false
+	}
+	return expr[:open], expr[open+1 : len(expr)-1], true
+}
+
+var filterCache = struct {
+	sync.RWMutex
+	exprs map[string]FilterExpr
+}{exprs: make(map[string]FilterExpr)}
+
+// cachedFilter returns the compiled expression, compiling it only the first time it is seen.
+// Invalid expressions don't match any value.
+func cachedFilter(expr string) FilterExpr {
+	filterCache.RLock()
+	compiled, ok := filterCache.exprs[expr]
+	filterCache.RUnlock()
+	if ok {
+		return compiled
+	}
+
+	compiled, err := CompileFilter(expr)
+	if err != nil {
+		logger.WithError(err).Warn("Invalid filter expression")
+		compiled = noneFilter{}
+	}
+
+	filterCache.Lock()
+	defer filterCache.Unlock()
+	if len(filterCache.exprs) >= filterCacheSize {
+		filterCache.exprs = make(map[string]FilterExpr)
+	}
+	filterCache.exprs[expr] = compiled
+	return compiled
+}
+
+// compileSubscriberFilters returns the compiled expressions of the route params having
+// the SubscriberFilterPrefix, indexed by the name of the message filter they apply to.
+func compileSubscriberFilters(params RouteParams) map[string]FilterExpr {
+	var filters map[string]FilterExpr
+	for key, value := range params {
+		if !strings.HasPrefix(key, SubscriberFilterPrefix) {
+			continue
+		}
+		if filters == nil {
+			filters = make(map[string]FilterExpr)
+		}
+		expr, err := CompileFilter(value)
+		if err != nil {
+			logger.WithError(err).WithField("param", key).Error("Invalid subscriber filter expression")
+			expr = noneFilter{}
+		}
+		filters[strings.TrimPrefix(key, SubscriberFilterPrefix)] = expr
+	}
+	return filters
+}
+
+// matchFilters returns true if the message filters match the route params and the subscriber filters.
+// A message filter having a subscriber filter with the same name is matched only by the subscriber filter;
+// a subscriber filter without a message filter is matched against an empty value.
+func matchFilters(params RouteParams, subscriberFilters map[string]FilterExpr, messageFilters map[string]string) bool {
+	for key, value := range messageFilters {
+		if _, ok := subscriberFilters[key]; ok {
+			continue
+		}
+		if !cachedFilter(value).Match(params.Get(key)) {
+			return false
+		}
+	}
+	for name, expr := range subscriberFilters {
+		if !expr.Match(messageFilters[name]) {
+			return false
+		}
+	}
+	return true
+}
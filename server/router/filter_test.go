@@ -0,0 +1,104 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompileFilter(t *testing.T) {
+	a := assert.New(t)
+
+	testcases := []struct {
+		expr     string
+		matching []string
+		other    []string
+	}{
+		{"value", []string{"value"}, []string{"", "value2", "other"}},
+		{"=>5", []string{">5"}, []string{"6"}},
+		{"!value", []string{"", "other"}, []string{"value"}},
+		{"!=value", []string{"other"}, []string{"value"}},
+		{"in(a, b,c)", []string{"a", "b", "c"}, []string{"", "d", "a, b"}},
+		{"!in(a,b)", []string{"c"}, []string{"a", "b"}},
+		{"prefix(user-)", []string{"user-", "user-1"}, []string{"user", "admin-1"}},
+		{"regex(^(ios|android)-[0-9]+$)", []string{"ios-1", "android-42"}, []string{"ios", "web-1"}},
+		{">5", []string{"6", "5.5"}, []string{"5", "4", "six", ""}},
+		{">=5", []string{"5", "6"}, []string{"4.9"}},
+		{"<-1", []string{"-2"}, []string{"-1", "0"}},
+		{"<=1.5", []string{"1.5", "0"}, []string{"2"}},
+		{"unknown(a)", []string{"unknown(a)"}, []string{"a"}},
+	}
+
+	for _, c := range testcases {
+		expr, err := CompileFilter(c.expr)
+		a.NoError(err, "Compiling: "+c.expr)
+		for _, value := range c.matching {
+			a.True(expr.Match(value), c.expr+" should match "+value)
+		}
+		for _, value := range c.other {
+			a.False(expr.Match(value), c.expr+" should not match "+value)
+		}
+	}
+
+	for _, invalid := range []string{">", ">=a", "<five", "regex([a-)", "!regex(*)"} {
+		_, err := CompileFilter(invalid)
+		a.Error(err, "Compiling: "+invalid)
+	}
+}
+
+func TestCachedFilter_Invalid(t *testing.T) {
+	a := assert.New(t)
+	a.False(cachedFilter(">a").Match(""))
+	a.False(cachedFilter(">a").Match(">a"))
+}
+
+func TestRoute_messageFilterExpressions(t *testing.T) {
+	a := assert.New(t)
+
+	route := NewRoute(RouteConfig{
+		Path: protocol.Path("/topic"),
+		RouteParams: RouteParams{
+			"user_id":                           "user01",
+			"platform":                          "android",
+			SubscriberFilterPrefix + "priority": ">=5",
+			SubscriberFilterPrefix + "type":     "!in(debug,trace)",
+		},
+	})
+
+	testcases := map[string]struct {
+		filters map[string]string
+		result  bool
+	}{
+		"no publisher filters, subscriber filters not matched": {nil, false},
+		"subscriber filters matched": {
+			map[string]string{"priority": "7", "type": "alert"},
+			true,
+		},
+		"subscriber numeric filter not matched": {
+			map[string]string{"priority": "3", "type": "alert"},
+			false,
+		},
+		"subscriber negated filter not matched": {
+			map[string]string{"priority": "7", "type": "debug"},
+			false,
+		},
+		"publisher expressions matched": {
+			map[string]string{"priority": "5", "user_id": "prefix(user)", "platform": "in(ios,android)"},
+			true,
+		},
+		"publisher expression not matched": {
+			map[string]string{"priority": "5", "user_id": "!user01"},
+			false,
+		},
+		"publisher filter on missing route param": {
+			map[string]string{"priority": "5", "device": "regex(.+)"},
+			false,
+		},
+	}
+
+	for name, c := range testcases {
+		m := &protocol.Message{Filters: c.filters}
+		a.Equal(c.result, route.messageFilter(m), "Failed filter: "+name)
+	}
+}
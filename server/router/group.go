@@ -0,0 +1,93 @@
+package router
+
+import (
+	"github.com/cosminrentea/gobbler/protocol"
+)
+
+// GroupParam is the route param holding the name of the consumer group of a route.
+// The routes subscribed on the same path with the same group share the messages of the path:
+// each message is delivered to only one member of the group, the least loaded one (the ties are broken round-robin).
+// The groups are not supported in a cluster (see ErrGroupInCluster).
+const GroupParam = "group"
+
+// groupKey identifies a consumer group by the path of its routes and its name
+type groupKey struct {
+	path  protocol.Path
+	group string
+}
+
+// deliver delivers the message to the routes of the path, and to one member of each consumer group.
+// It returns the invalid routes.
+func (router *router) deliver(path protocol.Path, routes []*Route, message *protocol.Message) []*Route {
+	var invalidRoutes []*Route
+	var groups map[string][]*Route
+	for _, route := range routes {
+		if group := route.Get(GroupParam); group != "" {
+			if groups == nil {
+				groups = make(map[string][]*Route)
+			}
+			groups[group] = append(groups[group], route)
+			continue
+		}
+		routeMessage := router.interceptDelivery(route, message)
+		if routeMessage == nil {
+			continue
+		}
+		if err := route.Deliver(routeMessage, false); err == ErrInvalidRoute {
+			invalidRoutes = append(invalidRoutes, route)
+		}
+	}
+	for group, members := range groups {
+		invalidRoutes = append(invalidRoutes, router.deliverToGroup(groupKey{path: path, group: group}, members, message)...)
+	}
+	return invalidRoutes
+}
+
+// deliverToGroup delivers the message to the least loaded member of the group whose filters match the message,
+// starting the search after the member which received the previous message.
+// If the selected member is invalid, or its delivery is rejected by an interceptor, the message is delivered to another member.
+// It returns the invalid members.
+func (router *router) deliverToGroup(key groupKey, members []*Route, message *protocol.Message) []*Route {
+	var invalidRoutes []*Route
+	candidates := make([]*Route, 0, len(members))
+	for _, member := range members {
+		if member.isInvalid() {
+			invalidRoutes = append(invalidRoutes, member)
+		} else if member.messageFilter(message) {
+			candidates = append(candidates, member)
+		}
+	}
+
+	for len(candidates) > 0 {
+		start := router.groupTurns[key] % len(candidates)
+		selected := start
+		for i := 1; i < len(candidates); i++ {
+			j := (start + i) % len(candidates)
+			if candidates[j].load() < candidates[selected].load() {
+				selected = j
+			}
+		}
+		router.groupTurns[key] = selected + 1
+
+		if routeMessage := router.interceptDelivery(candidates[selected], message); routeMessage != nil {
+			if err := candidates[selected].Deliver(routeMessage, false); err != ErrInvalidRoute {
+				mTotalGroupDeliveries.Add(1)
+				pGroupDeliveries.Inc()
+				return invalidRoutes
+			}
+			invalidRoutes = append(invalidRoutes, candidates[selected])
+		}
+		candidates = append(candidates[:selected], candidates[selected+1:]...)
+	}
+	return invalidRoutes
+}
+
+// hasGroup returns true if one of the routes is a member of the group
+func hasGroup(routes []*Route, group string) bool {
+	for _, route := range routes {
+		if route.Get(GroupParam) == group {
+			return true
+		}
+	}
+	return false
+}
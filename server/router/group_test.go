@@ -0,0 +1,94 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/cluster"
+)
+
+func TestRouter_ConsumerGroup(t *testing.T) {
+	a := assert.New(t)
+	router, _, _ := aStartedRouter()
+	defer router.Stop()
+
+	subscribe := func(params RouteParams) *Route {
+		route, err := router.Subscribe(NewRoute(RouteConfig{
+			RouteParams: params,
+			Path:        "/jobs",
+			ChannelSize: 10,
+		}))
+		a.NoError(err)
+		return route
+	}
+	publish := func(count int) {
+		for i := 0; i < count; i++ {
+			a.NoError(router.HandleMessage(&protocol.Message{Path: "/jobs", Body: []byte(fmt.Sprintf("job %d", i))}))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	worker1 := subscribe(RouteParams{"application_id": "worker1", GroupParam: "workers"})
+	worker2 := subscribe(RouteParams{"application_id": "worker2", GroupParam: "workers"})
+	other := subscribe(RouteParams{"application_id": "other", GroupParam: "others"})
+	monitor := subscribe(RouteParams{"application_id": "monitor"})
+
+	// every message is delivered to one member of each group, and to the routes without group
+	publish(4)
+	a.Equal(2, len(worker1.MessagesChannel()))
+	a.Equal(2, len(worker2.MessagesChannel()))
+	a.Equal(4, len(other.MessagesChannel()))
+	a.Equal(4, len(monitor.MessagesChannel()))
+
+	// the least loaded member receives the messages
+	<-worker1.MessagesChannel()
+	<-worker1.MessagesChannel()
+	publish(2)
+	a.Equal(2, len(worker1.MessagesChannel()))
+	a.Equal(2, len(worker2.MessagesChannel()))
+
+	// the messages are delivered to the remaining members, when a member is invalid
+	worker1.setInvalid(true)
+	publish(2)
+	a.Equal(4, len(worker2.MessagesChannel()))
+
+	// the members whose filters do not match the message are skipped
+	filtered := subscribe(RouteParams{"application_id": "worker3", GroupParam: "workers", SubscriberFilterPrefix + "priority": ">5"})
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/jobs"}))
+	time.Sleep(20 * time.Millisecond)
+	a.Equal(0, len(filtered.MessagesChannel()))
+	a.Equal(5, len(worker2.MessagesChannel()))
+
+	router.Unsubscribe(worker2)
+	router.Unsubscribe(filtered)
+	router.Unsubscribe(other)
+	a.Empty(router.groupTurns)
+}
+
+func TestRouter_ConsumerGroupInCluster(t *testing.T) {
+	a := assert.New(t)
+	router, _, _ := aStartedRouter()
+	defer router.Stop()
+
+	// the nodes of a cluster would each deliver the messages to a member of the group
+	router.cluster = &cluster.Cluster{Config: &cluster.Config{ID: 1}}
+	defer func() { router.cluster = nil }()
+
+	_, err := router.Subscribe(NewRoute(RouteConfig{
+		RouteParams: RouteParams{"application_id": "worker1", GroupParam: "workers"},
+		Path:        "/jobs",
+		ChannelSize: 10,
+	}))
+	a.Equal(ErrGroupInCluster, err)
+
+	_, err = router.Subscribe(NewRoute(RouteConfig{
+		RouteParams: RouteParams{"application_id": "monitor"},
+		Path:        "/jobs",
+		ChannelSize: 10,
+	}))
+	a.NoError(err)
+}
@@ -0,0 +1,114 @@
+package router
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/cosminrentea/gobbler/protocol"
+)
+
+const idempotencySchema = "idempotency_keys"
+
+// IdempotencyWindow is the duration for which the idempotency keys of the published messages are remembered.
+// A message published again with the same key on the same topic during this window is dropped.
+// If not positive, the idempotency keys are ignored.
+var IdempotencyWindow = 10 * time.Minute
+
+// idempotencyEntry is stored in the KVStore for each idempotency key
+type idempotencyEntry struct {
+	ID   uint64 `json:"id"`
+	Time int64  `json:"time"`
+}
+
+func (e *idempotencyEntry) expired(now time.Time) bool {
+	return now.Sub(time.Unix(0, e.Time)) > IdempotencyWindow
+}
+
+// idempotency serializes the publishing of the messages having idempotency keys, and cleans up the expired keys
+type idempotency struct {
+	mu          sync.Mutex
+	lastCleanup time.Time
+	cleaning    bool
+}
+
+// the keys are scoped by topic, since the message IDs are generated per partition
+func idempotencyKVKey(message *protocol.Message, key string) string {
+	return string(message.Path) + " " + key
+}
+
+// handleIdempotentMessage stores and routes the message only if its idempotency key was not seen during the window.
+// Otherwise, the ID of the message is set to the ID of the original message and ErrDuplicateMessage is returned.
+func (router *router) handleIdempotentMessage(message *protocol.Message, key string, nodeID uint8) error {
+	kvKey := idempotencyKVKey(message, key)
+
+	router.idempotency.mu.Lock()
+	defer router.idempotency.mu.Unlock()
+
+	now := time.Now()
+	data, exists, err := router.kvStore.Get(idempotencySchema, kvKey)
+	if err != nil {
+		logger.WithError(err).WithField("key", kvKey).Error("Error reading idempotency key")
+		return err
+	}
+	if exists {
+		var entry idempotencyEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			logger.WithError(err).WithField("key", kvKey).Error("Error decoding idempotency key")
+		} else if !entry.expired(now) {
+			logger.WithField("key", kvKey).WithField("messageID", entry.ID).Info("Dropping duplicate message")
+			mTotalDuplicateMessages.Add(1)
+			pDuplicateMessages.Inc()
+			message.ID = entry.ID
+			return ErrDuplicateMessage
+		}
+	}
+
+	if err := router.storeAndRoute(message, nodeID); err != nil {
+		return err
+	}
+
+	data, err = json.Marshal(&idempotencyEntry{ID: message.ID, Time: now.UnixNano()})
+	if err != nil {
+		return err
+	}
+	if err := router.kvStore.Put(idempotencySchema, kvKey, data); err != nil {
+		// the message was already routed, so this is not reported to the publisher
+		logger.WithError(err).WithField("key", kvKey).Error("Error storing idempotency key")
+	}
+
+	router.cleanupIdempotencyKeys(now)
+	return nil
+}
+
+// cleanupIdempotencyKeys removes the expired keys from the KVStore in background, at most once per window.
+// It is called while holding the idempotency lock.
+func (router *router) cleanupIdempotencyKeys(now time.Time) {
+	if router.idempotency.cleaning || now.Sub(router.idempotency.lastCleanup) < IdempotencyWindow {
+		return
+	}
+	router.idempotency.cleaning = true
+	router.idempotency.lastCleanup = now
+
+	go func() {
+		defer func() {
+			router.idempotency.mu.Lock()
+			router.idempotency.cleaning = false
+			router.idempotency.mu.Unlock()
+		}()
+
+		var expired []string
+		for kv := range router.kvStore.Iterate(idempotencySchema, "") {
+			var entry idempotencyEntry
+			if err := json.Unmarshal([]byte(kv[1]), &entry); err != nil || entry.expired(now) {
+				expired = append(expired, kv[0])
+			}
+		}
+		for _, key := range expired {
+			if err := router.kvStore.Delete(idempotencySchema, key); err != nil {
+				logger.WithError(err).WithField("key", key).Error("Error deleting expired idempotency key")
+			}
+		}
+		logger.WithField("count", len(expired)).Debug("Deleted expired idempotency keys")
+	}()
+}
@@ -0,0 +1,95 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func idempotentMessage(path protocol.Path, key string) *protocol.Message {
+	return &protocol.Message{
+		Path:       path,
+		Body:       aTestByteMessage,
+		HeaderJSON: `{"Correlation-Id": "7sdks723ksgqn", "Idempotency-Key": "` + key + `"}`,
+	}
+}
+
+func TestRouter_HandleMessage_IdempotencyKey(t *testing.T) {
+	a := assert.New(t)
+
+	router, r := aRouterRoute(chanSize)
+
+	first := idempotentMessage(r.Path, "key1")
+	a.NoError(router.HandleMessage(first))
+	assertChannelContainsMessage(a, r.MessagesChannel(), aTestByteMessage)
+
+	// a retry is dropped and gets the ID of the original message
+	retry := idempotentMessage(r.Path, "key1")
+	a.Equal(ErrDuplicateMessage, router.HandleMessage(retry))
+	a.Equal(first.ID, retry.ID)
+
+	// other keys, and the same key on other topics are published
+	other := idempotentMessage(r.Path, "key2")
+	a.NoError(router.HandleMessage(other))
+	a.NotEqual(first.ID, other.ID)
+	assertChannelContainsMessage(a, r.MessagesChannel(), aTestByteMessage)
+	a.NoError(router.HandleMessage(idempotentMessage(r.Path+"/sub", "key1")))
+	assertChannelContainsMessage(a, r.MessagesChannel(), aTestByteMessage)
+
+	time.Sleep(10 * time.Millisecond)
+	a.Equal(0, len(r.MessagesChannel()))
+
+	// the key is kept in the kvstore
+	kvs, err := router.KVStore()
+	a.NoError(err)
+	_, exists, err := kvs.Get(idempotencySchema, string(r.Path)+" key1")
+	a.NoError(err)
+	a.True(exists)
+}
+
+func TestRouter_HandleMessage_IdempotencyKeyExpired(t *testing.T) {
+	a := assert.New(t)
+
+	defer func(window time.Duration) { IdempotencyWindow = window }(IdempotencyWindow)
+	IdempotencyWindow = 20 * time.Millisecond
+
+	router, r := aRouterRoute(chanSize)
+
+	first := idempotentMessage(r.Path, "key1")
+	a.NoError(router.HandleMessage(first))
+	assertChannelContainsMessage(a, r.MessagesChannel(), aTestByteMessage)
+
+	time.Sleep(30 * time.Millisecond)
+	retry := idempotentMessage(r.Path, "key1")
+	a.NoError(router.HandleMessage(retry))
+	a.NotEqual(first.ID, retry.ID)
+	assertChannelContainsMessage(a, r.MessagesChannel(), aTestByteMessage)
+
+	// the expired keys are deleted in background
+	router.HandleMessage(idempotentMessage(r.Path, "key2"))
+	time.Sleep(30 * time.Millisecond)
+	router.HandleMessage(idempotentMessage(r.Path, "key3"))
+	time.Sleep(10 * time.Millisecond)
+
+	kvs, err := router.KVStore()
+	a.NoError(err)
+	_, exists, err := kvs.Get(idempotencySchema, string(r.Path)+" key2")
+	a.NoError(err)
+	a.False(exists)
+}
+
+func TestRouter_HandleMessage_IdempotencyDisabled(t *testing.T) {
+	a := assert.New(t)
+
+	defer func(window time.Duration) { IdempotencyWindow = window }(IdempotencyWindow)
+	IdempotencyWindow = 0
+
+	router, r := aRouterRoute(chanSize)
+
+	a.NoError(router.HandleMessage(idempotentMessage(r.Path, "key1")))
+	a.NoError(router.HandleMessage(idempotentMessage(r.Path, "key1")))
+	assertChannelContainsMessage(a, r.MessagesChannel(), aTestByteMessage)
+	assertChannelContainsMessage(a, r.MessagesChannel(), aTestByteMessage)
+}
@@ -0,0 +1,176 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/cosminrentea/gobbler/protocol"
+)
+
+// Interceptor is called by the router for each message published locally, before it is stored.
+// It can enrich, transform or validate the message, and reject it by returning an error (preferably a *RejectedError).
+type Interceptor interface {
+	InterceptMessage(message *protocol.Message) error
+}
+
+// DeliveryInterceptor is called by the router before delivering a message to a route.
+// It returns the message to deliver to the route: the message given is shared by all the routes, so it must not be modified,
+// but a modified copy can be returned instead. The delivery to the route is skipped if an error is returned.
+type DeliveryInterceptor interface {
+	InterceptDelivery(route *Route, message *protocol.Message) (*protocol.Message, error)
+}
+
+// InterceptorRegistry is implemented by the routers accepting interceptors.
+// The interceptors are called in the order in which they were added; they should be added at startup.
+// The service adds the modules implementing Interceptor or DeliveryInterceptor, in the start order of the modules.
+type InterceptorRegistry interface {
+	AddInterceptor(interceptor Interceptor)
+	AddDeliveryInterceptor(interceptor DeliveryInterceptor)
+}
+
+// FetchInterceptor is implemented by the routers calling delivery interceptors, so that the messages fetched from the store
+// for a route (e.g. by its FetchRequest) pass through the same interceptors as the messages routed to it.
+// The routers wrapping another router implement it by passing the messages to the wrapped router.
+type FetchInterceptor interface {
+	InterceptFetched(route *Route, message *protocol.Message) *protocol.Message
+}
+
+// InterceptFetched returns the fetched message to deliver to the route after the delivery interceptors of the router,
+// or nil if the delivery was rejected. The message is returned unchanged if the router is not a FetchInterceptor.
+func InterceptFetched(r Router, route *Route, message *protocol.Message) *protocol.Message {
+	if interceptor, ok := r.(FetchInterceptor); ok {
+		return interceptor.InterceptFetched(route, message)
+	}
+	return message
+}
+
+// Validator is implemented by the routers which can check a message without handling it,
+// so that the messages handled later (e.g. the scheduled ones) are rejected when they are published.
+// The routers wrapping another router implement it by adding their own checks to the ones of the wrapped router.
+type Validator interface {
+	ValidateMessage(message *protocol.Message) error
+}
+
+// ValidateMessage returns the error with which the router would reject the message published locally,
+// or nil if the router is not a Validator.
+func ValidateMessage(r Router, message *protocol.Message) error {
+	if validator, ok := r.(Validator); ok {
+		return validator.ValidateMessage(message)
+	}
+	return nil
+}
+
+// RejectedError is returned by an Interceptor rejecting a message, with the reason given to the publisher.
+// The REST API responds with its StatusCode (400 Bad Request, if not set).
+type RejectedError struct {
+	Reason     string
+	StatusCode int
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("Message rejected: %s", e.Reason)
+}
+
+// HTTPStatus returns the status of the response to a message rejected by an interceptor
+func (e *RejectedError) HTTPStatus() int {
+	if e.StatusCode == 0 {
+		return http.StatusBadRequest
+	}
+	return e.StatusCode
+}
+
+// interceptors are the ordered interceptors of the router
+type interceptors struct {
+	mu       sync.RWMutex
+	messages []Interceptor
+	delivery []DeliveryInterceptor
+}
+
+// AddInterceptor adds an interceptor of the messages published locally, called after the interceptors already added
+func (router *router) AddInterceptor(interceptor Interceptor) {
+	router.interceptors.mu.Lock()
+	defer router.interceptors.mu.Unlock()
+	router.interceptors.messages = append(router.interceptors.messages, interceptor)
+}
+
+// AddDeliveryInterceptor adds an interceptor of the deliveries to the routes, called after the interceptors already added
+func (router *router) AddDeliveryInterceptor(interceptor DeliveryInterceptor) {
+	router.interceptors.mu.Lock()
+	defer router.interceptors.mu.Unlock()
+	router.interceptors.delivery = append(router.interceptors.delivery, interceptor)
+}
+
+// ValidateMessage returns ErrWildcardTopic or the rejection of an interceptor, for a message published locally.
+// The interceptors are called with a copy of the message, which is not modified.
+// It is a part of the Validator implementation.
+func (router *router) ValidateMessage(message *protocol.Message) error {
+	if message.Path.IsWildcard() {
+		return ErrWildcardTopic
+	}
+	copied, err := protocol.ParseMessage(message.Encode())
+	if err != nil {
+		return err
+	}
+	return router.interceptMessage(copied)
+}
+
+// InterceptFetched returns the message fetched for the route after the delivery interceptors,
+// or nil if the delivery to the route was rejected.
+// It is a part of the FetchInterceptor implementation.
+func (router *router) InterceptFetched(route *Route, message *protocol.Message) *protocol.Message {
+	return router.interceptDelivery(route, message)
+}
+
+// interceptMessage calls the interceptors in order, stopping at the first one rejecting the message
+func (router *router) interceptMessage(message *protocol.Message) error {
+	router.interceptors.mu.RLock()
+	defer router.interceptors.mu.RUnlock()
+
+	for _, interceptor := range router.interceptors.messages {
+		if err := interceptor.InterceptMessage(message); err != nil {
+			logger.WithError(err).WithFields(log.Fields{
+				"path":   message.Path,
+				"userID": message.UserID,
+			}).Info("Message rejected by interceptor")
+			mTotalRejectedMessages.Add(1)
+			pRejectedMessages.Inc()
+			return err
+		}
+	}
+	return nil
+}
+
+// interceptDelivery returns the message to deliver to the route after the delivery interceptors,
+// or nil if the delivery to the route was rejected
+func (router *router) interceptDelivery(route *Route, message *protocol.Message) *protocol.Message {
+	router.interceptors.mu.RLock()
+	defer router.interceptors.mu.RUnlock()
+
+	for _, interceptor := range router.interceptors.delivery {
+		var err error
+		if message, err = interceptor.InterceptDelivery(route, message); err != nil || message == nil {
+			logger.WithError(err).WithField("route", route).Debug("Delivery rejected by interceptor")
+			mTotalRejectedDeliveries.Add(1)
+			pRejectedDeliveries.Inc()
+			return nil
+		}
+	}
+	return message
+}
+
+// MaxBodySize is an Interceptor rejecting the messages having a body larger than its value, in bytes.
+type MaxBodySize int
+
+// InterceptMessage rejects the message if its body is too large
+func (max MaxBodySize) InterceptMessage(message *protocol.Message) error {
+	if len(message.Body) > int(max) {
+		return &RejectedError{
+			Reason:     fmt.Sprintf("the body has %d bytes, more than the maximum of %d", len(message.Body), int(max)),
+			StatusCode: http.StatusRequestEntityTooLarge,
+		}
+	}
+	return nil
+}
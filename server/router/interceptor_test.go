@@ -0,0 +1,174 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/store"
+	"github.com/cosminrentea/gobbler/testutil"
+)
+
+// interceptorFunc is an Interceptor calling a func
+type interceptorFunc func(message *protocol.Message) error
+
+func (f interceptorFunc) InterceptMessage(message *protocol.Message) error {
+	return f(message)
+}
+
+// deliveryInterceptorFunc is a DeliveryInterceptor calling a func
+type deliveryInterceptorFunc func(route *Route, message *protocol.Message) (*protocol.Message, error)
+
+func (f deliveryInterceptorFunc) InterceptDelivery(route *Route, message *protocol.Message) (*protocol.Message, error) {
+	return f(route, message)
+}
+
+func TestRouter_Interceptors(t *testing.T) {
+	a := assert.New(t)
+	router, _, _ := aStartedRouter()
+	defer router.Stop()
+
+	route, err := router.Subscribe(NewRoute(RouteConfig{
+		RouteParams: RouteParams{"application_id": "appid01", "user_id": "user01"},
+		Path:        "/blah",
+		ChannelSize: chanSize,
+	}))
+	a.NoError(err)
+
+	// the interceptors are called in order
+	var calls []string
+	router.AddInterceptor(interceptorFunc(func(message *protocol.Message) error {
+		calls = append(calls, "tenant")
+		message.HeaderJSON = `{"Tenant":"acme"}`
+		return nil
+	}))
+	router.AddInterceptor(MaxBodySize(5))
+	router.AddInterceptor(interceptorFunc(func(message *protocol.Message) error {
+		calls = append(calls, "after")
+		return nil
+	}))
+
+	message := &protocol.Message{Path: "/blah", Body: []byte("hello")}
+	a.NoError(router.HandleMessage(message))
+	a.Equal([]string{"tenant", "after"}, calls)
+	select {
+	case received := <-route.MessagesChannel():
+		a.Equal(`{"Tenant":"acme"}`, received.HeaderJSON)
+	case <-time.After(time.Second):
+		a.FailNow("message not delivered")
+	}
+
+	// a rejected message is not stored, and the next interceptors are not called
+	message = &protocol.Message{Path: "/blah", Body: []byte("too large")}
+	err = router.HandleMessage(message)
+	if rejected, ok := err.(*RejectedError); a.True(ok) {
+		a.Equal(http.StatusRequestEntityTooLarge, rejected.HTTPStatus())
+	}
+	a.Equal(uint64(0), message.ID)
+	a.Equal([]string{"tenant", "after", "tenant"}, calls)
+
+	// the messages received from other nodes are not intercepted again
+	a.NoError(router.HandleMessage(&protocol.Message{ID: 100, NodeID: 2, Path: "/blah", Body: []byte("too large")}))
+	a.Len(calls, 3)
+
+	// the validation calls the interceptors with a copy of the message
+	message = &protocol.Message{Path: "/blah", Body: []byte("hello")}
+	a.NoError(router.ValidateMessage(message))
+	a.Equal("", message.HeaderJSON)
+	_, ok := router.ValidateMessage(&protocol.Message{Path: "/blah", Body: []byte("too large")}).(*RejectedError)
+	a.True(ok)
+	a.Equal(ErrWildcardTopic, router.ValidateMessage(&protocol.Message{Path: "/blah/+", Body: []byte("hello")}))
+	a.Equal(uint64(0), message.ID)
+}
+
+func TestRouter_DeliveryInterceptors(t *testing.T) {
+	a := assert.New(t)
+	router, _, _ := aStartedRouter()
+	defer router.Stop()
+
+	subscribe := func(userID string, params RouteParams) *Route {
+		params["application_id"] = "app"
+		params["user_id"] = userID
+		route, err := router.Subscribe(NewRoute(RouteConfig{RouteParams: params, Path: "/blah", ChannelSize: chanSize}))
+		a.NoError(err)
+		return route
+	}
+	marvin := subscribe("marvin", RouteParams{})
+	arthur := subscribe("arthur", RouteParams{})
+	worker1 := subscribe("worker1", RouteParams{GroupParam: "workers"})
+	worker2 := subscribe("worker2", RouteParams{GroupParam: "workers"})
+
+	// the deliveries to marvin and worker1 are rejected, and arthur receives a modified copy
+	router.AddDeliveryInterceptor(deliveryInterceptorFunc(func(route *Route, message *protocol.Message) (*protocol.Message, error) {
+		switch route.Get("user_id") {
+		case "marvin", "worker1":
+			return nil, errors.New("rejected")
+		case "arthur":
+			stripped := *message
+			stripped.Body = []byte("***")
+			return &stripped, nil
+		}
+		return message, nil
+	}))
+
+	for i := 0; i < 2; i++ {
+		a.NoError(router.HandleMessage(&protocol.Message{Path: "/blah", Body: []byte("secret")}))
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	a.Equal(0, len(marvin.MessagesChannel()))
+	a.Equal(0, len(worker1.MessagesChannel()))
+	a.Equal(2, len(worker2.MessagesChannel()))
+	if a.Equal(2, len(arthur.MessagesChannel())) {
+		a.Equal("***", string((<-arthur.MessagesChannel()).Body))
+	}
+	a.Equal("secret", string((<-worker2.MessagesChannel()).Body))
+}
+
+func TestRouter_DeliveryInterceptorsOnFetch(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	msMock := NewMockMessageStore(ctrl)
+	router := New(msMock, kvstore.NewMemoryKVStore(), nil).(*router)
+	router.Start()
+	defer router.Stop()
+
+	router.AddDeliveryInterceptor(deliveryInterceptorFunc(func(route *Route, message *protocol.Message) (*protocol.Message, error) {
+		if string(message.Body) == "rejected" {
+			return nil, errors.New("rejected")
+		}
+		stripped := *message
+		stripped.Body = []byte("***")
+		return &stripped, nil
+	}))
+
+	msMock.EXPECT().MaxMessageID("blah").Return(uint64(2), nil).AnyTimes()
+	msMock.EXPECT().Fetch(gomock.Any()).Do(func(req *store.FetchRequest) {
+		go func() {
+			req.StartC <- 2
+			req.Push(1, (&protocol.Message{ID: 1, Path: "/blah", Body: []byte("secret")}).Encode())
+			req.Push(2, (&protocol.Message{ID: 2, Path: "/blah", Body: []byte("rejected")}).Encode())
+			req.Done()
+		}()
+	})
+
+	// the fetched messages pass through the delivery interceptors too
+	route := NewRoute(RouteConfig{
+		RouteParams:  RouteParams{"application_id": "app", "user_id": "marvin"},
+		Path:         "/blah",
+		ChannelSize:  chanSize,
+		FetchRequest: store.NewFetchRequest("", 0, 0, store.DirectionForward, -1),
+	})
+	a.NoError(route.Provide(router, false))
+	if a.Equal(1, len(route.MessagesChannel())) {
+		a.Equal("***", string((<-route.MessagesChannel()).Body))
+	}
+}
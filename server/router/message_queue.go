@@ -44,6 +44,21 @@ func (q *queue) remove() {
 	q.queue = q.queue[1:]
 }
 
+// dropOldest removes the oldest item from the queue, or the second oldest one if keepFirst is true
+func (q *queue) dropOldest(keepFirst bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := 0
+	if keepFirst {
+		i = 1
+	}
+	if len(q.queue) <= i {
+		return
+	}
+	q.queue = append(q.queue[:i], q.queue[i+1:]...)
+}
+
 // poll returns the first item from the queue without removing it
 func (q *queue) poll() (*protocol.Message, error) {
 	q.mu.Lock()
@@ -14,29 +14,50 @@ import (
 )
 
 var (
-	errEmptyQueue = errors.New("Empty queue")
-	errTimeout    = errors.New("Channel sending timeout")
+	errEmptyQueue     = errors.New("Empty queue")
+	errTimeout        = errors.New("Channel sending timeout")
+	errUnreadMessages = errors.New("Unread messages available")
 
 	ErrMissingFetchRequest = errors.New("Missing FetchRequest configuration.")
 )
 
 // Route represents a topic for subscription that has a channel to receive messages.
 type Route struct {
+	// counters of the messages sent in the channel, and dropped by the backpressure policy;
+	// they are accessed atomically, so they are kept first for 64-bit alignment
+	delivered uint64
+	dropped   uint64
+
 	RouteConfig
 
 	messagesC chan *protocol.Message
 
 	// queue that will store the messages in correct order.
 	// The queue can have a settable size;
-	// if it reaches the capacity the route is closed.
+	// if it reaches the capacity the backpressure policy is applied.
 	queue *queue
 
 	closeC chan struct{}
 
+	// messages held by the block backpressure policy, until there is room for them
+	blocked []blockedMessage
+
+	// filters of the subscriber, compiled from the route params
+	filters map[string]FilterExpr
+
 	// Indicates if the consumer go routine is running
 	consuming bool
 	invalid   bool
-	mu        sync.RWMutex
+
+	// the router in which the route is subscribed, used to refetch spilled messages
+	router Router
+
+	// Indicates if messages are spilled to the store, starting with spillFromID
+	spilling    bool
+	spillFromID uint64
+	refetchedID uint64
+
+	mu sync.RWMutex
 
 	logger *log.Entry
 }
@@ -49,6 +70,7 @@ func NewRoute(config RouteConfig) *Route {
 		queue:     newQueue(config.QueueSize),
 		messagesC: make(chan *protocol.Message, config.ChannelSize),
 		closeC:    make(chan struct{}),
+		filters:   compileSubscriberFilters(config.RouteParams),
 
 		logger: logger.WithFields(log.Fields{"path": config.Path, "params": config.RouteParams}),
 	}
@@ -90,17 +112,30 @@ func (r *Route) Deliver(msg *protocol.Message, isFromStore bool) error {
 		pNotMatchedByFilters.Inc()
 		return nil
 	}
+	if !isFromStore && r.Backpressure == BackpressureSpill {
+		if r.isSpilling() {
+			// the message will be refetched from the store, after the spilled ones
+			r.spill(msg)
+			return nil
+		}
+		if r.isRefetched(msg) {
+			loggerMessage.Debug("Message already sent by refetching")
+			return nil
+		}
+	}
+
+	// the new messages wait behind the blocked ones, to keep their order
+	if !isFromStore && r.Backpressure == BackpressureBlock && r.hasBlocked() {
+		return r.block(msg)
+	}
+
 	// not an infinite queue
 	if r.QueueSize >= 0 {
 		// if size is zero the sending is direct
 		if r.QueueSize == 0 {
 			return r.sendDirect(msg, isFromStore)
 		} else if r.queue.size() >= r.QueueSize {
-			loggerMessage.Error("Closing route because queue is full")
-			r.Close()
-			mTotalDeliverMessageErrors.Add(1)
-			pDeliverMessageErrors.Inc()
-			return ErrQueueFull
+			return r.deliverFull(msg)
 		}
 	}
 
@@ -111,6 +146,12 @@ func (r *Route) Deliver(msg *protocol.Message, isFromStore bool) error {
 	return nil
 }
 
+// messageFilter returns true if the route matches message filters,
+// and the message matches the subscriber filters compiled when the route was created
+func (r *Route) messageFilter(m *protocol.Message) bool {
+	return matchFilters(r.RouteParams, r.filters, m.Filters)
+}
+
 // MessagesChannel returns the route channel to send or receive messages.
 func (r *Route) MessagesChannel() <-chan *protocol.Message {
 	return r.messagesC
@@ -139,12 +180,42 @@ func (r *Route) handleFetch(router Router) error {
 		return ErrInvalidRoute
 	}
 
-	r.FetchRequest.Partition = r.Path.Partition()
+	return r.fetch(router, r.FetchRequest, func(message *protocol.Message) error {
+		if message = InterceptFetched(router, r, message); message == nil {
+			return nil
+		}
+		return r.Deliver(message, true)
+	})
+}
+
+// fetch passes the messages fetched from the store to the deliver function.
+// If the partition level of the route path is a wildcard, all partitions are fetched
+// using the same fetch parameters; otherwise the partition of the request is overridden.
+func (r *Route) fetch(router Router, fr *store.FetchRequest, deliver func(*protocol.Message) error) error {
 	ms, err := router.MessageStore()
 	if err != nil {
 		return err
 	}
 
+	if !r.Path.HasWildcardPartition() {
+		fr.Partition = r.Path.Partition()
+		return r.fetchPartition(router, ms, fr, deliver)
+	}
+
+	partitions, err := ms.Partitions()
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		pfr := store.NewFetchRequest(partition.Name(), fr.StartID, fr.EndID, fr.Direction, fr.Count)
+		if err := r.fetchPartition(router, ms, pfr, deliver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Route) fetchPartition(router Router, ms store.MessageStore, fr *store.FetchRequest, deliver func(*protocol.Message) error) error {
 	var (
 		lastID   uint64
 		received int
@@ -152,30 +223,30 @@ func (r *Route) handleFetch(router Router) error {
 
 REFETCH:
 	// check if we need to continue fetching
-	maxID, err := ms.MaxMessageID(r.FetchRequest.Partition)
+	maxID, err := ms.MaxMessageID(fr.Partition)
 	if err != nil {
 		return err
 	}
 
-	if r.FetchRequest.StartID > maxID && r.FetchRequest.Direction == store.DirectionForward {
+	if fr.StartID > maxID && fr.Direction == store.DirectionForward {
 		return nil
 	}
 
-	if received >= r.FetchRequest.Count || lastID >= maxID ||
-		(r.FetchRequest.EndID > 0 && r.FetchRequest.EndID <= lastID) {
+	if received >= fr.Count || lastID >= maxID ||
+		(fr.EndID > 0 && fr.EndID <= lastID) {
 		return nil
 	}
-	r.FetchRequest.Init()
+	fr.Init()
 
-	if err := router.Fetch(r.FetchRequest); err != nil {
+	if err := router.Fetch(fr); err != nil {
 		return err
 	}
-	count := r.FetchRequest.Ready()
+	count := fr.Ready()
 	r.logger.WithField("count", count).Debug("Receiving messages")
 
 	for {
 		select {
-		case fetchedMessage, open := <-r.FetchRequest.Messages():
+		case fetchedMessage, open := <-fr.Messages():
 			if !open {
 				r.logger.Debug("Fetch channel closed.")
 				goto REFETCH
@@ -187,15 +258,27 @@ REFETCH:
 				log.WithError(err).Error("Parsing Message failed.")
 				return err
 			}
+			lastID = message.ID
+
+			// the partition of a wildcard route may contain topics not matched by the route
+			if r.Path.IsWildcard() && !r.Path.Matches(message.Path) {
+				continue
+			}
+
+			if message.IsExpired() {
+				r.logger.WithField("messageID", message.ID).Debug("Skipping expired fetched message")
+				mTotalExpiredMessages.Add(1)
+				pExpiredMessages.Inc()
+				continue
+			}
 
 			r.logger.WithField("messageID", message.ID).Debug("Sending fetched message in channel")
-			if err := r.Deliver(message, true); err != nil {
+			if err := deliver(message); err != nil {
 				log.WithError(err).Error("Deliver Message failed.")
 				return err
 			}
-			lastID = message.ID
 			received++
-		case err := <-r.FetchRequest.Errors():
+		case err := <-fr.Errors():
 			return err
 		case <-router.Done():
 			r.logger.Debug("Stopping fetch because the router is shutting down")
@@ -227,6 +310,13 @@ func (r *Route) Close() error {
 	return ErrInvalidRoute
 }
 
+// load returns the number of messages waiting to be consumed from the route
+func (r *Route) load() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.queue.size() + len(r.blocked) + len(r.messagesC)
+}
+
 // Equal will check if the route path is matched and all the parameters or just a
 // subset of specific parameters between the routes
 func (r *Route) Equal(other *Route, keys ...string) bool {
@@ -258,6 +348,12 @@ func (r *Route) setConsuming(consuming bool) {
 	r.consuming = consuming
 }
 
+func (r *Route) setRouter(router Router) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.router = router
+}
+
 // consume starts a goroutine to consume the queue and pass the messages to route
 // channel. Stops if there are no items in the queue.
 func (r *Route) consume() {
@@ -285,10 +381,25 @@ func (r *Route) consume() {
 				return
 			}
 
+			r.unblock()
 			msg, err = r.queue.poll()
 
 			if err != nil {
 				if err == errEmptyQueue {
+					if r.hasBlocked() {
+						// the route has no queue
+						if err := r.sendBlocked(); err != nil {
+							return
+						}
+						continue
+					}
+					if r.isSpilling() {
+						if err := r.refetchSpilled(); err != nil {
+							r.logger.WithError(err).Error("Error refetching spilled messages")
+							return
+						}
+						continue
+					}
 					r.logger.Debug("Empty queue")
 					return
 				}
@@ -296,7 +407,11 @@ func (r *Route) consume() {
 				continue
 			}
 
-			if err = r.send(msg); err != nil {
+			if msg.IsExpired() {
+				r.logger.WithField("message", msg).Debug("Dropping expired message from queue")
+				mTotalExpiredMessages.Add(1)
+				pExpiredMessages.Inc()
+			} else if err = r.send(msg); err != nil {
 				r.logger.WithFields(log.Fields{
 					"message": msg,
 					"error":   err.Error(),
@@ -323,12 +438,14 @@ func (r *Route) send(msg *protocol.Message) error {
 	// no timeout, means we don't close the channel
 	if r.Timeout == -1 {
 		r.messagesC <- msg
+		r.countDelivered()
 		r.logger.WithField("size", len(r.messagesC)).Debug("Channel size")
 		return nil
 	}
 
 	select {
 	case r.messagesC <- msg:
+		r.countDelivered()
 		return nil
 	case <-r.closeC:
 		return ErrInvalidRoute
@@ -352,15 +469,15 @@ func (r *Route) invalidRecover() error {
 func (r *Route) sendDirect(msg *protocol.Message, store bool) error {
 	if store {
 		r.messagesC <- msg
+		r.countDelivered()
 		return nil
 	}
 
 	select {
 	case r.messagesC <- msg:
+		r.countDelivered()
 		return nil
 	default:
-		r.logger.Debug("Closing route because of full channel")
-		r.Close()
-		return ErrChannelFull
+		return r.sendDirectFull(msg)
 	}
 }
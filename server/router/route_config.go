@@ -19,20 +19,33 @@ type RouteConfig struct {
 	ChannelSize int
 
 	// QueueSize specifies the size of the internal queue slice
-	// (how many items to hold before the channel is closed).
+	// (how many items to hold before the backpressure policy is applied).
 	// If set to `0` then the queue will have no capacity and the messages
 	// are directly sent, without buffering.
 	QueueSize int
 
+	// Backpressure defines what happens when the queue is full, or when the channel is full
+	// for routes without queue. By default the route is closed.
+	Backpressure BackpressurePolicy
+
+	// BlockTimeout defines how long to wait for room in a full route with the block policy.
+	// If not set, a default of one second is used; it is limited to MaxBlockTimeout.
+	BlockTimeout time.Duration
+
 	// Timeout defines how long to wait for the message to be read on the channel.
 	// If Timeout is reached the route is closed.
 	Timeout time.Duration
 
+	// Roles are the roles of the authenticated subscriber, used for checking its access to the topic.
+	// They are not part of the route params, thus they are not persisted.
+	Roles []string `json:"-"`
+
 	// Matcher if set will be used to check equality of the routes
 	Matcher Matcher `json:"-"`
 
 	// FetchRequest to fetch messages before subscribing
-	// The Partition field of the FetchRequest is overrided with the Partition of the Route topic
+	// The Partition field of the FetchRequest is overrided with the Partition of the Route topic.
+	// If the partition level of the Path is a wildcard, the messages are fetched from all partitions.
 	FetchRequest *store.FetchRequest `json:"-"`
 }
 
@@ -43,19 +56,11 @@ func (rc *RouteConfig) Equal(other RouteConfig, keys ...string) bool {
 	return rc.Path == other.Path && rc.RouteParams.Equal(other.RouteParams, keys...)
 }
 
-// messageFilter returns true if the route matches message filters
-func (rc *RouteConfig) messageFilter(m *protocol.Message) bool {
-	if m.Filters == nil {
-		return true
-	}
-
-	return rc.Filter(m.Filters)
-}
-
-// Filter returns true if all filters are matched on the route
+// Filter returns true if all filters are matched on the route.
+// The values of the filters are filter expressions (see FilterExpr), matched against the route params.
 func (rc *RouteConfig) Filter(filters map[string]string) bool {
 	for key, value := range filters {
-		if rc.Get(key) != value {
+		if !cachedFilter(value).Match(rc.Get(key)) {
 			return false
 		}
 	}
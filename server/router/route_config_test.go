@@ -201,8 +201,9 @@ func TestRouteConfig_messageFilter(t *testing.T) {
 		},
 	}
 
+	route := NewRoute(routeConfig)
 	for name, c := range testcases {
 		m := &protocol.Message{Filters: c.filters}
-		a.Equal(c.result, routeConfig.messageFilter(m), "Failed filter: "+name)
+		a.Equal(c.result, route.messageFilter(m), "Failed filter: "+name)
 	}
 }
@@ -318,6 +318,71 @@ func TestRoute_Provide_Fetch(t *testing.T) {
 	<-done
 }
 
+type namedPartition struct {
+	store.MessagePartition
+	name string
+}
+
+func (p namedPartition) Name() string {
+	return p.name
+}
+
+func TestRoute_Provide_FetchWildcardPartition(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+	msMock := NewMockMessageStore(ctrl)
+	routerMock := NewMockRouter(ctrl)
+
+	routerMock.EXPECT().MessageStore().Return(msMock, nil)
+	routerMock.EXPECT().Done().Return(make(chan bool)).AnyTimes()
+
+	route := NewRoute(RouteConfig{
+		Path:         protocol.Path("/+/status"),
+		ChannelSize:  5,
+		FetchRequest: store.NewFetchRequest("", 0, 0, store.DirectionForward, -1),
+	})
+
+	msMock.EXPECT().Partitions().Return([]store.MessagePartition{
+		namedPartition{name: "orders"},
+		namedPartition{name: "payments"},
+	}, nil)
+	msMock.EXPECT().MaxMessageID("orders").Return(uint64(2), nil).Times(2)
+	msMock.EXPECT().MaxMessageID("payments").Return(uint64(1), nil).Times(2)
+
+	messages := map[string][]string{
+		"orders":   {"/orders/status", "/orders/other"},
+		"payments": {"/payments/status"},
+	}
+	routerMock.EXPECT().Fetch(gomock.Any()).Do(func(req *store.FetchRequest) {
+		paths, ok := messages[req.Partition]
+		a.True(ok)
+		go func() {
+			req.StartC <- len(paths)
+			for i, path := range paths {
+				data := strings.Replace(dummyMessageBytes, "MESSAGE_ID", strconv.Itoa(i+1), 1)
+				req.Push(uint64(i+1), []byte(strings.Replace(data, "/dummy", path, 1)))
+			}
+			req.Done()
+		}()
+	}).Times(2)
+
+	err := route.Provide(routerMock, false)
+	a.NoError(err)
+
+	// only the messages matching the wildcard path are delivered, from both partitions
+	for _, expected := range []protocol.Path{"/orders/status", "/payments/status"} {
+		select {
+		case m := <-route.MessagesChannel():
+			a.Equal(expected, m.Path)
+		case <-time.After(50 * time.Millisecond):
+			a.Fail("Message not received")
+		}
+	}
+	a.Equal(0, len(route.MessagesChannel()))
+}
+
 func TestRoute_Provide_WithSubscribe(t *testing.T) {
 	ctrl, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -5,14 +5,13 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/distribution/health"
 
 	"encoding/json"
 
-	"net/http"
-
 	"github.com/cosminrentea/gobbler/protocol"
 	"github.com/cosminrentea/gobbler/server/cluster"
 	"github.com/cosminrentea/gobbler/server/kvstore"
@@ -42,6 +41,28 @@ type Router interface {
 	Done() <-chan bool
 }
 
+// AccessChecker is implemented by the routers enforcing access control lists on the topics,
+// allowing the modules to check the access of a user before a Subscribe or a Fetch.
+type AccessChecker interface {
+	CanPublish(userID string, roles []string, path protocol.Path) bool
+	CanSubscribe(userID string, roles []string, path protocol.Path) bool
+}
+
+// SystemPublisher is implemented by the routers enforcing access control lists on the topics,
+// allowing the server to publish its own messages (e.g. the dead letters of the connectors) without the checks of the publishers.
+type SystemPublisher interface {
+	HandleSystemMessage(message *protocol.Message) error
+}
+
+// HandleSystemMessage publishes a message created by the server, bypassing the access control lists of the router
+// if it is a SystemPublisher.
+func HandleSystemMessage(r Router, message *protocol.Message) error {
+	if publisher, ok := r.(SystemPublisher); ok {
+		return publisher.HandleSystemMessage(message)
+	}
+	return r.HandleMessage(message)
+}
+
 // Helper struct to pass `Route` to subscription channel and provide a notification channel.
 type subRequest struct {
 	route *Route
@@ -49,34 +70,48 @@ type subRequest struct {
 }
 
 type router struct {
-	routes       map[protocol.Path][]*Route // mapping the path to the route slice
+	routes       *topicTrie // index of the route slices by the segments of their path
 	handleC      chan *protocol.Message
 	subscribeC   chan subRequest
 	unsubscribeC chan subRequest
-	stopC        chan bool      // Channel that signals stop of the router
-	stopping     bool           // Flag: the router is in stopping process and no incoming messages are accepted
-	wg           sync.WaitGroup // Add any operation that we need to wait upon here
+	routesC      chan chan []*Route // Channel of the requests for a snapshot of the routes, used by the admin API
+	stopC        chan bool          // Channel that signals stop of the router
+	stopping     bool               // Flag: the router is in stopping process and no incoming messages are accepted
+	wg           sync.WaitGroup     // Add any operation that we need to wait upon here
 
 	messageStore store.MessageStore
 	kvStore      kvstore.KVStore
 	cluster      *cluster.Cluster
 
+	idempotency idempotency
+
+	// the round-robin positions of the consumer groups; they are used only by the router loop
+	groupTurns map[groupKey]int
+
+	interceptors interceptors
+
+	// the publish rates of the topics, for their statistics
+	topicRates topicRates
+
 	sync.RWMutex
 }
 
 // New returns a pointer to Router
 func New(messageStore store.MessageStore, kvStore kvstore.KVStore, cluster *cluster.Cluster) Router {
 	return &router{
-		routes: make(map[protocol.Path][]*Route),
+		routes: newTopicTrie(),
 
 		handleC:      make(chan *protocol.Message, handleChannelCapacity),
 		subscribeC:   make(chan subRequest, subscribeChannelCapacity),
 		unsubscribeC: make(chan subRequest, unsubscribeChannelCapacity),
+		routesC:      make(chan chan []*Route),
 		stopC:        make(chan bool, 1),
 
 		messageStore: messageStore,
 		kvStore:      kvStore,
 		cluster:      cluster,
+
+		groupTurns: make(map[groupKey]int),
 	}
 }
 
@@ -109,6 +144,8 @@ func (router *router) Start() error {
 				case unsubscriber := <-router.unsubscribeC:
 					router.unsubscribe(unsubscriber.route)
 					unsubscriber.doneC <- true
+				case resultC := <-router.routesC:
+					resultC <- router.allRoutes()
 				case <-router.Done():
 					router.setStopping(true)
 				}
@@ -152,6 +189,10 @@ func (router *router) Check() error {
 
 // HandleMessage stores the message in the MessageStore(and gets a new ID for it if the message was created locally)
 // and then passes it to the internal channel, and asynchronously to the cluster (if available).
+// A locally created message without an expiration time gets the default TTL of its topic, if configured.
+// A locally created message is passed to the interceptors before being stored, and a rejection is returned.
+// If a locally created message has an idempotency key which was already seen, ErrDuplicateMessage is returned
+// and the ID of the message is set to the ID of the original message.
 func (router *router) HandleMessage(message *protocol.Message) error {
 	logger.WithFields(log.Fields{
 		"userID":         message.UserID,
@@ -166,11 +207,30 @@ func (router *router) HandleMessage(message *protocol.Message) error {
 		return err
 	}
 
+	if message.Path.IsWildcard() {
+		logger.WithField("path", message.Path).Error("Cannot publish on a wildcard path")
+		return ErrWildcardTopic
+	}
+
 	var nodeID uint8
 	if router.cluster != nil {
 		nodeID = router.cluster.Config.ID
 	}
 
+	// messages received from other nodes were already checked by the node which created them
+	if message.NodeID == 0 {
+		setDefaultExpires(message)
+		if err := router.interceptMessage(message); err != nil {
+			return err
+		}
+	}
+	if key := message.IdempotencyKey(); key != "" && message.NodeID == 0 && IdempotencyWindow > 0 {
+		return router.handleIdempotentMessage(message, key, nodeID)
+	}
+	return router.storeAndRoute(message, nodeID)
+}
+
+func (router *router) storeAndRoute(message *protocol.Message, nodeID uint8) error {
 	mTotalMessagesIncomingBytes.Add(int64(len(message.Encode())))
 	pMessagesIncomingBytes.Add(float64(len(message.Encode())))
 	size, err := router.messageStore.StoreMessage(message, nodeID)
@@ -201,6 +261,16 @@ func (router *router) Subscribe(r *Route) (*Route, error) {
 		return nil, err
 	}
 
+	if err := r.Path.Validate(); err != nil {
+		return nil, err
+	}
+	if r.Backpressure == BackpressureSpill && r.Path.HasWildcardPartition() {
+		return nil, ErrSpillWildcardPartition
+	}
+	if r.Get(GroupParam) != "" && router.cluster != nil {
+		return nil, ErrGroupInCluster
+	}
+
 	req := subRequest{
 		route: r,
 		doneC: make(chan bool),
@@ -223,10 +293,11 @@ func (router *router) Unsubscribe(r *Route) {
 	<-req.doneC
 }
 
+// GetSubscribers returns the JSON-encoded params of the routes subscribed on the topic path.
+// If the path is a wildcard, the routes subscribed on all paths matching it are returned.
 func (router *router) GetSubscribers(topicPath string) ([]byte, error) {
 	subscribers := make([]RouteParams, 0)
-	routes, present := router.routes[protocol.Path(topicPath)]
-	if present {
+	appendSubscribers := func(routes []*Route) {
 		for index, currRoute := range routes {
 			logger.WithFields(log.Fields{
 				"index":       index,
@@ -235,6 +306,20 @@ func (router *router) GetSubscribers(topicPath string) ([]byte, error) {
 			subscribers = append(subscribers, currRoute.RouteParams)
 		}
 	}
+
+	pattern := protocol.Path(topicPath)
+	if !pattern.IsWildcard() {
+		appendSubscribers(router.routes.get(pattern))
+		return json.Marshal(subscribers)
+	}
+	if err := pattern.Validate(); err != nil {
+		return nil, err
+	}
+	router.routes.walk(func(path protocol.Path, routes []*Route) {
+		if path == pattern || pattern.Matches(path) {
+			appendSubscribers(routes)
+		}
+	})
 	return json.Marshal(subscribers)
 }
 
@@ -243,20 +328,21 @@ func (router *router) subscribe(r *Route) {
 	mTotalSubscriptionAttempts.Add(1)
 	pSubscriptionAttempts.Inc()
 
+	r.setRouter(router)
+
 	routePath := r.Path
-	slice, present := router.routes[routePath]
+	slice := router.routes.get(routePath)
 	var removed bool
-	if present {
+	if len(slice) > 0 {
 		// Try to remove, to avoid double subscriptions of the same app
 		slice, removed = removeIfMatching(slice, r)
 	} else {
 		// Path not present yet. Initialize the slice
 		slice = make([]*Route, 0, 1)
-		router.routes[routePath] = slice
 		mCurrentRoutes.Add(1)
 		pRoutes.Inc()
 	}
-	router.routes[routePath] = append(slice, r)
+	router.routes.set(routePath, append(slice, r))
 	if removed {
 		mTotalDuplicateSubscriptionsAttempts.Add(1)
 		pDuplicateSubscriptionAttempts.Inc()
@@ -274,14 +360,14 @@ func (router *router) unsubscribe(r *Route) {
 	pUnsubscriptionAttempts.Inc()
 
 	routePath := r.Path
-	slice, present := router.routes[routePath]
-	if !present {
+	slice := router.routes.get(routePath)
+	if len(slice) == 0 {
 		mTotalInvalidTopicOnUnsubscriptionAttempts.Add(1)
 		pInvalidTopicOnUnsubscriptionAttempts.Inc()
 		return
 	}
-	var removed bool
-	router.routes[routePath], removed = removeIfMatching(slice, r)
+	slice, removed := removeIfMatching(slice, r)
+	router.routes.set(routePath, slice)
 	if removed {
 		mTotalUnsubscriptions.Add(1)
 		pTotalUnsubscriptions.Inc()
@@ -291,11 +377,13 @@ func (router *router) unsubscribe(r *Route) {
 		mTotalInvalidUnsubscriptionAttempts.Add(1)
 		pInvalidUnsubscriptionAttempts.Inc()
 	}
-	if len(router.routes[routePath]) == 0 {
-		delete(router.routes, routePath)
+	if len(slice) == 0 {
 		mCurrentRoutes.Add(-1)
 		pRoutes.Dec()
 	}
+	if group := r.Get(GroupParam); group != "" && !hasGroup(slice, group) {
+		delete(router.groupTurns, groupKey{path: routePath, group: group})
+	}
 }
 
 func (router *router) panicIfInternalDependenciesAreNil() {
@@ -338,20 +426,27 @@ func (router *router) handleMessage(message *protocol.Message) {
 		"filters":  message.Filters,
 	})
 	flog.Debug("Called routeMessage for data")
+
+	if message.IsExpired() {
+		flog.Debug("Message expired, not routing it")
+		mTotalExpiredMessages.Add(1)
+		pExpiredMessages.Inc()
+		return
+	}
 	mTotalMessagesRouted.Add(1)
 	pMessagesRouted.Inc()
+	router.topicRates.add(message.Path, time.Now())
 
 	matched := false
-	for path, pathRoutes := range router.routes {
-		if matchesTopic(message.Path, path) {
-			matched = true
-			for _, route := range pathRoutes {
-				if err := route.Deliver(message, false); err == ErrInvalidRoute {
-					// Unsubscribe invalid routes
-					router.unsubscribe(route)
-				}
-			}
-		}
+	var invalidRoutes []*Route
+	router.routes.match(message.Path, func(path protocol.Path, pathRoutes []*Route) {
+		matched = true
+		invalidRoutes = append(invalidRoutes, router.deliver(path, pathRoutes, message)...)
+	})
+
+	// Unsubscribe invalid routes, after the trie traversal is done
+	for _, route := range invalidRoutes {
+		router.unsubscribe(route)
 	}
 
 	if !matched {
@@ -364,12 +459,14 @@ func (router *router) handleMessage(message *protocol.Message) {
 func (router *router) closeRoutes() {
 	logger.Debug("closeRoutes")
 
-	for _, currentRouteList := range router.routes {
-		for _, route := range currentRouteList {
-			router.unsubscribe(route)
-			log.WithFields(log.Fields{"module": "router", "route": route.String()}).Debug("Closing route")
-			route.Close()
-		}
+	var routes []*Route
+	router.routes.walk(func(path protocol.Path, pathRoutes []*Route) {
+		routes = append(routes, pathRoutes...)
+	})
+	for _, route := range routes {
+		router.unsubscribe(route)
+		log.WithFields(log.Fields{"module": "router", "route": route.String()}).Debug("Closing route")
+		route.Close()
 	}
 }
 
@@ -439,22 +536,6 @@ func (router *router) Cluster() *cluster.Cluster {
 	return router.cluster
 }
 
-func (router *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if req.Method != http.MethodGet {
-		http.Error(w, `{"error": Error method not allowed.Only HTTP GET is accepted}`, http.StatusMethodNotAllowed)
-		return
-	}
-
-	err := json.NewEncoder(w).Encode(router.routes)
-	if err != nil {
-		http.Error(w, `{"error":Error encoding data.}`, http.StatusInternalServerError)
-		logger.WithField("error", err.Error()).Error("Error encoding data.")
-		return
-	}
-}
-
 func (router *router) GetPrefix() string {
 	return prefix
 }
@@ -0,0 +1,76 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cosminrentea/gobbler/protocol"
+)
+
+const benchmarkTopics = 20000
+
+// benchmarkRoutePaths returns distinct route paths spread over a few partitions, 3 levels deep
+func benchmarkRoutePaths(n int) []protocol.Path {
+	paths := make([]protocol.Path, 0, n)
+	for i := 0; i < n; i++ {
+		paths = append(paths, protocol.Path(fmt.Sprintf("/partition%d/user%d/topic%d", i%10, i%1000, i)))
+	}
+	return paths
+}
+
+func Benchmark_MapScan_Match(b *testing.B) {
+	routes := make(map[protocol.Path][]*Route, benchmarkTopics)
+	paths := benchmarkRoutePaths(benchmarkTopics)
+	for _, path := range paths {
+		routes[path] = []*Route{NewRoute(RouteConfig{Path: path})}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		messagePath := paths[i%len(paths)] + "/subtopic"
+		matched := 0
+		for path := range routes {
+			if matchesTopic(messagePath, path) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			b.Fatalf("expected 1 match, got %d", matched)
+		}
+	}
+}
+
+func Benchmark_TopicTrie_Match(b *testing.B) {
+	trie := newTopicTrie()
+	paths := benchmarkRoutePaths(benchmarkTopics)
+	for _, path := range paths {
+		trie.set(path, []*Route{NewRoute(RouteConfig{Path: path})})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		messagePath := paths[i%len(paths)] + "/subtopic"
+		matched := 0
+		trie.match(messagePath, func(path protocol.Path, routes []*Route) {
+			matched++
+		})
+		if matched != 1 {
+			b.Fatalf("expected 1 match, got %d", matched)
+		}
+	}
+}
+
+func Benchmark_TopicTrie_SubscribeUnsubscribe(b *testing.B) {
+	trie := newTopicTrie()
+	paths := benchmarkRoutePaths(benchmarkTopics)
+	for _, path := range paths {
+		trie.set(path, []*Route{NewRoute(RouteConfig{Path: path})})
+	}
+	route := NewRoute(RouteConfig{Path: "/partition1/user1/new"})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.set(route.Path, []*Route{route})
+		trie.remove(route.Path)
+	}
+}
@@ -23,6 +23,18 @@ var (
 	mTotalMessageStoreErrors                   = metrics.NewInt("router.total_errors_message_store")
 	mTotalDeliverMessageErrors                 = metrics.NewInt("router.total_errors_deliver_message")
 	mTotalNotMatchedByFilters                  = metrics.NewInt("router.total_not_matched_by_filters")
+	mTotalBackpressureClose                    = metrics.NewInt("router.total_backpressure_close")
+	mTotalBackpressureDropOldest               = metrics.NewInt("router.total_backpressure_drop_oldest")
+	mTotalBackpressureDropNewest               = metrics.NewInt("router.total_backpressure_drop_newest")
+	mTotalBackpressureBlock                    = metrics.NewInt("router.total_backpressure_block")
+	mTotalBackpressureBlockTimeouts            = metrics.NewInt("router.total_backpressure_block_timeouts")
+	mTotalBackpressureSpill                    = metrics.NewInt("router.total_backpressure_spill")
+	mTotalBackpressureRefetched                = metrics.NewInt("router.total_backpressure_refetched")
+	mTotalDuplicateMessages                    = metrics.NewInt("router.total_duplicate_messages")
+	mTotalExpiredMessages                      = metrics.NewInt("router.total_expired_messages")
+	mTotalGroupDeliveries                      = metrics.NewInt("router.total_group_deliveries")
+	mTotalRejectedMessages                     = metrics.NewInt("router.total_rejected_messages")
+	mTotalRejectedDeliveries                   = metrics.NewInt("router.total_rejected_deliveries")
 )
 
 func resetRouterMetrics() {
@@ -44,4 +56,16 @@ func resetRouterMetrics() {
 	mTotalMessagesIncomingBytes.Set(0)
 	mTotalMessagesStoredBytes.Set(0)
 	mTotalNotMatchedByFilters.Set(0)
+	mTotalBackpressureClose.Set(0)
+	mTotalBackpressureDropOldest.Set(0)
+	mTotalBackpressureDropNewest.Set(0)
+	mTotalBackpressureBlock.Set(0)
+	mTotalBackpressureBlockTimeouts.Set(0)
+	mTotalBackpressureSpill.Set(0)
+	mTotalBackpressureRefetched.Set(0)
+	mTotalDuplicateMessages.Set(0)
+	mTotalExpiredMessages.Set(0)
+	mTotalGroupDeliveries.Set(0)
+	mTotalRejectedMessages.Set(0)
+	mTotalRejectedDeliveries.Set(0)
 }
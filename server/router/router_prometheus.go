@@ -94,6 +94,66 @@ var (
 		Name: "router_not_matched_by_filters",
 		Help: "Number of messages not matched by any filters in the router",
 	})
+
+	pBackpressureClose = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "router_backpressure_close",
+		Help: "Number of routes closed because they were full",
+	})
+
+	pBackpressureDropOldest = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "router_backpressure_drop_oldest",
+		Help: "Number of oldest messages dropped from full routes",
+	})
+
+	pBackpressureDropNewest = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "router_backpressure_drop_newest",
+		Help: "Number of new messages dropped by full routes",
+	})
+
+	pBackpressureBlock = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "router_backpressure_block",
+		Help: "Number of times the delivery blocked on full routes",
+	})
+
+	pBackpressureBlockTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "router_backpressure_block_timeouts",
+		Help: "Number of messages dropped because routes were still full after blocking",
+	})
+
+	pBackpressureSpill = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "router_backpressure_spill",
+		Help: "Number of messages spilled to the message-store by full routes",
+	})
+
+	pBackpressureRefetched = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "router_backpressure_refetched",
+		Help: "Number of spilled messages refetched from the message-store",
+	})
+
+	pDuplicateMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "router_duplicate_messages",
+		Help: "Number of messages dropped because their idempotency key was already used",
+	})
+
+	pExpiredMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "router_expired_messages",
+		Help: "Number of expired messages which were not delivered",
+	})
+
+	pGroupDeliveries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "router_group_deliveries",
+		Help: "Number of messages delivered to a single member of a consumer group",
+	})
+
+	pRejectedMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "router_rejected_messages",
+		Help: "Number of messages rejected by the interceptors before being stored",
+	})
+
+	pRejectedDeliveries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "router_rejected_deliveries",
+		Help: "Number of deliveries to routes rejected by the delivery interceptors",
+	})
 )
 
 func init() {
@@ -116,5 +176,17 @@ func init() {
 		pMessageStoreErrors,
 		pDeliverMessageErrors,
 		pNotMatchedByFilters,
+		pBackpressureClose,
+		pBackpressureDropOldest,
+		pBackpressureDropNewest,
+		pBackpressureBlock,
+		pBackpressureBlockTimeouts,
+		pBackpressureSpill,
+		pBackpressureRefetched,
+		pDuplicateMessages,
+		pExpiredMessages,
+		pGroupDeliveries,
+		pRejectedMessages,
+		pRejectedDeliveries,
 	)
 }
@@ -1,7 +1,9 @@
 package router
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -75,22 +77,22 @@ func TestRouter_AddAndRemoveRoutes(t *testing.T) {
 	// then
 
 	// the routes are stored
-	a.Equal(2, len(router.routes[protocol.Path("/blah")]))
-	a.True(routeBlah1.Equal(router.routes[protocol.Path("/blah")][0]))
-	a.True(routeBlah2.Equal(router.routes[protocol.Path("/blah")][1]))
+	a.Equal(2, len(router.routes.get(protocol.Path("/blah"))))
+	a.True(routeBlah1.Equal(router.routes.get(protocol.Path("/blah"))[0]))
+	a.True(routeBlah2.Equal(router.routes.get(protocol.Path("/blah"))[1]))
 
-	a.Equal(1, len(router.routes[protocol.Path("/foo")]))
-	a.True(routeFoo.Equal(router.routes[protocol.Path("/foo")][0]))
+	a.Equal(1, len(router.routes.get(protocol.Path("/foo"))))
+	a.True(routeFoo.Equal(router.routes.get(protocol.Path("/foo"))[0]))
 
 	// when i remove routes
 	router.Unsubscribe(routeBlah1)
 	router.Unsubscribe(routeFoo)
 
 	// then they are gone
-	a.Equal(1, len(router.routes[protocol.Path("/blah")]))
-	a.True(routeBlah2.Equal(router.routes[protocol.Path("/blah")][0]))
+	a.Equal(1, len(router.routes.get(protocol.Path("/blah"))))
+	a.True(routeBlah2.Equal(router.routes.get(protocol.Path("/blah"))[0]))
 
-	a.Nil(router.routes[protocol.Path("/foo")])
+	a.Nil(router.routes.get(protocol.Path("/foo")))
 }
 
 func TestRouter_ReplacingOfRoutesMatchingAppID(t *testing.T) {
@@ -120,9 +122,9 @@ func TestRouter_ReplacingOfRoutesMatchingAppID(t *testing.T) {
 	))
 
 	// then: the router only contains the new route
-	a.Equal(1, len(router.routes))
-	a.Equal(1, len(router.routes["/blah"]))
-	a.Equal("newUserId", router.routes["/blah"][0].Get("user_id"))
+	a.Equal(1, router.routes.len())
+	a.Equal(1, len(router.routes.get("/blah")))
+	a.Equal("newUserId", router.routes.get("/blah")[0].Get("user_id"))
 }
 
 func TestRouter_SimpleMessageSending(t *testing.T) {
@@ -198,6 +200,85 @@ func TestRouter_RoutingWithSubTopics(t *testing.T) {
 	a.Equal(0, len(r.MessagesChannel()))
 }
 
+func TestRouter_RoutingWithWildcards(t *testing.T) {
+	a := assert.New(t)
+
+	// Given a Router with wildcard routes
+	router, _, _ := aStartedRouter()
+
+	singleLevel, err := router.Subscribe(NewRoute(
+		RouteConfig{
+			RouteParams: RouteParams{"application_id": "appid01", "user_id": "user01"},
+			Path:        protocol.Path("/orders/*/status"),
+			ChannelSize: chanSize,
+		},
+	))
+	a.NoError(err)
+	multiLevel, err := router.Subscribe(NewRoute(
+		RouteConfig{
+			RouteParams: RouteParams{"application_id": "appid02", "user_id": "user01"},
+			Path:        protocol.Path("/tenant/+/events/#"),
+			ChannelSize: chanSize,
+		},
+	))
+	a.NoError(err)
+
+	// when i send messages to topics matching the patterns
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/orders/123/status", Body: aTestByteMessage}))
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/tenant/t1/events/created", Body: aTestByteMessage}))
+
+	// then they are received
+	assertChannelContainsMessage(a, singleLevel.MessagesChannel(), aTestByteMessage)
+	assertChannelContainsMessage(a, multiLevel.MessagesChannel(), aTestByteMessage)
+
+	// but messages to topics not matching the patterns are not delivered
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/orders/123/payment", Body: aTestByteMessage}))
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/tenant/t1/logs", Body: aTestByteMessage}))
+	time.Sleep(5 * time.Millisecond)
+	a.Equal(0, len(singleLevel.MessagesChannel()))
+	a.Equal(0, len(multiLevel.MessagesChannel()))
+}
+
+func TestRouter_WildcardValidation(t *testing.T) {
+	a := assert.New(t)
+
+	router, _, _ := aStartedRouter()
+
+	// publishing on a wildcard path is rejected
+	err := router.HandleMessage(&protocol.Message{Path: "/orders/+/status", Body: aTestByteMessage})
+	a.Equal(ErrWildcardTopic, err)
+
+	// subscribing with a multi-level wildcard which is not the last level is rejected
+	_, err = router.Subscribe(NewRoute(RouteConfig{Path: protocol.Path("/orders/#/status")}))
+	a.Equal(protocol.ErrInvalidWildcard, err)
+	a.Equal(0, router.routes.len())
+}
+
+func TestRouter_GetSubscribersWithWildcard(t *testing.T) {
+	a := assert.New(t)
+
+	router, _, _ := aStartedRouter()
+	for i, path := range []protocol.Path{"/orders/1/status", "/orders/2/status", "/orders/+/status", "/orders/1/payment"} {
+		router.Subscribe(NewRoute(RouteConfig{
+			RouteParams: RouteParams{"user_id": fmt.Sprintf("user%d", i)},
+			Path:        path,
+		}))
+	}
+
+	data, err := router.GetSubscribers("/orders/1/status")
+	a.NoError(err)
+	a.JSONEq(`[{"user_id":"user0"}]`, string(data))
+
+	data, err = router.GetSubscribers("/orders/+/status")
+	a.NoError(err)
+	var subscribers []RouteParams
+	a.NoError(json.Unmarshal(data, &subscribers))
+	a.Len(subscribers, 3)
+
+	_, err = router.GetSubscribers("/orders/#/status")
+	a.Equal(protocol.ErrInvalidWildcard, err)
+}
+
 func TestMatchesTopic(t *testing.T) {
 	for _, test := range []struct {
 		messagePath protocol.Path
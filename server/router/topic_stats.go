@@ -0,0 +1,161 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cosminrentea/gobbler/protocol"
+)
+
+// RateWindow is the duration of the sliding window over which the publish rates of the topics are computed.
+// It is rounded to seconds.
+var RateWindow = time.Minute
+
+// TopicActivity is implemented by the routers reporting the activity on their topics, used by the statistics of the topics.
+type TopicActivity interface {
+	// EnablePublishRates starts counting the messages routed on each topic, which is disabled by default
+	EnablePublishRates()
+
+	// PublishRates returns the number of messages per second routed on each topic during the RateWindow
+	PublishRates() map[protocol.Path]float64
+
+	// SubscriberCounts returns the number of live routes subscribed to each path
+	SubscriberCounts() (map[protocol.Path]int, error)
+}
+
+// rateCounter counts the messages in buckets of one second, over a sliding window
+type rateCounter struct {
+	buckets []uint64
+	last    int64 // the second of the last bucket written
+}
+
+func newRateCounter(window time.Duration) *rateCounter {
+	size := int(window / time.Second)
+	if size < 1 {
+		size = 1
+	}
+	return &rateCounter{buckets: make([]uint64, size)}
+}
+
+// advance clears the buckets of the seconds elapsed since the last one written
+func (c *rateCounter) advance(now int64) {
+	elapsed := now - c.last
+	if elapsed <= 0 {
+		return
+	}
+	if elapsed > int64(len(c.buckets)) {
+		elapsed = int64(len(c.buckets))
+	}
+	for i := int64(1); i <= elapsed; i++ {
+		c.buckets[(c.last+i)%int64(len(c.buckets))] = 0
+	}
+	c.last = now
+}
+
+func (c *rateCounter) add(now time.Time) {
+	c.advance(now.Unix())
+	c.buckets[c.last%int64(len(c.buckets))]++
+}
+
+// idle returns true if no message was counted during the window
+func (c *rateCounter) idle(now time.Time) bool {
+	return now.Unix()-c.last >= int64(len(c.buckets))
+}
+
+// rate returns the messages per second during the window
+func (c *rateCounter) rate(now time.Time) float64 {
+	c.advance(now.Unix())
+	var sum uint64
+	for _, count := range c.buckets {
+		sum += count
+	}
+	return float64(sum) / float64(len(c.buckets))
+}
+
+// topicRates are the rate counters of the topics on which messages were routed during the window.
+// The counters of the topics without messages during the window are removed once per window.
+type topicRates struct {
+	mu        sync.Mutex
+	enabled   bool
+	counters  map[protocol.Path]*rateCounter
+	lastSweep time.Time
+}
+
+func (t *topicRates) enable() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enabled = true
+}
+
+func (t *topicRates) add(path protocol.Path, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.enabled {
+		return
+	}
+	if t.counters == nil {
+		t.counters = make(map[protocol.Path]*rateCounter)
+		t.lastSweep = now
+	}
+	if now.Sub(t.lastSweep) >= RateWindow {
+		t.sweep(now)
+	}
+	counter, ok := t.counters[path]
+	if !ok {
+		counter = newRateCounter(RateWindow)
+		t.counters[path] = counter
+	}
+	counter.add(now)
+}
+
+// rates returns the rates of the topics, removing the counters of the topics without messages during the window
+func (t *topicRates) rates(now time.Time) map[protocol.Path]float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rates := make(map[protocol.Path]float64, len(t.counters))
+	for path, counter := range t.counters {
+		if rate := counter.rate(now); rate > 0 {
+			rates[path] = rate
+		} else {
+			delete(t.counters, path)
+		}
+	}
+	return rates
+}
+
+// sweep removes the counters of the topics without messages during the window; it is called while holding the lock
+func (t *topicRates) sweep(now time.Time) {
+	for path, counter := range t.counters {
+		if counter.idle(now) {
+			delete(t.counters, path)
+		}
+	}
+	t.lastSweep = now
+}
+
+// EnablePublishRates starts counting the messages routed on each topic
+func (router *router) EnablePublishRates() {
+	router.topicRates.enable()
+}
+
+// PublishRates returns the number of messages per second routed on each topic during the RateWindow
+func (router *router) PublishRates() map[protocol.Path]float64 {
+	return router.topicRates.rates(time.Now())
+}
+
+// SubscriberCounts returns the number of live routes subscribed to each path
+func (router *router) SubscriberCounts() (map[protocol.Path]int, error) {
+	routes, err := router.routesSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[protocol.Path]int)
+	for _, r := range routes {
+		if !r.isInvalid() {
+			counts[r.Path]++
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,81 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+)
+
+func TestRateCounter(t *testing.T) {
+	a := assert.New(t)
+	counter := newRateCounter(10 * time.Second)
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 5; i++ {
+		counter.add(now)
+	}
+	counter.add(now.Add(3 * time.Second))
+	a.Equal(0.6, counter.rate(now.Add(3*time.Second)))
+
+	// the messages older than the window are not counted
+	a.Equal(0.1, counter.rate(now.Add(10*time.Second)))
+	a.Equal(0.0, counter.rate(now.Add(time.Hour)))
+
+	// the counter is idle when the window has no messages
+	counter = newRateCounter(10 * time.Second)
+	counter.add(now)
+	a.False(counter.idle(now.Add(9 * time.Second)))
+	a.True(counter.idle(now.Add(10 * time.Second)))
+}
+
+func TestTopicRates(t *testing.T) {
+	a := assert.New(t)
+	rates := &topicRates{}
+	now := time.Unix(1000, 0)
+
+	// nothing is counted until enabled
+	rates.add("/news", now)
+	a.Nil(rates.counters)
+
+	// the counters of the topics without messages during the window are removed
+	rates.enable()
+	rates.add("/news", now)
+	rates.add("/chat", now.Add(RateWindow/2))
+	a.Len(rates.counters, 2)
+	rates.add("/chat", now.Add(RateWindow+time.Second))
+	a.Len(rates.counters, 1)
+	a.Contains(rates.counters, protocol.Path("/chat"))
+}
+
+func TestRouter_TopicActivity(t *testing.T) {
+	a := assert.New(t)
+	router, _, _ := aStartedRouter()
+	defer router.Stop()
+	router.EnablePublishRates()
+
+	for _, path := range []protocol.Path{"/chat/room1", "/chat/*"} {
+		_, err := router.Subscribe(NewRoute(RouteConfig{
+			RouteParams: RouteParams{"application_id": "appid01", "user_id": "user01"},
+			Path:        path,
+			ChannelSize: chanSize,
+		}))
+		a.NoError(err)
+	}
+	for i := 0; i < 3; i++ {
+		a.NoError(router.HandleMessage(&protocol.Message{Path: "/chat/room1"}))
+	}
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/news"}))
+	time.Sleep(20 * time.Millisecond)
+
+	rates := router.PublishRates()
+	a.Len(rates, 2)
+	a.InDelta(3/RateWindow.Seconds(), rates["/chat/room1"], 0.0001)
+	a.InDelta(1/RateWindow.Seconds(), rates["/news"], 0.0001)
+
+	counts, err := router.SubscriberCounts()
+	a.NoError(err)
+	a.Equal(map[protocol.Path]int{"/chat/room1": 1, "/chat/*": 1}, counts)
+}
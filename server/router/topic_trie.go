@@ -0,0 +1,178 @@
+package router
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/cosminrentea/gobbler/protocol"
+)
+
+// topicTrie indexes the routes by the segments of their path, so that finding the routes
+// matching a message topic costs the depth of the topic instead of the number of route paths.
+// Wildcard segments are stored as regular children and followed in addition to the exact segment.
+// The trie is not safe for concurrent use; it is owned by the router goroutine.
+type topicTrie struct {
+	root *trieNode
+
+	// number of paths having at least one route
+	paths int
+}
+
+type trieNode struct {
+	path     protocol.Path
+	children map[string]*trieNode
+	routes   []*Route
+}
+
+func newTopicTrie() *topicTrie {
+	return &topicTrie{root: &trieNode{}}
+}
+
+// splitPath splits a path into its segments. Splitting on every separator
+// (keeping the empty segments) preserves the semantics of `matchesTopic`:
+// a route path matches a message path if its segments are a prefix of the message segments.
+func splitPath(path protocol.Path) []string {
+	return strings.Split(string(path), "/")
+}
+
+// len returns the number of distinct paths having routes
+func (t *topicTrie) len() int {
+	return t.paths
+}
+
+// get returns the routes registered exactly on the given path
+func (t *topicTrie) get(path protocol.Path) []*Route {
+	if node := t.find(path); node != nil {
+		return node.routes
+	}
+	return nil
+}
+
+// set replaces the routes registered on the given path, creating the intermediary nodes if needed.
+// Setting an empty slice removes the path and prunes the nodes that are left empty.
+func (t *topicTrie) set(path protocol.Path, routes []*Route) {
+	if len(routes) == 0 {
+		t.remove(path)
+		return
+	}
+
+	node := t.root
+	for _, segment := range splitPath(path) {
+		if node.children == nil {
+			node.children = make(map[string]*trieNode)
+		}
+		child, ok := node.children[segment]
+		if !ok {
+			child = &trieNode{}
+			node.children[segment] = child
+		}
+		node = child
+	}
+	if len(node.routes) == 0 {
+		node.path = path
+		t.paths++
+	}
+	node.routes = routes
+}
+
+// remove deletes all routes registered on the given path.
+func (t *topicTrie) remove(path protocol.Path) {
+	segments := splitPath(path)
+	nodes := make([]*trieNode, 0, len(segments)+1)
+
+	node := t.root
+	nodes = append(nodes, node)
+	for _, segment := range segments {
+		child, ok := node.children[segment]
+		if !ok {
+			return
+		}
+		node = child
+		nodes = append(nodes, node)
+	}
+	if len(node.routes) == 0 {
+		return
+	}
+	node.routes = nil
+	t.paths--
+
+	// prune the nodes which are left without routes and children, bottom-up
+	for i := len(nodes) - 1; i > 0; i-- {
+		if len(nodes[i].routes) > 0 || len(nodes[i].children) > 0 {
+			break
+		}
+		delete(nodes[i-1].children, segments[i-1])
+	}
+}
+
+// match calls fn for each path having routes which matches the message path:
+// the path itself, all its parent topics, and the wildcard paths matching any of them.
+func (t *topicTrie) match(messagePath protocol.Path, fn func(path protocol.Path, routes []*Route)) {
+	t.root.match(splitPath(messagePath), fn)
+}
+
+func (n *trieNode) match(segments []string, fn func(path protocol.Path, routes []*Route)) {
+	// a multi-level wildcard matches all remaining segments, including none
+	if child, ok := n.children[protocol.MultiLevelWildcard]; ok && len(child.routes) > 0 {
+		fn(child.path, child.routes)
+	}
+	if len(segments) == 0 {
+		return
+	}
+
+	segment, remaining := segments[0], segments[1:]
+	if child, ok := n.children[segment]; ok {
+		child.visit(remaining, fn)
+	}
+	for _, wildcard := range []string{protocol.SingleLevelWildcard, protocol.SingleLevelWildcardAlias} {
+		if segment == wildcard {
+			// already visited as an exact segment
+			continue
+		}
+		if child, ok := n.children[wildcard]; ok {
+			child.visit(remaining, fn)
+		}
+	}
+}
+
+func (n *trieNode) visit(remaining []string, fn func(path protocol.Path, routes []*Route)) {
+	if len(n.routes) > 0 {
+		fn(n.path, n.routes)
+	}
+	n.match(remaining, fn)
+}
+
+// walk calls fn for each path having routes in the trie.
+func (t *topicTrie) walk(fn func(path protocol.Path, routes []*Route)) {
+	t.root.walk(fn)
+}
+
+func (n *trieNode) walk(fn func(path protocol.Path, routes []*Route)) {
+	if len(n.routes) > 0 {
+		fn(n.path, n.routes)
+	}
+	for _, child := range n.children {
+		child.walk(fn)
+	}
+}
+
+func (t *topicTrie) find(path protocol.Path) *trieNode {
+	node := t.root
+	for _, segment := range splitPath(path) {
+		child, ok := node.children[segment]
+		if !ok {
+			return nil
+		}
+		node = child
+	}
+	return node
+}
+
+// MarshalJSON encodes the trie as a map of paths to their routes.
+func (t *topicTrie) MarshalJSON() ([]byte, error) {
+	routes := make(map[protocol.Path][]*Route, t.paths)
+	t.walk(func(path protocol.Path, pathRoutes []*Route) {
+		routes[path] = pathRoutes
+	})
+	return json.Marshal(routes)
+}
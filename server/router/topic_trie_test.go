@@ -0,0 +1,109 @@
+package router
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicTrie_SetGetRemove(t *testing.T) {
+	a := assert.New(t)
+
+	trie := newTopicTrie()
+	r1 := NewRoute(RouteConfig{Path: "/foo/bar"})
+	r2 := NewRoute(RouteConfig{Path: "/foo"})
+
+	trie.set("/foo/bar", []*Route{r1})
+	trie.set("/foo", []*Route{r2})
+	a.Equal(2, trie.len())
+	a.Equal([]*Route{r1}, trie.get("/foo/bar"))
+	a.Equal([]*Route{r2}, trie.get("/foo"))
+	a.Nil(trie.get("/foo/baz"))
+	a.Nil(trie.get("/"))
+
+	// removing the parent keeps the child
+	trie.set("/foo", nil)
+	a.Equal(1, trie.len())
+	a.Nil(trie.get("/foo"))
+	a.Equal([]*Route{r1}, trie.get("/foo/bar"))
+
+	// removing the last path prunes all the nodes
+	trie.remove("/foo/bar")
+	a.Equal(0, trie.len())
+	a.Empty(trie.root.children)
+
+	// removing a missing path is a no-op
+	trie.remove("/not/there")
+	a.Equal(0, trie.len())
+}
+
+func TestTopicTrie_MatchIsConsistentWithMatchesTopic(t *testing.T) {
+	a := assert.New(t)
+
+	routePaths := []protocol.Path{"", "/", "/foo", "/foo/", "/foo/bar", "/fooxyz", "/bar/xyz", "/foo/bar/baz"}
+	messagePaths := []protocol.Path{"/", "/foo", "/foo/", "/foo//x", "/foo/xyz", "/fooxyz", "/foo/bar", "/foo/bar/baz/x", "/bar", "/bar/xyz/1"}
+
+	trie := newTopicTrie()
+	for _, path := range routePaths {
+		trie.set(path, []*Route{NewRoute(RouteConfig{Path: path})})
+	}
+
+	for _, messagePath := range messagePaths {
+		var expected, matched []string
+		for _, routePath := range routePaths {
+			if matchesTopic(messagePath, routePath) {
+				expected = append(expected, string(routePath))
+			}
+		}
+		trie.match(messagePath, func(path protocol.Path, routes []*Route) {
+			matched = append(matched, string(path))
+		})
+		sort.Strings(expected)
+		sort.Strings(matched)
+		a.Equal(expected, matched, "message path: %s", messagePath)
+	}
+}
+
+func TestTopicTrie_MarshalJSON(t *testing.T) {
+	a := assert.New(t)
+
+	trie := newTopicTrie()
+	trie.set("/foo", []*Route{NewRoute(RouteConfig{
+		RouteParams: RouteParams{"user_id": "user01"},
+		Path:        "/foo",
+	})})
+
+	data, err := trie.MarshalJSON()
+	a.NoError(err)
+	a.Contains(string(data), `"/foo":[{`)
+	a.Contains(string(data), `"user_id":"user01"`)
+}
+
+func TestTopicTrie_MatchWildcards(t *testing.T) {
+	a := assert.New(t)
+
+	routePaths := []protocol.Path{"/orders/*/status", "/orders/+/status", "/tenant/+/events/#", "/#", "/+/foo", "/orders"}
+	messagePaths := []protocol.Path{"/orders/1/status", "/orders/1/status/x", "/orders/1", "/tenant/t1/events", "/tenant/t1/events/a/b", "/tenant/t1/other", "/bar/foo", "/foo"}
+
+	trie := newTopicTrie()
+	for _, path := range routePaths {
+		trie.set(path, []*Route{NewRoute(RouteConfig{Path: path})})
+	}
+
+	for _, messagePath := range messagePaths {
+		var expected, matched []string
+		for _, routePath := range routePaths {
+			if routePath.Matches(messagePath) {
+				expected = append(expected, string(routePath))
+			}
+		}
+		trie.match(messagePath, func(path protocol.Path, routes []*Route) {
+			matched = append(matched, string(path))
+		})
+		sort.Strings(expected)
+		sort.Strings(matched)
+		a.Equal(expected, matched, "message path: %s", messagePath)
+	}
+}
@@ -0,0 +1,60 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cosminrentea/gobbler/protocol"
+)
+
+// TopicTTLs are the default time-to-live durations of the messages published on a topic and on its subtopics.
+// They are applied to the messages published without an expiration time, using the TTL of the most specific topic.
+var TopicTTLs map[protocol.Path]time.Duration
+
+// ParseTopicTTLs parses the default topic TTLs, given as `/topic=duration` (e.g. `/news=24h`).
+func ParseTopicTTLs(settings []string) (map[protocol.Path]time.Duration, error) {
+	ttls := make(map[protocol.Path]time.Duration, len(settings))
+	for _, setting := range settings {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid topic TTL %q: the format is /topic=duration", setting)
+		}
+		path := protocol.Path(parts[0])
+		if err := path.Validate(); err != nil || !strings.HasPrefix(parts[0], "/") || path.IsWildcard() {
+			return nil, fmt.Errorf("invalid topic TTL %q: invalid topic", setting)
+		}
+		ttl, err := time.ParseDuration(parts[1])
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid topic TTL %q: invalid duration", setting)
+		}
+		ttls[path] = ttl
+	}
+	return ttls, nil
+}
+
+// topicTTL returns the default TTL of the topic, or of its closest parent topic having one
+func topicTTL(path protocol.Path) (time.Duration, bool) {
+	if len(TopicTTLs) == 0 {
+		return 0, false
+	}
+	topic := string(path)
+	for topic != "" {
+		if ttl, ok := TopicTTLs[protocol.Path(topic)]; ok {
+			return ttl, true
+		}
+		topic = topic[:strings.LastIndex(topic, "/")]
+	}
+	return 0, false
+}
+
+// setDefaultExpires sets the expiration time of a message published without one, if its topic has a default TTL
+func setDefaultExpires(message *protocol.Message) {
+	if message.Expires != nil {
+		return
+	}
+	if ttl, ok := topicTTL(message.Path); ok {
+		expires := time.Now().Add(ttl)
+		message.Expires = &expires
+	}
+}
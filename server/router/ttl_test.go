@@ -0,0 +1,119 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/store"
+	"github.com/cosminrentea/gobbler/testutil"
+)
+
+func TestParseTopicTTLs(t *testing.T) {
+	a := assert.New(t)
+
+	ttls, err := ParseTopicTTLs([]string{"/news=24h", "/news/sport=1h30m"})
+	a.NoError(err)
+	a.Equal(map[protocol.Path]time.Duration{
+		"/news":       24 * time.Hour,
+		"/news/sport": 90 * time.Minute,
+	}, ttls)
+
+	for _, setting := range []string{"/news", "news=1h", "/news/*=1h", "/news=tomorrow", "/news=-1h"} {
+		_, err := ParseTopicTTLs([]string{setting})
+		a.Error(err, setting)
+	}
+}
+
+func TestRouter_HandleMessage_TopicTTL(t *testing.T) {
+	a := assert.New(t)
+
+	defer func(ttls map[protocol.Path]time.Duration) { TopicTTLs = ttls }(TopicTTLs)
+	TopicTTLs = map[protocol.Path]time.Duration{
+		"/blah":       time.Hour,
+		"/blah/short": time.Minute,
+	}
+
+	router, r := aRouterRoute(chanSize)
+
+	message := &protocol.Message{Path: "/blah/topic", Body: aTestByteMessage}
+	a.NoError(router.HandleMessage(message))
+	a.NotNil(message.Expires)
+	a.WithinDuration(time.Now().Add(time.Hour), *message.Expires, time.Second)
+	assertChannelContainsMessage(a, r.MessagesChannel(), aTestByteMessage)
+
+	message = &protocol.Message{Path: "/blah/short/topic", Body: aTestByteMessage}
+	a.NoError(router.HandleMessage(message))
+	a.WithinDuration(time.Now().Add(time.Minute), *message.Expires, time.Second)
+	assertChannelContainsMessage(a, r.MessagesChannel(), aTestByteMessage)
+
+	// an explicit expiration time is kept
+	expires := time.Now().Add(time.Hour * 48)
+	message = &protocol.Message{Path: "/blah/short", Body: aTestByteMessage, Expires: &expires}
+	a.NoError(router.HandleMessage(message))
+	a.Equal(expires, *message.Expires)
+	assertChannelContainsMessage(a, r.MessagesChannel(), aTestByteMessage)
+
+	// topics without a default TTL
+	message = &protocol.Message{Path: "/other", Body: aTestByteMessage}
+	a.NoError(router.HandleMessage(message))
+	a.Nil(message.Expires)
+}
+
+func TestRouter_HandleMessage_Expired(t *testing.T) {
+	a := assert.New(t)
+
+	router, r := aRouterRoute(chanSize)
+
+	expires := time.Now().Add(-time.Minute)
+	a.NoError(router.HandleMessage(&protocol.Message{Path: r.Path, Body: []byte("expired"), Expires: &expires}))
+	a.NoError(router.HandleMessage(&protocol.Message{Path: r.Path, Body: aTestByteMessage}))
+
+	assertChannelContainsMessage(a, r.MessagesChannel(), aTestByteMessage)
+	time.Sleep(10 * time.Millisecond)
+	a.Equal(0, len(r.MessagesChannel()))
+}
+
+func TestRoute_Provide_FetchSkipsExpired(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+	msMock := NewMockMessageStore(ctrl)
+	routerMock := NewMockRouter(ctrl)
+
+	routerMock.EXPECT().MessageStore().Return(msMock, nil)
+	routerMock.EXPECT().Done().Return(make(chan bool)).AnyTimes()
+
+	route := NewRoute(RouteConfig{
+		Path:         protocol.Path("/fetch_request"),
+		ChannelSize:  5,
+		FetchRequest: store.NewFetchRequest("", 0, 0, store.DirectionForward, -1),
+	})
+
+	msMock.EXPECT().MaxMessageID("fetch_request").Return(uint64(2), nil).Times(2)
+
+	expired := time.Now().Add(-time.Minute)
+	valid := time.Now().Add(time.Minute)
+	routerMock.EXPECT().Fetch(gomock.Any()).Do(func(req *store.FetchRequest) {
+		go func() {
+			req.StartC <- 2
+			req.Push(1, (&protocol.Message{ID: 1, Path: "/fetch_request", Expires: &expired}).Encode())
+			req.Push(2, (&protocol.Message{ID: 2, Path: "/fetch_request", Expires: &valid}).Encode())
+			req.Done()
+		}()
+	})
+
+	a.NoError(route.Provide(routerMock, false))
+
+	select {
+	case m := <-route.MessagesChannel():
+		a.Equal(uint64(2), m.ID)
+	case <-time.After(50 * time.Millisecond):
+		a.Fail("Message not received")
+	}
+	a.Equal(0, len(route.MessagesChannel()))
+}
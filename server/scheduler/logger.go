@@ -0,0 +1,7 @@
+package scheduler
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+var logger = log.WithField("module", "scheduler")
@@ -0,0 +1,389 @@
+package scheduler
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rs/xid"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/auth"
+	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/router"
+)
+
+const (
+	schema = "scheduled_messages"
+
+	// maximum duration to wait when there are no scheduled messages
+	maxWait = time.Hour
+)
+
+// RetryInterval is the duration after which the delivery of a scheduled message is retried, if the router failed to handle it
+var RetryInterval = 10 * time.Second
+
+// Scheduler is a router.Router holding the published messages which have a future delivery time (DeliverAt)
+// in the KVStore, until they are due and are passed to the wrapped router.
+// The scheduled messages are loaded again from the KVStore at start.
+// It is also an Endpoint, used for listing and cancelling the scheduled messages.
+type Scheduler struct {
+	router.Router
+
+	kvStore       kvstore.KVStore
+	prefix        string
+	authenticator *auth.Authenticator
+	// the keys of the scheduled messages are prefixed by the ID of the node, so that every node
+	// of a cluster having a shared KVStore delivers only the messages it scheduled
+	keyPrefix string
+
+	mu      sync.Mutex
+	pending entries
+	byID    map[string]*entry
+
+	wakeC chan struct{}
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+// entry is a scheduled message, as it is stored in the KVStore
+type entry struct {
+	ID        string    `json:"id"`
+	DeliverAt time.Time `json:"deliver_at"`
+	Message   string    `json:"message"`
+
+	index int
+}
+
+// scheduledMessage is the JSON representation of a scheduled message in the admin API
+type scheduledMessage struct {
+	ID        string            `json:"id"`
+	DeliverAt time.Time         `json:"deliver_at"`
+	Path      protocol.Path     `json:"path"`
+	UserID    string            `json:"user_id,omitempty"`
+	Filters   map[string]string `json:"filters,omitempty"`
+	Header    string            `json:"header,omitempty"`
+	Body      string            `json:"body"`
+}
+
+// New returns a new Scheduler wrapping the given router, having the admin API at the given prefix.
+func New(r router.Router, prefix string) (*Scheduler, error) {
+	kvStore, err := r.KVStore()
+	if err != nil {
+		return nil, err
+	}
+	var nodeID uint8
+	if r.Cluster() != nil {
+		nodeID = r.Cluster().Config.ID
+	}
+	return &Scheduler{
+		Router:    r,
+		kvStore:   kvStore,
+		prefix:    prefix,
+		keyPrefix: fmt.Sprintf("%d:", nodeID),
+		byID:      make(map[string]*entry),
+		wakeC:     make(chan struct{}, 1),
+	}, nil
+}
+
+// SetAuthenticator sets the authenticator of the requests to the admin API, which then requires the admin role.
+func (s *Scheduler) SetAuthenticator(authenticator *auth.Authenticator) {
+	s.authenticator = authenticator
+}
+
+// Start loads the scheduled messages from the KVStore, and starts delivering them when they are due.
+func (s *Scheduler) Start() error {
+	s.mu.Lock()
+	for kv := range s.kvStore.Iterate(schema, s.keyPrefix) {
+		e := &entry{}
+		if err := json.Unmarshal([]byte(kv[1]), e); err != nil {
+			logger.WithError(err).WithField("key", kv[0]).Error("Error decoding scheduled message")
+			continue
+		}
+		s.push(e)
+	}
+	logger.WithField("count", len(s.pending)).Info("Loaded scheduled messages")
+	s.mu.Unlock()
+
+	s.stopC = make(chan struct{})
+	s.wg.Add(1)
+	go s.loop()
+	return nil
+}
+
+// Stop stops delivering the scheduled messages; they remain stored in the KVStore.
+func (s *Scheduler) Stop() error {
+	close(s.stopC)
+	s.wg.Wait()
+	return nil
+}
+
+// HandleMessage schedules the message if it has a future delivery time,
+// otherwise it passes the message to the wrapped router.
+// The message is scheduled only if the wrapped router would not reject it now (see router.Validator).
+func (s *Scheduler) HandleMessage(message *protocol.Message) error {
+	if message.DeliverAt == nil || !message.DeliverAt.After(time.Now()) {
+		return s.Router.HandleMessage(message)
+	}
+	if message.Path.IsWildcard() {
+		return router.ErrWildcardTopic
+	}
+	if err := router.ValidateMessage(s.Router, message); err != nil {
+		return err
+	}
+
+	e := &entry{
+		ID:        xid.New().String(),
+		DeliverAt: *message.DeliverAt,
+		Message:   string(message.Encode()),
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := s.kvStore.Put(schema, s.keyPrefix+e.ID, data); err != nil {
+		logger.WithError(err).Error("Error storing scheduled message")
+		return err
+	}
+	logger.WithFields(log.Fields{
+		"id":        e.ID,
+		"path":      message.Path,
+		"deliverAt": e.DeliverAt,
+	}).Debug("Scheduled message")
+	mTotalScheduledMessages.Add(1)
+	pScheduledMessages.Inc()
+
+	s.mu.Lock()
+	s.push(e)
+	s.mu.Unlock()
+	s.wake()
+	return nil
+}
+
+// InterceptFetched passes the message fetched for the route to the delivery interceptors of the wrapped router.
+// It is a part of the router.FetchInterceptor implementation.
+func (s *Scheduler) InterceptFetched(route *router.Route, message *protocol.Message) *protocol.Message {
+	return router.InterceptFetched(s.Router, route, message)
+}
+
+// Cancel removes a scheduled message, returning false if it was not found (e.g. it was already delivered).
+func (s *Scheduler) Cancel(id string) (bool, error) {
+	s.mu.Lock()
+	e, ok := s.byID[id]
+	if ok {
+		heap.Remove(&s.pending, e.index)
+		delete(s.byID, id)
+		pPendingMessages.Dec()
+	}
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+
+	mTotalCanceledMessages.Add(1)
+	pCanceledMessages.Inc()
+	s.wake()
+	return true, s.kvStore.Delete(schema, s.keyPrefix+id)
+}
+
+// GetPrefix returns the prefix of the admin API.
+// It is a part of the service.endpoint implementation.
+func (s *Scheduler) GetPrefix() string {
+	return s.prefix
+}
+
+// ServeHTTP lists the scheduled messages on GET (optionally only the ones matching the `topic` query parameter),
+// and cancels a scheduled message on DELETE `<prefix>/<id>`.
+// If the authentication is enabled, the requests require the admin role.
+// It is a part of the service.endpoint implementation.
+func (s *Scheduler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.authenticator.AdminOnly(s.serveScheduled)(w, req)
+}
+
+func (s *Scheduler) serveScheduled(w http.ResponseWriter, req *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, s.prefix), "/")
+
+	switch {
+	case req.Method == http.MethodGet && id == "":
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.list(protocol.Path(req.URL.Query().Get("topic")))); err != nil {
+			logger.WithError(err).Error("Error encoding scheduled messages")
+		}
+	case req.Method == http.MethodDelete && id != "":
+		found, err := s.Cancel(id)
+		if err != nil {
+			logger.WithError(err).WithField("id", id).Error("Error deleting scheduled message")
+			http.Error(w, "Server error.", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, req)
+			return
+		}
+		fmt.Fprintf(w, "OK")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// list returns the scheduled messages ordered by their delivery time.
+// If a topic is given, only the messages published on it (or matching it, if it is a wildcard) are returned.
+func (s *Scheduler) list(topic protocol.Path) []scheduledMessage {
+	s.mu.Lock()
+	pending := make([]entry, 0, len(s.pending))
+	for _, e := range s.pending {
+		pending = append(pending, *e)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].DeliverAt.Before(pending[j].DeliverAt)
+	})
+
+	messages := make([]scheduledMessage, 0, len(pending))
+	for _, e := range pending {
+		m, err := protocol.ParseMessage([]byte(e.Message))
+		if err != nil {
+			continue
+		}
+		if topic != "" && m.Path != topic && !topic.Matches(m.Path) {
+			continue
+		}
+		messages = append(messages, scheduledMessage{
+			ID:        e.ID,
+			DeliverAt: e.DeliverAt,
+			Path:      m.Path,
+			UserID:    m.UserID,
+			Filters:   m.Filters,
+			Header:    m.HeaderJSON,
+			Body:      string(m.Body),
+		})
+	}
+	return messages
+}
+
+func (s *Scheduler) loop() {
+	defer s.wg.Done()
+
+	for {
+		timer := time.NewTimer(s.deliverDue())
+		select {
+		case <-timer.C:
+		case <-s.wakeC:
+			timer.Stop()
+		case <-s.stopC:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// wake signals the loop to recompute the time until the next due message
+func (s *Scheduler) wake() {
+	select {
+	case s.wakeC <- struct{}{}:
+	default:
+	}
+}
+
+// deliverDue delivers the due messages, and returns the duration until the next message is due.
+func (s *Scheduler) deliverDue() time.Duration {
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			s.mu.Unlock()
+			return maxWait
+		}
+		if wait := s.pending[0].DeliverAt.Sub(time.Now()); wait > 0 {
+			s.mu.Unlock()
+			return wait
+		}
+		e := heap.Pop(&s.pending).(*entry)
+		delete(s.byID, e.ID)
+		pPendingMessages.Dec()
+		s.mu.Unlock()
+
+		s.deliver(e)
+	}
+}
+
+// deliver passes the message to the router, and removes it from the KVStore.
+// A crash in between may lead to the message being delivered again after restart.
+// The delivery is retried later if the router failed to handle the message, unless it rejected the message.
+func (s *Scheduler) deliver(e *entry) {
+	flog := logger.WithField("id", e.ID)
+
+	m, err := protocol.ParseMessage([]byte(e.Message))
+	if err != nil {
+		flog.WithError(err).Error("Error decoding scheduled message, dropping it")
+	} else if err := s.Router.HandleMessage(m); err != nil && isRejection(err) {
+		flog.WithError(err).Error("Scheduled message rejected by the router, dropping it")
+		mTotalRejectedMessages.Add(1)
+		pRejectedMessages.Inc()
+	} else if err != nil && err != router.ErrDuplicateMessage {
+		flog.WithError(err).Error("Error handling scheduled message, retrying later")
+		mTotalDeliveryErrors.Add(1)
+		pDeliveryErrors.Inc()
+
+		e.DeliverAt = time.Now().Add(RetryInterval)
+		s.mu.Lock()
+		s.push(e)
+		s.mu.Unlock()
+		return
+	} else {
+		flog.WithField("messageID", m.ID).Debug("Delivered scheduled message")
+		mTotalDeliveredMessages.Add(1)
+		pDeliveredMessages.Inc()
+	}
+
+	if err := s.kvStore.Delete(schema, s.keyPrefix+e.ID); err != nil {
+		flog.WithError(err).Error("Error deleting delivered scheduled message")
+	}
+}
+
+// isRejection returns true if the router rejected the message, so that handling it again would fail the same way
+func isRejection(err error) bool {
+	if _, ok := err.(*router.RejectedError); ok {
+		return true
+	}
+	return err == router.ErrWildcardTopic || err == router.ErrInvalidDelivery || err == router.ErrAccessDenied
+}
+
+// push adds an entry to the pending messages; it is called while holding the lock
+func (s *Scheduler) push(e *entry) {
+	heap.Push(&s.pending, e)
+	s.byID[e.ID] = e
+	pPendingMessages.Inc()
+}
+
+// entries is a heap of scheduled messages, ordered by their delivery time
+type entries []*entry
+
+func (h entries) Len() int           { return len(h) }
+func (h entries) Less(i, j int) bool { return h[i].DeliverAt.Before(h[j].DeliverAt) }
+
+func (h entries) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *entries) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *entries) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
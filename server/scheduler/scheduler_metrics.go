@@ -0,0 +1,14 @@
+package scheduler
+
+import (
+	"github.com/cosminrentea/expvarmetrics"
+)
+
+var (
+	ns                      = metrics.NS("scheduler")
+	mTotalScheduledMessages = ns.NewInt("total_scheduled_messages")
+	mTotalDeliveredMessages = ns.NewInt("total_delivered_messages")
+	mTotalCanceledMessages  = ns.NewInt("total_canceled_messages")
+	mTotalDeliveryErrors    = ns.NewInt("total_delivery_errors")
+	mTotalRejectedMessages  = ns.NewInt("total_rejected_messages")
+)
@@ -0,0 +1,48 @@
+package scheduler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pScheduledMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scheduler_scheduled_messages",
+		Help: "Number of messages published for a later delivery",
+	})
+
+	pDeliveredMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scheduler_delivered_messages",
+		Help: "Number of scheduled messages passed to the router when due",
+	})
+
+	pCanceledMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scheduler_canceled_messages",
+		Help: "Number of canceled scheduled messages",
+	})
+
+	pDeliveryErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scheduler_delivery_errors",
+		Help: "Number of errors when passing scheduled messages to the router",
+	})
+
+	pRejectedMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scheduler_rejected_messages",
+		Help: "Number of scheduled messages rejected by the router when due, which are dropped",
+	})
+
+	pPendingMessages = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "scheduler_pending_messages",
+		Help: "Number of scheduled messages waiting for their delivery time",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		pScheduledMessages,
+		pDeliveredMessages,
+		pCanceledMessages,
+		pDeliveryErrors,
+		pRejectedMessages,
+		pPendingMessages,
+	)
+}
@@ -0,0 +1,228 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/auth"
+	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/router"
+	"github.com/cosminrentea/gobbler/server/store/dummystore"
+)
+
+type testRouter interface {
+	router.Router
+	Start() error
+	Stop() error
+}
+
+func newTestScheduler(a *assert.Assertions, kvStore kvstore.KVStore) (*Scheduler, testRouter) {
+	r := router.New(dummystore.New(kvstore.NewMemoryKVStore()), kvStore, nil).(testRouter)
+	a.NoError(r.Start())
+	s, err := New(r, "/admin/scheduled")
+	a.NoError(err)
+	a.NoError(s.Start())
+	return s, r
+}
+
+func subscribe(a *assert.Assertions, r router.Router, path string) *router.Route {
+	route := router.NewRoute(router.RouteConfig{
+		RouteParams: router.RouteParams{"application_id": "app", "user_id": "user"},
+		Path:        protocol.Path(path),
+		ChannelSize: 10,
+	})
+	_, err := r.Subscribe(route)
+	a.NoError(err)
+	return route
+}
+
+func delayedMessage(path, body string, deliverAt time.Time) *protocol.Message {
+	return &protocol.Message{Path: protocol.Path(path), Body: []byte(body), DeliverAt: &deliverAt}
+}
+
+func receive(route *router.Route, timeout time.Duration) *protocol.Message {
+	select {
+	case m := <-route.MessagesChannel():
+		return m
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestScheduler_DeliverWhenDue(t *testing.T) {
+	a := assert.New(t)
+	s, r := newTestScheduler(a, kvstore.NewMemoryKVStore())
+	defer r.Stop()
+	defer s.Stop()
+	route := subscribe(a, s, "/topic")
+
+	a.NoError(s.HandleMessage(delayedMessage("/topic", "later", time.Now().Add(50*time.Millisecond))))
+	a.NoError(s.HandleMessage(&protocol.Message{Path: "/topic", Body: []byte("now")}))
+	a.NoError(s.HandleMessage(delayedMessage("/topic", "past", time.Now().Add(-time.Second))))
+
+	a.Equal("now", string(receive(route, 50*time.Millisecond).Body))
+	a.Equal("past", string(receive(route, 50*time.Millisecond).Body))
+	a.Nil(receive(route, 10*time.Millisecond))
+	a.Len(s.list(""), 1)
+
+	m := receive(route, 200*time.Millisecond)
+	a.NotNil(m)
+	a.Equal("later", string(m.Body))
+	a.True(m.ID > 0)
+	a.Len(s.list(""), 0)
+
+	a.Equal(router.ErrWildcardTopic, s.HandleMessage(delayedMessage("/topic/*", "wildcard", time.Now().Add(time.Hour))))
+}
+
+func TestScheduler_Restart(t *testing.T) {
+	a := assert.New(t)
+	kvStore := kvstore.NewMemoryKVStore()
+
+	s, r := newTestScheduler(a, kvStore)
+	a.NoError(s.HandleMessage(delayedMessage("/topic", "later", time.Now().Add(100*time.Millisecond))))
+	a.NoError(s.Stop())
+	a.NoError(r.Stop())
+
+	s, r = newTestScheduler(a, kvStore)
+	defer r.Stop()
+	defer s.Stop()
+	route := subscribe(a, s, "/topic")
+
+	messages := s.list("")
+	a.Len(messages, 1)
+	a.Equal(protocol.Path("/topic"), messages[0].Path)
+	a.Equal("later", messages[0].Body)
+
+	m := receive(route, 300*time.Millisecond)
+	a.NotNil(m)
+	a.Equal("later", string(m.Body))
+}
+
+func TestScheduler_ListAndCancel(t *testing.T) {
+	a := assert.New(t)
+	s, r := newTestScheduler(a, kvstore.NewMemoryKVStore())
+	defer r.Stop()
+	defer s.Stop()
+
+	a.NoError(s.HandleMessage(delayedMessage("/foo/a", "second", time.Now().Add(2*time.Hour))))
+	a.NoError(s.HandleMessage(delayedMessage("/foo/b", "first", time.Now().Add(time.Hour))))
+	a.NoError(s.HandleMessage(delayedMessage("/bar", "third", time.Now().Add(3*time.Hour))))
+
+	list := func(query string) (messages []scheduledMessage) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/scheduled"+query, nil))
+		a.Equal(http.StatusOK, w.Code)
+		a.NoError(json.Unmarshal(w.Body.Bytes(), &messages))
+		return
+	}
+
+	messages := list("")
+	a.Len(messages, 3)
+	a.Equal("first", messages[0].Body)
+	a.Equal("second", messages[1].Body)
+	a.Equal("third", messages[2].Body)
+
+	a.Len(list("?topic=/bar"), 1)
+	a.Len(list("?topic=/foo/*"), 2)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/scheduled/"+messages[0].ID, nil))
+	a.Equal(http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/scheduled/"+messages[0].ID, nil))
+	a.Equal(http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/scheduled", nil))
+	a.Equal(http.StatusMethodNotAllowed, w.Code)
+
+	messages = list("")
+	a.Len(messages, 2)
+	a.Equal("second", messages[0].Body)
+
+	count := 0
+	for range s.kvStore.IterateKeys(schema, "") {
+		count++
+	}
+	a.Equal(2, count)
+}
+
+func TestScheduler_AdminAPIAuthentication(t *testing.T) {
+	a := assert.New(t)
+	s, r := newTestScheduler(a, kvstore.NewMemoryKVStore())
+	defer r.Stop()
+	defer s.Stop()
+	s.SetAuthenticator(auth.NewAuthenticator(auth.NewAPIKeyVerifier(map[string]*auth.Identity{
+		"key1":  {UserID: "marvin"},
+		"admin": {UserID: "root", Roles: []string{auth.AdminRole}},
+	})))
+	a.NoError(s.HandleMessage(delayedMessage("/foo", "scheduled", time.Now().Add(time.Hour))))
+	id := s.list("")[0].ID
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		for token, expectedCode := range map[string]int{"": http.StatusUnauthorized, "key1": http.StatusForbidden} {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "/admin/scheduled/"+id, nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			s.ServeHTTP(w, req)
+			a.Equal(expectedCode, w.Code, method+" "+token)
+		}
+	}
+	a.Len(s.list(""), 1)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodDelete, "/admin/scheduled/"+id, nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	s.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+	a.Len(s.list(""), 0)
+}
+
+// rejectAll is an interceptor rejecting all the messages, counting them
+type rejectAll struct {
+	count int32
+}
+
+func (r *rejectAll) InterceptMessage(message *protocol.Message) error {
+	atomic.AddInt32(&r.count, 1)
+	return &router.RejectedError{Reason: "rejected"}
+}
+
+func TestScheduler_Rejections(t *testing.T) {
+	a := assert.New(t)
+	defer func(interval time.Duration) { RetryInterval = interval }(RetryInterval)
+	RetryInterval = 10 * time.Millisecond
+
+	kvStore := kvstore.NewMemoryKVStore()
+	s, r := newTestScheduler(a, kvStore)
+	defer r.Stop()
+	defer s.Stop()
+
+	// the messages are checked by the interceptors when they are scheduled
+	r.(router.InterceptorRegistry).AddInterceptor(router.MaxBodySize(5))
+	err := s.HandleMessage(delayedMessage("/topic", "too large", time.Now().Add(time.Hour)))
+	a.IsType(&router.RejectedError{}, err)
+	a.Len(s.list(""), 0)
+
+	// a message rejected when it is due is dropped instead of being retried
+	a.NoError(s.HandleMessage(delayedMessage("/topic", "later", time.Now().Add(20*time.Millisecond))))
+	interceptor := &rejectAll{}
+	r.(router.InterceptorRegistry).AddInterceptor(interceptor)
+	time.Sleep(100 * time.Millisecond)
+
+	a.Equal(int32(1), atomic.LoadInt32(&interceptor.count))
+	a.Len(s.list(""), 0)
+	for range kvStore.Iterate(schema, "") {
+		a.Fail("the rejected message is still stored")
+	}
+}
@@ -39,7 +39,8 @@ func (criteria by) sort(modules []module) {
 		modules: modules,
 		by:      criteria,
 	}
-	sort.Sort(ms)
+	// the modules having the same order keep their registration order
+	sort.Stable(ms)
 }
 
 // functions implementing the sort.Interface
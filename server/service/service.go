@@ -99,6 +99,7 @@ func (s *Service) TogglesEndpoint(endpointPrefix string) *Service {
 }
 
 // Start the health-check, old-format metrics, and Prometheus metrics endpoint,
+// adds the modules which are router interceptors to the router (in their start order),
 // and then check the modules for the following interfaces and registers and/or start:
 //   Startable:
 //   health.Checker:
@@ -129,6 +130,7 @@ func (s *Service) Start() error {
 	} else {
 		logger.Info("Toggles endpoint disabled")
 	}
+	s.registerInterceptors()
 	for order, iface := range s.ModulesSortedByStartOrder() {
 		name := reflect.TypeOf(iface).String()
 		if s, ok := iface.(Startable); ok {
@@ -146,6 +148,10 @@ func (s *Service) Start() error {
 		}
 		if e, ok := iface.(Endpoint); ok {
 			prefix := e.GetPrefix()
+			if prefix == "" {
+				logger.WithField("name", name).Info("Endpoint disabled")
+				continue
+			}
 			logger.WithFields(log.Fields{"name": name, "prefix": prefix}).Info("Registering module as Endpoint")
 			s.webserver.Handle(prefix, e)
 		}
@@ -170,6 +176,26 @@ func (s *Service) Stop() error {
 	return multierr.ErrorOrNil()
 }
 
+// registerInterceptors adds to the router the modules implementing router.Interceptor or router.DeliveryInterceptor,
+// in the start order of the modules
+func (s *Service) registerInterceptors() {
+	registry, ok := s.router.(router.InterceptorRegistry)
+	if !ok {
+		return
+	}
+	for _, iface := range s.ModulesSortedByStartOrder() {
+		name := reflect.TypeOf(iface).String()
+		if i, ok := iface.(router.Interceptor); ok {
+			logger.WithField("name", name).Info("Registering module as message interceptor")
+			registry.AddInterceptor(i)
+		}
+		if i, ok := iface.(router.DeliveryInterceptor); ok {
+			logger.WithField("name", name).Info("Registering module as delivery interceptor")
+			registry.AddDeliveryInterceptor(i)
+		}
+	}
+}
+
 // WebServer returns the service *webserver.WebServer instance
 func (s *Service) WebServer() *webserver.WebServer {
 	return s.webserver
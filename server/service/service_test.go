@@ -1,7 +1,9 @@
 package service
 
 import (
+	"github.com/cosminrentea/gobbler/protocol"
 	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/router"
 	"github.com/cosminrentea/gobbler/server/store"
 	"github.com/cosminrentea/gobbler/server/store/dummystore"
 	"github.com/cosminrentea/gobbler/server/webserver"
@@ -189,6 +191,28 @@ func TestPrometheusMetricsEnabled(t *testing.T) {
 	a.True(len(body) > 0)
 }
 
+func TestInterceptorsRegistration(t *testing.T) {
+	defer testutil.ResetDefaultRegistryHealthCheck()
+	a := assert.New(t)
+
+	// given: a service with interceptor modules
+	kvStore := kvstore.NewMemoryKVStore()
+	r := router.New(dummystore.New(kvStore), kvStore, nil)
+	service := New(r, webserver.New("localhost:0"))
+	var calls []string
+	service.RegisterModules(5, 0, &testInterceptor{name: "last", calls: &calls})
+	service.RegisterModules(4, 0, &testInterceptor{name: "first", calls: &calls})
+	service.RegisterModules(4, 0, &testInterceptor{name: "second", calls: &calls})
+
+	// when starting the service and publishing a message
+	a.NoError(service.Start())
+	defer service.Stop()
+	a.NoError(r.HandleMessage(&protocol.Message{Path: "/foo"}))
+
+	// then the interceptors are called in the start order of the modules
+	a.Equal([]string{"first", "second", "last"}, calls)
+}
+
 func aMockedServiceWithMockedRouterStandalone() (*Service, kvstore.KVStore, store.MessageStore, *MockRouter) {
 	kvStore := kvstore.NewMemoryKVStore()
 	messageStore := dummystore.New(kvStore)
@@ -223,3 +247,13 @@ type testStopable struct {
 func (*testStopable) Stop() error {
 	panic(fmt.Errorf("In a panic when I should stop"))
 }
+
+type testInterceptor struct {
+	name  string
+	calls *[]string
+}
+
+func (i *testInterceptor) InterceptMessage(message *protocol.Message) error {
+	*i.calls = append(*i.calls, i.name)
+	return nil
+}
@@ -55,6 +55,7 @@ var (
 	ErrLastIDCouldNotBeSet         = errors.New("Setting last id failed")
 	errKafkaReportingConfiguration = errors.New("Kafka Reporting for Nexmo is not correctly configured")
 	ErrSmsTooLong                  = errors.New("Sms maximum length exceeded")
+	ErrMessageExpired              = errors.New("Sms message expired")
 )
 
 var nexmoResponseCodeMap = map[ResponseCode]string{
@@ -202,6 +203,25 @@ func (ns *NexmoSender) Send(msg *protocol.Message) error {
 		return ErrSmsTooLong
 	}
 
+	event := &ReportEvent{
+		Type: "tour_arrival_estimate_regular_delivered",
+		Payload: ReportPayload{
+			MessageID: msg.CorrelationID(),
+			OrderID:   nexmoSMS.ClientRef,
+			SmsText:   nexmoSMS.Text,
+		},
+	}
+
+	if msg.IsExpired() {
+		logger.WithField("sms", nexmoSMS).WithField("expires", msg.Expires).Info("Sms message expired, not sending it")
+		event.Payload.SmsRequestTime = time.Now().UTC().Format(time.RFC3339)
+		expiredReport := NexmoMessageReport{To: nexmoSMS.To, Status: ResponseInvalidTTL, ErrorText: "Expired"}
+		if err := event.report(expiredReport, ns.kafkaProducer, ns.kafkaReportingTopic); err != nil && err != errKafkaReportingConfiguration {
+			logger.WithError(err).Error("Could not report expired sms to Kafka topic")
+		}
+		return ErrMessageExpired
+	}
+
 	withRetry := &retryable{
 		maxTries: 3,
 		Backoff: backoff.Backoff{
@@ -217,14 +237,7 @@ func (ns *NexmoSender) Send(msg *protocol.Message) error {
 		},
 		ns.kafkaProducer,
 		ns.kafkaReportingTopic,
-		&ReportEvent{
-			Type: "tour_arrival_estimate_regular_delivered",
-			Payload: ReportPayload{
-				MessageID: msg.CorrelationID(),
-				OrderID:   nexmoSMS.ClientRef,
-				SmsText:   nexmoSMS.Text,
-			},
-		})
+		event)
 	if err == ErrRetryFailed {
 		logger.WithField("msg", msg).Info("Retry failed or not necessary.Moving on")
 	}
@@ -100,3 +100,26 @@ func TestNexmoSender_SendReport(t *testing.T) {
 	a.NoError(err)
 	readServedResponses(t, 1, countCh)
 }
+
+func TestNexmoSender_SendExpired(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	producer := NewMockProducer(ctrl)
+	nexmoSender, err := NewNexmoSender(KEY, SECRET, producer, "sms_reporting")
+	a.NoError(err)
+
+	msg := encodeProtocolMessage(t, 0, "body")
+	expires := time.Now().Add(-time.Minute)
+	msg.Expires = &expires
+
+	producer.EXPECT().Report("sms_reporting", gomock.Any(), gomock.Any()).Do(func(topic string, bytes []byte, key string) {
+		var event ReportEvent
+		a.NoError(json.Unmarshal(bytes, &event))
+		a.Equal("toNumber", event.Payload.MobileNumber)
+		a.Equal("Expired", event.Payload.DeliveryStatus)
+		a.Equal("body", event.Payload.SmsText)
+	})
+	a.Equal(ErrMessageExpired, nexmoSender.Send(&msg))
+}
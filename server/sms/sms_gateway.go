@@ -29,6 +29,8 @@ type Config struct {
 	SMSTopic        *string
 	IntervalMetrics *bool
 	Toggleable      *bool
+	QueueSize       *int
+	Backpressure    *string
 
 	Name   string
 	Schema string
@@ -96,6 +98,12 @@ func (g *gateway) initRoute(fetch bool) {
 		QueueSize:   -1,
 		Timeout:     -1,
 	})
+	if g.config.QueueSize != nil && *g.config.QueueSize > 0 {
+		g.route.QueueSize = *g.config.QueueSize
+	}
+	if g.config.Backpressure != nil {
+		g.route.Backpressure = router.BackpressurePolicy(*g.config.Backpressure)
+	}
 	if fetch || !*g.config.Toggleable {
 		g.route.FetchRequest = g.fetchRequest()
 	}
@@ -172,7 +180,7 @@ func (g *gateway) proxyLoop() error {
 			}
 
 			err := g.send(receivedMsg)
-			if err == ErrRetryFailed || err == ErrLastIDCouldNotBeSet || err == ErrSmsTooLong {
+			if err == ErrRetryFailed || err == ErrLastIDCouldNotBeSet || err == ErrSmsTooLong || err == ErrMessageExpired {
 				// THIS MAY BE BLOCKING.Maybe not a good idea.
 				for errSetLastSentId := g.SetLastSentID(receivedMsg.ID); errSetLastSentId != nil; {
 					g.logger.WithError(errSetLastSentId).Error("Error setting last ID, retrying")
@@ -195,6 +203,11 @@ func (g *gateway) proxyLoop() error {
 
 func (g *gateway) send(receivedMsg *protocol.Message) error {
 	err := g.sender.Send(receivedMsg)
+	if err == ErrMessageExpired {
+		mTotalExpiredMessages.Add(1)
+		pExpired.Inc()
+		return err
+	}
 	if err != nil {
 		log.WithField("error", err.Error()).Error("Sending of message failed")
 		mTotalResponseErrors.Add(1)
@@ -311,6 +324,7 @@ func (g *gateway) Cancel() {
 
 func (g *gateway) startMetrics() {
 	mTotalSentMessages.Set(0)
+	mTotalExpiredMessages.Set(0)
 	mTotalSendErrors.Set(0)
 	mTotalResponseErrors.Set(0)
 	mTotalResponseInternalErrors.Set(0)
@@ -8,6 +8,7 @@ import (
 var (
 	ns                           = metrics.NS("sms")
 	mTotalSentMessages           = ns.NewInt("total_sent_messages")
+	mTotalExpiredMessages        = ns.NewInt("total_expired_messages")
 	mTotalSendErrors             = ns.NewInt("total_sent_message_errors")
 	mTotalResponseErrors         = ns.NewInt("total_response_errors")
 	mTotalResponseInternalErrors = ns.NewInt("total_response_internal_errors")
@@ -8,6 +8,11 @@ var (
 		Help: "Number of sms sent to the SMS service",
 	})
 
+	pExpired = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sms_expired",
+		Help: "Number of expired sms which were not sent to the SMS service",
+	})
+
 	pNexmoSendErrors = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "sms_nexmo_send_errors",
 		Help: "Number of errors while trying to send sms to Nexmo",
@@ -27,6 +32,7 @@ var (
 func init() {
 	prometheus.MustRegister(
 		pSent,
+		pExpired,
 		pNexmoSendErrors,
 		pNexmoResponseErrors,
 		pNexmoResponseInternalErrors,
@@ -32,8 +32,32 @@ func (c *cache) add(entry *cacheEntry) {
 	c.entries = append(c.entries, entry)
 }
 
+// containsFile returns true if the file at the position is full
+func (c *cache) containsFile(fileID int) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	for _, entry := range c.entries {
+		if entry.fileID == fileID {
+			return true
+		}
+	}
+	return false
+}
+
+// removeFirst removes the entry of the oldest file
+func (c *cache) removeFirst() {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.entries) > 0 {
+		c.entries = c.entries[1:]
+	}
+}
+
 type cacheEntry struct {
 	min, max uint64
+	fileID   int // the position of the file
 }
 
 // Contains returns true if the req.StartID is between the min and max
@@ -0,0 +1,19 @@
+package filestore
+
+import (
+	"github.com/cosminrentea/expvarmetrics"
+)
+
+var (
+	ns                    = metrics.NS("filestore")
+	mTotalCorruptReads    = ns.NewInt("total_corrupt_reads")
+	mTotalScrubs          = ns.NewInt("total_scrubs")
+	mCorruptMessages      = ns.NewInt("corrupt_messages")
+	mTotalRecoveries      = ns.NewInt("total_recoveries")
+	mTotalSyncs           = ns.NewInt("total_syncs")
+	mTotalSyncedWrites    = ns.NewInt("total_synced_writes")
+	mTotalDeletedFiles    = ns.NewInt("total_deleted_files")
+	mTotalDeletedMessages = ns.NewInt("total_deleted_messages")
+	mTotalFileReads       = ns.NewInt("total_file_reads")
+	mTotalHotReads        = ns.NewInt("total_hot_reads")
+)
@@ -0,0 +1,72 @@
+package filestore
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pCorruptReads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "filestore_corrupt_reads",
+		Help: "Number of corrupt messages skipped when fetching messages",
+	})
+
+	pScrubs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "filestore_scrubs",
+		Help: "Number of completed verifications of the checksums of all the stored messages",
+	})
+
+	pCorruptMessages = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "filestore_corrupt_messages",
+		Help: "Number of corrupt messages found by the last verification of the stored messages",
+	})
+
+	pRecoveries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "filestore_recoveries",
+		Help: "Number of partitions whose index files were rebuilt from their message files",
+	})
+
+	pSyncs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "filestore_syncs",
+		Help: "Number of syncs of the files of the partitions to the disk",
+	})
+
+	pSyncedWrites = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "filestore_synced_writes",
+		Help: "Number of messages made durable by the syncs of the files of the partitions",
+	})
+
+	pDeletedFiles = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "filestore_deleted_files",
+		Help: "Number of message files deleted by the retention policies",
+	})
+
+	pDeletedMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "filestore_deleted_messages",
+		Help: "Number of messages deleted by the retention policies",
+	})
+
+	pFileReads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "filestore_file_reads",
+		Help: "Number of reads of message files by the fetches, each one reading the messages stored contiguously",
+	})
+
+	pHotReads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "filestore_hot_reads",
+		Help: "Number of fetched messages read from the memory, among the last messages stored",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		pCorruptReads,
+		pScrubs,
+		pCorruptMessages,
+		pRecoveries,
+		pSyncs,
+		pSyncedWrites,
+		pDeletedFiles,
+		pDeletedMessages,
+		pFileReads,
+		pHotReads,
+	)
+}
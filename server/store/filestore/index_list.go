@@ -208,12 +208,6 @@ func (l *indexList) extract(req *store.FetchRequest) *indexList {
 
 	for potentialEntries.len() < req.Count && currentPos >= 0 && currentPos < l.len() {
 		elem := l.get(currentPos)
-		logger.WithFields(log.Fields{
-			"elem":       *elem,
-			"currentPos": currentPos,
-			"req":        *req,
-		}).Debug("Elem in retrieve")
-
 		if elem == nil {
 			logger.WithFields(log.Fields{
 				"pos":     currentPos,
@@ -224,6 +218,12 @@ func (l *indexList) extract(req *store.FetchRequest) *indexList {
 			}).Error("Error in retrieving from list.Got nil entry")
 			break
 		}
+		logger.WithFields(log.Fields{
+			"elem":       *elem,
+			"currentPos": currentPos,
+			"startID":    req.StartID,
+			"count":      req.Count,
+		}).Debug("Elem in retrieve")
 
 		potentialEntries.insert(elem)
 		currentPos += int(req.Direction)
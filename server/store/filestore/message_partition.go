@@ -1,8 +1,11 @@
 package filestore
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -10,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/cosminrentea/gobbler/protocol"
 	"github.com/cosminrentea/gobbler/server/store"
 
 	"io"
@@ -19,9 +23,28 @@ import (
 
 var (
 	magicNumber       = []byte{42, 249, 180, 108, 82, 75, 222, 182}
-	fileFormatVersion = []byte{1}
+	fileFormatVersion = []byte{formatVersion2}
 	messagesPerFile   = uint64(10000)
 	indexEntrySize    = 20
+
+	// crcTable is used for the CRC-32C (Castagnoli) checksums of the messages
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrCorruptMessage is returned when a stored message does not match its checksum, or is truncated.
+	ErrCorruptMessage = errors.New("Message is corrupt. The stored data does not match its checksum.")
+
+	// ErrInvalidFile is returned when a .msg file has an unknown magic number or format version.
+	ErrInvalidFile = errors.New("Invalid message file. Unknown magic number or format version.")
+)
+
+const (
+	// the messages of the .msg files with format version 1 have a 12 bytes header: the size and the ID
+	formatVersion1 = 1
+	// the messages of the .msg files with format version 2 have a 16 bytes header: the size, the ID and the CRC-32C of the data
+	formatVersion2 = 2
+
+	fileHeaderSize = 9 // the magic number and the format version
+	checksumSize   = 4
 )
 
 const (
@@ -43,6 +66,7 @@ type messagePartition struct {
 	basedir               string
 	name                  string
 	appendFile            *os.File
+	appendFileVersion     byte
 	indexFile             *os.File
 	appendFilePosition    uint64
 	maxMessageID          uint64
@@ -51,17 +75,32 @@ type messagePartition struct {
 	entriesCount          uint64
 	list                  *indexList
 	fileCache             *cache
+	firstFileID           int // the position of the oldest file, once the older ones are deleted by the retention
+	retention             RetentionPolicy
+	segments              *segmentCache
+	hotMessages           *hotCache
+
+	syncPolicy   SyncPolicy
+	written      uint64 // the number of writes, compared to the number of writes synced
+	syncedWrites uint64
+	syncMutex    sync.Mutex
+	groupSync    *groupSync
 
 	sync.RWMutex
 }
 
 func newMessagePartition(basedir string, storeName string) (*messagePartition, error) {
 	p := &messagePartition{
-		basedir:   basedir,
-		name:      storeName,
-		list:      newIndexList(int(messagesPerFile)),
-		fileCache: newCache(),
-	}
+		basedir:     basedir,
+		name:        storeName,
+		list:        newIndexList(int(messagesPerFile)),
+		fileCache:   newCache(),
+		syncPolicy:  Durability,
+		groupSync:   newGroupSync(),
+		retention:   retentionPolicy(storeName),
+		hotMessages: newHotCache(HotMessages),
+	}
+	p.segments = newSegmentCache(MaxOpenFiles, p.openSegment)
 	return p, p.initialize()
 }
 
@@ -87,6 +126,14 @@ func (p *messagePartition) initialize() error {
 	p.Lock()
 	defer p.Unlock()
 
+	// the .idx files are rebuilt if they do not match the .msg files, after a crash
+	if !p.checkFiles() {
+		if err := p.recoverFiles(); err != nil {
+			logger.WithField("err", err).Error("MessagePartition error on recoverFiles")
+			return err
+		}
+	}
+
 	// reset the cache entries
 	p.fileCache = newCache()
 	err := p.readIdxFiles()
@@ -101,18 +148,16 @@ func (p *messagePartition) initialize() error {
 // Returns the start messages ids for all available message files
 // in a sorted list
 func (p *messagePartition) readIdxFiles() error {
-	allFiles, err := ioutil.ReadDir(p.basedir)
+	fileIDs, err := p.fileIDs(".idx")
 	if err != nil {
 		return err
 	}
 
 	var indexFilenames []string
-	for _, fileInfo := range allFiles {
-		if strings.HasPrefix(fileInfo.Name(), p.name+"-") && strings.HasSuffix(fileInfo.Name(), ".idx") {
-			fileIDString := filepath.Join(p.basedir, fileInfo.Name())
-			logger.WithField("name", fileIDString).Info("Index name")
-			indexFilenames = append(indexFilenames, fileIDString)
-		}
+	for _, fileID := range fileIDs {
+		fileIDString := p.composeIdxFilenameForPosition(uint64(fileID))
+		logger.WithField("name", fileIDString).Info("Index name")
+		indexFilenames = append(indexFilenames, fileIDString)
 	}
 
 	// if no .idx file are found.. there is nothing to load
@@ -120,6 +165,7 @@ func (p *messagePartition) readIdxFiles() error {
 		logger.Info("No .idx files found")
 		return nil
 	}
+	p.firstFileID = fileIDs[0]
 
 	//load the filecache from all the files
 	logger.WithFields(log.Fields{
@@ -136,6 +182,7 @@ func (p *messagePartition) readIdxFiles() error {
 			}).Error("Error loading existing .idxFile")
 			return err
 		}
+		cEntry.fileID = fileIDs[i]
 		//add to total number of messages per partition
 		p.totalNumberOfMessages += messagesPerFile
 
@@ -212,12 +259,12 @@ func readCacheEntryFromIdxFile(filename string) (entry *cacheEntry, err error) {
 		return
 	}
 
-	entry = &cacheEntry{min, max}
+	entry = &cacheEntry{min: min, max: max}
 	return
 }
 
 func (p *messagePartition) createNextAppendFiles() error {
-	filename := p.composeMsgFilenameForPosition(uint64(p.fileCache.length()))
+	filename := p.composeMsgFilenameForPosition(uint64(p.currentFileID()))
 	logger.WithField("filename", filename).Info("Creating next append files")
 
 	appendfile, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
@@ -240,14 +287,31 @@ func (p *messagePartition) createNextAppendFiles() error {
 		}
 	}
 
-	indexfile, errIndex := os.OpenFile(p.composeIdxFilenameForPosition(uint64(p.fileCache.length())), os.O_RDWR|os.O_CREATE, 0666)
+	// the messages are appended in the format of the existing file
+	version, err := readFileVersion(appendfile)
+	if err != nil {
+		appendfile.Close()
+		return err
+	}
+
+	indexfile, errIndex := os.OpenFile(p.composeIdxFilenameForPosition(uint64(p.currentFileID())), os.O_RDWR|os.O_CREATE, 0666)
 	if errIndex != nil {
 		defer appendfile.Close()
 		defer os.Remove(appendfile.Name())
 		return err
 	}
 
+	// the new files are durable once their directory is synced
+	if p.syncPolicy != SyncNone {
+		if err := syncDir(p.basedir); err != nil {
+			appendfile.Close()
+			indexfile.Close()
+			return err
+		}
+	}
+
 	p.appendFile = appendfile
+	p.appendFileVersion = version
 	p.indexFile = indexfile
 	stat, err := appendfile.Stat()
 	if err != nil {
@@ -294,7 +358,9 @@ func (p *messagePartition) Close() error {
 	p.Lock()
 	defer p.Unlock()
 
-	return p.closeAppendFiles()
+	p.segments.clear()
+	p.hotMessages.clear()
+	return p.syncAndCloseAppendFiles()
 }
 
 func (p *messagePartition) DoInTx(fnToExecute func(maxMessageId uint64) error) error {
@@ -303,11 +369,17 @@ func (p *messagePartition) DoInTx(fnToExecute func(maxMessageId uint64) error) e
 	return fnToExecute(p.maxMessageID)
 }
 
+// Store stores a message, returning once it is synced to the disk if the sync policy is SyncAlways
 func (p *messagePartition) Store(msgID uint64, msg []byte) error {
 	p.Lock()
-	defer p.Unlock()
+	err := p.store(msgID, msg)
+	written := p.written
+	p.Unlock()
 
-	return p.store(msgID, msg)
+	if err != nil || p.syncPolicy != SyncAlways {
+		return err
+	}
+	return p.groupSync.wait(p, written)
 }
 
 func (p *messagePartition) store(messageID uint64, data []byte) error {
@@ -321,7 +393,7 @@ func (p *messagePartition) store(messageID uint64, data []byte) error {
 			"fileCache":    p.fileCache,
 		}).Debug("store")
 
-		if err := p.closeAppendFiles(); err != nil {
+		if err := p.syncAndCloseAppendFiles(); err != nil {
 			return err
 		}
 
@@ -333,20 +405,26 @@ func (p *messagePartition) store(messageID uint64, data []byte) error {
 			}).Info("Dumping current file")
 
 			//sort the indexFile
-			err := p.rewriteSortedIdxFile(p.composeIdxFilenameForPosition(uint64(p.fileCache.length())))
+			err := p.rewriteSortedIdxFile(p.composeIdxFilenameForPosition(uint64(p.currentFileID())))
 			if err != nil {
 				logger.WithError(err).Error("Error dumping file")
 				return err
 			}
 			//Add items in the filecache
 			p.fileCache.add(&cacheEntry{
-				min: p.list.front().id,
-				max: p.list.back().id,
+				min:    p.list.front().id,
+				max:    p.list.back().id,
+				fileID: p.currentFileID(),
 			})
 
 			//clear the current sorted cache
 			p.list.clear()
 			p.entriesCount = 0
+
+			// the full file may exceed the retention policy
+			if _, err := p.applyRetention(time.Now()); err != nil {
+				logger.WithError(err).Error("Error applying the retention policy")
+			}
 		}
 
 		if err := p.createNextAppendFiles(); err != nil {
@@ -354,12 +432,16 @@ func (p *messagePartition) store(messageID uint64, data []byte) error {
 		}
 	}
 
-	// write the message size and the message id: 32 bit and 64 bit, so 12 bytes
-	sizeAndID := make([]byte, 12)
-	binary.LittleEndian.PutUint32(sizeAndID, uint32(len(data)))
-	binary.LittleEndian.PutUint64(sizeAndID[4:], messageID)
+	// write the message size and the message id: 32 bit and 64 bit, so 12 bytes,
+	// followed since the format version 2 by the 32 bit checksum of the message
+	header := make([]byte, messageHeaderSize(p.appendFileVersion))
+	binary.LittleEndian.PutUint32(header, uint32(len(data)))
+	binary.LittleEndian.PutUint64(header[4:], messageID)
+	if p.appendFileVersion >= formatVersion2 {
+		binary.LittleEndian.PutUint32(header[12:], crc32.Checksum(data, crcTable))
+	}
 
-	if _, err := p.appendFile.Write(sizeAndID); err != nil {
+	if _, err := p.appendFile.Write(header); err != nil {
 		return err
 	}
 
@@ -369,13 +451,15 @@ func (p *messagePartition) store(messageID uint64, data []byte) error {
 	}
 
 	// write the index entry to the index file
-	messageOffset := p.appendFilePosition + uint64(len(sizeAndID))
+	messageOffset := p.appendFilePosition + uint64(len(header))
 	err := writeIndexEntry(p.indexFile, messageID, messageOffset, uint32(len(data)), p.entriesCount)
 	if err != nil {
 		return err
 	}
 	p.entriesCount++
 	p.totalNumberOfMessages++
+	p.written++
+	p.hotMessages.add(messageID, data)
 
 	logger.WithFields(log.Fields{
 		"entriesInIndexFile": p.entriesCount,
@@ -390,11 +474,11 @@ func (p *messagePartition) store(messageID uint64, data []byte) error {
 		id:     messageID,
 		offset: messageOffset,
 		size:   uint32(len(data)),
-		fileID: p.fileCache.length(),
+		fileID: p.currentFileID(),
 	}
 	p.list.insert(e)
 
-	p.appendFilePosition += uint64(len(sizeAndID) + len(data))
+	p.appendFilePosition += uint64(len(header) + len(data))
 
 	if messageID > p.maxMessageID {
 		p.maxMessageID = messageID
@@ -436,25 +520,26 @@ func (p *messagePartition) Fetch(req *store.FetchRequest) {
 
 // fetchByFetchlist fetches the messages in the supplied fetchlist and sends them to the message-channel
 func (p *messagePartition) fetchByFetchlist(fetchList *indexList, req *store.FetchRequest) error {
-	return fetchList.mapWithPredicate(func(index *index, _ int) error {
+	return p.readMessages(fetchList.toSliceArray(), func(index *index, msg []byte, err error) error {
 		if req.IsDone() {
 			return store.ErrRequestDone
 		}
-
-		filename := p.composeMsgFilenameForPosition(uint64(index.fileID))
-		file, err := os.Open(filename)
-		if err != nil {
-			return err
+		if os.IsNotExist(err) {
+			// the file was deleted by the retention since the fetch list was calculated
+			return nil
 		}
-		defer file.Close()
-
-		msg := make([]byte, index.size, index.size)
-		_, err = file.ReadAt(msg, int64(index.offset))
-		if err != nil {
+		if err == ErrCorruptMessage {
+			// the corrupt messages are skipped, not to block the replay of the following ones
+			mTotalCorruptReads.Add(1)
+			pCorruptReads.Inc()
 			logger.WithFields(log.Fields{
-				"err":    err,
-				"offset": index.offset,
-			}).Error("Error ReadAt")
+				"partition": p.name,
+				"msgID":     index.id,
+				"fileID":    index.fileID,
+			}).Error("Skipping corrupt message")
+			return nil
+		}
+		if err != nil {
 			return err
 		}
 
@@ -463,6 +548,190 @@ func (p *messagePartition) fetchByFetchlist(fetchList *indexList, req *store.Fet
 	})
 }
 
+// readMessageAt reads the message of the index entry from a .msg file with the given format version.
+// It returns ErrCorruptMessage if the message does not match its checksum, or if it is truncated.
+func readMessageAt(file io.ReaderAt, version byte, index *index) ([]byte, error) {
+	// since the format version 2, the checksum precedes the message
+	headerSize := 0
+	if version >= formatVersion2 {
+		headerSize = checksumSize
+	}
+	if index.offset < uint64(headerSize) {
+		return nil, ErrCorruptMessage
+	}
+
+	buffer := make([]byte, headerSize+int(index.size))
+	if _, err := file.ReadAt(buffer, int64(index.offset)-int64(headerSize)); err != nil {
+		if err == io.EOF {
+			return nil, ErrCorruptMessage
+		}
+		return nil, err
+	}
+
+	msg := buffer[headerSize:]
+	if version >= formatVersion2 && binary.LittleEndian.Uint32(buffer) != crc32.Checksum(msg, crcTable) {
+		return nil, ErrCorruptMessage
+	}
+	return msg, nil
+}
+
+// readFileVersion reads the header of a .msg file and returns its format version
+func readFileVersion(file *os.File) (byte, error) {
+	header := make([]byte, fileHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return 0, ErrInvalidFile
+		}
+		return 0, err
+	}
+	if !bytes.Equal(header[:len(magicNumber)], magicNumber) {
+		return 0, ErrInvalidFile
+	}
+
+	version := header[len(magicNumber)]
+	if version != formatVersion1 && version != formatVersion2 {
+		return 0, ErrInvalidFile
+	}
+	return version, nil
+}
+
+// messageHeaderSize returns the size of the header of the messages in a .msg file with the given format version
+func messageHeaderSize(version byte) int {
+	if version >= formatVersion2 {
+		return 12 + checksumSize
+	}
+	return 12
+}
+
+// scrub verifies the checksums of all the messages of the partition, returning the number of corrupt messages.
+// The messages of the files in the format version 1 have no checksums, so they are only checked for truncation.
+func (p *messagePartition) scrub() (int, error) {
+	p.RLock()
+	first, current := p.firstFileID, p.currentFileID()
+	currentEntries := append([]*index(nil), p.list.toSliceArray()...)
+	p.RUnlock()
+
+	corrupt := 0
+	for fileID := first; fileID < current; fileID++ {
+		l, err := p.loadIndexList(fileID)
+		if os.IsNotExist(err) {
+			// deleted by the retention
+			continue
+		}
+		if err != nil {
+			return corrupt, err
+		}
+		n, err := p.scrubFile(fileID, l.toSliceArray())
+		corrupt += n
+		if err != nil {
+			return corrupt, err
+		}
+	}
+	n, err := p.scrubFile(current, currentEntries)
+	return corrupt + n, err
+}
+
+// scrubFile verifies the messages of the index entries in a .msg file, returning the number of corrupt messages.
+// All the messages are corrupt if the header of the file is invalid.
+func (p *messagePartition) scrubFile(fileID int, entries []*index) (int, error) {
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	filename := p.composeMsgFilenameForPosition(uint64(fileID))
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	version, err := readFileVersion(file)
+	if err == ErrInvalidFile {
+		logger.WithField("filename", filename).Error("Invalid header of message file")
+		return len(entries), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	corrupt := 0
+	for _, index := range entries {
+		if _, err := readMessageAt(file, version, index); err == ErrCorruptMessage {
+			logger.WithFields(log.Fields{
+				"filename": filename,
+				"msgID":    index.id,
+				"offset":   index.offset,
+			}).Error("Corrupt message")
+			corrupt++
+		} else if err != nil {
+			return corrupt, err
+		}
+	}
+	return corrupt, nil
+}
+
+// Size returns the size in bytes of the message and index files of the partition
+func (p *messagePartition) Size() (int64, error) {
+	files, err := ioutil.ReadDir(p.basedir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, fileInfo := range files {
+		if strings.HasPrefix(fileInfo.Name(), p.name+"-") {
+			size += fileInfo.Size()
+		}
+	}
+	return size, nil
+}
+
+// MessageTimes returns the creation times of the first and of the last message stored in the partition
+func (p *messagePartition) MessageTimes() (time.Time, time.Time, bool) {
+	p.RLock()
+	defer p.RUnlock()
+
+	first, last := p.list.front(), p.list.back()
+	if files := p.fileCache.length(); files > 0 {
+		l, err := p.loadIndexList(p.firstFileID)
+		if err != nil {
+			return time.Time{}, time.Time{}, false
+		}
+		first = l.front()
+		if last == nil {
+			if l, err = p.loadIndexList(p.firstFileID + files - 1); err != nil {
+				return time.Time{}, time.Time{}, false
+			}
+			last = l.back()
+		}
+	}
+	if first == nil || last == nil {
+		return time.Time{}, time.Time{}, false
+	}
+
+	firstTime, err := p.messageTime(first)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	lastTime, err := p.messageTime(last)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	return firstTime, lastTime, true
+}
+
+// messageTime returns the creation time of the message of the index entry
+func (p *messagePartition) messageTime(index *index) (time.Time, error) {
+	data, err := p.readMessage(index)
+	if err != nil {
+		return time.Time{}, err
+	}
+	message, err := protocol.ParseMessage(data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(message.Time, 0), nil
+}
+
 // calculateFetchList returns a list of fetchEntry records for all messages in the fetch request.
 func (p *messagePartition) calculateFetchList(req *store.FetchRequest) (*indexList, error) {
 	if req.Direction == 0 {
@@ -478,12 +747,27 @@ func (p *messagePartition) calculateFetchList(req *store.FetchRequest) (*indexLi
 	prev := false
 
 	p.fileCache.RLock()
+	defer p.fileCache.RUnlock()
+
+	// the fetches starting before the first message retained begin with it,
+	// the request of the caller being left unchanged
+	if req.Direction > 0 {
+		if first := p.firstMessageID(); req.StartID < first {
+			req = &store.FetchRequest{
+				Partition: req.Partition,
+				StartID:   first,
+				EndID:     req.EndID,
+				Direction: req.Direction,
+				Count:     req.Count,
+			}
+		}
+	}
 
-	for i, fce := range p.fileCache.entries {
+	for _, fce := range p.fileCache.entries {
 		if fce.Contains(req) || (prev && potentialEntries.len() < req.Count) {
 			prev = true
 
-			l, err := p.loadIndexList(i)
+			l, err := p.loadIndexList(fce.fileID)
 			if err != nil {
 				logger.WithError(err).Info("Error loading idx file in memory")
 				return nil, err
@@ -504,8 +788,6 @@ func (p *messagePartition) calculateFetchList(req *store.FetchRequest) (*indexLi
 	// from in memory. From this will select only Count.
 	fetchList := potentialEntries.extract(req)
 
-	p.fileCache.RUnlock()
-
 	return fetchList, nil
 }
 
@@ -547,6 +829,9 @@ func (p *messagePartition) rewriteSortedIdxFile(filename string) error {
 			return err
 		}
 	}
+	if p.syncPolicy != SyncNone {
+		return file.Sync()
+	}
 	return nil
 }
 
@@ -603,7 +888,7 @@ func calculateNoEntries(filename string) (uint64, error) {
 func (p *messagePartition) loadLastIndexList(filename string) error {
 	logger.WithField("filename", filename).Info("Loading last index file")
 
-	l, err := p.loadIndexList(p.fileCache.length())
+	l, err := p.loadIndexList(p.currentFileID())
 	if err != nil {
 		logger.WithError(err).Error("Error loading last index filename")
 		return err
@@ -621,41 +906,23 @@ func (p *messagePartition) loadIndexList(fileID int) (*indexList, error) {
 	l := newIndexList(int(messagesPerFile))
 	logger.WithField("filename", filename).Debug("loadIndexFile")
 
-	entriesInIndex, err := calculateNoEntries(filename)
-	if err != nil {
-		return nil, err
-	}
-
-	file, err := os.Open(filename)
+	// the whole file is read at once, ignoring a partial entry at its end
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
-		logger.WithField("err", err).Error("os.Open failed")
+		logger.WithField("err", err).Error("Read error")
 		return nil, err
 	}
-	defer file.Close()
-
-	for i := uint64(0); i < entriesInIndex; i++ {
-		id, offset, size, err := readIndexEntry(file, int64(i*uint64(indexEntrySize)))
-		logger.WithFields(log.Fields{
-			"offset": offset,
-			"size":   size,
-			"id":     id,
-			"err":    err,
-		}).Debug("readIndexEntry")
 
-		if err != nil {
-			logger.WithField("err", err).Error("Read error")
-			return nil, err
-		}
-
-		e := &index{
-			id:     id,
-			size:   size,
-			offset: offset,
+	for position := 0; position+indexEntrySize <= len(data); position += indexEntrySize {
+		entry := data[position : position+indexEntrySize]
+		l.insert(&index{
+			id:     binary.LittleEndian.Uint64(entry),
+			offset: binary.LittleEndian.Uint64(entry[8:]),
+			size:   binary.LittleEndian.Uint32(entry[16:]),
 			fileID: fileID,
-		}
-		l.insert(e)
-		logger.WithField("len", l.len()).Debug("loadIndexFile")
+		})
 	}
+	logger.WithField("len", l.len()).Debug("loadIndexFile")
 	return l, nil
 }
 
@@ -1,6 +1,7 @@
 package filestore
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -8,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cosminrentea/gobbler/protocol"
 	"github.com/cosminrentea/gobbler/server/store"
 
 	"errors"
@@ -81,27 +83,27 @@ func Test_MessagePartition_loadFiles(t *testing.T) {
 	mStore, _ := newMessagePartition(dir, "myMessages")
 
 	msgData := []byte("aaaaaaaaaa")             // 10 bytes message
-	a.NoError(mStore.Store(uint64(3), msgData)) // stored offset 21, size: 10
-	a.NoError(mStore.Store(uint64(4), msgData)) // stored offset 21+10+12=43
+	a.NoError(mStore.Store(uint64(3), msgData)) // stored offset 25, size: 10
+	a.NoError(mStore.Store(uint64(4), msgData)) // stored offset 25+10+16=51
 
-	a.NoError(mStore.Store(uint64(10), msgData)) // stored offset 43+22=65
+	a.NoError(mStore.Store(uint64(10), msgData)) // stored offset 51+26=77
 
-	a.NoError(mStore.Store(uint64(9), msgData)) // stored offset 65+22=87
-	a.NoError(mStore.Store(uint64(5), msgData)) // stored offset 87+22=109
+	a.NoError(mStore.Store(uint64(9), msgData)) // stored offset 77+26=103
+	a.NoError(mStore.Store(uint64(5), msgData)) // stored offset 103+26=129
 
 	// here second file will start
-	a.NoError(mStore.Store(uint64(8), msgData))  // stored offset 21
-	a.NoError(mStore.Store(uint64(15), msgData)) // stored offset 43
-	a.NoError(mStore.Store(uint64(13), msgData)) // stored offset 65
+	a.NoError(mStore.Store(uint64(8), msgData))  // stored offset 25
+	a.NoError(mStore.Store(uint64(15), msgData)) // stored offset 51
+	a.NoError(mStore.Store(uint64(13), msgData)) // stored offset 77
 
-	a.NoError(mStore.Store(uint64(22), msgData)) // stored offset 87
-	a.NoError(mStore.Store(uint64(23), msgData)) // stored offset 109
+	a.NoError(mStore.Store(uint64(22), msgData)) // stored offset 103
+	a.NoError(mStore.Store(uint64(23), msgData)) // stored offset 129
 
 	// third file
-	a.NoError(mStore.Store(uint64(24), msgData)) // stored offset 21
-	a.NoError(mStore.Store(uint64(26), msgData)) // stored offset 43
+	a.NoError(mStore.Store(uint64(24), msgData)) // stored offset 25
+	a.NoError(mStore.Store(uint64(26), msgData)) // stored offset 51
 
-	a.NoError(mStore.Store(uint64(30), msgData)) // stored offset 65
+	a.NoError(mStore.Store(uint64(30), msgData)) // stored offset 77
 	a.Equal(uint64(13), mStore.Count())
 
 	a.NoError(mStore.Close())
@@ -201,29 +203,29 @@ func Test_calculateFetchList(t *testing.T) {
 	mStore, _ := newMessagePartition(dir, "myMessages")
 
 	// File header: MAGIC_NUMBER + FILE_NUMBER_VERSION = 9 bytes in the file
-	// For each stored message there is a 12 bytes write that contains the msgID and size
+	// For each stored message there is a 16 bytes write that contains the msgID, size and checksum
 
-	a.NoError(mStore.Store(uint64(3), msgData)) // stored offset 21, size: 10
-	a.NoError(mStore.Store(uint64(4), msgData)) // stored offset 21+10+12=43
+	a.NoError(mStore.Store(uint64(3), msgData)) // stored offset 25, size: 10
+	a.NoError(mStore.Store(uint64(4), msgData)) // stored offset 25+10+16=51
 
-	a.NoError(mStore.Store(uint64(10), msgData)) // stored offset 43+22=65
+	a.NoError(mStore.Store(uint64(10), msgData)) // stored offset 51+26=77
 
-	a.NoError(mStore.Store(uint64(9), msgData)) // stored offset 65+22=87
-	a.NoError(mStore.Store(uint64(5), msgData)) // stored offset 87+22=109
+	a.NoError(mStore.Store(uint64(9), msgData)) // stored offset 77+26=103
+	a.NoError(mStore.Store(uint64(5), msgData)) // stored offset 103+26=129
 
 	// here second file will start
-	a.NoError(mStore.Store(uint64(8), msgData))  // stored offset 21
-	a.NoError(mStore.Store(uint64(15), msgData)) // stored offset 43
-	a.NoError(mStore.Store(uint64(13), msgData)) // stored offset 65
+	a.NoError(mStore.Store(uint64(8), msgData))  // stored offset 25
+	a.NoError(mStore.Store(uint64(15), msgData)) // stored offset 51
+	a.NoError(mStore.Store(uint64(13), msgData)) // stored offset 77
 
-	a.NoError(mStore.Store(uint64(22), msgData)) // stored offset 87
-	a.NoError(mStore.Store(uint64(23), msgData)) // stored offset 109
+	a.NoError(mStore.Store(uint64(22), msgData)) // stored offset 103
+	a.NoError(mStore.Store(uint64(23), msgData)) // stored offset 129
 
 	// third file
-	a.NoError(mStore.Store(uint64(24), msgData)) // stored offset 21
-	a.NoError(mStore.Store(uint64(26), msgData)) // stored offset 43
+	a.NoError(mStore.Store(uint64(24), msgData)) // stored offset 25
+	a.NoError(mStore.Store(uint64(26), msgData)) // stored offset 51
 
-	a.NoError(mStore.Store(uint64(30), msgData)) // stored offset 65
+	a.NoError(mStore.Store(uint64(30), msgData)) // stored offset 77
 
 	defer a.NoError(mStore.Close())
 
@@ -235,34 +237,34 @@ func Test_calculateFetchList(t *testing.T) {
 		{`direct match`,
 			store.FetchRequest{StartID: 3, Direction: 0, Count: 1},
 			indexList{
-				items: []*index{{3, uint64(21), 10, 0}}, // messageId, offset, size, fileId
+				items: []*index{{3, uint64(25), 10, 0}}, // messageId, offset, size, fileId
 			},
 		},
 		{`direct match in second file`,
 			store.FetchRequest{StartID: 8, Direction: 0, Count: 1},
 			indexList{
-				items: []*index{{8, uint64(21), 10, 1}}, // messageId, offset, size, fileId,
+				items: []*index{{8, uint64(25), 10, 1}}, // messageId, offset, size, fileId,
 			},
 		},
 		{`direct match in second file, not first position`,
 			store.FetchRequest{StartID: 13, Direction: 0, Count: 1},
 			indexList{
-				items: []*index{{13, uint64(65), 10, 1}}, // messageId, offset, size, fileId,
+				items: []*index{{13, uint64(77), 10, 1}}, // messageId, offset, size, fileId,
 			},
 		},
 		// TODO this is caused by hasStartID() functions.This will be done when implementing the EndID logic
 		// {`next entry matches`,
 		// 	store.FetchRequest{StartID: 1, Direction: 0, Count: 1},
 		// 	SortedIndexList{
-		// 		{3, uint64(21), 10, 0}, // messageId, offset, size, fileId
+		// 		{3, uint64(25), 10, 0}, // messageId, offset, size, fileId
 		// 	},
 		// },
 		{`entry before matches`,
 			store.FetchRequest{StartID: 5, Direction: -1, Count: 2},
 			indexList{
 				items: []*index{
-					{4, uint64(43), 10, 0},  // messageId, offset, size, fileId
-					{5, uint64(109), 10, 0}, // messageId, offset, size, fileId
+					{4, uint64(51), 10, 0},  // messageId, offset, size, fileId
+					{5, uint64(129), 10, 0}, // messageId, offset, size, fileId
 				},
 			},
 		},
@@ -282,9 +284,9 @@ func Test_calculateFetchList(t *testing.T) {
 			store.FetchRequest{StartID: 9, Direction: 1, Count: 3},
 			indexList{
 				items: []*index{
-					{9, uint64(87), 10, 0},  // messageId, offset, size, fileId
-					{10, uint64(65), 10, 0}, // messageId, offset, size, fileId
-					{13, uint64(65), 10, 1}, // messageId, offset, size, fileId
+					{9, uint64(103), 10, 0}, // messageId, offset, size, fileId
+					{10, uint64(77), 10, 0}, // messageId, offset, size, fileId
+					{13, uint64(77), 10, 1}, // messageId, offset, size, fileId
 				},
 			},
 		},
@@ -292,11 +294,11 @@ func Test_calculateFetchList(t *testing.T) {
 			store.FetchRequest{StartID: 26, Direction: -1, Count: 4},
 			indexList{
 				items: []*index{
-					// {15, uint64(43), 10, 1},  // messageId, offset, size, fileId
-					{22, uint64(87), 10, 1},  // messageId, offset, size, fileId
-					{23, uint64(109), 10, 1}, // messageId, offset, size, fileId
-					{24, uint64(21), 10, 2},  // messageId, offset, size, fileId
-					{26, uint64(43), 10, 2},  // messageId, offset, size, fileId
+					// {15, uint64(51), 10, 1},  // messageId, offset, size, fileId
+					{22, uint64(103), 10, 1}, // messageId, offset, size, fileId
+					{23, uint64(129), 10, 1}, // messageId, offset, size, fileId
+					{24, uint64(25), 10, 2},  // messageId, offset, size, fileId
+					{26, uint64(51), 10, 2},  // messageId, offset, size, fileId
 				},
 			},
 		},
@@ -304,16 +306,16 @@ func Test_calculateFetchList(t *testing.T) {
 			store.FetchRequest{StartID: 5, Direction: 1, Count: 10},
 			indexList{
 				items: []*index{
-					{5, uint64(109), 10, 0},  // messageId, offset, size, fileId
-					{8, uint64(21), 10, 1},   // messageId, offset, size, fileId
-					{9, uint64(87), 10, 0},   // messageId, offset, size, fileId
-					{10, uint64(65), 10, 0},  // messageId, offset, size, fileId
-					{13, uint64(65), 10, 1},  // messageId, offset, size, fileId
-					{15, uint64(43), 10, 1},  // messageId, offset, size, fileId
-					{22, uint64(87), 10, 1},  // messageId, offset, size, fileId
-					{23, uint64(109), 10, 1}, // messageId, offset, size, fileId
-					{24, uint64(21), 10, 2},  // messageId, offset, size, fileId
-					{26, uint64(43), 10, 2},  // messageId, offset, size, fileId
+					{5, uint64(129), 10, 0},  // messageId, offset, size, fileId
+					{8, uint64(25), 10, 1},   // messageId, offset, size, fileId
+					{9, uint64(103), 10, 0},  // messageId, offset, size, fileId
+					{10, uint64(77), 10, 0},  // messageId, offset, size, fileId
+					{13, uint64(77), 10, 1},  // messageId, offset, size, fileId
+					{15, uint64(51), 10, 1},  // messageId, offset, size, fileId
+					{22, uint64(103), 10, 1}, // messageId, offset, size, fileId
+					{23, uint64(129), 10, 1}, // messageId, offset, size, fileId
+					{24, uint64(25), 10, 2},  // messageId, offset, size, fileId
+					{26, uint64(51), 10, 2},  // messageId, offset, size, fileId
 				},
 			},
 		},
@@ -362,29 +364,29 @@ func Test_Partition_Fetch(t *testing.T) {
 	mStore, _ := newMessagePartition(dir, "myMessages")
 
 	// File header: MAGIC_NUMBER + FILE_NUMBER_VERSION = 9 bytes in the file
-	// For each stored message there is a 12 bytes write that contains the msgID and size
+	// For each stored message there is a 16 bytes write that contains the msgID, size and checksum
 
-	a.NoError(mStore.Store(uint64(3), msgData)) // stored offset 21, size: 10
-	a.NoError(mStore.Store(uint64(4), msgData)) // stored offset 21+10+12=43
+	a.NoError(mStore.Store(uint64(3), msgData)) // stored offset 25, size: 10
+	a.NoError(mStore.Store(uint64(4), msgData)) // stored offset 25+10+16=51
 
-	a.NoError(mStore.Store(uint64(10), msgData)) // stored offset 43+22=65
+	a.NoError(mStore.Store(uint64(10), msgData)) // stored offset 51+26=77
 
-	a.NoError(mStore.Store(uint64(9), msgData2)) // stored offset 65+22=87
-	a.NoError(mStore.Store(uint64(5), msgData3)) // stored offset 87+22=109
+	a.NoError(mStore.Store(uint64(9), msgData2)) // stored offset 77+26=103
+	a.NoError(mStore.Store(uint64(5), msgData3)) // stored offset 103+26=129
 
 	// here second file will start
-	a.NoError(mStore.Store(uint64(8), msgData2))  // stored offset 21
-	a.NoError(mStore.Store(uint64(15), msgData))  // stored offset 43
-	a.NoError(mStore.Store(uint64(13), msgData3)) // stored offset 65
+	a.NoError(mStore.Store(uint64(8), msgData2))  // stored offset 25
+	a.NoError(mStore.Store(uint64(15), msgData))  // stored offset 51
+	a.NoError(mStore.Store(uint64(13), msgData3)) // stored offset 77
 
-	a.NoError(mStore.Store(uint64(22), msgData)) // stored offset 87
-	a.NoError(mStore.Store(uint64(23), msgData)) // stored offset 109
+	a.NoError(mStore.Store(uint64(22), msgData)) // stored offset 103
+	a.NoError(mStore.Store(uint64(23), msgData)) // stored offset 129
 
 	// third file
-	a.NoError(mStore.Store(uint64(24), msgData)) // stored offset 21
-	a.NoError(mStore.Store(uint64(26), msgData)) // stored offset 43
+	a.NoError(mStore.Store(uint64(24), msgData)) // stored offset 25
+	a.NoError(mStore.Store(uint64(26), msgData)) // stored offset 51
 
-	a.NoError(mStore.Store(uint64(30), msgData)) // stored offset 65
+	a.NoError(mStore.Store(uint64(30), msgData)) // stored offset 77
 
 	defer a.NoError(mStore.Close())
 
@@ -476,6 +478,35 @@ func Test_Partition_Fetch(t *testing.T) {
 	}
 }
 
+func Test_MessagePartition_Stats(t *testing.T) {
+	a := assert.New(t)
+	defer func() { messagesPerFile = uint64(10000) }()
+	messagesPerFile = uint64(5)
+
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+
+	_, _, ok := mStore.MessageTimes()
+	a.False(ok)
+
+	// the messages are stored in two files
+	for i := 1; i <= 7; i++ {
+		message := &protocol.Message{ID: uint64(i), Path: "/myMessages", Time: int64(i * 100)}
+		a.NoError(mStore.Store(uint64(i), message.Encode()))
+	}
+
+	first, last, ok := mStore.MessageTimes()
+	a.True(ok)
+	a.Equal(time.Unix(100, 0), first)
+	a.Equal(time.Unix(700, 0), last)
+
+	size, err := mStore.Size()
+	a.NoError(err)
+	a.True(size > int64(7*indexEntrySize))
+}
+
 func TestFilenameGeneration(t *testing.T) {
 	a := assert.New(t)
 
@@ -490,3 +521,110 @@ func TestFilenameGeneration(t *testing.T) {
 	a.Equal("/foo/bar/myMessages-00000000000000000000.idx", mStore.composeIdxFilenameForPosition(0))
 	a.Equal(fmt.Sprintf("/foo/bar/myMessages-%020d.idx", messagesPerFile), mStore.composeIdxFilenameForPosition(messagesPerFile))
 }
+
+func Test_MessagePartition_Checksums(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+
+	a.NoError(mStore.Store(uint64(1), []byte("1111111111"))) // stored offset 25
+	a.NoError(mStore.Store(uint64(2), []byte("2222222222"))) // stored offset 51
+	a.NoError(mStore.Store(uint64(3), []byte("3333333333"))) // stored offset 77
+	a.NoError(mStore.Close())
+
+	corrupt, err := mStore.scrub()
+	a.NoError(err)
+	a.Equal(0, corrupt)
+
+	// corrupt a byte of the second message
+	file, err := os.OpenFile(mStore.composeMsgFilenameForPosition(0), os.O_RDWR, 0666)
+	a.NoError(err)
+	_, err = file.WriteAt([]byte("x"), 55)
+	a.NoError(err)
+	a.NoError(file.Close())
+
+	_, err = mStore.readMessage(mStore.list.get(1))
+	a.Equal(ErrCorruptMessage, err)
+
+	// the corrupt message is skipped when fetching
+	a.Equal([]string{"1111111111", "3333333333"}, fetchMessages(a, mStore, 1, 3))
+
+	corrupt, err = mStore.scrub()
+	a.NoError(err)
+	a.Equal(1, corrupt)
+}
+
+func Test_MessagePartition_FormatVersion1(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_message_partition_test")
+	defer os.RemoveAll(dir)
+
+	// a file written in the format version 1, with a message without checksum
+	msgFile, err := os.Create(path.Join(dir, "myMessages-00000000000000000000.msg"))
+	a.NoError(err)
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header, 10)
+	binary.LittleEndian.PutUint64(header[4:], 1)
+	_, err = msgFile.Write(append(append(append(magicNumber, formatVersion1), header...), []byte("1111111111")...))
+	a.NoError(err)
+	a.NoError(msgFile.Close())
+
+	idxFile, err := os.Create(path.Join(dir, "myMessages-00000000000000000000.idx"))
+	a.NoError(err)
+	a.NoError(writeIndexEntry(idxFile, 1, 21, 10, 0))
+	a.NoError(idxFile.Close())
+
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+
+	// the following messages are appended in the format of the file
+	a.NoError(mStore.Store(uint64(2), []byte("2222222222")))
+	a.Equal(byte(formatVersion1), mStore.appendFileVersion)
+	a.Equal(uint64(43), mStore.list.get(1).offset)
+	a.NoError(mStore.Close())
+
+	a.Equal([]string{"1111111111", "2222222222"}, fetchMessages(a, mStore, 1, 2))
+
+	corrupt, err := mStore.scrub()
+	a.NoError(err)
+	a.Equal(0, corrupt)
+}
+
+func fetchMessages(a *assert.Assertions, p *messagePartition, startID uint64, count int) []string {
+	req := &store.FetchRequest{
+		Partition: p.name,
+		StartID:   startID,
+		Direction: 1,
+		Count:     count,
+		MessageC:  make(chan *store.FetchedMessage),
+		ErrorC:    make(chan error),
+		StartC:    make(chan int),
+	}
+	p.Fetch(req)
+
+	select {
+	case <-req.StartC:
+	case <-time.After(time.Second):
+		a.Fail("timeout")
+		return nil
+	}
+
+	messages := []string{}
+	for {
+		select {
+		case msg, open := <-req.MessageC:
+			if !open {
+				return messages
+			}
+			messages = append(messages, string(msg.Message))
+		case err := <-req.ErrorC:
+			a.Fail(err.Error())
+			return messages
+		case <-time.After(time.Second):
+			a.Fail("timeout")
+			return messages
+		}
+	}
+}
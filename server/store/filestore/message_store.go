@@ -3,24 +3,38 @@ package filestore
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cosminrentea/gobbler/protocol"
 	"github.com/cosminrentea/gobbler/server/store"
 )
 
+// ScrubInterval is the interval at which a started FileMessageStore verifies the checksums
+// of all the stored messages (value for disabling it: 0).
+var ScrubInterval = time.Hour
+
 // FileMessageStore is a struct used by the filesystem-based implementation of the MessageStore interface.
 // It holds the base directory, a map of messagePartitions etc.
 type FileMessageStore struct {
 	partitions map[string]*messagePartition
 	basedir    string
 	mutex      sync.RWMutex
+
+	// the number of corrupt messages found by the last scrub
+	corruptMessages int64
+	stopC           chan struct{}
+	scrubberDoneC   chan struct{}
+	syncerDoneC     chan struct{}
+	retentionDoneC  chan struct{}
 }
 
 // New returns a new FileMessageStore.
@@ -40,9 +54,47 @@ func (fms *FileMessageStore) MaxMessageID(partition string) (uint64, error) {
 	return p.MaxMessageID(), nil
 }
 
+// Start the background scrubber of the FileMessageStore, verifying the stored messages every ScrubInterval,
+// the periodic syncs of the partitions, if the Durability is SyncInterval,
+// and the application of the retention policies every RetentionInterval.
+// Implements the service.startable interface.
+func (fms *FileMessageStore) Start() error {
+	fms.stopC = make(chan struct{})
+	if ScrubInterval > 0 {
+		logger.WithField("interval", ScrubInterval).Info("Starting scrubber")
+		fms.scrubberDoneC = make(chan struct{})
+		go fms.scrubLoop(ScrubInterval)
+	}
+	if Durability == SyncInterval && SyncPeriod > 0 {
+		logger.WithField("period", SyncPeriod).Info("Starting periodic syncs")
+		fms.syncerDoneC = make(chan struct{})
+		go fms.syncLoop(SyncPeriod)
+	}
+	if RetentionInterval > 0 {
+		logger.WithField("interval", RetentionInterval).Info("Starting retention")
+		fms.retentionDoneC = make(chan struct{})
+		go fms.retentionLoop(RetentionInterval)
+	}
+	return nil
+}
+
 // Stop the FileMessageStore.
 // Implements the service.stopable interface.
 func (fms *FileMessageStore) Stop() error {
+	if fms.stopC != nil {
+		close(fms.stopC)
+		if fms.scrubberDoneC != nil {
+			<-fms.scrubberDoneC
+		}
+		if fms.syncerDoneC != nil {
+			<-fms.syncerDoneC
+		}
+		if fms.retentionDoneC != nil {
+			<-fms.retentionDoneC
+		}
+		fms.stopC, fms.scrubberDoneC, fms.syncerDoneC, fms.retentionDoneC = nil, nil, nil, nil
+	}
+
 	fms.mutex.Lock()
 	defer fms.mutex.Unlock()
 
@@ -168,6 +220,33 @@ func (fms *FileMessageStore) Partitions() (partitions []store.MessagePartition,
 	return
 }
 
+// Recover rebuilds the index files of all the partitions from their message files, truncating the partial writes.
+// The partitions are also recovered automatically when they are loaded with inconsistent files.
+func (fms *FileMessageStore) Recover() error {
+	entries, err := ioutil.ReadDir(fms.basedir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		partition, err := fms.Partition(entry.Name())
+		if err != nil {
+			return err
+		}
+		if err := partition.(*messagePartition).recover(); err != nil {
+			logger.WithError(err).WithField("partition", entry.Name()).Error("Error recovering partition")
+			return err
+		}
+	}
+	return nil
+}
+
 func (fms *FileMessageStore) Partition(partition string) (store.MessagePartition, error) {
 	fms.mutex.Lock()
 	defer fms.mutex.Unlock()
@@ -218,9 +297,57 @@ func (fms *FileMessageStore) Check() error {
 		return errors.New(errorMessage)
 	}
 
+	if corrupt := atomic.LoadInt64(&fms.corruptMessages); corrupt > 0 {
+		errorMessage := fmt.Sprintf("Storage contains %d corrupt messages", corrupt)
+		logger.WithField("corruptMessages", corrupt).Warn(errorMessage)
+		return errors.New(errorMessage)
+	}
+
 	return nil
 }
 
+func (fms *FileMessageStore) scrubLoop(interval time.Duration) {
+	defer close(fms.scrubberDoneC)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fms.scrub()
+		case <-fms.stopC:
+			return
+		}
+	}
+}
+
+// scrub verifies the checksums of the messages of all the partitions,
+// reporting the number of corrupt messages through the metrics and the health check.
+func (fms *FileMessageStore) scrub() int {
+	partitions, err := fms.Partitions()
+	if err != nil {
+		return 0
+	}
+
+	corrupt := 0
+	for _, partition := range partitions {
+		n, err := partition.(*messagePartition).scrub()
+		if err != nil {
+			logger.WithError(err).WithField("partition", partition.Name()).Error("Error scrubbing partition")
+		}
+		corrupt += n
+	}
+
+	atomic.StoreInt64(&fms.corruptMessages, int64(corrupt))
+	mTotalScrubs.Add(1)
+	mCorruptMessages.Set(int64(corrupt))
+	pScrubs.Inc()
+	pCorruptMessages.Set(float64(corrupt))
+
+	logger.WithField("corruptMessages", corrupt).Info("Scrubbed stored messages")
+	return corrupt
+}
+
 // extractPartitionName returns the partition name from a filepath
 // The files would have this format /basepath/partition-number.extenstion
 // if filepath is not in the right format empty string is returned
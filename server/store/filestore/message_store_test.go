@@ -3,6 +3,9 @@ package filestore
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -178,6 +181,52 @@ func Test_Check(t *testing.T) {
 	a.Nil(err)
 }
 
+func Test_CheckCorruptMessages(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_message_store_test")
+	defer os.RemoveAll(dir)
+	mStore := New(dir)
+	a.NoError(mStore.Store("p1", uint64(1), []byte("aaaaaaaaaa")))
+	a.NoError(mStore.Store("p1", uint64(2), []byte("bbbbbbbbbb")))
+	a.NoError(mStore.Store("p2", uint64(1), []byte("cccccccccc")))
+
+	a.Equal(0, mStore.scrub())
+	a.NoError(mStore.Check())
+
+	// corrupt the checksum of the first message of p1
+	file, err := os.OpenFile(path.Join(dir, "p1", "p1-00000000000000000000.msg"), os.O_RDWR, 0666)
+	a.NoError(err)
+	_, err = file.WriteAt([]byte{0, 0, 0, 0}, 21)
+	a.NoError(err)
+	a.NoError(file.Close())
+
+	a.Equal(1, mStore.scrub())
+	a.Error(mStore.Check())
+}
+
+func Test_Scrubber(t *testing.T) {
+	a := assert.New(t)
+	defer func(interval time.Duration) { ScrubInterval = interval }(ScrubInterval)
+	ScrubInterval = 10 * time.Millisecond
+
+	dir, _ := ioutil.TempDir("", "guble_message_store_test")
+	defer os.RemoveAll(dir)
+	mStore := New(dir)
+	a.NoError(mStore.Store("p1", uint64(1), []byte("aaaaaaaaaa")))
+
+	file, err := os.OpenFile(path.Join(dir, "p1", "p1-00000000000000000000.msg"), os.O_RDWR, 0666)
+	a.NoError(err)
+	_, err = file.WriteAt([]byte("x"), 25)
+	a.NoError(err)
+	a.NoError(file.Close())
+
+	a.NoError(mStore.Start())
+	time.Sleep(50 * time.Millisecond)
+	a.NoError(mStore.Stop())
+
+	a.Equal(int64(1), atomic.LoadInt64(&mStore.corruptMessages))
+}
+
 // func Test_Partitions(t *testing.T) {
 // 	// Store multiple partitions then recreate the store and see if they are picked up
 // 	a := assert.New(t)
@@ -0,0 +1,362 @@
+package filestore
+
+import (
+	"container/list"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// MaxOpenFiles is the maximum number of .msg files kept open by each partition for the fetches
+	// (the least recently used ones are closed first)
+	MaxOpenFiles = 8
+
+	// MmapFiles enables the mapping in memory of the full .msg files opened for the fetches
+	MmapFiles = false
+
+	// HotMessages is the number of the last messages stored in each partition loaded afterwards,
+	// which are kept in memory for the fetches (value for disabling it: 0)
+	HotMessages = 256
+
+	// readBatchSize is the maximum number of bytes read at once for the messages stored contiguously in a file
+	readBatchSize = uint64(256 * 1024)
+)
+
+// segment is a .msg file opened for reading the messages of a partition
+type segment struct {
+	fileID  int
+	file    *os.File
+	version byte
+	data    []byte // the content of the file, if it is mapped in memory
+
+	// the number of reads in progress; an evicted segment is closed by its last read
+	refs    int
+	evicted bool
+}
+
+// ReadAt implements io.ReaderAt, reading from the memory if the file is mapped
+func (s *segment) ReadAt(b []byte, off int64) (int, error) {
+	if s.data == nil {
+		return s.file.ReadAt(b, off)
+	}
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, s.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *segment) close() error {
+	if s.data != nil {
+		if err := syscall.Munmap(s.data); err != nil {
+			logger.WithError(err).WithField("filename", s.file.Name()).Error("Error unmapping message file")
+		}
+		s.data = nil
+	}
+	return s.file.Close()
+}
+
+// contiguous returns the end of the range of index entries starting at i which are stored contiguously
+// in the file of the segment, without exceeding readBatchSize bytes
+func (s *segment) contiguous(entries []*index, i int) int {
+	headerSize := uint64(messageHeaderSize(s.version))
+	size := uint64(entries[i].size)
+
+	j := i + 1
+	for ; j < len(entries); j++ {
+		prev, next := entries[j-1], entries[j]
+		if next.fileID != s.fileID ||
+			next.offset != prev.offset+uint64(prev.size)+headerSize ||
+			size+headerSize+uint64(next.size) > readBatchSize {
+			break
+		}
+		size += headerSize + uint64(next.size)
+	}
+	return j
+}
+
+// readBatch reads with a single read the messages of the index entries, which are stored contiguously,
+// calling fn with each message or the error reading it
+func (s *segment) readBatch(entries []*index, fn func(*index, []byte, error) error) error {
+	mTotalFileReads.Add(1)
+	pFileReads.Inc()
+
+	// since the format version 2, the checksum precedes each message
+	checksum := 0
+	if s.version >= formatVersion2 {
+		checksum = checksumSize
+	}
+	first, last := entries[0], entries[len(entries)-1]
+	if len(entries) == 1 || first.offset < uint64(checksum) {
+		for _, index := range entries {
+			msg, err := readMessageAt(s, s.version, index)
+			if err := fn(index, msg, err); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	start := int64(first.offset) - int64(checksum)
+	buffer := make([]byte, int64(last.offset)+int64(last.size)-start)
+	if _, err := s.ReadAt(buffer, start); err != nil {
+		if err != io.EOF {
+			return fn(first, nil, err)
+		}
+		// the file is truncated, so the messages are read one by one to find the missing ones
+		for _, entry := range entries {
+			if err := s.readBatch([]*index{entry}, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, index := range entries {
+		position := int64(index.offset) - start
+		end := position + int64(index.size)
+		msg := buffer[position:end:end]
+
+		var err error
+		if checksum > 0 && binary.LittleEndian.Uint32(buffer[position-int64(checksum):]) != crc32.Checksum(msg, crcTable) {
+			msg, err = nil, ErrCorruptMessage
+		}
+		if err := fn(index, msg, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentCache keeps open a bounded number of segments of a partition, closing the least recently used ones
+type segmentCache struct {
+	mutex    sync.Mutex
+	capacity int
+	lru      *list.List // the segments, the most recently used first
+	elements map[int]*list.Element
+	open     func(fileID int) (*segment, error)
+}
+
+func newSegmentCache(capacity int, open func(fileID int) (*segment, error)) *segmentCache {
+	return &segmentCache{
+		capacity: capacity,
+		lru:      list.New(),
+		elements: make(map[int]*list.Element),
+		open:     open,
+	}
+}
+
+// acquire returns the segment of the file at the position, opening it if needed.
+// The segment has to be released after reading it.
+func (c *segmentCache) acquire(fileID int) (*segment, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e, ok := c.elements[fileID]; ok {
+		c.lru.MoveToFront(e)
+		s := e.Value.(*segment)
+		s.refs++
+		return s, nil
+	}
+
+	s, err := c.open(fileID)
+	if err != nil {
+		return nil, err
+	}
+	s.refs = 1
+	c.elements[fileID] = c.lru.PushFront(s)
+	for c.lru.Len() > c.capacity {
+		c.evict(c.lru.Back())
+	}
+	return s, nil
+}
+
+func (c *segmentCache) release(s *segment) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s.refs--
+	if s.evicted && s.refs == 0 {
+		s.close()
+	}
+}
+
+// remove closes the segment of the file at the position, if it is open
+func (c *segmentCache) remove(fileID int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e, ok := c.elements[fileID]; ok {
+		c.evict(e)
+	}
+}
+
+// clear closes all the segments
+func (c *segmentCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for c.lru.Len() > 0 {
+		c.evict(c.lru.Back())
+	}
+}
+
+func (c *segmentCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lru.Len()
+}
+
+// evict removes a segment from the cache, closing it unless it is being read.
+// It is called with the mutex held.
+func (c *segmentCache) evict(e *list.Element) {
+	s := c.lru.Remove(e).(*segment)
+	delete(c.elements, s.fileID)
+	s.evicted = true
+	if s.refs == 0 {
+		s.close()
+	}
+}
+
+// hotCache keeps in memory the last messages stored in a partition, which are likely to be fetched soon
+type hotCache struct {
+	mutex    sync.RWMutex
+	ids      []uint64 // the ring of the IDs of the cached messages, in the order they were stored
+	next     int
+	full     bool
+	messages map[uint64][]byte
+}
+
+func newHotCache(size int) *hotCache {
+	if size < 0 {
+		size = 0
+	}
+	return &hotCache{
+		ids:      make([]uint64, size),
+		messages: make(map[uint64][]byte, size),
+	}
+}
+
+// add caches a copy of the message, replacing the oldest one
+func (c *hotCache) add(id uint64, msg []byte) {
+	if len(c.ids) == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.full {
+		delete(c.messages, c.ids[c.next])
+	}
+	c.ids[c.next] = id
+	c.messages[id] = make([]byte, len(msg))
+	copy(c.messages[id], msg)
+	c.next = (c.next + 1) % len(c.ids)
+	c.full = c.full || c.next == 0
+}
+
+func (c *hotCache) get(id uint64) ([]byte, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	msg, ok := c.messages[id]
+	return msg, ok
+}
+
+func (c *hotCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.next, c.full = 0, false
+	c.messages = make(map[uint64][]byte, len(c.ids))
+}
+
+// openSegment opens the .msg file at the position for reading,
+// mapping it in memory if MmapFiles is set and the file is full
+func (p *messagePartition) openSegment(fileID int) (*segment, error) {
+	file, err := os.Open(p.composeMsgFilenameForPosition(uint64(fileID)))
+	if err != nil {
+		return nil, err
+	}
+	version, err := readFileVersion(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	s := &segment{fileID: fileID, file: file, version: version}
+	if MmapFiles && p.fileCache.containsFile(fileID) {
+		if s.data, err = mmapFile(file); err != nil {
+			logger.WithError(err).WithField("filename", file.Name()).Warn("Error mapping message file in memory")
+		}
+	}
+	return s, nil
+}
+
+func mmapFile(file *os.File) ([]byte, error) {
+	stat, err := file.Stat()
+	if err != nil || stat.Size() == 0 {
+		return nil, err
+	}
+	return syscall.Mmap(int(file.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// readMessages reads the messages of the index entries, sorted by ID, calling fn with each message or the error reading it.
+// The last messages stored are taken from the memory, and the messages stored contiguously in a file are read at once.
+func (p *messagePartition) readMessages(entries []*index, fn func(*index, []byte, error) error) error {
+	for i := 0; i < len(entries); {
+		if msg, ok := p.hotMessages.get(entries[i].id); ok {
+			mTotalHotReads.Add(1)
+			pHotReads.Inc()
+			if err := fn(entries[i], msg, nil); err != nil {
+				return err
+			}
+			i++
+			continue
+		}
+
+		s, err := p.segments.acquire(entries[i].fileID)
+		if err != nil {
+			if err := fn(entries[i], nil, err); err != nil {
+				return err
+			}
+			i++
+			continue
+		}
+		j := s.contiguous(entries, i)
+		err = s.readBatch(entries[i:j], fn)
+		p.segments.release(s)
+		if err != nil {
+			return err
+		}
+		i = j
+	}
+	return nil
+}
+
+// readMessage reads the message of the index entry, verifying its checksum
+func (p *messagePartition) readMessage(entry *index) ([]byte, error) {
+	var msg []byte
+	err := p.readMessages([]*index{entry}, func(_ *index, m []byte, err error) error {
+		msg = m
+		return err
+	})
+	if err != nil && err != ErrCorruptMessage && !os.IsNotExist(err) {
+		logger.WithFields(log.Fields{
+			"err":    err,
+			"offset": entry.offset,
+		}).Error("Error ReadAt")
+	}
+	return msg, err
+}
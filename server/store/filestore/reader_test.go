@@ -0,0 +1,262 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/server/store"
+)
+
+// reopenPartition returns the partition loaded again, with no open files and no messages in memory
+func reopenPartition(a *assert.Assertions, p *messagePartition) *messagePartition {
+	a.NoError(p.Close())
+	p, err := newMessagePartition(p.basedir, p.name)
+	a.NoError(err)
+	return p
+}
+
+func Test_MessagePartition_BatchedReads(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_reader_test")
+	defer os.RemoveAll(dir)
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	storeNumberedMessages(a, mStore, 1, 10)
+	mStore = reopenPartition(a, mStore)
+
+	// the messages stored contiguously are read at once
+	reads := counterValue(pFileReads)
+	messages := fetchMessages(a, mStore, 1, 10)
+	a.Len(messages, 10)
+	a.Equal("message 1", messages[0])
+	a.Equal("message 10", messages[9])
+	a.Equal(1.0, counterValue(pFileReads)-reads)
+	a.Equal(1, mStore.segments.len())
+
+	// a corrupt message is skipped without failing the read of the others
+	a.NoError(mStore.Close())
+	file, err := os.OpenFile(mStore.composeMsgFilenameForPosition(0), os.O_RDWR, 0666)
+	a.NoError(err)
+	_, err = file.WriteAt([]byte("x"), 51) // the second message is stored at offset 50
+	a.NoError(err)
+	a.NoError(file.Close())
+
+	reads = counterValue(pFileReads)
+	messages = fetchMessages(a, mStore, 1, 10)
+	a.Len(messages, 9)
+	a.Equal("message 1", messages[0])
+	a.Equal("message 3", messages[1])
+	a.Equal(1.0, counterValue(pFileReads)-reads)
+
+	// the messages of a truncated file are read one by one
+	a.NoError(mStore.Close())
+	msgFilename := mStore.composeMsgFilenameForPosition(0)
+	a.NoError(os.Truncate(msgFilename, fileSize(a, msgFilename)-5))
+
+	reads = counterValue(pFileReads)
+	messages = fetchMessages(a, mStore, 3, 10)
+	a.Len(messages, 7)
+	a.Equal("message 9", messages[6])
+	a.Equal(1.0+8, counterValue(pFileReads)-reads)
+}
+
+func Test_MessagePartition_OpenFiles(t *testing.T) {
+	a := assert.New(t)
+	defer func(maxOpenFiles int) {
+		messagesPerFile = uint64(10000)
+		MaxOpenFiles = maxOpenFiles
+	}(MaxOpenFiles)
+	messagesPerFile = uint64(2)
+	MaxOpenFiles = 2
+
+	dir, _ := ioutil.TempDir("", "guble_reader_test")
+	defer os.RemoveAll(dir)
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	storeNumberedMessages(a, mStore, 1, 7)
+	mStore = reopenPartition(a, mStore)
+
+	// the least recently used files are closed
+	a.Len(fetchMessages(a, mStore, 1, 7), 7)
+	a.Equal(2, mStore.segments.len())
+	a.Contains(mStore.segments.elements, 2)
+	a.Contains(mStore.segments.elements, 3)
+
+	// a file being read is closed when it is released
+	s, err := mStore.segments.acquire(0)
+	a.NoError(err)
+	s1, err := mStore.segments.acquire(1)
+	a.NoError(err)
+	s2, err := mStore.segments.acquire(2)
+	a.NoError(err)
+	a.True(s.evicted)
+	msg, err := readMessageAt(s, s.version, &index{offset: 25, size: 9})
+	a.NoError(err)
+	a.Equal("message 1", string(msg))
+
+	mStore.segments.release(s)
+	_, err = s.file.Stat()
+	a.Error(err)
+	mStore.segments.release(s1)
+	mStore.segments.release(s2)
+	a.NoError(mStore.Close())
+}
+
+func Test_MessagePartition_MmapFiles(t *testing.T) {
+	a := assert.New(t)
+	defer func() {
+		messagesPerFile = uint64(10000)
+		MmapFiles = false
+	}()
+	messagesPerFile = uint64(2)
+	MmapFiles = true
+
+	dir, _ := ioutil.TempDir("", "guble_reader_test")
+	defer os.RemoveAll(dir)
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	storeNumberedMessages(a, mStore, 1, 5)
+	mStore = reopenPartition(a, mStore)
+
+	a.Equal([]string{"message 1", "message 2", "message 3", "message 4", "message 5"}, fetchMessages(a, mStore, 1, 5))
+
+	// only the full files are mapped in memory
+	for fileID, mapped := range []bool{true, true, false} {
+		e, ok := mStore.segments.elements[fileID]
+		if a.True(ok) {
+			a.Equal(mapped, e.Value.(*segment).data != nil)
+		}
+	}
+	a.NoError(mStore.Close())
+}
+
+func Test_MessagePartition_HotMessages(t *testing.T) {
+	a := assert.New(t)
+	defer func(hotMessages int) { HotMessages = hotMessages }(HotMessages)
+	HotMessages = 3
+
+	dir, _ := ioutil.TempDir("", "guble_reader_test")
+	defer os.RemoveAll(dir)
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	storeNumberedMessages(a, mStore, 1, 5)
+
+	// the last messages stored are read from the memory
+	hotReads, reads := counterValue(pHotReads), counterValue(pFileReads)
+	a.Equal([]string{"message 3", "message 4", "message 5"}, fetchMessages(a, mStore, 3, 5))
+	a.Equal(3.0, counterValue(pHotReads)-hotReads)
+	a.Equal(0.0, counterValue(pFileReads)-reads)
+
+	// the following messages are read with the older ones stored contiguously
+	hotReads, reads = counterValue(pHotReads), counterValue(pFileReads)
+	a.Equal([]string{"message 1", "message 2", "message 3", "message 4", "message 5"}, fetchMessages(a, mStore, 1, 5))
+	a.Equal(0.0, counterValue(pHotReads)-hotReads)
+	a.Equal(1.0, counterValue(pFileReads)-reads)
+	a.NoError(mStore.Close())
+}
+
+func Test_HotCache(t *testing.T) {
+	a := assert.New(t)
+	c := newHotCache(2)
+
+	msg := []byte("message 1")
+	c.add(1, msg)
+	msg[0] = 'x'
+	cached, ok := c.get(1)
+	a.True(ok)
+	a.Equal("message 1", string(cached))
+
+	c.add(2, []byte("message 2"))
+	c.add(3, []byte{})
+	_, ok = c.get(1)
+	a.False(ok)
+	cached, ok = c.get(3)
+	a.True(ok)
+	a.Equal([]byte{}, cached)
+	a.Len(c.messages, 2)
+
+	c.clear()
+	_, ok = c.get(2)
+	a.False(ok)
+
+	// a cache of size 0 is disabled
+	c = newHotCache(0)
+	c.add(1, []byte("message 1"))
+	_, ok = c.get(1)
+	a.False(ok)
+}
+
+// Fetch benchmarks
+// Each operation fetches 1000 messages of 100 bytes, replaying a partition of 100000 messages stored in 10 files
+func Benchmark_Fetch_Unbatched(b *testing.B) {
+	// equivalent to opening the file and reading each message separately
+	defer func(maxOpenFiles int, batchSize uint64) {
+		MaxOpenFiles = maxOpenFiles
+		readBatchSize = batchSize
+	}(MaxOpenFiles, readBatchSize)
+	MaxOpenFiles = 0
+	readBatchSize = 0
+	benchmarkFetch(b)
+}
+
+func Benchmark_Fetch_OpenFiles(b *testing.B) {
+	defer func(batchSize uint64) { readBatchSize = batchSize }(readBatchSize)
+	readBatchSize = 0
+	benchmarkFetch(b)
+}
+
+func Benchmark_Fetch_Batched(b *testing.B) {
+	benchmarkFetch(b)
+}
+
+func Benchmark_Fetch_Mmap(b *testing.B) {
+	defer func() { MmapFiles = false }()
+	MmapFiles = true
+	benchmarkFetch(b)
+}
+
+func benchmarkFetch(b *testing.B) {
+	a := assert.New(b)
+	dir, _ := ioutil.TempDir("", "guble_reader_test")
+	defer os.RemoveAll(dir)
+
+	const messages, count, size = 100000, 1000, 100
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	message := make([]byte, size)
+	for i := range message {
+		message[i] = 'a'
+	}
+	for i := 1; i <= messages; i++ {
+		a.NoError(mStore.Store(uint64(i), message))
+	}
+	mStore = reopenPartition(a, mStore)
+	defer mStore.Close()
+
+	b.SetBytes(count * size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		startID := uint64(i*count%messages + 1)
+		req := &store.FetchRequest{
+			Partition: "myMessages",
+			StartID:   startID,
+			Direction: 1,
+			Count:     count,
+			MessageC:  make(chan *store.FetchedMessage, count),
+			ErrorC:    make(chan error, 1),
+			StartC:    make(chan int, 1),
+		}
+		mStore.Fetch(req)
+		fetched := 0
+		for range req.MessageC {
+			fetched++
+		}
+		if fetched != count {
+			b.Fatalf("fetched %d messages from %d instead of %d", fetched, startID, count)
+		}
+	}
+	b.StopTimer()
+}
@@ -0,0 +1,287 @@
+package filestore
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// checkFiles returns false if the .msg and .idx files of the partition are inconsistent:
+// a file without its pair, a gap in the positions of the files (which start after the ones deleted by the retention),
+// an .idx file with a partial entry,
+// a file without messages before the last one, or a last .msg file not ending with its last indexed message.
+func (p *messagePartition) checkFiles() bool {
+	msgFileIDs, err := p.fileIDs(".msg")
+	if err != nil {
+		return false
+	}
+	idxFileIDs, err := p.fileIDs(".idx")
+	if err != nil {
+		return false
+	}
+	if len(msgFileIDs) != len(idxFileIDs) {
+		return false
+	}
+	for i := range msgFileIDs {
+		fileID := msgFileIDs[0] + i
+		if msgFileIDs[i] != fileID || idxFileIDs[i] != fileID {
+			return false
+		}
+		idxStat, err := os.Stat(p.composeIdxFilenameForPosition(uint64(fileID)))
+		if err != nil || idxStat.Size()%int64(indexEntrySize) != 0 {
+			return false
+		}
+		msgStat, err := os.Stat(p.composeMsgFilenameForPosition(uint64(fileID)))
+		if err != nil {
+			return false
+		}
+		// the files before the last one are full
+		if i < len(msgFileIDs)-1 && (idxStat.Size() == 0 || msgStat.Size() <= fileHeaderSize) {
+			return false
+		}
+	}
+	if len(msgFileIDs) == 0 {
+		return true
+	}
+
+	// the messages are appended to the last file, so a crash can only leave it with a partial write
+	last := msgFileIDs[len(msgFileIDs)-1]
+	stat, err := os.Stat(p.composeMsgFilenameForPosition(uint64(last)))
+	if err != nil {
+		return false
+	}
+	l, err := p.loadIndexList(last)
+	if err != nil {
+		return false
+	}
+	end := uint64(fileHeaderSize)
+	for _, index := range l.toSliceArray() {
+		if index.offset+uint64(index.size) > end {
+			end = index.offset + uint64(index.size)
+		}
+	}
+	return uint64(stat.Size()) == end || (stat.Size() == 0 && l.len() == 0)
+}
+
+// recover rebuilds the .idx files of the partition from its .msg files, truncating their partial writes,
+// and reloads the partition.
+func (p *messagePartition) recover() error {
+	p.Lock()
+	defer p.Unlock()
+
+	if err := p.syncAndCloseAppendFiles(); err != nil {
+		return err
+	}
+	p.segments.clear()
+	p.hotMessages.clear()
+	if err := p.recoverFiles(); err != nil {
+		return err
+	}
+
+	p.fileCache = newCache()
+	p.firstFileID = 0
+	p.list = newIndexList(int(messagesPerFile))
+	p.entriesCount = 0
+	p.totalNumberOfMessages = 0
+	return p.readIdxFiles()
+}
+
+// recoverFiles scans the .msg files of the partition, truncating their partial writes, and rewrites their .idx files.
+// The .msg files without any message, except the last one, are removed,
+// and the following ones are renamed so that their positions have no gaps after the first one.
+func (p *messagePartition) recoverFiles() error {
+	logger.WithField("partition", p.name).Warn("Recovering partition")
+	mTotalRecoveries.Add(1)
+	pRecoveries.Inc()
+
+	msgFileIDs, err := p.fileIDs(".msg")
+	if err != nil {
+		return err
+	}
+	idxFileIDs, err := p.fileIDs(".idx")
+	if err != nil {
+		return err
+	}
+	for _, fileID := range idxFileIDs {
+		if err := os.Remove(p.composeIdxFilenameForPosition(uint64(fileID))); err != nil {
+			return err
+		}
+	}
+
+	position := 0
+	if len(msgFileIDs) > 0 {
+		position = msgFileIDs[0]
+	}
+	for i, fileID := range msgFileIDs {
+		filename := p.composeMsgFilenameForPosition(uint64(fileID))
+		last := i == len(msgFileIDs)-1
+
+		entries, err := scanMsgFile(filename, last)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 && !last {
+			logger.WithField("filename", filename).Warn("Removing message file without messages")
+			if err := os.Remove(filename); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if fileID != position {
+			newFilename := p.composeMsgFilenameForPosition(uint64(position))
+			logger.WithFields(log.Fields{
+				"filename":    filename,
+				"newFilename": newFilename,
+			}).Warn("Renaming message file")
+			if err := os.Rename(filename, newFilename); err != nil {
+				return err
+			}
+		}
+		if err := p.writeIdxFile(position, entries); err != nil {
+			return err
+		}
+		position++
+	}
+	return nil
+}
+
+// scanMsgFile returns the index entries of the messages of a .msg file, sorted by ID.
+// If it is the last file, it truncates the file at its first partial message, if any: a message exceeding
+// the end of the file, or the last message of the file not matching its checksum.
+// A file shorter than its header is truncated to zero bytes if it is the last file.
+// Since only the last file is written, the earlier files are never truncated: a message exceeding
+// their end is corrupt, so the messages starting with it are not indexed.
+func scanMsgFile(filename string, last bool) ([]*index, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(stat.Size())
+	if size < fileHeaderSize {
+		if last {
+			return nil, truncateMsgFile(file, 0)
+		}
+		return nil, nil
+	}
+
+	version, err := readFileVersion(file)
+	if err != nil {
+		return nil, err
+	}
+	headerSize := uint64(messageHeaderSize(version))
+
+	var entries []*index
+	header := make([]byte, headerSize)
+	position := uint64(fileHeaderSize)
+	for position < size {
+		if position+headerSize > size {
+			break
+		}
+		if _, err := file.ReadAt(header, int64(position)); err != nil {
+			return nil, err
+		}
+		msgSize := binary.LittleEndian.Uint32(header)
+		end := position + headerSize + uint64(msgSize)
+		if end > size {
+			break
+		}
+
+		if version >= formatVersion2 {
+			data := make([]byte, msgSize)
+			if _, err := file.ReadAt(data, int64(position+headerSize)); err != nil {
+				return nil, err
+			}
+			if binary.LittleEndian.Uint32(header[12:]) != crc32.Checksum(data, crcTable) {
+				// a torn write at the end of the file, or a corrupt message which is reported by the scrubber
+				if end == size {
+					break
+				}
+				logger.WithFields(log.Fields{
+					"filename": filename,
+					"offset":   position,
+				}).Warn("Corrupt message found while recovering")
+			}
+		}
+
+		entries = append(entries, &index{
+			id:     binary.LittleEndian.Uint64(header[4:]),
+			offset: position + headerSize,
+			size:   msgSize,
+		})
+		position = end
+	}
+
+	if position < size {
+		if !last {
+			logger.WithFields(log.Fields{
+				"filename": filename,
+				"offset":   position,
+			}).Error("Corrupt message found while recovering, not indexing the following messages")
+		} else if err := truncateMsgFile(file, position); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+	return entries, nil
+}
+
+func truncateMsgFile(file *os.File, size uint64) error {
+	logger.WithFields(log.Fields{
+		"filename": file.Name(),
+		"size":     size,
+	}).Warn("Truncating partial write of message file")
+	return file.Truncate(int64(size))
+}
+
+// writeIdxFile writes the .idx file of the given position with the index entries
+func (p *messagePartition) writeIdxFile(fileID int, entries []*index) error {
+	file, err := os.OpenFile(p.composeIdxFilenameForPosition(uint64(fileID)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for i, entry := range entries {
+		if err := writeIndexEntry(file, entry.id, entry.offset, entry.size, uint64(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileIDs returns the sorted positions of the files of the partition with the given extension
+func (p *messagePartition) fileIDs(extension string) ([]int, error) {
+	files, err := ioutil.ReadDir(p.basedir)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileIDs []int
+	for _, fileInfo := range files {
+		name := fileInfo.Name()
+		if !strings.HasPrefix(name, p.name+"-") || !strings.HasSuffix(name, extension) {
+			continue
+		}
+		fileID, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, p.name+"-"), extension))
+		if err != nil {
+			continue
+		}
+		fileIDs = append(fileIDs, fileID)
+	}
+	sort.Ints(fileIDs)
+	return fileIDs, nil
+}
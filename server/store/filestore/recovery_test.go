@@ -0,0 +1,169 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func storeMessages(a *assert.Assertions, dir string, ids ...uint64) {
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	for _, id := range ids {
+		a.NoError(mStore.Store(id, []byte("aaaaaaaaaa")))
+	}
+	a.NoError(mStore.Close())
+}
+
+func fileSize(a *assert.Assertions, filename string) int64 {
+	stat, err := os.Stat(filename)
+	a.NoError(err)
+	return stat.Size()
+}
+
+func Test_Recovery_UnindexedMessage(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_recovery_test")
+	defer os.RemoveAll(dir)
+	storeMessages(a, dir, 1, 2, 3)
+
+	// the process died before writing the index entry of the last message
+	idxFilename := path.Join(dir, "myMessages-00000000000000000000.idx")
+	a.NoError(os.Truncate(idxFilename, int64(2*indexEntrySize)))
+
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	a.Equal(uint64(3), mStore.Count())
+	a.Equal(uint64(3), mStore.MaxMessageID())
+	a.Equal(int64(3*indexEntrySize), fileSize(a, idxFilename))
+	a.Equal([]string{"aaaaaaaaaa", "aaaaaaaaaa", "aaaaaaaaaa"}, fetchMessages(a, mStore, 1, 3))
+}
+
+func Test_Recovery_PartialWrite(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_recovery_test")
+	defer os.RemoveAll(dir)
+	storeMessages(a, dir, 1, 2)
+
+	msgFilename := path.Join(dir, "myMessages-00000000000000000000.msg")
+	size := fileSize(a, msgFilename)
+
+	for _, partialWrite := range [][]byte{
+		{10, 0, 0}, // a partial header
+		{10, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 'a'}, // a partial message
+		{1, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 'a'},  // a message not matching its checksum
+	} {
+		file, err := os.OpenFile(msgFilename, os.O_WRONLY|os.O_APPEND, 0666)
+		a.NoError(err)
+		_, err = file.Write(partialWrite)
+		a.NoError(err)
+		a.NoError(file.Close())
+
+		mStore, err := newMessagePartition(dir, "myMessages")
+		a.NoError(err)
+		a.Equal(size, fileSize(a, msgFilename))
+		a.Equal(uint64(2), mStore.Count())
+		a.NoError(mStore.Close())
+	}
+
+	// the following messages are appended after the truncated partial write
+	storeMessages(a, dir, 3)
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	a.Equal([]string{"aaaaaaaaaa", "aaaaaaaaaa", "aaaaaaaaaa"}, fetchMessages(a, mStore, 1, 3))
+}
+
+func Test_Recovery_CorruptSizeNotTruncatedBeforeLastFile(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_recovery_test")
+	defer os.RemoveAll(dir)
+	storeMessages(a, dir, 1, 2, 3)
+
+	// a corrupt size field in the second message
+	msgFilename := path.Join(dir, "myMessages-00000000000000000000.msg")
+	size := fileSize(a, msgFilename)
+	file, err := os.OpenFile(msgFilename, os.O_WRONLY, 0666)
+	a.NoError(err)
+	_, err = file.WriteAt([]byte{0xff, 0xff, 0, 0}, int64(fileHeaderSize+messageHeaderSize(formatVersion2)+10))
+	a.NoError(err)
+	a.NoError(file.Close())
+
+	// a sealed file is not truncated, only the messages before the corrupt one are indexed
+	entries, err := scanMsgFile(msgFilename, false)
+	a.NoError(err)
+	a.Equal(1, len(entries))
+	a.Equal(uint64(1), entries[0].id)
+	a.Equal(size, fileSize(a, msgFilename))
+
+	// the last file is truncated at the corrupt message
+	entries, err = scanMsgFile(msgFilename, true)
+	a.NoError(err)
+	a.Equal(1, len(entries))
+	a.Equal(int64(fileHeaderSize+messageHeaderSize(formatVersion2)+10), fileSize(a, msgFilename))
+}
+
+func Test_Recovery_LostIndexFile(t *testing.T) {
+	a := assert.New(t)
+	defer func() { messagesPerFile = uint64(10000) }()
+	messagesPerFile = uint64(5)
+
+	dir, _ := ioutil.TempDir("", "guble_recovery_test")
+	defer os.RemoveAll(dir)
+	storeMessages(a, dir, 5, 4, 3, 2, 1, 6, 7)
+	a.NoError(os.Remove(path.Join(dir, "myMessages-00000000000000000000.idx")))
+
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	a.Equal(1, mStore.fileCache.length())
+	a.Equal(uint64(1), mStore.fileCache.entries[0].min)
+	a.Equal(uint64(5), mStore.fileCache.entries[0].max)
+	a.Equal(uint64(7), mStore.Count())
+	a.Len(fetchMessages(a, mStore, 1, 10), 7)
+}
+
+func Test_Recovery_EmptyMessageFile(t *testing.T) {
+	a := assert.New(t)
+	defer func() { messagesPerFile = uint64(10000) }()
+	messagesPerFile = uint64(2)
+
+	dir, _ := ioutil.TempDir("", "guble_recovery_test")
+	defer os.RemoveAll(dir)
+	storeMessages(a, dir, 1, 2, 3, 4, 5)
+
+	// the second file lost its messages, so the third one takes its position
+	a.NoError(os.Truncate(path.Join(dir, "myMessages-00000000000000000001.msg"), 0))
+
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	a.Equal(1, mStore.fileCache.length())
+	_, err = os.Stat(path.Join(dir, "myMessages-00000000000000000002.msg"))
+	a.True(os.IsNotExist(err))
+	a.Len(fetchMessages(a, mStore, 1, 10), 3)
+}
+
+func Test_FileMessageStore_Recover(t *testing.T) {
+	a := assert.New(t)
+	defer func() { messagesPerFile = uint64(10000) }()
+	messagesPerFile = uint64(2)
+
+	dir, _ := ioutil.TempDir("", "guble_recovery_test")
+	defer os.RemoveAll(dir)
+	a.NoError(os.Mkdir(path.Join(dir, "myMessages"), 0700))
+	storeMessages(a, path.Join(dir, "myMessages"), 1, 2, 3)
+
+	// a wrong offset in the index of a full file is not detected at startup
+	file, err := os.OpenFile(path.Join(dir, "myMessages", "myMessages-00000000000000000000.idx"), os.O_RDWR, 0666)
+	a.NoError(err)
+	a.NoError(writeIndexEntry(file, 2, 12345, 10, 1))
+	a.NoError(file.Close())
+
+	mStore := New(dir)
+	a.NoError(mStore.Recover())
+
+	p, err := mStore.Partition("myMessages")
+	a.NoError(err)
+	a.Equal([]string{"aaaaaaaaaa", "aaaaaaaaaa", "aaaaaaaaaa"}, fetchMessages(a, p.(*messagePartition), 1, 3))
+}
@@ -0,0 +1,226 @@
+package filestore
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RetentionPolicy limits the messages kept by a partition.
+// When a limit is exceeded, the oldest full files of the partition are deleted.
+// The file to which the messages are appended is never deleted, so a limit can be exceeded by its messages.
+// A zero value disables the corresponding limit.
+type RetentionPolicy struct {
+	// MaxAge is the maximum age of the newest message of a file
+	MaxAge time.Duration
+
+	// MaxBytes is the maximum size of the message and index files of the partition
+	MaxBytes int64
+
+	// MaxMessages is the maximum number of messages of the partition
+	MaxMessages uint64
+}
+
+var (
+	// Retention is the default RetentionPolicy of the partitions loaded afterwards
+	Retention RetentionPolicy
+
+	// PartitionRetention holds the RetentionPolicy of partitions, replacing the default one
+	PartitionRetention = make(map[string]RetentionPolicy)
+
+	// RetentionInterval is the interval at which a started FileMessageStore applies the retention policies
+	// to all the partitions (value for disabling it: 0)
+	RetentionInterval = time.Minute
+)
+
+func (r RetentionPolicy) enabled() bool {
+	return r.MaxAge > 0 || r.MaxBytes > 0 || r.MaxMessages > 0
+}
+
+func retentionPolicy(partition string) RetentionPolicy {
+	if policy, ok := PartitionRetention[partition]; ok {
+		return policy
+	}
+	return Retention
+}
+
+// ParseRetention parses the retention policies of partitions, each setting having the format
+// `partition:limit=value[|limit=value...]`, where the limit is one of `age` (a duration), `bytes` or `messages`.
+// The settings of the same partition are merged.
+func ParseRetention(settings []string) (map[string]RetentionPolicy, error) {
+	policies := make(map[string]RetentionPolicy)
+	for _, setting := range settings {
+		parts := strings.SplitN(setting, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid retention setting %q, expected partition:limit=value", setting)
+		}
+
+		policy := policies[parts[0]]
+		for _, limit := range strings.Split(parts[1], "|") {
+			kv := strings.SplitN(limit, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid retention limit %q of partition %s", limit, parts[0])
+			}
+
+			var err error
+			switch kv[0] {
+			case "age":
+				policy.MaxAge, err = time.ParseDuration(kv[1])
+			case "bytes":
+				policy.MaxBytes, err = strconv.ParseInt(kv[1], 10, 64)
+			case "messages":
+				policy.MaxMessages, err = strconv.ParseUint(kv[1], 10, 64)
+			default:
+				err = fmt.Errorf("unknown limit %q", kv[0])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid retention limit %q of partition %s: %v", limit, parts[0], err)
+			}
+		}
+		policies[parts[0]] = policy
+	}
+	return policies, nil
+}
+
+// currentFileID returns the position of the file to which the messages are appended
+func (p *messagePartition) currentFileID() int {
+	return p.firstFileID + p.fileCache.length()
+}
+
+// firstMessageID returns the ID of the first message kept by the partition, or 0 if it has no messages.
+// It is called with the lock of the file cache held.
+func (p *messagePartition) firstMessageID() uint64 {
+	if len(p.fileCache.entries) > 0 {
+		return p.fileCache.entries[0].min
+	}
+	if first := p.list.front(); first != nil {
+		return first.id
+	}
+	return 0
+}
+
+// applyRetention deletes the oldest full files of the partition while its retention policy is exceeded.
+// It is called with the lock of the partition held, and returns the number of files deleted.
+func (p *messagePartition) applyRetention(now time.Time) (int, error) {
+	if !p.retention.enabled() {
+		return 0, nil
+	}
+
+	deleted := 0
+	for p.fileCache.length() > 0 {
+		l, err := p.loadIndexList(p.firstFileID)
+		if err != nil {
+			return deleted, err
+		}
+		exceeded, err := p.retentionExceeded(l, now)
+		if err != nil || !exceeded {
+			return deleted, err
+		}
+		if err := p.deleteFirstFile(l.len()); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// retentionExceeded returns true if the retention policy of the partition is exceeded,
+// given the index list of its oldest file
+func (p *messagePartition) retentionExceeded(first *indexList, now time.Time) (bool, error) {
+	if p.retention.MaxMessages > 0 && p.totalNumberOfMessages > p.retention.MaxMessages {
+		return true, nil
+	}
+	if p.retention.MaxBytes > 0 {
+		size, err := p.Size()
+		if err != nil {
+			return false, err
+		}
+		if size > p.retention.MaxBytes {
+			return true, nil
+		}
+	}
+	if p.retention.MaxAge > 0 && first.len() > 0 {
+		newest, err := p.messageTime(first.back())
+		if err != nil {
+			return false, err
+		}
+		if now.Sub(newest) > p.retention.MaxAge {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// deleteFirstFile deletes the .idx and .msg files of the oldest full file of the partition
+func (p *messagePartition) deleteFirstFile(messages int) error {
+	idxFilename := p.composeIdxFilenameForPosition(uint64(p.firstFileID))
+	msgFilename := p.composeMsgFilenameForPosition(uint64(p.firstFileID))
+	logger.WithFields(log.Fields{
+		"partition": p.name,
+		"filename":  msgFilename,
+		"messages":  messages,
+	}).Info("Deleting message file exceeding the retention policy")
+
+	// a crash between the deletions leaves a .msg file without its .idx file, which is recovered at startup
+	if err := os.Remove(idxFilename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(msgFilename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	p.segments.remove(p.firstFileID)
+	p.fileCache.removeFirst()
+	p.firstFileID++
+	if uint64(messages) < p.totalNumberOfMessages {
+		p.totalNumberOfMessages -= uint64(messages)
+	} else {
+		p.totalNumberOfMessages = 0
+	}
+
+	mTotalDeletedFiles.Add(1)
+	mTotalDeletedMessages.Add(int64(messages))
+	pDeletedFiles.Inc()
+	pDeletedMessages.Add(float64(messages))
+	return nil
+}
+
+func (fms *FileMessageStore) retentionLoop(interval time.Duration) {
+	defer close(fms.retentionDoneC)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fms.applyRetention(time.Now())
+		case <-fms.stopC:
+			return
+		}
+	}
+}
+
+// applyRetention applies the retention policies of all the partitions, returning the number of files deleted
+func (fms *FileMessageStore) applyRetention(now time.Time) int {
+	partitions, err := fms.Partitions()
+	if err != nil {
+		return 0
+	}
+
+	deleted := 0
+	for _, partition := range partitions {
+		p := partition.(*messagePartition)
+		p.Lock()
+		n, err := p.applyRetention(now)
+		p.Unlock()
+		if err != nil {
+			logger.WithError(err).WithField("partition", p.name).Error("Error applying the retention policy")
+		}
+		deleted += n
+	}
+	return deleted
+}
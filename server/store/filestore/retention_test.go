@@ -0,0 +1,184 @@
+package filestore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/store"
+)
+
+func storeNumberedMessages(a *assert.Assertions, p *messagePartition, from, to int) {
+	for i := from; i <= to; i++ {
+		a.NoError(p.Store(uint64(i), []byte(fmt.Sprintf("message %d", i))))
+	}
+}
+
+func Test_MessagePartition_RetentionMessages(t *testing.T) {
+	a := assert.New(t)
+	defer func() {
+		messagesPerFile = uint64(10000)
+		PartitionRetention = make(map[string]RetentionPolicy)
+	}()
+	messagesPerFile = uint64(2)
+	PartitionRetention = map[string]RetentionPolicy{"myMessages": {MaxMessages: 3}}
+
+	dir, _ := ioutil.TempDir("", "guble_retention_test")
+	defer os.RemoveAll(dir)
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+
+	// the oldest files are deleted when the next files are full
+	storeNumberedMessages(a, mStore, 1, 7)
+	a.Equal(uint64(3), mStore.Count())
+	a.Equal(2, mStore.firstFileID)
+	a.Equal(1, mStore.fileCache.length())
+	for _, fileID := range []int{0, 1} {
+		_, err = os.Stat(mStore.composeMsgFilenameForPosition(uint64(fileID)))
+		a.True(os.IsNotExist(err))
+		_, err = os.Stat(mStore.composeIdxFilenameForPosition(uint64(fileID)))
+		a.True(os.IsNotExist(err))
+	}
+
+	// the fetches starting before the retained messages begin with the first one
+	a.Equal([]string{"message 5", "message 6", "message 7"}, fetchMessages(a, mStore, 1, 10))
+	a.Equal([]string{"message 5", "message 6"}, fetchMessages(a, mStore, 2, 2))
+	a.Equal([]string{"message 6", "message 7"}, fetchMessages(a, mStore, 6, 10))
+
+	// the request of the caller is not changed
+	req := &store.FetchRequest{Partition: "myMessages", StartID: 1, Direction: 1, Count: 10}
+	list, err := mStore.calculateFetchList(req)
+	a.NoError(err)
+	a.Equal(3, list.len())
+	a.Equal(uint64(1), req.StartID)
+	a.NoError(mStore.Close())
+
+	// the partition is loaded starting with its first retained file
+	mStore, err = newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+	a.Equal(uint64(3), mStore.Count())
+	a.Equal(2, mStore.firstFileID)
+	a.Equal(uint64(7), mStore.MaxMessageID())
+	storeNumberedMessages(a, mStore, 8, 9)
+	a.Equal(uint64(3), mStore.Count())
+	a.Equal([]string{"message 7", "message 8", "message 9"}, fetchMessages(a, mStore, 1, 10))
+	a.NoError(mStore.Close())
+}
+
+func Test_MessagePartition_RetentionBytes(t *testing.T) {
+	a := assert.New(t)
+	defer func() {
+		messagesPerFile = uint64(10000)
+		Retention = RetentionPolicy{}
+	}()
+	messagesPerFile = uint64(2)
+	Retention = RetentionPolicy{MaxBytes: 250}
+
+	dir, _ := ioutil.TempDir("", "guble_retention_test")
+	defer os.RemoveAll(dir)
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+
+	// the files of 99 bytes (100 with the 10th message) are deleted while exceeding the limit,
+	// except the one to which the messages are appended
+	storeNumberedMessages(a, mStore, 1, 10)
+	size, err := mStore.Size()
+	a.NoError(err)
+	a.Equal(int64(99+99+100), size)
+	a.Equal(2, mStore.fileCache.length())
+	a.Equal(uint64(6), mStore.Count())
+	a.Equal([]string{"message 5", "message 6", "message 7"}, fetchMessages(a, mStore, 1, 3))
+	a.NoError(mStore.Close())
+}
+
+func Test_MessagePartition_RetentionAge(t *testing.T) {
+	a := assert.New(t)
+	defer func() { messagesPerFile = uint64(10000) }()
+	messagesPerFile = uint64(2)
+
+	dir, _ := ioutil.TempDir("", "guble_retention_test")
+	defer os.RemoveAll(dir)
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+
+	for i, ts := range []int64{1000, 1000, 2000, 2000, 3000} {
+		message := &protocol.Message{ID: uint64(i + 1), Path: "/myMessages", Time: ts}
+		a.NoError(mStore.Store(uint64(i+1), message.Encode()))
+	}
+
+	// only the first file has its newest message older than the maximum age
+	mStore.retention = RetentionPolicy{MaxAge: 1700 * time.Second}
+	mStore.Lock()
+	deleted, err := mStore.applyRetention(time.Unix(3600, 0))
+	mStore.Unlock()
+	a.NoError(err)
+	a.Equal(1, deleted)
+	a.Equal(uint64(3), mStore.Count())
+	a.Equal(1, mStore.firstFileID)
+
+	first, last, ok := mStore.MessageTimes()
+	a.True(ok)
+	a.Equal(int64(2000), first.Unix())
+	a.Equal(int64(3000), last.Unix())
+
+	// the file to which the messages are appended is kept
+	mStore.Lock()
+	deleted, err = mStore.applyRetention(time.Unix(100000, 0))
+	mStore.Unlock()
+	a.NoError(err)
+	a.Equal(1, deleted)
+	a.Equal(uint64(1), mStore.Count())
+	a.Equal(0, mStore.fileCache.length())
+	a.Len(fetchMessages(a, mStore, 1, 10), 1)
+	a.NoError(mStore.Close())
+}
+
+func Test_FileMessageStore_Retention(t *testing.T) {
+	a := assert.New(t)
+	defer func() {
+		messagesPerFile = uint64(10000)
+		Retention = RetentionPolicy{}
+	}()
+	messagesPerFile = uint64(2)
+	Retention = RetentionPolicy{MaxAge: time.Hour}
+
+	dir, _ := ioutil.TempDir("", "guble_retention_test")
+	defer os.RemoveAll(dir)
+	mStore := New(dir)
+
+	for i := 1; i <= 5; i++ {
+		message := &protocol.Message{ID: uint64(i), Path: "/p1", Time: time.Now().Unix()}
+		a.NoError(mStore.Store("p1", uint64(i), message.Encode()))
+	}
+	a.Equal(0, mStore.applyRetention(time.Now()))
+	a.Equal(2, mStore.applyRetention(time.Now().Add(2*time.Hour)))
+
+	p, err := mStore.Partition("p1")
+	a.NoError(err)
+	a.Equal(uint64(1), p.Count())
+	_, err = os.Stat(path.Join(dir, "p1", "p1-00000000000000000002.msg"))
+	a.NoError(err)
+	a.NoError(mStore.Stop())
+}
+
+func Test_ParseRetention(t *testing.T) {
+	a := assert.New(t)
+
+	policies, err := ParseRetention([]string{"news:age=24h|messages=1000", "sms:bytes=1048576", "news:bytes=10"})
+	a.NoError(err)
+	a.Equal(map[string]RetentionPolicy{
+		"news": {MaxAge: 24 * time.Hour, MaxBytes: 10, MaxMessages: 1000},
+		"sms":  {MaxBytes: 1048576},
+	}, policies)
+
+	for _, setting := range []string{"news", "news:", ":age=1h", "news:age", "news:age=1", "news:size=10", "news:messages=-1"} {
+		_, err := ParseRetention([]string{setting})
+		a.Error(err, setting)
+	}
+}
@@ -0,0 +1,171 @@
+package filestore
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncPolicy is the durability policy of the FileMessageStore, defining when the stored messages are synced to the disk
+type SyncPolicy string
+
+const (
+	// SyncNone leaves the syncing of the stored messages to the operating system
+	SyncNone SyncPolicy = "none"
+
+	// SyncInterval syncs the messages stored in each partition every SyncPeriod, once the FileMessageStore is started
+	SyncInterval SyncPolicy = "interval"
+
+	// SyncAlways syncs each message before it is acknowledged as stored;
+	// the concurrent writers in a partition share the same sync (group commit)
+	SyncAlways SyncPolicy = "always"
+)
+
+var (
+	// Durability is the SyncPolicy of the partitions loaded afterwards
+	Durability = SyncNone
+
+	// SyncPeriod is the period of the syncs of the SyncInterval policy
+	SyncPeriod = 100 * time.Millisecond
+)
+
+// groupSync lets the writers of a partition wait until their messages are synced,
+// the writers waiting while a sync is in progress sharing the next one.
+type groupSync struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	syncing bool
+	synced  uint64 // the number of writes synced
+}
+
+func newGroupSync() *groupSync {
+	g := &groupSync{}
+	g.cond = sync.NewCond(&g.mutex)
+	return g
+}
+
+// wait returns once the first `written` writes of the partition are synced
+func (g *groupSync) wait(p *messagePartition, written uint64) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for g.synced < written {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+
+		g.syncing = true
+		g.mutex.Unlock()
+		synced, err := p.sync()
+		g.mutex.Lock()
+
+		g.syncing = false
+		if err == nil && synced > g.synced {
+			g.synced = synced
+		}
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sync syncs the append files of the partition to the disk, if they have writes not yet synced.
+// It returns the number of writes synced.
+func (p *messagePartition) sync() (uint64, error) {
+	// the append files are not closed while they are synced
+	p.RLock()
+	written := p.written
+	appendFile, indexFile := p.appendFile, p.indexFile
+	p.syncMutex.Lock()
+	p.RUnlock()
+	defer p.syncMutex.Unlock()
+
+	if written == p.syncedWrites || appendFile == nil || indexFile == nil {
+		return p.syncedWrites, nil
+	}
+	if err := appendFile.Sync(); err != nil {
+		logger.WithError(err).WithField("partition", p.name).Error("Error syncing message file")
+		return 0, err
+	}
+	if err := indexFile.Sync(); err != nil {
+		logger.WithError(err).WithField("partition", p.name).Error("Error syncing index file")
+		return 0, err
+	}
+
+	mTotalSyncs.Add(1)
+	mTotalSyncedWrites.Add(int64(written - p.syncedWrites))
+	pSyncs.Inc()
+	pSyncedWrites.Add(float64(written - p.syncedWrites))
+
+	p.syncedWrites = written
+	return written, nil
+}
+
+// syncAndCloseAppendFiles syncs the append files before closing them, unless the sync policy is SyncNone.
+// It is called with the lock of the partition held.
+func (p *messagePartition) syncAndCloseAppendFiles() error {
+	if p.syncPolicy == SyncNone {
+		return p.closeAppendFiles()
+	}
+
+	p.syncMutex.Lock()
+	defer p.syncMutex.Unlock()
+
+	if p.written != p.syncedWrites && p.appendFile != nil && p.indexFile != nil {
+		if err := p.appendFile.Sync(); err != nil {
+			return err
+		}
+		if err := p.indexFile.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := p.closeAppendFiles(); err != nil {
+		return err
+	}
+	p.syncedWrites = p.written
+	return nil
+}
+
+// syncDir syncs a directory, making durable the files created in it
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (fms *FileMessageStore) syncLoop(period time.Duration) {
+	defer close(fms.syncerDoneC)
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fms.syncPartitions()
+		case <-fms.stopC:
+			return
+		}
+	}
+}
+
+// syncPartitions syncs the partitions having the SyncInterval policy
+func (fms *FileMessageStore) syncPartitions() {
+	fms.mutex.RLock()
+	partitions := make([]*messagePartition, 0, len(fms.partitions))
+	for _, p := range fms.partitions {
+		if p.syncPolicy == SyncInterval {
+			partitions = append(partitions, p)
+		}
+	}
+	fms.mutex.RUnlock()
+
+	for _, p := range partitions {
+		p.sync()
+	}
+}
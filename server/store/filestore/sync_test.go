@@ -0,0 +1,128 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func counterValue(c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	c.Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func writes(p *messagePartition) (uint64, uint64) {
+	p.RLock()
+	defer p.RUnlock()
+	p.syncMutex.Lock()
+	defer p.syncMutex.Unlock()
+	return p.written, p.syncedWrites
+}
+
+func Test_MessagePartition_SyncAlways(t *testing.T) {
+	a := assert.New(t)
+	defer func() { Durability = SyncNone }()
+	Durability = SyncAlways
+
+	dir, _ := ioutil.TempDir("", "guble_sync_test")
+	defer os.RemoveAll(dir)
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+
+	a.NoError(mStore.Store(uint64(1), []byte("aaaaaaaaaa")))
+	written, synced := writes(mStore)
+	a.Equal(uint64(1), written)
+	a.Equal(uint64(1), synced)
+
+	// the writers waiting while a sync is in progress share the next one
+	syncs := counterValue(pSyncs)
+	mStore.groupSync.mutex.Lock()
+	mStore.groupSync.syncing = true
+	mStore.groupSync.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 2; i <= 11; i++ {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			a.NoError(mStore.Store(id, []byte("aaaaaaaaaa")))
+		}(uint64(i))
+	}
+	for i := 0; i < 100; i++ {
+		if written, _ = writes(mStore); written == 11 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Equal(uint64(11), written)
+
+	mStore.groupSync.mutex.Lock()
+	mStore.groupSync.syncing = false
+	mStore.groupSync.cond.Broadcast()
+	mStore.groupSync.mutex.Unlock()
+	wg.Wait()
+
+	a.Equal(1.0, counterValue(pSyncs)-syncs)
+	_, synced = writes(mStore)
+	a.Equal(uint64(11), synced)
+	a.NoError(mStore.Close())
+}
+
+func Test_MessagePartition_SyncOnClose(t *testing.T) {
+	a := assert.New(t)
+	defer func() {
+		Durability = SyncNone
+		messagesPerFile = uint64(10000)
+	}()
+	Durability = SyncInterval
+	messagesPerFile = uint64(2)
+
+	dir, _ := ioutil.TempDir("", "guble_sync_test")
+	defer os.RemoveAll(dir)
+	mStore, err := newMessagePartition(dir, "myMessages")
+	a.NoError(err)
+
+	// the files are synced when they are full
+	for i := 1; i <= 3; i++ {
+		a.NoError(mStore.Store(uint64(i), []byte("aaaaaaaaaa")))
+	}
+	written, synced := writes(mStore)
+	a.Equal(uint64(3), written)
+	a.Equal(uint64(2), synced)
+
+	a.NoError(mStore.Close())
+	_, synced = writes(mStore)
+	a.Equal(uint64(3), synced)
+}
+
+func Test_FileMessageStore_SyncInterval(t *testing.T) {
+	a := assert.New(t)
+	defer func(period time.Duration) {
+		Durability = SyncNone
+		SyncPeriod = period
+	}(SyncPeriod)
+	Durability = SyncInterval
+	SyncPeriod = 10 * time.Millisecond
+
+	dir, _ := ioutil.TempDir("", "guble_sync_test")
+	defer os.RemoveAll(dir)
+	mStore := New(dir)
+	a.NoError(mStore.Start())
+
+	a.NoError(mStore.Store("p1", uint64(1), []byte("aaaaaaaaaa")))
+	a.NoError(mStore.Store("p1", uint64(2), []byte("aaaaaaaaaa")))
+	time.Sleep(50 * time.Millisecond)
+
+	p, err := mStore.Partition("p1")
+	a.NoError(err)
+	_, synced := writes(p.(*messagePartition))
+	a.Equal(uint64(2), synced)
+	a.NoError(mStore.Stop())
+}
@@ -1,6 +1,10 @@
 package store
 
-import "github.com/cosminrentea/gobbler/protocol"
+import (
+	"time"
+
+	"github.com/cosminrentea/gobbler/protocol"
+)
 
 // MessageStore is an interface for a persistence backend storing topics.
 type MessageStore interface {
@@ -54,3 +58,15 @@ type MessagePartition interface {
 
 	DoInTx(func(uint64) error) error
 }
+
+// PartitionStats is implemented by the message partitions which can report the size of their files,
+// and the creation times of their messages.
+type PartitionStats interface {
+
+	// Size returns the size in bytes of the files of the partition
+	Size() (int64, error)
+
+	// MessageTimes returns the creation times of the first and of the last message stored in the partition,
+	// or false if the partition is empty
+	MessageTimes() (first time.Time, last time.Time, ok bool)
+}
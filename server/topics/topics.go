@@ -0,0 +1,222 @@
+package topics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/router"
+	"github.com/cosminrentea/gobbler/server/store"
+)
+
+// Topics is an Endpoint returning the statistics of the partitions of the message store and of their topics:
+// the numbers of messages, the sizes on disk, the times of the first and last messages,
+// the publish rates over the router.RateWindow and the numbers of live subscribers.
+// It can also export the statistics of the partitions as Prometheus metrics.
+type Topics struct {
+	router  router.Router
+	prefix  string
+	metrics bool
+}
+
+// PartitionStats are the statistics of a partition of the message store
+type PartitionStats struct {
+	Name          string     `json:"name"`
+	Messages      uint64     `json:"messages"`
+	MaxMessageID  uint64     `json:"max_message_id"`
+	SizeBytes     int64      `json:"size_bytes"`
+	FirstMessage  *time.Time `json:"first_message,omitempty"`
+	LastMessage   *time.Time `json:"last_message,omitempty"`
+	PublishRate   float64    `json:"publish_rate"`
+	Subscribers   int        `json:"subscribers"`
+	SubtopicCount int        `json:"subtopics"`
+}
+
+// TopicStats are the statistics of a topic (or subtopic) of a partition
+type TopicStats struct {
+	Path        protocol.Path `json:"path"`
+	PublishRate float64       `json:"publish_rate"`
+	Subscribers int           `json:"subscribers"`
+}
+
+// PartitionDetail are the statistics of a partition, with its topics
+type PartitionDetail struct {
+	PartitionStats
+	Topics []TopicStats `json:"topics"`
+}
+
+// New returns the statistics of the topics of the router, served at the given prefix.
+// The router should be the one routing all the messages of the node, to report their publish rates.
+// If metrics is true, the statistics of the partitions are exported as Prometheus metrics once started.
+func New(r router.Router, prefix string, metrics bool) *Topics {
+	return &Topics{
+		router:  r,
+		prefix:  prefix,
+		metrics: metrics,
+	}
+}
+
+// Start enables the publish rates of the router, and registers the Prometheus collector of the partitions,
+// if the metrics are enabled. It replaces the collector of a previous instance, which was not stopped.
+func (t *Topics) Start() error {
+	if activity, ok := t.router.(router.TopicActivity); ok {
+		activity.EnablePublishRates()
+	}
+	if !t.metrics {
+		return nil
+	}
+	if err := prometheus.Register(t); err != nil {
+		registered, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return err
+		}
+		prometheus.Unregister(registered.ExistingCollector)
+		return prometheus.Register(t)
+	}
+	return nil
+}
+
+// Stop unregisters the Prometheus collector of the partitions
+func (t *Topics) Stop() error {
+	if t.metrics {
+		prometheus.Unregister(t)
+	}
+	return nil
+}
+
+// GetPrefix returns the prefix of the statistics endpoint.
+// It is a part of the service.endpoint implementation.
+func (t *Topics) GetPrefix() string {
+	return t.prefix
+}
+
+// ServeHTTP returns on GET the statistics of all the partitions, ordered by name,
+// and on GET `<prefix>/<partition>` the statistics of the partition with the ones of its topics.
+// It is a part of the service.endpoint implementation.
+func (t *Topics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, t.prefix), "/")
+	if strings.Contains(name, "/") {
+		http.NotFound(w, req)
+		return
+	}
+
+	partitions, topics, err := t.stats()
+	if err != nil {
+		logger.WithError(err).Error("Error collecting the statistics of the topics")
+		http.Error(w, "Server error.", http.StatusInternalServerError)
+		return
+	}
+
+	var result interface{} = partitions
+	if name != "" {
+		detail := &PartitionDetail{Topics: make([]TopicStats, 0)}
+		for _, p := range partitions {
+			if p.Name == name {
+				detail.PartitionStats = p
+			}
+		}
+		if detail.Name == "" {
+			http.NotFound(w, req)
+			return
+		}
+		for _, topic := range topics {
+			if topic.Path.Partition() == name {
+				detail.Topics = append(detail.Topics, topic)
+			}
+		}
+		result = detail
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		logger.WithError(err).Error("Error encoding the statistics of the topics")
+	}
+}
+
+// stats returns the statistics of the partitions and of the topics, both ordered by name.
+// The partitions are the ones of the message store, and the ones having topics with messages published or subscribers.
+// The routes subscribed to a wildcard partition are not counted.
+func (t *Topics) stats() ([]PartitionStats, []TopicStats, error) {
+	byName := make(map[string]*PartitionStats)
+	partition := func(name string) *PartitionStats {
+		p, ok := byName[name]
+		if !ok {
+			p = &PartitionStats{Name: name}
+			byName[name] = p
+		}
+		return p
+	}
+
+	messageStore, err := t.router.MessageStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	partitions, err := messageStore.Partitions()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, mp := range partitions {
+		p := partition(mp.Name())
+		p.Messages = mp.Count()
+		p.MaxMessageID = mp.MaxMessageID()
+		if stats, ok := mp.(store.PartitionStats); ok {
+			if p.SizeBytes, err = stats.Size(); err != nil {
+				logger.WithError(err).WithField("partition", p.Name).Error("Error reading the size of the partition")
+			}
+			if first, last, ok := stats.MessageTimes(); ok {
+				p.FirstMessage, p.LastMessage = &first, &last
+			}
+		}
+	}
+
+	byPath := make(map[protocol.Path]*TopicStats)
+	topic := func(path protocol.Path) *TopicStats {
+		s, ok := byPath[path]
+		if !ok {
+			s = &TopicStats{Path: path}
+			byPath[path] = s
+			partition(path.Partition()).SubtopicCount++
+		}
+		return s
+	}
+	if activity, ok := t.router.(router.TopicActivity); ok {
+		for path, rate := range activity.PublishRates() {
+			topic(path).PublishRate = rate
+			partition(path.Partition()).PublishRate += rate
+		}
+		subscribers, err := activity.SubscriberCounts()
+		if err != nil {
+			return nil, nil, err
+		}
+		for path, count := range subscribers {
+			if path.HasWildcardPartition() {
+				continue
+			}
+			topic(path).Subscribers = count
+			partition(path.Partition()).Subscribers += count
+		}
+	}
+
+	partitionStats := make([]PartitionStats, 0, len(byName))
+	for _, p := range byName {
+		partitionStats = append(partitionStats, *p)
+	}
+	sort.Slice(partitionStats, func(i, j int) bool { return partitionStats[i].Name < partitionStats[j].Name })
+
+	topicStats := make([]TopicStats, 0, len(byPath))
+	for _, s := range byPath {
+		topicStats = append(topicStats, *s)
+	}
+	sort.Slice(topicStats, func(i, j int) bool { return topicStats[i].Path < topicStats[j].Path })
+
+	return partitionStats, topicStats, nil
+}
@@ -0,0 +1,51 @@
+package topics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pPartitionMessages = prometheus.NewDesc(
+		"topics_partition_messages",
+		"Number of messages stored in the partition",
+		[]string{"partition"}, nil)
+
+	pPartitionSizeBytes = prometheus.NewDesc(
+		"topics_partition_size_bytes",
+		"Size in bytes of the files of the partition",
+		[]string{"partition"}, nil)
+
+	pPartitionPublishRate = prometheus.NewDesc(
+		"topics_partition_publish_rate",
+		"Number of messages per second published in the partition, over the sliding window",
+		[]string{"partition"}, nil)
+
+	pPartitionSubscribers = prometheus.NewDesc(
+		"topics_partition_subscribers",
+		"Number of live subscribers to the topics of the partition",
+		[]string{"partition"}, nil)
+)
+
+// Describe is a part of the prometheus.Collector implementation
+func (t *Topics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pPartitionMessages
+	ch <- pPartitionSizeBytes
+	ch <- pPartitionPublishRate
+	ch <- pPartitionSubscribers
+}
+
+// Collect returns the statistics of the partitions, when they are scraped.
+// It is a part of the prometheus.Collector implementation.
+func (t *Topics) Collect(ch chan<- prometheus.Metric) {
+	partitions, _, err := t.stats()
+	if err != nil {
+		logger.WithError(err).Error("Error collecting the statistics of the partitions")
+		return
+	}
+	for _, p := range partitions {
+		ch <- prometheus.MustNewConstMetric(pPartitionMessages, prometheus.GaugeValue, float64(p.Messages), p.Name)
+		ch <- prometheus.MustNewConstMetric(pPartitionSizeBytes, prometheus.GaugeValue, float64(p.SizeBytes), p.Name)
+		ch <- prometheus.MustNewConstMetric(pPartitionPublishRate, prometheus.GaugeValue, p.PublishRate, p.Name)
+		ch <- prometheus.MustNewConstMetric(pPartitionSubscribers, prometheus.GaugeValue, float64(p.Subscribers), p.Name)
+	}
+}
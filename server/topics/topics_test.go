@@ -0,0 +1,144 @@
+package topics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/router"
+	"github.com/cosminrentea/gobbler/server/store/filestore"
+)
+
+type testRouter interface {
+	router.Router
+	Start() error
+	Stop() error
+}
+
+func TestTopics_ServeHTTP(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gobbler_topics_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+
+	r := router.New(filestore.New(dir), kvstore.NewMemoryKVStore(), nil).(testRouter)
+	a.NoError(r.Start())
+	defer r.Stop()
+
+	// the publish rates are counted once the statistics are started
+	topics := New(r, "/admin/topics", false)
+	a.NoError(topics.Start())
+	defer topics.Stop()
+
+	for _, path := range []protocol.Path{"/chat/room1", "/chat/room2", "/presence/*"} {
+		_, err := r.Subscribe(router.NewRoute(router.RouteConfig{
+			RouteParams: router.RouteParams{"application_id": "app", "user_id": "marvin"},
+			Path:        path,
+			ChannelSize: 10,
+		}))
+		a.NoError(err)
+	}
+	for _, path := range []protocol.Path{"/chat/room1", "/chat/room1", "/chat/room3", "/news"} {
+		a.NoError(r.HandleMessage(&protocol.Message{Path: path, Body: []byte("hello")}))
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	get := func(url string, v interface{}) int {
+		w := httptest.NewRecorder()
+		topics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		if w.Code == http.StatusOK {
+			a.NoError(json.Unmarshal(w.Body.Bytes(), v))
+		}
+		return w.Code
+	}
+
+	// the partitions of the store, and the ones having subscribers
+	var partitions []PartitionStats
+	a.Equal(http.StatusOK, get("/admin/topics", &partitions))
+	if a.Len(partitions, 3) {
+		chat := partitions[0]
+		a.Equal("chat", chat.Name)
+		a.Equal(uint64(3), chat.Messages)
+		a.True(chat.SizeBytes > 0)
+		a.NotNil(chat.FirstMessage)
+		a.NotNil(chat.LastMessage)
+		a.Equal(2, chat.Subscribers)
+		a.Equal(3, chat.SubtopicCount)
+		a.InDelta(3/router.RateWindow.Seconds(), chat.PublishRate, 0.0001)
+
+		a.Equal("news", partitions[1].Name)
+		a.Equal(uint64(1), partitions[1].Messages)
+		a.Equal(0, partitions[1].Subscribers)
+
+		a.Equal("presence", partitions[2].Name)
+		a.Equal(uint64(0), partitions[2].Messages)
+		a.Equal(1, partitions[2].Subscribers)
+	}
+
+	// the topics of a partition
+	var detail PartitionDetail
+	a.Equal(http.StatusOK, get("/admin/topics/chat", &detail))
+	a.Equal("chat", detail.Name)
+	if a.Len(detail.Topics, 3) {
+		a.Equal(protocol.Path("/chat/room1"), detail.Topics[0].Path)
+		a.Equal(1, detail.Topics[0].Subscribers)
+		a.InDelta(2/router.RateWindow.Seconds(), detail.Topics[0].PublishRate, 0.0001)
+		a.Equal(protocol.Path("/chat/room2"), detail.Topics[1].Path)
+		a.Equal(0.0, detail.Topics[1].PublishRate)
+		a.Equal(protocol.Path("/chat/room3"), detail.Topics[2].Path)
+		a.Equal(0, detail.Topics[2].Subscribers)
+	}
+
+	a.Equal(http.StatusNotFound, get("/admin/topics/unknown", nil))
+	a.Equal(http.StatusNotFound, get("/admin/topics/chat/room1", nil))
+
+	w := httptest.NewRecorder()
+	topics.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/topics", nil))
+	a.Equal(http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestTopics_Metrics(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "gobbler_topics_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+
+	r := router.New(filestore.New(dir), kvstore.NewMemoryKVStore(), nil).(testRouter)
+	a.NoError(r.Start())
+	defer r.Stop()
+	a.NoError(r.HandleMessage(&protocol.Message{Path: "/news", Body: []byte("hello")}))
+
+	// the metrics of a previous instance are replaced
+	a.NoError(New(r, "", true).Start())
+	topics := New(r, "", true)
+	a.NoError(topics.Start())
+	defer topics.Stop()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	a.NoError(err)
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "partition" && label.GetValue() == "news" {
+					values[family.GetName()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	a.Equal(1.0, values["topics_partition_messages"])
+	a.True(values["topics_partition_size_bytes"] > 0)
+	a.Contains(values, "topics_partition_publish_rate")
+	a.Equal(0.0, values["topics_partition_subscribers"])
+}
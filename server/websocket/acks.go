@@ -0,0 +1,392 @@
+package websocket
+
+import (
+	"container/heap"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/kvstore"
+)
+
+const (
+	// AtLeastOnce is the receive mode in which the messages are redelivered until the client acknowledges them
+	AtLeastOnce = "at-least-once"
+
+	// the schema of the committed offsets in the KVStore
+	offsetsSchema = "ws_offsets"
+)
+
+// DefaultAckTimeout is the duration after which a message not acknowledged by the client is redelivered,
+// in the at-least-once receive mode.
+var DefaultAckTimeout = 30 * time.Second
+
+// sentMessage is a message sent to a client, and not yet acknowledged
+type sentMessage struct {
+	id     uint64
+	data   []byte
+	sentAt time.Time
+	sendC  chan []byte
+	index  int
+}
+
+// sentMessages is a heap of the messages sent and not yet acknowledged, ordered by their ID
+type sentMessages []*sentMessage
+
+func (h sentMessages) Len() int           { return len(h) }
+func (h sentMessages) Less(i, j int) bool { return h[i].id < h[j].id }
+
+func (h sentMessages) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *sentMessages) Push(x interface{}) {
+	m := x.(*sentMessage)
+	m.index = len(*h)
+	*h = append(*h, m)
+}
+
+func (h *sentMessages) Pop() interface{} {
+	old := *h
+	n := len(old)
+	m := old[n-1]
+	*h = old[:n-1]
+	return m
+}
+
+// messageIDs is a heap of the IDs of the messages acknowledged, but not yet covered by the committed offset
+type messageIDs []uint64
+
+func (h messageIDs) Len() int           { return len(h) }
+func (h messageIDs) Less(i, j int) bool { return h[i] < h[j] }
+func (h messageIDs) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *messageIDs) Push(x interface{}) {
+	*h = append(*h, x.(uint64))
+}
+
+func (h *messageIDs) Pop() interface{} {
+	old := *h
+	n := len(old)
+	id := old[n-1]
+	*h = old[:n-1]
+	return id
+}
+
+// ackTracker tracks the messages sent by the receivers in the at-least-once mode, redelivering them until they are acknowledged.
+// The committed offset is the highest ID up to which all the messages sent were acknowledged;
+// it is persisted in the KVStore for the user (or the consumer group) and the path, and the receivers resume from it.
+// The offset is written outside the lock, so a slow KVStore does not block the sending of the messages;
+// the offsets committed while a write is in progress are coalesced into the next write.
+// The tracker of a consumer group is shared by all the members of the group connected to this node.
+type ackTracker struct {
+	kvStore kvstore.KVStore
+	key     string
+	timeout time.Duration
+	shared  bool
+
+	mu         sync.Mutex
+	pending    map[uint64]*sentMessage
+	inFlight   sentMessages
+	acked      messageIDs
+	committed  uint64
+	hasOffset  bool
+	dirty      bool
+	committing bool
+	members    map[chan []byte]bool
+
+	stopC    chan struct{}
+	stopOnce sync.Once
+}
+
+// groupTrackers are the trackers of the consumer groups, by their key
+var groupTrackers = struct {
+	sync.Mutex
+	trackers map[string]*ackTracker
+}{trackers: make(map[string]*ackTracker)}
+
+// offsetKey returns the key of the committed offset of the user, or of the consumer group if it is given
+func offsetKey(userID, group string, path protocol.Path) string {
+	if group != "" {
+		return "group/" + group + ":" + string(path)
+	}
+	return userID + ":" + string(path)
+}
+
+// joinAckTracker adds the send channel of a receiver to the members of the tracker of the user or of the group,
+// creating the tracker if it does not exist. It returns true if the receiver is the first member of the tracker.
+func joinAckTracker(kvStore kvstore.KVStore, userID, group string, path protocol.Path, timeout time.Duration, sendC chan []byte) (*ackTracker, bool, error) {
+	if group != "" {
+		groupTrackers.Lock()
+		defer groupTrackers.Unlock()
+		if t, ok := groupTrackers.trackers[offsetKey(userID, group, path)]; ok {
+			t.mu.Lock()
+			t.members[sendC] = true
+			t.mu.Unlock()
+			return t, false, nil
+		}
+	}
+
+	t, err := newAckTracker(kvStore, offsetKey(userID, group, path), timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	t.members[sendC] = true
+	if group != "" {
+		t.shared = true
+		groupTrackers.trackers[t.key] = t
+	}
+	go t.redeliverLoop()
+	return t, true, nil
+}
+
+func newAckTracker(kvStore kvstore.KVStore, key string, timeout time.Duration) (*ackTracker, error) {
+	t := &ackTracker{
+		kvStore: kvStore,
+		key:     key,
+		timeout: timeout,
+		pending: make(map[uint64]*sentMessage),
+		members: make(map[chan []byte]bool),
+		stopC:   make(chan struct{}),
+	}
+	value, exists, err := kvStore.Get(offsetsSchema, t.key)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if t.committed, err = strconv.ParseUint(string(value), 10, 64); err != nil {
+			return nil, err
+		}
+		t.hasOffset = true
+	}
+	return t, nil
+}
+
+// offset returns the committed offset, if there is one
+func (t *ackTracker) offset() (uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.committed, t.hasOffset
+}
+
+// isCommitted returns true if the message is covered by the committed offset
+func (t *ackTracker) isCommitted(id uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.hasOffset && id <= t.committed
+}
+
+// sent records a message sent to a client. If there is no committed offset yet,
+// it is set before the message, so that the message is redelivered after a reconnect.
+func (t *ackTracker) sent(id uint64, data []byte, sendC chan []byte) {
+	t.mu.Lock()
+	if m, ok := t.pending[id]; ok {
+		m.data, m.sentAt, m.sendC = data, time.Now(), sendC
+	} else {
+		m = &sentMessage{id: id, data: data, sentAt: time.Now(), sendC: sendC}
+		heap.Push(&t.inFlight, m)
+		t.pending[id] = m
+	}
+	if !t.hasOffset && id > 0 {
+		t.commit(id - 1)
+	}
+	t.mu.Unlock()
+
+	t.persist()
+}
+
+// ack removes the message from the pending messages, and advances the committed offset
+// up to the lowest message still pending. It returns false if the message was not pending.
+func (t *ackTracker) ack(id uint64) bool {
+	t.mu.Lock()
+	m, ok := t.pending[id]
+	if !ok {
+		t.mu.Unlock()
+		return false
+	}
+	delete(t.pending, id)
+	heap.Remove(&t.inFlight, m.index)
+	heap.Push(&t.acked, id)
+
+	offset := t.committed
+	for len(t.acked) > 0 && (len(t.inFlight) == 0 || t.acked[0] < t.inFlight[0].id) {
+		if ackedID := heap.Pop(&t.acked).(uint64); ackedID > offset {
+			offset = ackedID
+		}
+	}
+	if offset > t.committed {
+		t.commit(offset)
+	}
+	t.mu.Unlock()
+
+	t.persist()
+	return true
+}
+
+// commit sets the offset to persist; it is called with the lock held
+func (t *ackTracker) commit(offset uint64) {
+	t.committed, t.hasOffset, t.dirty = offset, true, true
+}
+
+// persist writes the committed offset in the KVStore, unless it is already being written.
+// In that case, the write in progress is followed by a write of the latest committed offset.
+func (t *ackTracker) persist() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.committing {
+		return
+	}
+	t.committing = true
+	for t.dirty {
+		offset := t.committed
+		t.dirty = false
+		t.mu.Unlock()
+		if err := t.kvStore.Put(offsetsSchema, t.key, []byte(strconv.FormatUint(offset, 10))); err != nil {
+			logger.WithError(err).WithFields(log.Fields{
+				"key":    t.key,
+				"offset": offset,
+			}).Error("Error committing offset")
+		}
+		t.mu.Lock()
+	}
+	t.committing = false
+}
+
+// redeliverLoop sends again the messages which are not acknowledged before the timeout, until stopped
+func (t *ackTracker) redeliverLoop() {
+	interval := t.timeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, m := range t.expired() {
+				select {
+				case m.sendC <- m.data:
+				case <-t.stopC:
+					return
+				case <-time.After(t.timeout):
+					// the receiver is gone, and its messages were passed to another member
+				}
+			}
+		case <-t.stopC:
+			return
+		}
+	}
+}
+
+// expired returns the messages to redeliver ordered by ID, and restarts their timeouts
+func (t *ackTracker) expired() []sentMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	ids := make([]uint64, 0)
+	for id, m := range t.pending {
+		if now.Sub(m.sentAt) >= t.timeout {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	messages := make([]sentMessage, 0, len(ids))
+	for _, id := range ids {
+		t.pending[id].sentAt = now
+		messages = append(messages, *t.pending[id])
+	}
+	if len(ids) > 0 {
+		logger.WithFields(log.Fields{
+			"key":   t.key,
+			"count": len(ids),
+		}).Debug("Redelivering messages not acknowledged")
+	}
+	return messages
+}
+
+// leave removes a receiver from the members of the tracker, passing its pending messages to another member.
+// The tracker is stopped when its last member leaves; its pending messages are redelivered from the committed offset
+// by the next receivers.
+func (t *ackTracker) leave(sendC chan []byte) {
+	if t.shared {
+		groupTrackers.Lock()
+		defer groupTrackers.Unlock()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.members, sendC)
+	for other := range t.members {
+		for _, m := range t.pending {
+			if m.sendC == sendC {
+				m.sendC = other
+			}
+		}
+		return
+	}
+	if t.shared && groupTrackers.trackers[t.key] == t {
+		delete(groupTrackers.trackers, t.key)
+	}
+	t.stopOnce.Do(func() { close(t.stopC) })
+}
+
+// maxOnlineFirst is the maximum number of online-first messages tracked by a receiver until they are acknowledged
+const maxOnlineFirst = 1000
+
+type onlineFirstKey struct {
+	path protocol.Path
+	id   uint64
+}
+
+// onlineFirstTracker tracks the online-first messages sent by a receiver (see protocol.OnlineFirstDelivery).
+// Only their acknowledgements are passed to the Acknowledger.
+type onlineFirstTracker struct {
+	mu     sync.Mutex
+	sentAt map[onlineFirstKey]time.Time
+}
+
+func newOnlineFirstTracker() *onlineFirstTracker {
+	return &onlineFirstTracker{sentAt: make(map[onlineFirstKey]time.Time)}
+}
+
+// sent records an online-first message sent to the client. If the maximum is reached, the oldest message is forgotten,
+// since its acknowledgement timeout most likely expired already.
+func (t *onlineFirstTracker) sent(path protocol.Path, id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.sentAt) >= maxOnlineFirst {
+		var (
+			oldest   onlineFirstKey
+			oldestAt time.Time
+		)
+		for key, sentAt := range t.sentAt {
+			if oldestAt.IsZero() || sentAt.Before(oldestAt) {
+				oldest, oldestAt = key, sentAt
+			}
+		}
+		delete(t.sentAt, oldest)
+	}
+	t.sentAt[onlineFirstKey{path: path, id: id}] = time.Now()
+}
+
+// ack returns true if the message is an online-first message sent to the client, and not yet acknowledged
+func (t *onlineFirstTracker) ack(path protocol.Path, id uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := onlineFirstKey{path: path, id: id}
+	if _, ok := t.sentAt[key]; !ok {
+		return false
+	}
+	delete(t.sentAt, key)
+	return true
+}
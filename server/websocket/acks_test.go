@@ -0,0 +1,303 @@
+package websocket
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/router"
+	"github.com/cosminrentea/gobbler/server/store/filestore"
+)
+
+func Test_AckTracker_Offsets(t *testing.T) {
+	a := assert.New(t)
+	kvStore := kvstore.NewMemoryKVStore()
+
+	tracker, err := newAckTracker(kvStore, offsetKey("marvin", "", "/foo"), time.Minute)
+	a.NoError(err)
+	_, ok := tracker.offset()
+	a.False(ok)
+
+	// the first message sent commits the offset before it
+	sendC := make(chan []byte)
+	tracker.sent(5, []byte("5"), sendC)
+	tracker.sent(6, []byte("6"), sendC)
+	tracker.sent(8, []byte("8"), sendC)
+	offset, ok := tracker.offset()
+	a.True(ok)
+	a.Equal(uint64(4), offset)
+
+	// the offset is not moved past the messages still pending
+	a.True(tracker.ack(6))
+	offset, _ = tracker.offset()
+	a.Equal(uint64(4), offset)
+
+	a.True(tracker.ack(5))
+	offset, _ = tracker.offset()
+	a.Equal(uint64(6), offset)
+
+	a.False(tracker.ack(6))
+	a.False(tracker.ack(7))
+
+	a.True(tracker.ack(8))
+	offset, _ = tracker.offset()
+	a.Equal(uint64(8), offset)
+
+	// the offset is persisted for the user and the path
+	tracker, err = newAckTracker(kvStore, offsetKey("marvin", "", "/foo"), time.Minute)
+	a.NoError(err)
+	offset, ok = tracker.offset()
+	a.True(ok)
+	a.Equal(uint64(8), offset)
+
+	tracker, err = newAckTracker(kvStore, offsetKey("arthur", "", "/foo"), time.Minute)
+	a.NoError(err)
+	_, ok = tracker.offset()
+	a.False(ok)
+}
+
+func Test_AckTracker_Redelivery(t *testing.T) {
+	a := assert.New(t)
+
+	sendC := make(chan []byte, 10)
+	tracker, first, err := joinAckTracker(kvstore.NewMemoryKVStore(), "marvin", "", "/foo", 20*time.Millisecond, sendC)
+	a.NoError(err)
+	a.True(first)
+	defer tracker.leave(sendC)
+
+	tracker.sent(2, []byte("2"), sendC)
+	tracker.sent(1, []byte("1"), sendC)
+	a.True(tracker.ack(2))
+
+	// only the message not acknowledged is redelivered, until it is acknowledged
+	expectMessages(a, sendC, "1", "1")
+	a.True(tracker.ack(1))
+	select {
+	case m := <-sendC:
+		a.Fail("unexpected redelivery", string(m))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_AckTracker_Group(t *testing.T) {
+	a := assert.New(t)
+	kvStore := kvstore.NewMemoryKVStore()
+
+	sendC1, sendC2 := make(chan []byte, 10), make(chan []byte, 10)
+	tracker, first, err := joinAckTracker(kvStore, "marvin", "workers", "/foo", 20*time.Millisecond, sendC1)
+	a.NoError(err)
+	a.True(first)
+
+	// the members of the group share the tracker, and the offset
+	shared, first, err := joinAckTracker(kvStore, "arthur", "workers", "/foo", 20*time.Millisecond, sendC2)
+	a.NoError(err)
+	a.False(first)
+	a.True(tracker == shared)
+
+	tracker.sent(1, []byte("1"), sendC1)
+	tracker.sent(2, []byte("2"), sendC2)
+	a.True(tracker.ack(2))
+
+	// the messages pending for a member which leaves are redelivered to another member
+	tracker.leave(sendC1)
+	expectMessages(a, sendC2, "1")
+	a.True(tracker.ack(1))
+	tracker.leave(sendC2)
+
+	// a new member of the group resumes from the committed offset of the group
+	tracker, first, err = joinAckTracker(kvStore, "trillian", "workers", "/foo", 20*time.Millisecond, sendC1)
+	a.NoError(err)
+	a.True(first)
+	defer tracker.leave(sendC1)
+	offset, ok := tracker.offset()
+	a.True(ok)
+	a.Equal(uint64(2), offset)
+}
+
+// startFileStoreRouter starts a router with a filestore in a temporary directory, returning a function to stop it
+// blockingKVStore blocks the writes until they are released
+type blockingKVStore struct {
+	kvstore.KVStore
+	putC chan struct{}
+}
+
+func (kvs *blockingKVStore) Put(schema, key string, value []byte) error {
+	<-kvs.putC
+	return kvs.KVStore.Put(schema, key, value)
+}
+
+func Test_AckTracker_SlowCommit(t *testing.T) {
+	a := assert.New(t)
+	kvStore := &blockingKVStore{KVStore: kvstore.NewMemoryKVStore(), putC: make(chan struct{})}
+
+	tracker, err := newAckTracker(kvStore, offsetKey("marvin", "", "/foo"), time.Minute)
+	a.NoError(err)
+
+	sendC := make(chan []byte)
+	committed := make(chan struct{})
+	go func() {
+		tracker.sent(1, []byte("1"), sendC)
+		close(committed)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// the messages are sent and acknowledged while the offset is written
+	done := make(chan struct{})
+	go func() {
+		tracker.sent(2, []byte("2"), sendC)
+		a.True(tracker.ack(1))
+		a.True(tracker.ack(2))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		a.Fail("blocked by the offset write")
+	}
+	offset, _ := tracker.offset()
+	a.Equal(uint64(2), offset)
+
+	// the offsets committed meanwhile are written once, after the write in progress
+	kvStore.putC <- struct{}{}
+	kvStore.putC <- struct{}{}
+	<-committed
+	value, _, err := kvStore.KVStore.Get(offsetsSchema, offsetKey("marvin", "", "/foo"))
+	a.NoError(err)
+	a.Equal("2", string(value))
+}
+
+func startFileStoreRouter(a *assert.Assertions) (testRouter, func()) {
+	dir, err := ioutil.TempDir("", "gobbler_receiver_test")
+	a.NoError(err)
+
+	r := router.New(filestore.New(dir), kvstore.NewMemoryKVStore(), nil).(testRouter)
+	a.NoError(r.Start())
+	return r, func() {
+		r.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// startReceiver starts a receiver for the command, returning it with its send channel
+func startReceiver(a *assert.Assertions, r router.Router, userID string, arg string, headerJSON string) (*Receiver, chan []byte) {
+	sendC := make(chan []byte, 10)
+	cmd := &protocol.Cmd{Name: protocol.CmdReceive, Arg: arg, HeaderJSON: headerJSON}
+	rec, err := NewReceiverFromCmd("any-appId", cmd, sendC, r, userID)
+	a.NoError(err)
+	a.NoError(rec.Start())
+	return rec, sendC
+}
+
+// receiveMessage returns the next message sent to the client, skipping the notifications
+func receiveMessage(a *assert.Assertions, sendC chan []byte) *protocol.Message {
+	for {
+		select {
+		case data := <-sendC:
+			if strings.HasPrefix(string(data), "#") {
+				continue
+			}
+			m, err := protocol.ParseMessage(data)
+			a.NoError(err)
+			return m
+		case <-time.After(time.Second):
+			a.FailNow("message not received")
+		}
+	}
+}
+
+func Test_Receiver_AtLeastOnce(t *testing.T) {
+	a := assert.New(t)
+	r, stop := startFileStoreRouter(a)
+	defer stop()
+
+	newReceiver := func(arg string) (*Receiver, chan []byte) {
+		return startReceiver(a, r, "marvin", arg, `{"Ack-Mode": "at-least-once", "Ack-Timeout": "100ms"}`)
+	}
+	receive := func(sendC chan []byte) *protocol.Message {
+		return receiveMessage(a, sendC)
+	}
+
+	rec, sendC := newReceiver("/foo")
+	time.Sleep(20 * time.Millisecond)
+	for i := 1; i <= 3; i++ {
+		a.NoError(r.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte(fmt.Sprintf("message %d", i))}))
+	}
+	first, second, third := receive(sendC), receive(sendC), receive(sendC)
+	a.Equal("message 1", string(first.Body))
+	a.True(rec.ack(first.ID))
+	a.True(rec.ack(third.ID))
+
+	// the message not acknowledged is redelivered
+	a.Equal(second.ID, receive(sendC).ID)
+	rec.Stop()
+
+	// after a reconnect, the delivery resumes after the committed offset
+	rec, sendC = newReceiver("/foo")
+	defer rec.Stop()
+	a.Equal("message 2", string(receive(sendC).Body))
+	a.Equal("message 3", string(receive(sendC).Body))
+}
+
+func Test_Receiver_Group(t *testing.T) {
+	a := assert.New(t)
+	r, stop := startFileStoreRouter(a)
+	defer stop()
+
+	options := `{"Group": "workers", "Ack-Mode": "at-least-once", "Ack-Timeout": "100ms"}`
+	rec1, sendC1 := startReceiver(a, r, "marvin", "/jobs", options)
+	rec2, sendC2 := startReceiver(a, r, "arthur", "/jobs", options)
+	time.Sleep(20 * time.Millisecond)
+
+	// each message is delivered to one member of the group
+	for i := 1; i <= 4; i++ {
+		a.NoError(r.HandleMessage(&protocol.Message{Path: "/jobs", Body: []byte(fmt.Sprintf("job %d", i))}))
+	}
+	received := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		m := receiveMessage(a, sendC1)
+		received[string(m.Body)] = true
+		a.True(rec1.ack(m.ID))
+	}
+	notAcked := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		m := receiveMessage(a, sendC2)
+		received[string(m.Body)] = true
+		notAcked[string(m.Body)] = true
+	}
+	a.Len(received, 4)
+
+	// the messages not acknowledged by a member which leaves are redelivered to another member
+	rec2.Stop()
+	redelivered := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		m := receiveMessage(a, sendC1)
+		redelivered[string(m.Body)] = true
+		a.True(rec1.ack(m.ID))
+	}
+	a.Equal(notAcked, redelivered)
+	rec1.Stop()
+
+	// a new member of the group resumes after the committed offset of the group
+	a.NoError(r.HandleMessage(&protocol.Message{Path: "/jobs", Body: []byte("job 5")}))
+	rec3, sendC3 := startReceiver(a, r, "trillian", "/jobs", options)
+	defer rec3.Stop()
+	a.Equal("job 5", string(receiveMessage(a, sendC3).Body))
+}
+
+func TestOnlineFirstTracker_Max(t *testing.T) {
+	a := assert.New(t)
+	tracker := newOnlineFirstTracker()
+
+	for id := uint64(1); id <= maxOnlineFirst+1; id++ {
+		tracker.sent("/chat", id)
+	}
+	a.Equal(maxOnlineFirst, len(tracker.sentAt))
+	a.True(tracker.ack("/chat", maxOnlineFirst+1))
+}
@@ -0,0 +1,327 @@
+package websocket
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/router"
+)
+
+const (
+	// PresenceConnected is the event of a new websocket connection of a user
+	PresenceConnected = "connected"
+
+	// PresenceDisconnected is the event of a closed websocket connection of a user
+	PresenceDisconnected = "disconnected"
+
+	// presenceSync is the event publishing all the sessions of a node, in a cluster
+	presenceSync = "sync"
+
+	// the presence of a user is given by the REST API, so the older events are not replayed to new subscribers
+	presenceTTL = time.Minute
+)
+
+// PresenceRetention is the maximum age of the presence events kept by default in their partition, when the messages are stored in files:
+// the events expire after a minute, but they are published all the time (e.g. the sync events of a cluster).
+var PresenceRetention = time.Hour
+
+// PresenceSyncInterval is the interval at which the nodes of a cluster publish all their sessions.
+// The sessions of a node are forgotten by the other nodes if they are not published again for three intervals
+// (e.g. if the node stopped).
+var PresenceSyncInterval = 10 * time.Second
+
+// PresenceEvent is the body of the messages published on the presence topics
+type PresenceEvent struct {
+	Event         string    `json:"event"`
+	UserID        string    `json:"user_id,omitempty"`
+	ApplicationID string    `json:"application_id,omitempty"`
+	NodeID        uint8     `json:"node_id"`
+	Time          time.Time `json:"time"`
+
+	// Sessions are the connection times of all the sessions of the node, by user and application ID (only for the sync events)
+	Sessions map[string]map[string]time.Time `json:"sessions,omitempty"`
+}
+
+// Session is a websocket connection of a user
+type Session struct {
+	ApplicationID string    `json:"application_id"`
+	NodeID        uint8     `json:"node_id"`
+	ConnectedAt   time.Time `json:"connected_at"`
+}
+
+// presenceInfo is the JSON representation of the presence of a user
+type presenceInfo struct {
+	UserID   string    `json:"user_id"`
+	Online   bool      `json:"online"`
+	Sessions []Session `json:"sessions"`
+}
+
+// nodeSessions are the connection times of the sessions of a node, by user and application ID
+type nodeSessions struct {
+	users    map[string]map[string]time.Time
+	lastSeen time.Time
+}
+
+// Presence tracks the websocket connections of the users, and publishes their presence events
+// on the topics `/_presence/<user_id>`. In a cluster, it aggregates the sessions of all the nodes
+// from their presence events.
+type Presence struct {
+	router    router.Router
+	nodeID    uint8
+	clustered bool
+
+	mu    sync.RWMutex
+	nodes map[uint8]*nodeSessions
+
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewPresence returns a new Presence, publishing the events through the given router.
+func NewPresence(r router.Router) *Presence {
+	p := &Presence{
+		router: r,
+		nodes:  make(map[uint8]*nodeSessions),
+	}
+	if r.Cluster() != nil {
+		p.nodeID = r.Cluster().Config.ID
+		p.clustered = true
+	}
+	p.nodes[p.nodeID] = &nodeSessions{users: make(map[string]map[string]time.Time)}
+	return p
+}
+
+// Start subscribes to the presence events of the other nodes, if the server is a part of a cluster.
+func (p *Presence) Start() error {
+	p.stopC = make(chan struct{})
+	if !p.clustered {
+		return nil
+	}
+
+	route := router.NewRoute(router.RouteConfig{
+		RouteParams: router.RouteParams{"application_id": "presence"},
+		Path:        protocol.Path(strings.TrimSuffix(protocol.PresencePrefix, "/")),
+		ChannelSize: 100,
+		QueueSize:   -1,
+	})
+	if _, err := p.router.Subscribe(route); err != nil {
+		return err
+	}
+	p.wg.Add(2)
+	go p.receiveLoop(route)
+	go p.syncLoop()
+	return nil
+}
+
+// Stop stops tracking the presence events.
+// The route of the events is not unsubscribed, since the router closes all the routes when it stops.
+func (p *Presence) Stop() error {
+	close(p.stopC)
+	p.wg.Wait()
+	return nil
+}
+
+// Connected records a new session of the user, and publishes its presence event.
+// It can be called on a nil Presence.
+func (p *Presence) Connected(userID, applicationID string) {
+	if p == nil || !protocol.IsTopicLevel(userID) {
+		return
+	}
+	now := time.Now()
+
+	p.mu.Lock()
+	local := p.nodes[p.nodeID]
+	if local.users[userID] == nil {
+		local.users[userID] = make(map[string]time.Time)
+	}
+	local.users[userID][applicationID] = now
+	p.mu.Unlock()
+
+	p.publish(protocol.Path(protocol.PresencePrefix+userID), &PresenceEvent{
+		Event:         PresenceConnected,
+		UserID:        userID,
+		ApplicationID: applicationID,
+		NodeID:        p.nodeID,
+		Time:          now,
+	})
+}
+
+// Disconnected removes a session of the user, and publishes its presence event.
+// It can be called on a nil Presence, and more than once for a session.
+func (p *Presence) Disconnected(userID, applicationID string) {
+	if p == nil || !protocol.IsTopicLevel(userID) {
+		return
+	}
+
+	p.mu.Lock()
+	local := p.nodes[p.nodeID]
+	_, found := local.users[userID][applicationID]
+	removeSession(local.users, userID, applicationID)
+	p.mu.Unlock()
+	if !found {
+		return
+	}
+
+	p.publish(protocol.Path(protocol.PresencePrefix+userID), &PresenceEvent{
+		Event:         PresenceDisconnected,
+		UserID:        userID,
+		ApplicationID: applicationID,
+		NodeID:        p.nodeID,
+		Time:          time.Now(),
+	})
+}
+
+// Sessions returns the sessions of the user on all the nodes, ordered by their connection time.
+func (p *Presence) Sessions(userID string) []Session {
+	expired := time.Now().Add(-3 * PresenceSyncInterval)
+	sessions := make([]Session, 0)
+
+	p.mu.RLock()
+	for nodeID, node := range p.nodes {
+		if nodeID != p.nodeID && node.lastSeen.Before(expired) {
+			continue
+		}
+		for applicationID, connectedAt := range node.users[userID] {
+			sessions = append(sessions, Session{
+				ApplicationID: applicationID,
+				NodeID:        nodeID,
+				ConnectedAt:   connectedAt,
+			})
+		}
+	}
+	p.mu.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ConnectedAt.Before(sessions[j].ConnectedAt)
+	})
+	return sessions
+}
+
+// Online returns true if the user has sessions on any node.
+// It can be called on a nil Presence.
+func (p *Presence) Online(userID string) bool {
+	return p != nil && len(p.Sessions(userID)) > 0
+}
+
+// GetPresence returns the JSON-encoded presence of the user, with its sessions.
+func (p *Presence) GetPresence(userID string) ([]byte, error) {
+	sessions := p.Sessions(userID)
+	return json.Marshal(presenceInfo{
+		UserID:   userID,
+		Online:   len(sessions) > 0,
+		Sessions: sessions,
+	})
+}
+
+func (p *Presence) publish(path protocol.Path, event *PresenceEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.WithError(err).Error("Error encoding presence event")
+		return
+	}
+	expires := time.Now().Add(presenceTTL)
+	if err := p.router.HandleMessage(&protocol.Message{Path: path, Body: body, Expires: &expires}); err != nil {
+		logger.WithError(err).WithFields(log.Fields{
+			"path":  path,
+			"event": event.Event,
+		}).Error("Error publishing presence event")
+	}
+}
+
+// receiveLoop applies the presence events of the other nodes
+func (p *Presence) receiveLoop(route *router.Route) {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case m, ok := <-route.MessagesChannel():
+			if !ok {
+				return
+			}
+			event := &PresenceEvent{}
+			if err := json.Unmarshal(m.Body, event); err != nil {
+				logger.WithError(err).WithField("path", m.Path).Error("Error decoding presence event")
+				continue
+			}
+			p.apply(event)
+		case <-p.stopC:
+			return
+		}
+	}
+}
+
+// apply updates the sessions of the node which published the event
+func (p *Presence) apply(event *PresenceEvent) {
+	if event.NodeID == p.nodeID {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	node, ok := p.nodes[event.NodeID]
+	if !ok {
+		node = &nodeSessions{users: make(map[string]map[string]time.Time)}
+		p.nodes[event.NodeID] = node
+	}
+	node.lastSeen = time.Now()
+
+	switch event.Event {
+	case PresenceConnected:
+		if node.users[event.UserID] == nil {
+			node.users[event.UserID] = make(map[string]time.Time)
+		}
+		node.users[event.UserID][event.ApplicationID] = event.Time
+	case PresenceDisconnected:
+		removeSession(node.users, event.UserID, event.ApplicationID)
+	case presenceSync:
+		node.users = event.Sessions
+		if node.users == nil {
+			node.users = make(map[string]map[string]time.Time)
+		}
+	}
+}
+
+// syncLoop publishes periodically all the sessions of this node
+func (p *Presence) syncLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(PresenceSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.RLock()
+			sessions := make(map[string]map[string]time.Time)
+			for userID, applications := range p.nodes[p.nodeID].users {
+				sessions[userID] = make(map[string]time.Time, len(applications))
+				for applicationID, connectedAt := range applications {
+					sessions[userID][applicationID] = connectedAt
+				}
+			}
+			p.mu.RUnlock()
+
+			p.publish(protocol.Path(strings.TrimSuffix(protocol.PresencePrefix, "/")), &PresenceEvent{
+				Event:    presenceSync,
+				NodeID:   p.nodeID,
+				Time:     time.Now(),
+				Sessions: sessions,
+			})
+		case <-p.stopC:
+			return
+		}
+	}
+}
+
+func removeSession(users map[string]map[string]time.Time, userID, applicationID string) {
+	delete(users[userID], applicationID)
+	if len(users[userID]) == 0 {
+		delete(users, userID)
+	}
+}
@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cosminrentea/gobbler/server/kvstore"
+	"github.com/cosminrentea/gobbler/server/router"
+	"github.com/cosminrentea/gobbler/server/store/dummystore"
+)
+
+type testRouter interface {
+	router.Router
+	Start() error
+	Stop() error
+}
+
+func presenceOf(a *assert.Assertions, p *Presence, userID string) *presenceInfo {
+	data, err := p.GetPresence(userID)
+	a.NoError(err)
+	info := &presenceInfo{}
+	a.NoError(json.Unmarshal(data, info))
+	return info
+}
+
+func TestPresence_Events(t *testing.T) {
+	a := assert.New(t)
+
+	r := router.New(dummystore.New(kvstore.NewMemoryKVStore()), kvstore.NewMemoryKVStore(), nil).(testRouter)
+	a.NoError(r.Start())
+	defer r.Stop()
+
+	route, err := r.Subscribe(router.NewRoute(router.RouteConfig{
+		RouteParams: router.RouteParams{"application_id": "app", "user_id": "arthur"},
+		Path:        "/_presence/marvin",
+		ChannelSize: 10,
+	}))
+	a.NoError(err)
+
+	p := NewPresence(r)
+	a.NoError(p.Start())
+	defer p.Stop()
+
+	p.Connected("marvin", "app1")
+	p.Connected("marvin", "app2")
+	p.Disconnected("marvin", "app1")
+	// a closed session is not published again
+	p.Disconnected("marvin", "app1")
+	// the user IDs which are not topic levels are not tracked
+	p.Connected("", "app3")
+	p.Connected("marvin/x", "app3")
+
+	for _, expected := range []struct{ event, applicationID string }{
+		{PresenceConnected, "app1"},
+		{PresenceConnected, "app2"},
+		{PresenceDisconnected, "app1"},
+	} {
+		select {
+		case m := <-route.MessagesChannel():
+			event := &PresenceEvent{}
+			a.NoError(json.Unmarshal(m.Body, event))
+			a.Equal(expected.event, event.Event)
+			a.Equal("marvin", event.UserID)
+			a.Equal(expected.applicationID, event.ApplicationID)
+			a.NotNil(m.Expires)
+		case <-time.After(time.Second):
+			a.FailNow("presence event not received")
+		}
+	}
+	select {
+	case m := <-route.MessagesChannel():
+		a.Fail("unexpected presence event", string(m.Body))
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	info := presenceOf(a, p, "marvin")
+	a.True(info.Online)
+	a.Len(info.Sessions, 1)
+	a.Equal("app2", info.Sessions[0].ApplicationID)
+
+	p.Disconnected("marvin", "app2")
+	info = presenceOf(a, p, "marvin")
+	a.False(info.Online)
+	a.Empty(info.Sessions)
+}
+
+func TestPresence_Nodes(t *testing.T) {
+	a := assert.New(t)
+
+	p := NewPresence(router.New(dummystore.New(kvstore.NewMemoryKVStore()), kvstore.NewMemoryKVStore(), nil))
+	p.nodeID = 1
+	p.nodes = map[uint8]*nodeSessions{1: {users: make(map[string]map[string]time.Time)}}
+
+	connectedAt := time.Now().Add(-time.Minute)
+	p.apply(&PresenceEvent{Event: PresenceConnected, UserID: "marvin", ApplicationID: "app2", NodeID: 2, Time: connectedAt})
+	p.apply(&PresenceEvent{Event: PresenceConnected, UserID: "marvin", ApplicationID: "app3", NodeID: 3, Time: connectedAt.Add(time.Second)})
+	// the events of the own node are ignored
+	p.apply(&PresenceEvent{Event: PresenceConnected, UserID: "marvin", ApplicationID: "app1", NodeID: 1, Time: connectedAt})
+
+	sessions := p.Sessions("marvin")
+	a.Len(sessions, 2)
+	a.Equal(uint8(2), sessions[0].NodeID)
+
+	// a sync replaces the sessions of the node
+	p.apply(&PresenceEvent{Event: presenceSync, NodeID: 2, Sessions: map[string]map[string]time.Time{
+		"arthur": {"app4": connectedAt},
+	}})
+	a.Len(p.Sessions("marvin"), 1)
+	a.Len(p.Sessions("arthur"), 1)
+
+	p.apply(&PresenceEvent{Event: PresenceDisconnected, UserID: "marvin", ApplicationID: "app3", NodeID: 3})
+	a.Empty(p.Sessions("marvin"))
+
+	// the sessions of the nodes which were not seen recently are ignored
+	p.nodes[2].lastSeen = time.Now().Add(-4 * PresenceSyncInterval)
+	a.Empty(p.Sessions("arthur"))
+}
+
+func TestPresence_Disabled(t *testing.T) {
+	var p *Presence
+	p.Connected("marvin", "app1")
+	p.Disconnected("marvin", "app1")
+}
@@ -5,11 +5,13 @@ import (
 	"github.com/cosminrentea/gobbler/server/router"
 	"github.com/cosminrentea/gobbler/server/store"
 
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -30,10 +32,32 @@ type Receiver struct {
 	startID             int64
 	maxCount            int
 	lastSentID          uint64
+	lastSentIDs         map[string]uint64 // the last IDs sent by partition, for the paths with a wildcard partition
 	shouldStop          bool
 	route               *router.Route
 	enableNotifications bool
 	userID              string
+	roles               []string
+	queueSize           int
+	backpressure        router.BackpressurePolicy
+	blockTimeout        time.Duration
+	filters             map[string]string
+	ackMode             string
+	ackTimeout          time.Duration
+	acks                *ackTracker
+	onlineFirst         *onlineFirstTracker
+	group               string
+}
+
+// receiveOptions are the optional settings of the route, sent as the header of the + (receive) command
+type receiveOptions struct {
+	QueueSize    int               `json:"Queue-Size"`
+	Backpressure string            `json:"Backpressure"`
+	BlockTimeout string            `json:"Block-Timeout"`
+	Filters      map[string]string `json:"Filters"`
+	AckMode      string            `json:"Ack-Mode"`
+	AckTimeout   string            `json:"Ack-Timeout"`
+	Group        string            `json:"Group"`
 }
 
 // NewReceiverFromCmd parses the info in the command
@@ -57,6 +81,8 @@ func NewReceiverFromCmd(
 		cancelC:             make(chan bool, 1),
 		enableNotifications: true,
 		userID:              userID,
+		lastSentIDs:         make(map[string]uint64),
+		onlineFirst:         newOnlineFirstTracker(),
 	}
 	if len(cmd.Arg) == 0 || cmd.Arg[0] != '/' {
 		return nil, fmt.Errorf("command requires at least a path argument, but non given")
@@ -64,6 +90,9 @@ func NewReceiverFromCmd(
 
 	args := strings.SplitN(cmd.Arg, " ", 3)
 	rec.path = protocol.Path(args[0])
+	if err := rec.path.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid path %q: %v", args[0], err)
+	}
 
 	if len(args) > 1 {
 		rec.doFetch = true
@@ -82,12 +111,107 @@ func NewReceiverFromCmd(
 		}
 	}
 
+	if err := rec.parseOptions(cmd.HeaderJSON); err != nil {
+		return nil, err
+	}
+	if rec.ackMode == AtLeastOnce && rec.userID == "" && rec.group == "" {
+		return nil, fmt.Errorf("the %s receive mode requires a user ID or a group", AtLeastOnce)
+	}
+
 	return rec, nil
 }
 
+// trackAcks enables the at-least-once mode: without a start ID, the first receiver of the user (or of the group)
+// resumes after the committed offset for the path, so that the messages not acknowledged before a reconnect are delivered again
+func (rec *Receiver) trackAcks() error {
+	kvStore, err := rec.router.KVStore()
+	if err != nil {
+		return err
+	}
+	var first bool
+	if rec.acks, first, err = joinAckTracker(kvStore, rec.userID, rec.group, rec.path, rec.ackTimeout, rec.sendC); err != nil {
+		return err
+	}
+	if offset, ok := rec.acks.offset(); ok && first && !rec.doFetch {
+		rec.doFetch = true
+		rec.startID = int64(offset) + 1
+	}
+	return nil
+}
+
+// parseOptions reads the route settings (queue size, backpressure policy and filters) from the command header
+func (rec *Receiver) parseOptions(headerJSON string) error {
+	if len(headerJSON) == 0 {
+		return nil
+	}
+
+	var options receiveOptions
+	if err := json.Unmarshal([]byte(headerJSON), &options); err != nil {
+		return fmt.Errorf("invalid receive options %q: %v", headerJSON, err)
+	}
+	if options.QueueSize < 0 {
+		return fmt.Errorf("Queue-Size has to be a positive int, but was %d", options.QueueSize)
+	}
+	rec.queueSize = options.QueueSize
+
+	policy, err := router.ParseBackpressurePolicy(options.Backpressure)
+	if err != nil {
+		return err
+	}
+	rec.backpressure = policy
+
+	if len(options.BlockTimeout) > 0 {
+		rec.blockTimeout, err = time.ParseDuration(options.BlockTimeout)
+		if err != nil {
+			return fmt.Errorf("Block-Timeout has to be a duration, but was %q: %v", options.BlockTimeout, err)
+		}
+		if rec.blockTimeout > router.MaxBlockTimeout {
+			return fmt.Errorf("Block-Timeout can be at most %v, but was %v", router.MaxBlockTimeout, rec.blockTimeout)
+		}
+	}
+
+	for name, expr := range options.Filters {
+		if _, err := router.CompileFilter(expr); err != nil {
+			return fmt.Errorf("invalid filter %q: %v", name, err)
+		}
+	}
+	rec.filters = options.Filters
+
+	if options.AckMode != "" && options.AckMode != AtLeastOnce {
+		return fmt.Errorf("Ack-Mode has to be %s, but was %q", AtLeastOnce, options.AckMode)
+	}
+	if options.AckMode == AtLeastOnce && rec.path.HasWildcardPartition() {
+		// the message IDs are generated by partition, so a single offset can not be committed for all the partitions
+		return fmt.Errorf("Ack-Mode %s is not supported for the paths with a wildcard partition, but was %q", AtLeastOnce, rec.path)
+	}
+	rec.ackMode = options.AckMode
+	rec.ackTimeout = DefaultAckTimeout
+	if len(options.AckTimeout) > 0 {
+		rec.ackTimeout, err = time.ParseDuration(options.AckTimeout)
+		if err != nil || rec.ackTimeout <= 0 {
+			return fmt.Errorf("Ack-Timeout has to be a positive duration, but was %q", options.AckTimeout)
+		}
+	}
+
+	if strings.ContainsAny(options.Group, " /") {
+		return fmt.Errorf("Group can not contain spaces or slashes, but was %q", options.Group)
+	}
+	if options.Group != "" && options.AckMode != AtLeastOnce {
+		// a new member of the group resumes after the offset committed by the acknowledgements of the group
+		return fmt.Errorf("Group requires the Ack-Mode %s", AtLeastOnce)
+	}
+	rec.group = options.Group
+	return nil
+}
+
 // Start starts the receiver loop
 func (rec *Receiver) Start() error {
 	rec.shouldStop = false
+	if rec.ackMode == AtLeastOnce {
+		if err := rec.trackAcks(); err != nil {
+			return err
+		}
+	}
 	if rec.doFetch && !rec.doSubscription {
 		go rec.fetchOnlyLoop()
 	} else {
@@ -106,7 +230,10 @@ func (rec *Receiver) subscriptionLoop() {
 				return
 			}
 
-			if err := rec.messageStore.DoInTx(rec.path.Partition(), rec.subscribeIfNoUnreadMessagesAvailable); err != nil {
+			if rec.path.HasWildcardPartition() {
+				// the path spans all partitions, which cannot be locked together
+				rec.subscribe()
+			} else if err := rec.messageStore.DoInTx(rec.path.Partition(), rec.subscribeIfNoUnreadMessagesAvailable); err != nil {
 				if err == errUnreadMsgsAvailable {
 					logger.WithFields(log.Fields{
 						"lastSentId": rec.lastSentID,
@@ -130,7 +257,10 @@ func (rec *Receiver) subscriptionLoop() {
 			//fmt.Printf(" router closed .. on msg: %v\n", rec.lastSendId)
 			// the router kicked us out, because we are too slow for realtime listening,
 			// so we setup parameters for fetching and closing the gap. Than we can subscribe again.
-			rec.startID = int64(rec.lastSentID) + 1
+			// (the paths with a wildcard partition resume each partition after its last message sent)
+			if !rec.path.HasWildcardPartition() {
+				rec.startID = int64(rec.lastSentID) + 1
+			}
 			rec.doFetch = true
 		}
 	}
@@ -145,11 +275,24 @@ func (rec *Receiver) subscribeIfNoUnreadMessagesAvailable(maxMessageID uint64) e
 }
 
 func (rec *Receiver) subscribe() {
+	params := router.RouteParams{"application_id": rec.applicationID, "user_id": rec.userID}
+	for name, expr := range rec.filters {
+		params[router.SubscriberFilterPrefix+name] = expr
+	}
+	if rec.group != "" {
+		params[router.GroupParam] = rec.group
+	}
+
 	rec.route = router.NewRoute(
 		router.RouteConfig{
-			RouteParams: router.RouteParams{"application_id": rec.applicationID, "user_id": rec.userID},
-			Path:        rec.path,
-			ChannelSize: 10,
+			RouteParams:  params,
+			Path:         rec.path,
+			Roles:        rec.roles,
+			ChannelSize:  10,
+			QueueSize:    rec.queueSize,
+			Timeout:      -1,
+			Backpressure: rec.backpressure,
+			BlockTimeout: rec.blockTimeout,
 		},
 	)
 
@@ -178,9 +321,12 @@ func (rec *Receiver) receiveFromSubscription() {
 				"messageMetadata": m.Metadata(),
 			}).Debug("Delivering message")
 
-			if m.ID > rec.lastSentID {
-				rec.lastSentID = m.ID
-				rec.sendC <- m.Encode()
+			if !rec.isSent(m.Path.Partition(), m.ID) {
+				rec.setSent(m.Path.Partition(), m.ID)
+				if m.IsOnlineFirst() {
+					rec.onlineFirst.sent(m.Path, m.ID)
+				}
+				rec.send(m.ID, m.Encode())
 			} else {
 				logger.WithFields(log.Fields{
 					"msgId": m.ID,
@@ -196,6 +342,26 @@ func (rec *Receiver) receiveFromSubscription() {
 	}
 }
 
+// isSent returns true if the message of the partition was already sent to the client.
+// The message IDs are generated by partition, so they are compared by partition for the paths with a wildcard partition.
+func (rec *Receiver) isSent(partition string, id uint64) bool {
+	if rec.path.HasWildcardPartition() {
+		return id <= rec.lastSentIDs[partition]
+	}
+	return id <= rec.lastSentID
+}
+
+// setSent records the ID of the last message of the partition sent to the client
+func (rec *Receiver) setSent(partition string, id uint64) {
+	if !rec.path.HasWildcardPartition() {
+		rec.lastSentID = id
+		return
+	}
+	if id > rec.lastSentIDs[partition] {
+		rec.lastSentIDs[partition] = id
+	}
+}
+
 func (rec *Receiver) fetchOnlyLoop() {
 	err := rec.fetch()
 	if err != nil {
@@ -205,15 +371,47 @@ func (rec *Receiver) fetchOnlyLoop() {
 }
 
 func (rec *Receiver) fetch() error {
+	if !rec.path.HasWildcardPartition() {
+		return rec.fetchPartition(rec.path.Partition(), true)
+	}
+
+	// the path spans all partitions: fetch each of them and notify the end only once
+	partitions, err := rec.messageStore.Partitions()
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		if err := rec.fetchPartition(partition.Name(), false); err != nil {
+			return err
+		}
+		if rec.shouldStop {
+			return nil
+		}
+	}
+	rec.sendOK(protocol.SUCCESS_FETCH_END, "%s", rec.path)
+	return nil
+}
+
+// fetchPartition fetches the messages of a single partition.
+// For wildcard paths the messages not matching the path are skipped,
+// so the number of results in the fetch-start notification is an upper bound.
+func (rec *Receiver) fetchPartition(partition string, notifyEnd bool) error {
 	fetch := &store.FetchRequest{
-		Partition: rec.path.Partition(),
+		Partition: partition,
 		MessageC:  make(chan *store.FetchedMessage, 10), //TODO MAKE more tests when the receiver will be refactored after the route params is integrated.Initial capacity was 3
 		ErrorC:    make(chan error),
 		StartC:    make(chan int),
 		Count:     rec.maxCount,
 	}
 
-	if rec.startID >= 0 {
+	if lastSentID, ok := rec.lastSentIDs[partition]; ok {
+		// the partition was already fetched, so the fetch resumes after the last message sent
+		fetch.Direction = 1
+		fetch.StartID = lastSentID + 1
+		if rec.maxCount == 0 {
+			fetch.Count = math.MaxInt32
+		}
+	} else if rec.startID >= 0 {
 		fetch.Direction = 1
 		fetch.StartID = uint64(rec.startID)
 		if rec.maxCount == 0 {
@@ -221,7 +419,7 @@ func (rec *Receiver) fetch() error {
 		}
 	} else {
 		fetch.Direction = -1
-		maxID, err := rec.messageStore.MaxMessageID(rec.path.Partition())
+		maxID, err := rec.messageStore.MaxMessageID(partition)
 		if err != nil {
 			return err
 		}
@@ -240,17 +438,34 @@ func (rec *Receiver) fetch() error {
 			rec.sendOK(protocol.SUCCESS_FETCH_START, fmt.Sprintf("%v %v", rec.path, numberOfResults))
 		case msgAndID, open := <-fetch.MessageC:
 			if !open {
-				rec.sendOK(protocol.SUCCESS_FETCH_END, string(rec.path))
+				if notifyEnd {
+					rec.sendOK(protocol.SUCCESS_FETCH_END, string(rec.path))
+				}
 				return nil
 			}
+			if rec.path.IsWildcard() && !rec.matches(msgAndID.Message) {
+				continue
+			}
+			if rec.path.HasWildcardPartition() && rec.isSent(partition, msgAndID.ID) {
+				continue
+			}
+			if rec.acks != nil && rec.acks.isCommitted(msgAndID.ID) {
+				// the store may also return the message preceding the start ID, which was already acknowledged
+				continue
+			}
+			if isExpired(msgAndID.Message) {
+				logger.WithField("msgId", msgAndID.ID).Debug("Skipping expired message")
+				rec.setSent(partition, msgAndID.ID)
+				continue
+			}
 			logger.WithFields(log.Fields{
 				"msgId":      msgAndID.ID,
 				"msg":        string(msgAndID.Message),
 				"lastSendId": rec.lastSentID,
 			}).Info("Reply sent")
 
-			rec.lastSentID = msgAndID.ID
-			rec.sendC <- msgAndID.Message
+			rec.setSent(partition, msgAndID.ID)
+			rec.send(msgAndID.ID, msgAndID.Message)
 		case err := <-fetch.ErrorC:
 			return err
 		case <-rec.cancelC:
@@ -262,8 +477,45 @@ func (rec *Receiver) fetch() error {
 	}
 }
 
+// matches returns true if the topic of the encoded message is matched by the receiver path
+func (rec *Receiver) matches(data []byte) bool {
+	message, err := protocol.ParseMessage(data)
+	if err != nil {
+		logger.WithError(err).Error("Parsing fetched message failed")
+		return false
+	}
+	return rec.path.Matches(message.Path)
+}
+
+// isExpired returns true if the encoded message has an expiration time which has passed
+func isExpired(data []byte) bool {
+	message, err := protocol.ParseMessage(data)
+	return err == nil && message.IsExpired()
+}
+
+// send sends the message to the client, tracking it in the at-least-once mode
+func (rec *Receiver) send(id uint64, data []byte) {
+	if rec.acks != nil {
+		rec.acks.sent(id, data, rec.sendC)
+	}
+	rec.sendC <- data
+}
+
+// ack acknowledges a message sent in the at-least-once mode, returning false if it was not pending
+func (rec *Receiver) ack(id uint64) bool {
+	return rec.acks != nil && rec.acks.ack(id)
+}
+
+// ackOnlineFirst returns true if the acknowledged message is an online-first message sent by the receiver
+func (rec *Receiver) ackOnlineFirst(path protocol.Path, id uint64) bool {
+	return rec.onlineFirst.ack(path, id)
+}
+
 // Stop stops/cancels the receiver
 func (rec *Receiver) Stop() error {
+	if rec.acks != nil {
+		rec.acks.leave(rec.sendC)
+	}
 	rec.cancelC <- true
 	return nil
 }
@@ -21,7 +21,7 @@ func Test_Receiver_error_handling_on_create(t *testing.T) {
 
 	a := assert.New(t)
 
-	badArgs := []string{"", "20", "foo 20 20", "/foo 20 20 20", "/foo a", "/foo 20 b"}
+	badArgs := []string{"", "20", "foo 20 20", "/foo 20 20 20", "/foo a", "/foo 20 b", "/foo/#/bar"}
 	for _, arg := range badArgs {
 		rec, _, _, _, err := aMockedReceiver(arg)
 		a.Nil(rec, "Testing with: "+arg)
@@ -29,6 +29,50 @@ func Test_Receiver_error_handling_on_create(t *testing.T) {
 	}
 }
 
+func Test_Receiver_Options(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().MessageStore().Return(NewMockMessageStore(testutil.MockCtrl), nil).AnyTimes()
+	newReceiver := func(headerJSON string) (*Receiver, error) {
+		cmd := &protocol.Cmd{Name: protocol.CmdReceive, Arg: "/foo", HeaderJSON: headerJSON}
+		return NewReceiverFromCmd("any-appId", cmd, make(chan []byte), routerMock, "userId")
+	}
+
+	rec, err := newReceiver("")
+	a.NoError(err)
+	a.Equal(0, rec.queueSize)
+	a.Equal(router.BackpressurePolicy(""), rec.backpressure)
+
+	rec, err = newReceiver(`{"Queue-Size": 100, "Backpressure": "block", "Block-Timeout": "200ms", "Filters": {"priority": ">5"}}`)
+	a.NoError(err)
+	a.Equal(100, rec.queueSize)
+	a.Equal(router.BackpressureBlock, rec.backpressure)
+	a.Equal(200*time.Millisecond, rec.blockTimeout)
+	a.Equal(map[string]string{"priority": ">5"}, rec.filters)
+
+	badOptions := []string{"{", `{"Queue-Size": -1}`, `{"Backpressure": "foo"}`, `{"Block-Timeout": "foo"}`, `{"Block-Timeout": "1h"}`, `{"Group": "workers"}`, `{"Filters": {"priority": ">five"}}`,
+		`{"Ack-Mode": "exactly-once"}`, `{"Ack-Mode": "at-least-once", "Ack-Timeout": "-1s"}`}
+	for _, options := range badOptions {
+		rec, err := newReceiver(options)
+		a.Nil(rec, "Testing with: "+options)
+		a.Error(err, "Testing with: "+options)
+	}
+
+	// a single offset can not be committed for the message IDs of all the partitions
+	for _, path := range []string{"/+/status", "/#"} {
+		cmd := &protocol.Cmd{Name: protocol.CmdReceive, Arg: path, HeaderJSON: `{"Ack-Mode": "at-least-once"}`}
+		_, err = NewReceiverFromCmd("any-appId", cmd, make(chan []byte), routerMock, "userId")
+		a.Error(err, "Testing with: "+path)
+	}
+	cmd := &protocol.Cmd{Name: protocol.CmdReceive, Arg: "/orders/+", HeaderJSON: `{"Ack-Mode": "at-least-once"}`}
+	_, err = NewReceiverFromCmd("any-appId", cmd, make(chan []byte), routerMock, "userId")
+	a.NoError(err)
+}
+
 func Test_Receiver_Fetch_Subscribe_Fetch_Subscribe(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -189,6 +233,131 @@ func Test_Receiver_Fetch_Returns_Correct_Messages(t *testing.T) {
 	ctrl.Finish()
 }
 
+type namedPartition struct {
+	store.MessagePartition
+	name string
+}
+
+func (p namedPartition) Name() string {
+	return p.name
+}
+
+func Test_Receiver_Fetch_Wildcard_Partition(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	rec, msgChannel, _, messageStore, err := aMockedReceiver("/+/status 0 10")
+	a.NoError(err)
+
+	messageStore.EXPECT().Partitions().Return([]store.MessagePartition{
+		namedPartition{name: "orders"},
+		namedPartition{name: "payments"},
+	}, nil)
+
+	messages := map[string][]string{
+		"orders": {
+			"/orders/status,1,,,,,1405544146,0\n\norder-status",
+			"/orders/other,2,,,,,1405544146,0\n\norder-other",
+		},
+		"payments": {
+			"/payments/status,3,,,,,1405544146,0\n\npayment-status",
+		},
+	}
+	messageStore.EXPECT().Fetch(gomock.Any()).Do(func(r *store.FetchRequest) {
+		go func() {
+			r.StartC <- len(messages[r.Partition])
+			for i, m := range messages[r.Partition] {
+				r.MessageC <- &store.FetchedMessage{ID: uint64(i + 1), Message: []byte(m)}
+			}
+			close(r.MessageC)
+		}()
+	}).Times(2)
+
+	go rec.fetchOnlyLoop()
+
+	expectMessages(a, msgChannel,
+		"#"+protocol.SUCCESS_FETCH_START+" /+/status 2",
+		messages["orders"][0],
+		"#"+protocol.SUCCESS_FETCH_START+" /+/status 1",
+		messages["payments"][0],
+		"#"+protocol.SUCCESS_FETCH_END+" /+/status",
+	)
+}
+
+func Test_Receiver_Subscribe_Wildcard_Partition(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	rec, msgChannel, routerMock, _, err := aMockedReceiver("/+/status")
+	a.NoError(err)
+
+	// the message IDs are generated by partition, so only the duplicates of the same partition are dropped
+	routerMock.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) {
+		r.Deliver(&protocol.Message{ID: uint64(5), Path: "/orders/status", Body: []byte("order-5"), Time: 1405544146}, true)
+		r.Deliver(&protocol.Message{ID: uint64(1), Path: "/payments/status", Body: []byte("payment-1"), Time: 1405544146}, true)
+		r.Deliver(&protocol.Message{ID: uint64(5), Path: "/orders/status", Body: []byte("order-5"), Time: 1405544146}, true)
+		r.Deliver(&protocol.Message{ID: uint64(2), Path: "/payments/status", Body: []byte("payment-2"), Time: 1405544146}, true)
+	})
+
+	subscriptionLoopDone := make(chan bool)
+	go func() {
+		rec.subscriptionLoop()
+		subscriptionLoopDone <- true
+	}()
+
+	expectMessages(a, msgChannel,
+		"#"+protocol.SUCCESS_SUBSCRIBED_TO+" /+/status",
+		"/orders/status,5,,,,,1405544146,0\n\norder-5",
+		"/payments/status,1,,,,,1405544146,0\n\npayment-1",
+		"/payments/status,2,,,,,1405544146,0\n\npayment-2",
+	)
+
+	routerMock.EXPECT().Unsubscribe(gomock.Any())
+	rec.Stop()
+
+	expectMessages(a, msgChannel,
+		"#"+protocol.SUCCESS_CANCELED+" /+/status",
+	)
+
+	testutil.ExpectDone(a, subscriptionLoopDone)
+}
+
+func Test_Receiver_OnlineFirst(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	rec, msgChannel, routerMock, _, err := aMockedReceiver("/chat")
+	a.NoError(err)
+
+	routerMock.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) {
+		r.Deliver(&protocol.Message{ID: uint64(1), Path: "/chat/room", HeaderJSON: `{"Delivery-Mode":"online-first"}`, Body: []byte("hello"), Time: 1405544146}, true)
+		r.Deliver(&protocol.Message{ID: uint64(2), Path: "/chat/room", Body: []byte("hello"), Time: 1405544146}, true)
+	})
+
+	go rec.subscriptionLoop()
+	expectMessages(a, msgChannel,
+		"#"+protocol.SUCCESS_SUBSCRIBED_TO+" /chat",
+		"/chat/room,1,,,,,1405544146,0\n{\"Delivery-Mode\":\"online-first\"}\nhello",
+		"/chat/room,2,,,,,1405544146,0\n\nhello",
+	)
+
+	// only the acknowledgement of the online-first message is passed to the acknowledger, once
+	a.False(rec.ackOnlineFirst("/chat/room", 2))
+	a.False(rec.ackOnlineFirst("/chat/other", 1))
+	a.True(rec.ackOnlineFirst("/chat/room", 1))
+	a.False(rec.ackOnlineFirst("/chat/room", 1))
+
+	routerMock.EXPECT().Unsubscribe(gomock.Any())
+	rec.Stop()
+	expectMessages(a, msgChannel, "#"+protocol.SUCCESS_CANCELED+" /chat")
+}
+
 func Test_Receiver_Fetch_Produces_Correct_Fetch_Requests(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
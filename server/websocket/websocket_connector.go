@@ -2,14 +2,18 @@ package websocket
 
 import (
 	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/auth"
+	"github.com/cosminrentea/gobbler/server/ratelimit"
 	"github.com/cosminrentea/gobbler/server/router"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
 	"github.com/rs/xid"
 
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -26,8 +30,17 @@ var webSocketUpgrader = websocket.Upgrader{
 
 // WSHandler is a struct used for handling websocket connections on a certain prefix.
 type WSHandler struct {
-	router router.Router
-	prefix string
+	router        router.Router
+	prefix        string
+	authenticator *auth.Authenticator
+	rateLimiter   *ratelimit.Limiter
+	presence      *Presence
+	acknowledger  Acknowledger
+}
+
+// Acknowledger is notified of the online-first messages acknowledged by the clients.
+type Acknowledger interface {
+	Acknowledge(userID string, path protocol.Path, id uint64)
 }
 
 // NewWSHandler returns a new WSHandler.
@@ -44,9 +57,41 @@ func (handler *WSHandler) GetPrefix() string {
 	return handler.prefix
 }
 
+// SetAuthenticator sets the authenticator of the websocket connections.
+// If it is enabled, the user ID is the one of the verified token, instead of the one in the URL.
+func (handler *WSHandler) SetAuthenticator(authenticator *auth.Authenticator) {
+	handler.authenticator = authenticator
+}
+
+// SetRateLimiter sets the rate limiter of the publish, subscribe and fetch commands.
+// The commands are limited by the user ID, shared by all the connections of the user,
+// since the application ID of a connection is generated for each connection.
+func (handler *WSHandler) SetRateLimiter(rateLimiter *ratelimit.Limiter) {
+	handler.rateLimiter = rateLimiter
+}
+
+// SetPresence sets the presence tracker, which is notified when the connections are opened and closed.
+func (handler *WSHandler) SetPresence(presence *Presence) {
+	handler.presence = presence
+}
+
+// SetAcknowledger sets the acknowledger notified of the `ack` commands of the clients for the online-first messages.
+func (handler *WSHandler) SetAcknowledger(acknowledger Acknowledger) {
+	handler.acknowledger = acknowledger
+}
+
 // ServeHTTP is an http.Handler.
 // It is a part of the service.endpoint implementation.
 func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var identity *auth.Identity
+	if handler.authenticator.Enabled() {
+		var err error
+		if identity, err = handler.authenticator.Authenticate(r); err != nil {
+			auth.Unauthorized(w, err)
+			return
+		}
+	}
+
 	c, err := webSocketUpgrader.Upgrade(w, r, nil)
 	if err != nil {
 		logger.WithError(err).Error("Error on upgrading to websocket")
@@ -54,6 +99,10 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer c.Close()
 
+	if identity != nil {
+		NewAuthenticatedWebSocket(handler, &wsconn{c}, identity).Start()
+		return
+	}
 	NewWebSocket(handler, &wsconn{c}, extractUserID(r.RequestURI)).Start()
 }
 
@@ -93,6 +142,7 @@ type WebSocket struct {
 	WSConnection
 	applicationID string
 	userID        string
+	identity      *auth.Identity
 	sendChannel   chan []byte
 	receivers     map[protocol.Path]*Receiver
 }
@@ -109,10 +159,18 @@ func NewWebSocket(handler *WSHandler, wsConn WSConnection, userID string) *WebSo
 	}
 }
 
+// NewAuthenticatedWebSocket returns a new WebSocket, for the verified identity.
+func NewAuthenticatedWebSocket(handler *WSHandler, wsConn WSConnection, identity *auth.Identity) *WebSocket {
+	ws := NewWebSocket(handler, wsConn, identity.UserID)
+	ws.identity = identity
+	return ws
+}
+
 // Start the WebSocket (the send and receive loops).
 // It is implementing the service.startable interface.
 func (ws *WebSocket) Start() error {
 	ws.sendConnectionMessage()
+	ws.presence.Connected(ws.userID, ws.applicationID)
 	go ws.sendLoop()
 	ws.receiveLoop()
 	return nil
@@ -165,6 +223,8 @@ func (ws *WebSocket) receiveLoop() {
 			ws.handleReceiveCmd(cmd)
 		case protocol.CmdCancel:
 			ws.handleCancelCmd(cmd)
+		case protocol.CmdAck:
+			ws.handleAckCmd(cmd)
 		default:
 			ws.sendError(protocol.ERROR_BAD_REQUEST, "unknown command %v", cmd.Name)
 		}
@@ -177,6 +237,12 @@ func (ws *WebSocket) sendConnectionMessage() {
 		Arg:  "You are connected to the server.",
 		Json: fmt.Sprintf(`{"ApplicationId": "%s", "UserId": "%s", "Time": "%s"}`, ws.applicationID, ws.userID, time.Now().Format(time.RFC3339)),
 	}
+	if ws.identity != nil {
+		// the verified identity is echoed, with its roles
+		roles, _ := json.Marshal(append([]string{}, ws.identity.Roles...))
+		n.Json = fmt.Sprintf(`{"ApplicationId": "%s", "UserId": "%s", "Roles": %s, "Authenticated": true, "Time": "%s"}`,
+			ws.applicationID, ws.userID, roles, time.Now().Format(time.RFC3339))
+	}
 	ws.sendChannel <- n.Bytes()
 }
 
@@ -193,8 +259,22 @@ func (ws *WebSocket) handleReceiveCmd(cmd *protocol.Cmd) {
 		ws.sendError(protocol.ERROR_BAD_REQUEST, err.Error())
 		return
 	}
+	// the access is checked before fetching the stored messages, and again by the router when subscribing
+	if checker, ok := ws.router.(router.AccessChecker); ok && !checker.CanSubscribe(ws.userID, ws.roles(), rec.path) {
+		ws.sendError(protocol.ERROR_FORBIDDEN, "%v %v", rec.path, router.ErrAccessDenied.Error())
+		return
+	}
+	if ok, retryAfter := ws.rateLimiter.AllowSubscribe(ws.userID, "", rec.path); !ok {
+		ws.sendError(protocol.ERROR_RATE_LIMITED, "%v %v", rec.path, retryAfter)
+		return
+	}
+	rec.roles = ws.roles()
+	if err := rec.Start(); err != nil {
+		logger.WithError(err).Error("Error starting receiver")
+		ws.sendError(protocol.ERROR_INTERNAL_SERVER, "%v %v", rec.path, err.Error())
+		return
+	}
 	ws.receivers[rec.path] = rec
-	rec.Start()
 }
 
 func (ws *WebSocket) handleCancelCmd(cmd *protocol.Cmd) {
@@ -210,6 +290,37 @@ func (ws *WebSocket) handleCancelCmd(cmd *protocol.Cmd) {
 	}
 }
 
+// handleAckCmd acknowledges the processing of a message by the client, given as `ack /path <id>`
+func (ws *WebSocket) handleAckCmd(cmd *protocol.Cmd) {
+	args := strings.Fields(cmd.Arg)
+	if len(args) != 2 {
+		ws.sendError(protocol.ERROR_BAD_REQUEST, "ack command requires a path and a message id")
+		return
+	}
+	id, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		ws.sendError(protocol.ERROR_BAD_REQUEST, "ack command requires a numeric message id, but got %v", args[1])
+		return
+	}
+	path := protocol.Path(args[0])
+	acked, onlineFirst := false, false
+	for _, rec := range ws.receivers {
+		if !rec.path.Matches(path) {
+			continue
+		}
+		if !acked {
+			acked = rec.ack(id)
+		}
+		if rec.ackOnlineFirst(path, id) {
+			onlineFirst = true
+		}
+	}
+	// only the online-first messages are waiting for the acknowledgements of the clients
+	if onlineFirst && ws.acknowledger != nil {
+		ws.acknowledger.Acknowledge(ws.userID, path, id)
+	}
+}
+
 func (ws *WebSocket) handleSendCmd(cmd *protocol.Cmd) {
 	logger.WithFields(log.Fields{
 		"cmd": string(cmd.Bytes()),
@@ -225,13 +336,54 @@ func (ws *WebSocket) handleSendCmd(cmd *protocol.Cmd) {
 		Path:          protocol.Path(args[0]),
 		ApplicationID: ws.applicationID,
 		UserID:        ws.userID,
+		Roles:         ws.roles(),
 		HeaderJSON:    cmd.HeaderJSON,
 		Body:          cmd.Body,
 	}
+	if err := msg.SetDeliverAtFromHeader(); err != nil {
+		ws.sendError(protocol.ERROR_BAD_REQUEST, "%v", err.Error())
+		return
+	}
+	if msg.Path.IsSystem() {
+		ws.sendError(protocol.ERROR_FORBIDDEN, "%v %v", msg.Path, router.ErrSystemTopic.Error())
+		return
+	}
+	if ok, retryAfter := ws.rateLimiter.AllowPublish(ws.userID, "", msg.Path); !ok {
+		ws.sendError(protocol.ERROR_RATE_LIMITED, "%v %v", msg.Path, retryAfter)
+		return
+	}
 
-	ws.router.HandleMessage(msg)
+	if err := ws.router.HandleMessage(msg); err != nil {
+		if err == router.ErrDuplicateMessage {
+			// the message was already published, with the returned ID
+			ws.sendOK(protocol.SUCCESS_SEND, "%d", msg.ID)
+			return
+		}
+		if err == router.ErrWildcardTopic || err == router.ErrInvalidDelivery {
+			ws.sendError(protocol.ERROR_BAD_REQUEST, "%v", err.Error())
+			return
+		}
+		if err == router.ErrAccessDenied {
+			ws.sendError(protocol.ERROR_FORBIDDEN, "%v %v", msg.Path, err.Error())
+			return
+		}
+		if rejected, ok := err.(*router.RejectedError); ok {
+			ws.sendError(protocol.ERROR_REJECTED, "%v %v", msg.Path, rejected.Reason)
+			return
+		}
+		ws.sendError(protocol.ERROR_INTERNAL_SERVER, "%v", err.Error())
+		return
+	}
 
-	ws.sendOK(protocol.SUCCESS_SEND, "")
+	ws.sendOK(protocol.SUCCESS_SEND, "%d", msg.ID)
+}
+
+// roles returns the roles of the verified identity, if the client is authenticated
+func (ws *WebSocket) roles() []string {
+	if ws.identity == nil {
+		return nil
+	}
+	return ws.identity.Roles
 }
 
 func (ws *WebSocket) cleanAndClose() {
@@ -244,6 +396,7 @@ func (ws *WebSocket) cleanAndClose() {
 		rec.Stop()
 		delete(ws.receivers, path)
 	}
+	ws.presence.Disconnected(ws.userID, ws.applicationID)
 
 	ws.Close()
 }
@@ -2,14 +2,20 @@ package websocket
 
 import (
 	"github.com/cosminrentea/gobbler/protocol"
+	"github.com/cosminrentea/gobbler/server/auth"
+	"github.com/cosminrentea/gobbler/server/ratelimit"
 	"github.com/cosminrentea/gobbler/server/router"
 	"github.com/cosminrentea/gobbler/server/store"
 	"github.com/cosminrentea/gobbler/testutil"
 
 	"github.com/golang/mock/gomock"
+	gorilla "github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
@@ -67,12 +73,154 @@ func Test_SendMessage(t *testing.T) {
 	commands := []string{"> /path\n{\"key\": \"value\"}\nHello, this is a test"}
 	wsconn, routerMock, messageStore := createDefaultMocks(commands)
 
-	routerMock.EXPECT().HandleMessage(messageMatcher{path: "/path", message: "Hello, this is a test", header: `{"key": "value"}`})
-	wsconn.EXPECT().Send([]byte("#send"))
+	routerMock.EXPECT().HandleMessage(messageMatcher{path: "/path", message: "Hello, this is a test", header: `{"key": "value"}`}).Do(func(msg *protocol.Message) {
+		msg.ID = 7
+	})
+	wsconn.EXPECT().Send([]byte("#send 7"))
 
 	runNewWebSocket(wsconn, routerMock, messageStore)
 }
 
+func Test_SendDuplicateMessage(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"> /path\n{\"Idempotency-Key\": \"key\"}\nHello, this is a test"}
+	wsconn, routerMock, messageStore := createDefaultMocks(commands)
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		msg.ID = 42
+	}).Return(router.ErrDuplicateMessage)
+	wsconn.EXPECT().Send([]byte("#send 42"))
+
+	runNewWebSocket(wsconn, routerMock, messageStore)
+}
+
+func Test_SendMessageAccessDenied(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"> /path\n\nHello, this is a test"}
+	wsconn, routerMock, messageStore := createDefaultMocks(commands)
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Return(router.ErrAccessDenied)
+	wsconn.EXPECT().Send([]byte("!error-forbidden /path Access denied."))
+
+	runNewWebSocket(wsconn, routerMock, messageStore)
+}
+
+func Test_SendMessageRejected(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"> /path\n\nHello, this is a test"}
+	wsconn, routerMock, messageStore := createDefaultMocks(commands)
+
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Return(&router.RejectedError{Reason: "missing tenant"})
+	wsconn.EXPECT().Send([]byte("!error-rejected /path missing tenant"))
+
+	runNewWebSocket(wsconn, routerMock, messageStore)
+}
+
+func Test_SendMessageOnSystemTopic(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"> /_presence/marvin\n\nHello, this is a test"}
+	wsconn, routerMock, messageStore := createDefaultMocks(commands)
+
+	// the message is not passed to the router
+	wsconn.EXPECT().Send([]byte("!error-forbidden /_presence/marvin Cannot publish a message on a system topic."))
+
+	runNewWebSocket(wsconn, routerMock, messageStore)
+}
+
+// acknowledgerFunc is an Acknowledger calling a func
+type acknowledgerFunc func(userID string, path protocol.Path, id uint64)
+
+func (f acknowledgerFunc) Acknowledge(userID string, path protocol.Path, id uint64) {
+	f(userID, path, id)
+}
+
+func Test_AckMessage(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	commands := []string{"ack /chat 42", "ack /chat", "ack /chat latest"}
+	wsconn, routerMock, _ := createDefaultMocks(commands)
+
+	wsconn.EXPECT().Send([]byte("!error-bad-request ack command requires a path and a message id"))
+	wsconn.EXPECT().Send([]byte("!error-bad-request ack command requires a numeric message id, but got latest"))
+
+	acks := make(chan string, 3)
+	handler := testWSHandler(routerMock)
+	handler.SetAcknowledger(acknowledgerFunc(func(userID string, path protocol.Path, id uint64) {
+		acks <- fmt.Sprintf("%s %s %d", userID, path, id)
+	}))
+	go NewWebSocket(handler, wsconn, "testuser").Start()
+	time.Sleep(time.Millisecond * 2)
+
+	// the message was not sent as online-first message by a receiver
+	a.Equal(0, len(acks))
+}
+
+// accessCheckingRouter is a router denying the access to all the topics
+type accessCheckingRouter struct {
+	*MockRouter
+}
+
+func (accessCheckingRouter) CanPublish(userID string, roles []string, path protocol.Path) bool {
+	return false
+}
+
+func (accessCheckingRouter) CanSubscribe(userID string, roles []string, path protocol.Path) bool {
+	return false
+}
+
+func Test_ReceiveAccessDenied(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"+ /path 0"}
+	wsconn, routerMock, _ := createDefaultMocks(commands)
+
+	// the stored messages are not fetched, and the route is not subscribed
+	wsconn.EXPECT().Send([]byte("!error-forbidden /path Access denied."))
+
+	handler := &WSHandler{router: accessCheckingRouter{routerMock}, prefix: "/prefix"}
+	go NewWebSocket(handler, wsconn, "testuser").Start()
+	time.Sleep(time.Millisecond * 2)
+}
+
+func Test_RateLimit(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	commands := []string{"> /path\n\nfirst", "> /path\n\nsecond", "+ /path 0"}
+	wsconn, routerMock, _ := createDefaultMocks(commands)
+
+	routerMock.EXPECT().HandleMessage(gomock.Any())
+	wsconn.EXPECT().Send([]byte("#send 0"))
+	wsconn.EXPECT().Send([]byte("!error-rate-limited /path 10s"))
+	wsconn.EXPECT().Send([]byte("!error-rate-limited /path 1m0s"))
+
+	handler := testWSHandler(routerMock)
+	handler.SetRateLimiter(ratelimit.New(
+		map[protocol.Path]ratelimit.Limit{"/": {Rate: 0.1, Burst: 1}},
+		map[protocol.Path]ratelimit.Limit{"/path": {Rate: 1.0 / 60, Burst: 1}},
+	))
+	ws := NewWebSocket(handler, wsconn, "testuser")
+
+	// the user already subscribed once, on another connection
+	ok, _ := handler.rateLimiter.AllowSubscribe("testuser", "", "/path")
+	a.True(ok)
+
+	go ws.Start()
+	time.Sleep(time.Millisecond * 10)
+}
+
 func Test_AnIncomingMessageIsDelivered(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -220,3 +368,52 @@ func (notify connectedNotificationMatcher) Matches(x interface{}) bool {
 func (notify connectedNotificationMatcher) String() string {
 	return fmt.Sprintf("is connected message")
 }
+
+func Test_ServeHTTP_Authentication(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	handler := testWSHandler(routerMock)
+	handler.SetAuthenticator(auth.NewAuthenticator(
+		auth.NewAPIKeyVerifier(map[string]*auth.Identity{"key1": {UserID: "marvin", Roles: []string{"admin"}}}),
+	))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// unauthenticated requests are rejected before the upgrade
+	response, err := http.Get(server.URL + "/prefix/user/marvin")
+	a.NoError(err)
+	a.Equal(http.StatusUnauthorized, response.StatusCode)
+
+	_, response, err = gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/prefix/user/marvin?access_token=key2", nil)
+	a.Error(err)
+	a.Equal(http.StatusUnauthorized, response.StatusCode)
+
+	// the user id of the verified token is used instead of the one in the URL
+	conn, _, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/prefix/user/arthur?access_token=key1", nil)
+	a.NoError(err)
+	defer conn.Close()
+
+	_, data, err := conn.ReadMessage()
+	a.NoError(err)
+	notification, err := protocol.Decode(data)
+	a.NoError(err)
+	connected := make(map[string]interface{})
+	a.NoError(json.Unmarshal([]byte(notification.(*protocol.NotificationMessage).Json), &connected))
+	a.Equal("marvin", connected["UserId"])
+	a.Equal([]interface{}{"admin"}, connected["Roles"])
+	a.Equal(true, connected["Authenticated"])
+
+	published := make(chan *protocol.Message, 1)
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(m *protocol.Message) { published <- m })
+	a.NoError(conn.WriteMessage(gorilla.BinaryMessage, []byte("> /foo\n\nHello")))
+	select {
+	case m := <-published:
+		a.Equal("marvin", m.UserID)
+		a.Equal([]string{"admin"}, m.Roles)
+	case <-time.After(time.Second):
+		a.Fail("message was not published")
+	}
+}